@@ -0,0 +1,261 @@
+package cephbroker
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/tedsuo/rata"
+)
+
+const (
+	ListInstancesRoute  = "list_instances"
+	GetInstanceRoute    = "get_instance"
+	ListBindingsRoute   = "list_bindings"
+	GetBindingRoute     = "get_binding"
+	CheckSharesRoute    = "check_shares"
+	ListSnapshotsRoute  = "list_snapshots"
+	CreateSnapshotRoute = "create_snapshot"
+	DeleteSnapshotRoute = "delete_snapshot"
+)
+
+var AdminRoutes = rata.Routes{
+	{Path: "/admin/instances", Method: "GET", Name: ListInstancesRoute},
+	{Path: "/admin/instances/:instance_id", Method: "GET", Name: GetInstanceRoute},
+	{Path: "/admin/bindings", Method: "GET", Name: ListBindingsRoute},
+	{Path: "/admin/bindings/:binding_id", Method: "GET", Name: GetBindingRoute},
+	{Path: "/admin/shares/check", Method: "GET", Name: CheckSharesRoute},
+	{Path: "/admin/instances/:instance_id/snapshots", Method: "GET", Name: ListSnapshotsRoute},
+	{Path: "/admin/instances/:instance_id/snapshots", Method: "POST", Name: CreateSnapshotRoute},
+	{Path: "/admin/instances/:instance_id/snapshots/:snapshot_name", Method: "DELETE", Name: DeleteSnapshotRoute},
+}
+
+//go:generate counterfeiter -o ../cephfakes/fake_admin_broker.go . AdminBroker
+
+// AdminBroker is the part of the broker that is reachable through the admin API rather than the service broker API
+type AdminBroker interface {
+	ListInstances(ctx context.Context) ([]InstanceResponseBody, error)
+	GetInstance(ctx context.Context, instanceID string) (InstanceResponseBody, error)
+	ListBindings(ctx context.Context) ([]BindingResponseBody, error)
+	GetBinding(ctx context.Context, bindingID string) (BindingResponseBody, error)
+	CheckShares(ctx context.Context) (ReconcileReport, error)
+	CreateSnapshot(ctx context.Context, instanceID string, snapshotName string) error
+	ListSnapshots(ctx context.Context, instanceID string) ([]string, error)
+	DeleteSnapshot(ctx context.Context, instanceID string, snapshotName string) error
+}
+
+// InstanceResponseBody describes a service instance.  Quota and usage are left out when the filesystem cannot report
+// them, for instance while the share is still being created, and parameters are only given for a single instance.
+type InstanceResponseBody struct {
+	InstanceID       string          `json:"instance_id"`
+	ServiceID        string          `json:"service_id"`
+	PlanID           string          `json:"plan_id"`
+	PlanName         string          `json:"plan_name,omitempty"`
+	OrganizationGUID string          `json:"organization_guid"`
+	SpaceGUID        string          `json:"space_guid"`
+	Parameters       json.RawMessage `json:"parameters,omitempty"`
+	SharePath        string          `json:"share_path,omitempty"`
+	Backend          string          `json:"backend,omitempty"`
+	CreatedAt        time.Time       `json:"created_at"`
+	LastOperation    *OperationState `json:"last_operation,omitempty"`
+	Quota            *Quota          `json:"quota,omitempty"`
+	Usage            *Usage          `json:"usage,omitempty"`
+	Bindings         []string        `json:"bindings"`
+}
+
+type InstancesResponseBody struct {
+	Instances []InstanceResponseBody `json:"instances"`
+}
+
+// BindingResponseBody describes a binding.  Bindings made before the broker kept track of it have no instance ID, and
+// parameters are only given for a single binding.
+type BindingResponseBody struct {
+	BindingID  string                 `json:"binding_id"`
+	InstanceID string                 `json:"instance_id,omitempty"`
+	AppGUID    string                 `json:"app_guid"`
+	ServiceID  string                 `json:"service_id"`
+	PlanID     string                 `json:"plan_id"`
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+	CreatedAt  time.Time              `json:"created_at"`
+}
+
+type BindingsResponseBody struct {
+	Bindings []BindingResponseBody `json:"bindings"`
+}
+
+type SnapshotRequest struct {
+	Name string `json:"name"`
+}
+
+type SnapshotsResponseBody struct {
+	Snapshots []string `json:"snapshots"`
+}
+
+type AdminErrorResponse struct {
+	Description string `json:"description"`
+}
+
+// NewAdminHandler serves the admin API, protected by the same credentials as the service broker API
+func NewAdminHandler(logger lager.Logger, adminBroker AdminBroker, credentials brokerapi.BrokerCredentials) (http.Handler, error) {
+	logger = logger.Session("admin-handler")
+
+	handlers := rata.Handlers{
+		ListInstancesRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			logger := logger.Session("list-instances")
+			logger.Info("start")
+			defer logger.Info("end")
+
+			instances, err := adminBroker.ListInstances(req.Context())
+			if err != nil {
+				writeAdminError(logger, w, err)
+				return
+			}
+			writeAdminJSON(logger, w, http.StatusOK, InstancesResponseBody{Instances: instances})
+		}),
+
+		GetInstanceRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			logger := logger.Session("get-instance")
+			logger.Info("start")
+			defer logger.Info("end")
+
+			instance, err := adminBroker.GetInstance(req.Context(), rata.Param(req, "instance_id"))
+			if err != nil {
+				writeAdminError(logger, w, err)
+				return
+			}
+			writeAdminJSON(logger, w, http.StatusOK, instance)
+		}),
+
+		ListBindingsRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			logger := logger.Session("list-bindings")
+			logger.Info("start")
+			defer logger.Info("end")
+
+			bindings, err := adminBroker.ListBindings(req.Context())
+			if err != nil {
+				writeAdminError(logger, w, err)
+				return
+			}
+			writeAdminJSON(logger, w, http.StatusOK, BindingsResponseBody{Bindings: bindings})
+		}),
+
+		GetBindingRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			logger := logger.Session("get-binding")
+			logger.Info("start")
+			defer logger.Info("end")
+
+			binding, err := adminBroker.GetBinding(req.Context(), rata.Param(req, "binding_id"))
+			if err != nil {
+				writeAdminError(logger, w, err)
+				return
+			}
+			writeAdminJSON(logger, w, http.StatusOK, binding)
+		}),
+
+		CheckSharesRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			logger := logger.Session("check-shares")
+			logger.Info("start")
+			defer logger.Info("end")
+
+			report, err := adminBroker.CheckShares(req.Context())
+			if err != nil {
+				writeAdminError(logger, w, err)
+				return
+			}
+			writeAdminJSON(logger, w, http.StatusOK, report)
+		}),
+
+		ListSnapshotsRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			logger := logger.Session("list-snapshots")
+			logger.Info("start")
+			defer logger.Info("end")
+
+			snapshots, err := adminBroker.ListSnapshots(req.Context(), rata.Param(req, "instance_id"))
+			if err != nil {
+				writeAdminError(logger, w, err)
+				return
+			}
+			writeAdminJSON(logger, w, http.StatusOK, SnapshotsResponseBody{Snapshots: snapshots})
+		}),
+
+		CreateSnapshotRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			logger := logger.Session("create-snapshot")
+			logger.Info("start")
+			defer logger.Info("end")
+
+			request := SnapshotRequest{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				logger.Error("failed-decoding-request", err)
+				writeAdminJSON(logger, w, http.StatusBadRequest, AdminErrorResponse{Description: err.Error()})
+				return
+			}
+
+			err := adminBroker.CreateSnapshot(req.Context(), rata.Param(req, "instance_id"), request.Name)
+			if err != nil {
+				writeAdminError(logger, w, err)
+				return
+			}
+			writeAdminJSON(logger, w, http.StatusCreated, request)
+		}),
+
+		DeleteSnapshotRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			logger := logger.Session("delete-snapshot")
+			logger.Info("start")
+			defer logger.Info("end")
+
+			err := adminBroker.DeleteSnapshot(req.Context(), rata.Param(req, "instance_id"), rata.Param(req, "snapshot_name"))
+			if err != nil {
+				writeAdminError(logger, w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	}
+
+	router, err := rata.NewRouter(AdminRoutes, handlers)
+	if err != nil {
+		return nil, err
+	}
+	return basicAuth(router, credentials), nil
+}
+
+func basicAuth(handler http.Handler, credentials brokerapi.BrokerCredentials) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		username, password, ok := req.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(credentials.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(credentials.Password)) != 1 {
+			http.Error(w, "Not Authorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+func writeAdminError(logger lager.Logger, w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err {
+	case brokerapi.ErrInstanceDoesNotExist, brokerapi.ErrBindingDoesNotExist, ErrSnapshotDoesNotExist:
+		status = http.StatusNotFound
+	case ErrSnapshotAlreadyExists:
+		status = http.StatusConflict
+	case ErrInvalidSnapshotName:
+		status = http.StatusBadRequest
+	case ErrOperationInProgress:
+		status = http.StatusUnprocessableEntity
+	}
+	logger.Error("request-failed", err, lager.Data{"status": status})
+	writeAdminJSON(logger, w, status, AdminErrorResponse{Description: err.Error()})
+}
+
+func writeAdminJSON(logger lager.Logger, w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.Error("failed-encoding-response", err)
+	}
+}
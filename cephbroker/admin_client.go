@@ -0,0 +1,132 @@
+package cephbroker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/tedsuo/rata"
+)
+
+// adminErrors are the errors the admin API reports that callers may want to tell apart
+var adminErrors = []error{
+	brokerapi.ErrInstanceDoesNotExist,
+	brokerapi.ErrBindingDoesNotExist,
+	ErrSnapshotDoesNotExist,
+	ErrSnapshotAlreadyExists,
+	ErrInvalidSnapshotName,
+	ErrOperationInProgress,
+}
+
+type adminClient struct {
+	requests    *rata.RequestGenerator
+	httpClient  *http.Client
+	credentials brokerapi.BrokerCredentials
+}
+
+// NewAdminClient talks to the admin API of the broker at brokerURL
+func NewAdminClient(brokerURL string, credentials brokerapi.BrokerCredentials, httpClient *http.Client) AdminBroker {
+	return &adminClient{
+		requests:    rata.NewRequestGenerator(brokerURL, AdminRoutes),
+		httpClient:  httpClient,
+		credentials: credentials,
+	}
+}
+
+func (c *adminClient) ListInstances(ctx context.Context) ([]InstanceResponseBody, error) {
+	response := InstancesResponseBody{}
+	err := c.do(ctx, ListInstancesRoute, nil, nil, &response)
+	return response.Instances, err
+}
+
+func (c *adminClient) GetInstance(ctx context.Context, instanceID string) (InstanceResponseBody, error) {
+	response := InstanceResponseBody{}
+	err := c.do(ctx, GetInstanceRoute, rata.Params{"instance_id": instanceID}, nil, &response)
+	return response, err
+}
+
+func (c *adminClient) ListBindings(ctx context.Context) ([]BindingResponseBody, error) {
+	response := BindingsResponseBody{}
+	err := c.do(ctx, ListBindingsRoute, nil, nil, &response)
+	return response.Bindings, err
+}
+
+func (c *adminClient) GetBinding(ctx context.Context, bindingID string) (BindingResponseBody, error) {
+	response := BindingResponseBody{}
+	err := c.do(ctx, GetBindingRoute, rata.Params{"binding_id": bindingID}, nil, &response)
+	return response, err
+}
+
+func (c *adminClient) CheckShares(ctx context.Context) (ReconcileReport, error) {
+	response := ReconcileReport{}
+	err := c.do(ctx, CheckSharesRoute, nil, nil, &response)
+	return response, err
+}
+
+func (c *adminClient) CreateSnapshot(ctx context.Context, instanceID string, snapshotName string) error {
+	return c.do(ctx, CreateSnapshotRoute, rata.Params{"instance_id": instanceID}, SnapshotRequest{Name: snapshotName}, nil)
+}
+
+func (c *adminClient) ListSnapshots(ctx context.Context, instanceID string) ([]string, error) {
+	response := SnapshotsResponseBody{}
+	err := c.do(ctx, ListSnapshotsRoute, rata.Params{"instance_id": instanceID}, nil, &response)
+	return response.Snapshots, err
+}
+
+func (c *adminClient) DeleteSnapshot(ctx context.Context, instanceID string, snapshotName string) error {
+	return c.do(ctx, DeleteSnapshotRoute, rata.Params{"instance_id": instanceID, "snapshot_name": snapshotName}, nil, nil)
+}
+
+// do sends a request to the admin API and decodes its response, turning the errors it reports back into the broker's
+func (c *adminClient) do(ctx context.Context, route string, params rata.Params, request interface{}, response interface{}) error {
+	var body io.Reader
+	if request != nil {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := c.requests.CreateRequest(route, params, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(c.credentials.Username, c.credentials.Password)
+	if request != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		errorResponse := AdminErrorResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&errorResponse); err != nil || errorResponse.Description == "" {
+			return fmt.Errorf("admin API request failed: %s", resp.Status)
+		}
+		return adminError(errorResponse.Description)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+func adminError(description string) error {
+	for _, err := range adminErrors {
+		if err.Error() == description {
+			return err
+		}
+	}
+	return errors.New(description)
+}
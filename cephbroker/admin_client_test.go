@@ -0,0 +1,95 @@
+package cephbroker_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	"code.cloudfoundry.org/cephbroker/cephbroker"
+	"code.cloudfoundry.org/cephbroker/cephfakes"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var _ = Describe("AdminClient", func() {
+	var (
+		ctx             context.Context
+		fakeAdminBroker *cephfakes.FakeAdminBroker
+		server          *httptest.Server
+		credentials     brokerapi.BrokerCredentials
+		client          cephbroker.AdminBroker
+	)
+
+	BeforeEach(func() {
+		ctx = context.TODO()
+		fakeAdminBroker = &cephfakes.FakeAdminBroker{}
+		credentials = brokerapi.BrokerCredentials{Username: "admin", Password: "secret"}
+		handler, err := cephbroker.NewAdminHandler(lagertest.NewTestLogger("test-admin-client"), fakeAdminBroker, credentials)
+		Expect(err).NotTo(HaveOccurred())
+		server = httptest.NewServer(handler)
+	})
+
+	JustBeforeEach(func() {
+		client = cephbroker.NewAdminClient(server.URL, credentials, http.DefaultClient)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should list instances", func() {
+		fakeAdminBroker.ListInstancesReturns([]cephbroker.InstanceResponseBody{{InstanceID: "instance-id", Bindings: []string{"binding-id"}}}, nil)
+		instances, err := client.ListInstances(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(instances).To(HaveLen(1))
+		Expect(instances[0].InstanceID).To(Equal("instance-id"))
+		Expect(instances[0].Bindings).To(Equal([]string{"binding-id"}))
+	})
+
+	It("should get a binding", func() {
+		fakeAdminBroker.GetBindingReturns(cephbroker.BindingResponseBody{BindingID: "binding-id", AppGUID: "app-guid"}, nil)
+		binding, err := client.GetBinding(ctx, "binding-id")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(binding.AppGUID).To(Equal("app-guid"))
+		_, bindingID := fakeAdminBroker.GetBindingArgsForCall(0)
+		Expect(bindingID).To(Equal("binding-id"))
+	})
+
+	It("should check shares", func() {
+		fakeAdminBroker.CheckSharesReturns(cephbroker.ReconcileReport{OrphanedShares: []string{"orphan"}}, nil)
+		report, err := client.CheckShares(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.OrphanedShares).To(Equal([]string{"orphan"}))
+	})
+
+	It("should send snapshot requests", func() {
+		Expect(client.CreateSnapshot(ctx, "instance-id", "snap1")).To(Succeed())
+		_, instanceID, snapshotName := fakeAdminBroker.CreateSnapshotArgsForCall(0)
+		Expect(instanceID).To(Equal("instance-id"))
+		Expect(snapshotName).To(Equal("snap1"))
+	})
+
+	It("should return the broker's errors", func() {
+		fakeAdminBroker.GetBindingReturns(cephbroker.BindingResponseBody{}, brokerapi.ErrBindingDoesNotExist)
+		_, err := client.GetBinding(ctx, "binding-id")
+		Expect(err).To(Equal(brokerapi.ErrBindingDoesNotExist))
+
+		fakeAdminBroker.ListInstancesReturns(nil, errors.New("badness"))
+		_, err = client.ListInstances(ctx)
+		Expect(err).To(MatchError("badness"))
+	})
+
+	Context("with the wrong credentials", func() {
+		BeforeEach(func() {
+			credentials = brokerapi.BrokerCredentials{Username: "admin", Password: "wrong"}
+		})
+
+		It("should error", func() {
+			_, err := client.ListInstances(ctx)
+			Expect(err).To(MatchError(ContainSubstring("401")))
+		})
+	})
+})
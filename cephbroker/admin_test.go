@@ -0,0 +1,179 @@
+package cephbroker_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"code.cloudfoundry.org/cephbroker/cephbroker"
+	"code.cloudfoundry.org/cephbroker/cephfakes"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var _ = Describe("AdminHandler", func() {
+	var (
+		fakeAdminBroker *cephfakes.FakeAdminBroker
+		handler         http.Handler
+		recorder        *httptest.ResponseRecorder
+	)
+
+	BeforeEach(func() {
+		fakeAdminBroker = &cephfakes.FakeAdminBroker{}
+		var err error
+		handler, err = cephbroker.NewAdminHandler(lagertest.NewTestLogger("test-admin"), fakeAdminBroker, brokerapi.BrokerCredentials{Username: "admin", Password: "secret"})
+		Expect(err).NotTo(HaveOccurred())
+		recorder = httptest.NewRecorder()
+	})
+
+	serve := func(method, path, body string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.SetBasicAuth("admin", "secret")
+		handler.ServeHTTP(recorder, req)
+	}
+
+	It("should reject requests without valid credentials", func() {
+		req := httptest.NewRequest("GET", "/admin/instances/instance-id/snapshots", nil)
+		req.SetBasicAuth("admin", "wrong")
+		handler.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+		Expect(fakeAdminBroker.ListSnapshotsCallCount()).To(Equal(0))
+	})
+
+	It("should list instances", func() {
+		fakeAdminBroker.ListInstancesReturns([]cephbroker.InstanceResponseBody{{
+			InstanceID: "instance-id",
+			ServiceID:  "service-id",
+			PlanID:     "plan-id",
+			PlanName:   "plan-name",
+			SharePath:  "/volumes/instance-id",
+			Quota:      &cephbroker.Quota{MaxBytes: 1024},
+			Usage:      &cephbroker.Usage{Bytes: 512, Files: 2},
+			Bindings:   []string{"binding-id"},
+		}}, nil)
+		serve("GET", "/admin/instances", "")
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Body.String()).To(MatchJSON(`{"instances": [{
+			"instance_id": "instance-id",
+			"service_id": "service-id",
+			"plan_id": "plan-id",
+			"plan_name": "plan-name",
+			"organization_guid": "",
+			"space_guid": "",
+			"share_path": "/volumes/instance-id",
+			"created_at": "0001-01-01T00:00:00Z",
+			"quota": {"max_bytes": 1024, "max_files": 0},
+			"usage": {"bytes": 512, "files": 2},
+			"bindings": ["binding-id"]
+		}]}`))
+	})
+
+	It("should get an instance", func() {
+		fakeAdminBroker.GetInstanceReturns(cephbroker.InstanceResponseBody{InstanceID: "instance-id", Bindings: []string{}}, nil)
+		serve("GET", "/admin/instances/instance-id", "")
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Body.String()).To(ContainSubstring(`"instance_id":"instance-id"`))
+		_, instanceID := fakeAdminBroker.GetInstanceArgsForCall(0)
+		Expect(instanceID).To(Equal("instance-id"))
+	})
+
+	It("should get a binding", func() {
+		fakeAdminBroker.GetBindingReturns(cephbroker.BindingResponseBody{BindingID: "binding-id", InstanceID: "instance-id", AppGUID: "app-guid"}, nil)
+		serve("GET", "/admin/bindings/binding-id", "")
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Body.String()).To(MatchJSON(`{
+			"binding_id": "binding-id",
+			"instance_id": "instance-id",
+			"app_guid": "app-guid",
+			"service_id": "",
+			"plan_id": "",
+			"created_at": "0001-01-01T00:00:00Z"
+		}`))
+		_, bindingID := fakeAdminBroker.GetBindingArgsForCall(0)
+		Expect(bindingID).To(Equal("binding-id"))
+	})
+
+	It("should list bindings", func() {
+		fakeAdminBroker.ListBindingsReturns([]cephbroker.BindingResponseBody{{BindingID: "binding-id", InstanceID: "instance-id"}}, nil)
+		serve("GET", "/admin/bindings", "")
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Body.String()).To(MatchJSON(`{"bindings": [{
+			"binding_id": "binding-id",
+			"instance_id": "instance-id",
+			"app_guid": "",
+			"service_id": "",
+			"plan_id": "",
+			"created_at": "0001-01-01T00:00:00Z"
+		}]}`))
+	})
+
+	It("should check shares", func() {
+		fakeAdminBroker.CheckSharesReturns(cephbroker.ReconcileReport{OrphanedShares: []string{"orphan"}, MissingShares: []string{"instance-id"}}, nil)
+		serve("GET", "/admin/shares/check", "")
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Body.String()).To(MatchJSON(`{
+			"orphaned_shares": ["orphan"],
+			"missing_shares": ["instance-id"],
+			"quarantined_shares": null,
+			"recreated_shares": null
+		}`))
+	})
+
+	It("should report bindings that do not exist", func() {
+		fakeAdminBroker.GetBindingReturns(cephbroker.BindingResponseBody{}, brokerapi.ErrBindingDoesNotExist)
+		serve("GET", "/admin/bindings/binding-id", "")
+		Expect(recorder.Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("should list snapshots", func() {
+		fakeAdminBroker.ListSnapshotsReturns([]string{"snap1", "snap2"}, nil)
+		serve("GET", "/admin/instances/instance-id/snapshots", "")
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Body.String()).To(MatchJSON(`{"snapshots": ["snap1", "snap2"]}`))
+		_, instanceID := fakeAdminBroker.ListSnapshotsArgsForCall(0)
+		Expect(instanceID).To(Equal("instance-id"))
+	})
+
+	It("should create snapshots", func() {
+		serve("POST", "/admin/instances/instance-id/snapshots", `{"name": "snap1"}`)
+		Expect(recorder.Code).To(Equal(http.StatusCreated))
+		_, instanceID, snapshotName := fakeAdminBroker.CreateSnapshotArgsForCall(0)
+		Expect(instanceID).To(Equal("instance-id"))
+		Expect(snapshotName).To(Equal("snap1"))
+	})
+
+	It("should reject malformed create requests", func() {
+		serve("POST", "/admin/instances/instance-id/snapshots", `not json`)
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+		Expect(fakeAdminBroker.CreateSnapshotCallCount()).To(Equal(0))
+	})
+
+	It("should delete snapshots", func() {
+		serve("DELETE", "/admin/instances/instance-id/snapshots/snap1", "")
+		Expect(recorder.Code).To(Equal(http.StatusNoContent))
+		_, instanceID, snapshotName := fakeAdminBroker.DeleteSnapshotArgsForCall(0)
+		Expect(instanceID).To(Equal("instance-id"))
+		Expect(snapshotName).To(Equal("snap1"))
+	})
+
+	Context("when the broker errors", func() {
+		It("should map broker errors to status codes", func() {
+			for err, status := range map[error]int{
+				brokerapi.ErrInstanceDoesNotExist:   http.StatusNotFound,
+				cephbroker.ErrSnapshotDoesNotExist:  http.StatusNotFound,
+				cephbroker.ErrSnapshotAlreadyExists: http.StatusConflict,
+				cephbroker.ErrInvalidSnapshotName:   http.StatusBadRequest,
+				errors.New("badness"):               http.StatusInternalServerError,
+			} {
+				recorder = httptest.NewRecorder()
+				fakeAdminBroker.CreateSnapshotReturns(err)
+				serve("POST", "/admin/instances/instance-id/snapshots", `{"name": "snap1"}`)
+				Expect(recorder.Code).To(Equal(status))
+				Expect(recorder.Body.String()).To(MatchJSON(`{"description": "` + err.Error() + `"}`))
+			}
+		})
+	})
+})
@@ -0,0 +1,129 @@
+package cephbroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+)
+
+// DefaultSubvolumeFSName is the file system subvolume backends create their subvolumes in when they do not name one
+const DefaultSubvolumeFSName = "cephfs"
+
+var backendNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,62}$`)
+
+// Backend is a ceph cluster, or a file system of one, that plans can provision their shares in.  Settings left empty
+// are taken from the backend's ceph.conf when it has one.
+type Backend struct {
+	Name string `json:"name"`
+	// CephConf is the backend's ceph.conf, read for the settings below that are not given
+	CephConf   string `json:"ceph_conf,omitempty"`
+	Monitors   string `json:"monitors,omitempty"`
+	FSID       string `json:"fsid,omitempty"`
+	ClientName string `json:"client_name,omitempty"`
+	Keyring    string `json:"keyring,omitempty"`
+	SecretFile string `json:"secret_file,omitempty"`
+	// FSName is the ceph file system to mount, passed as --client_fs or mds_namespace; empty for the default one
+	FSName string `json:"fs_name,omitempty"`
+	// RootPath is the directory of the file system that the broker mounts, and so creates directory shares in
+	RootPath       string `json:"root_path,omitempty"`
+	ShareBackend   string `json:"share_backend,omitempty"`
+	SubvolumeGroup string `json:"subvolume_group,omitempty"`
+	// MountPath is where the broker mounts the backend, defaulting to one next to the default mount
+	MountPath string `json:"mount_path,omitempty"`
+}
+
+type backendsFile struct {
+	Backends []Backend `json:"backends"`
+}
+
+// LoadBackends reads the backends plans can name from a JSON file, filling in what each one leaves out from its
+// ceph.conf and the defaults
+func LoadBackends(backendFile string, os osshim.Os, ioutil ioutilshim.Ioutil) ([]Backend, error) {
+	contents, err := ioutil.ReadFile(backendFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backends file '%s': %s", backendFile, err.Error())
+	}
+
+	file := backendsFile{}
+	if err := json.Unmarshal(contents, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse backends file '%s': %s", backendFile, err.Error())
+	}
+
+	names := map[string]bool{}
+	backends := []Backend{}
+	for _, backend := range file.Backends {
+		if !backendNamePattern.MatchString(backend.Name) {
+			return nil, fmt.Errorf("invalid backend name '%s': must start with a letter or digit, and have only letters, digits, '-' and '_'", backend.Name)
+		}
+		if names[backend.Name] {
+			return nil, fmt.Errorf("duplicate backend '%s'", backend.Name)
+		}
+		names[backend.Name] = true
+
+		backend, err = backend.complete(os, ioutil)
+		if err != nil {
+			return nil, fmt.Errorf("backend '%s': %s", backend.Name, err.Error())
+		}
+		backends = append(backends, backend)
+	}
+	return backends, nil
+}
+
+func (b Backend) complete(os osshim.Os, ioutil ioutilshim.Ioutil) (Backend, error) {
+	if b.CephConf != "" {
+		cluster, err := LoadCephConfig(b.CephConf, b.ClientName, os, ioutil)
+		if err != nil {
+			return b, err
+		}
+		if b.Monitors == "" {
+			b.Monitors = cluster.MonHost
+		}
+		if b.FSID == "" {
+			b.FSID = cluster.FSID
+		}
+		if b.ClientName == "" {
+			b.ClientName = cluster.ClientName
+		}
+		if b.Keyring == "" && b.SecretFile == "" {
+			b.Keyring = cluster.Keyring
+			b.SecretFile = cluster.SecretFile
+		}
+		if b.RootPath == "" {
+			b.RootPath = cluster.RemoteMountPath
+		}
+	}
+
+	monitors, err := ParseMonitors(b.Monitors)
+	if err != nil {
+		return b, err
+	}
+	b.Monitors = strings.Join(monitors, ",")
+
+	if b.Keyring == "" && b.SecretFile == "" {
+		return b, fmt.Errorf("a keyring or a secret file is required")
+	}
+	if b.RootPath == "" {
+		b.RootPath = "/"
+	}
+
+	switch b.ShareBackend {
+	case "":
+		b.ShareBackend = ShareBackendDirectory
+	case ShareBackendDirectory, ShareBackendSubvolume:
+	default:
+		return b, fmt.Errorf("unknown share backend '%s'", b.ShareBackend)
+	}
+	if b.ShareBackend == ShareBackendSubvolume && b.FSName == "" {
+		b.FSName = DefaultSubvolumeFSName
+	}
+	return b, nil
+}
+
+// Credentials are what the backend's client authenticates to ceph with
+func (b Backend) Credentials() Credentials {
+	return Credentials{ClientName: b.ClientName, Keyring: b.Keyring, SecretFile: b.SecretFile}
+}
@@ -0,0 +1,111 @@
+package cephbroker_test
+
+import (
+	"errors"
+
+	"code.cloudfoundry.org/cephbroker/cephbroker"
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Backends", func() {
+	var (
+		fakeOs     *os_fake.FakeOs
+		fakeIoutil *ioutil_fake.FakeIoutil
+	)
+
+	BeforeEach(func() {
+		fakeOs = &os_fake.FakeOs{}
+		fakeIoutil = &ioutil_fake.FakeIoutil{}
+	})
+
+	Context(".LoadBackends", func() {
+		It("should load backends, with their defaults", func() {
+			fakeIoutil.ReadFileReturns([]byte(`{"backends":[`+
+				`{"name":"archive","monitors":"10.0.1.1,10.0.1.2:3300","keyring":"/etc/ceph/archive.keyring","fs_name":"archive"},`+
+				`{"name":"fast","monitors":"10.0.2.1","secret_file":"/etc/ceph/fast.secret","client_name":"broker","share_backend":"subvolume"}]}`), nil)
+
+			backends, err := cephbroker.LoadBackends("/backends.json", fakeOs, fakeIoutil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeIoutil.ReadFileArgsForCall(0)).To(Equal("/backends.json"))
+			Expect(backends).To(Equal([]cephbroker.Backend{
+				{
+					Name:         "archive",
+					Monitors:     "10.0.1.1:6789,10.0.1.2:3300",
+					Keyring:      "/etc/ceph/archive.keyring",
+					FSName:       "archive",
+					RootPath:     "/",
+					ShareBackend: cephbroker.ShareBackendDirectory,
+				},
+				{
+					Name:         "fast",
+					Monitors:     "10.0.2.1:6789",
+					ClientName:   "broker",
+					SecretFile:   "/etc/ceph/fast.secret",
+					FSName:       cephbroker.DefaultSubvolumeFSName,
+					RootPath:     "/",
+					ShareBackend: cephbroker.ShareBackendSubvolume,
+				},
+			}))
+			Expect(backends[1].Credentials()).To(Equal(cephbroker.Credentials{ClientName: "broker", SecretFile: "/etc/ceph/fast.secret"}))
+		})
+
+		It("should take what a backend leaves out from its ceph.conf", func() {
+			fakeIoutil.ReadFileStub = func(filename string) ([]byte, error) {
+				if filename == "/etc/ceph/archive.conf" {
+					return []byte("[global]\nfsid = archive-fsid\nmon_host = 10.0.1.1\n[client.broker]\nkeyring = /etc/ceph/$cluster.$name.keyring\nclient_mountpoint = /shares\n"), nil
+				}
+				return []byte(`{"backends":[{"name":"archive","ceph_conf":"/etc/ceph/archive.conf","root_path":"/volumes"}]}`), nil
+			}
+
+			backends, err := cephbroker.LoadBackends("/backends.json", fakeOs, fakeIoutil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backends).To(HaveLen(1))
+			Expect(backends[0].Monitors).To(Equal("10.0.1.1:6789"))
+			Expect(backends[0].FSID).To(Equal("archive-fsid"))
+			Expect(backends[0].ClientName).To(Equal("broker"))
+			Expect(backends[0].Keyring).To(Equal("/etc/ceph/archive.client.broker.keyring"))
+			Expect(backends[0].RootPath).To(Equal("/volumes"))
+		})
+
+		It("should error when the file cannot be read", func() {
+			fakeIoutil.ReadFileReturns(nil, errors.New("badness"))
+			_, err := cephbroker.LoadBackends("/backends.json", fakeOs, fakeIoutil)
+			Expect(err).To(MatchError(ContainSubstring("badness")))
+		})
+
+		It("should error when the file is not valid json", func() {
+			fakeIoutil.ReadFileReturns([]byte("{backends:"), nil)
+			_, err := cephbroker.LoadBackends("/backends.json", fakeOs, fakeIoutil)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should error on invalid or duplicate names", func() {
+			fakeIoutil.ReadFileReturns([]byte(`{"backends":[{"name":"../archive","monitors":"10.0.1.1","keyring":"k"}]}`), nil)
+			_, err := cephbroker.LoadBackends("/backends.json", fakeOs, fakeIoutil)
+			Expect(err).To(MatchError(ContainSubstring("invalid backend name")))
+
+			fakeIoutil.ReadFileReturns([]byte(`{"backends":[{"name":"archive","monitors":"10.0.1.1","keyring":"k"},{"name":"archive","monitors":"10.0.1.2","keyring":"k"}]}`), nil)
+			_, err = cephbroker.LoadBackends("/backends.json", fakeOs, fakeIoutil)
+			Expect(err).To(MatchError("duplicate backend 'archive'"))
+		})
+
+		It("should error on a backend it cannot reach", func() {
+			fakeIoutil.ReadFileReturns([]byte(`{"backends":[{"name":"archive","keyring":"k"}]}`), nil)
+			_, err := cephbroker.LoadBackends("/backends.json", fakeOs, fakeIoutil)
+			Expect(err).To(MatchError(ContainSubstring("backend 'archive'")))
+
+			fakeIoutil.ReadFileReturns([]byte(`{"backends":[{"name":"archive","monitors":"10.0.1.1"}]}`), nil)
+			_, err = cephbroker.LoadBackends("/backends.json", fakeOs, fakeIoutil)
+			Expect(err).To(MatchError("backend 'archive': a keyring or a secret file is required"))
+		})
+
+		It("should error on an unknown share backend", func() {
+			fakeIoutil.ReadFileReturns([]byte(`{"backends":[{"name":"archive","monitors":"10.0.1.1","keyring":"k","share_backend":"rbd"}]}`), nil)
+			_, err := cephbroker.LoadBackends("/backends.json", fakeOs, fakeIoutil)
+			Expect(err).To(MatchError("backend 'archive': unknown share backend 'rbd'"))
+		})
+	})
+})
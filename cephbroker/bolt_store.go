@@ -0,0 +1,118 @@
+package cephbroker
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	boltOpenTimeout = 10 * time.Second
+
+	boltMetaBucket = "meta"
+	boltVersionKey = "version"
+)
+
+type boltStore struct {
+	db    *bolt.DB
+	saved stateRecords
+}
+
+// NewBoltStore keeps the broker's state in an embedded BoltDB database, with a bucket per kind of record.  BoltDB
+// locks the database file, so only one broker can use it at a time.
+func NewBoltStore(path string) (Store, error) {
+	db, err := bolt.Open(path, stateFileMode, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database '%s': %s", path, err.Error())
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range append([]string{boltMetaBucket}, stateTables...) {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create buckets in '%s': %s", path, err.Error())
+	}
+
+	return &boltStore{db: db, saved: newStateRecords()}, nil
+}
+
+func (s *boltStore) Restore(logger lager.Logger) (State, error) {
+	logger = logger.Session("bolt-store-restore", lager.Data{"path": s.db.Path()})
+
+	var versionData []byte
+	records := newStateRecords()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		versionData = append([]byte{}, tx.Bucket([]byte(boltMetaBucket)).Get([]byte(boltVersionKey))...)
+		for _, table := range stateTables {
+			err := tx.Bucket([]byte(table)).ForEach(func(id, value []byte) error {
+				// values are only valid for the life of the transaction
+				records[table][string(id)] = append([]byte{}, value...)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return State{}, err
+	}
+
+	version := unversionedStateVersion(records)
+	if len(versionData) > 0 {
+		if version, err = strconv.Atoi(string(versionData)); err != nil {
+			return State{}, fmt.Errorf("invalid state version '%s': %s", versionData, err.Error())
+		}
+	}
+
+	state, err := recordsToState(version, records)
+	if err != nil {
+		return State{}, err
+	}
+
+	s.saved = records
+	logger.Info("state-read", lager.Data{"version": version})
+	return state, nil
+}
+
+func (s *boltStore) Save(logger lager.Logger, state State) error {
+	records, err := stateToRecords(state)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(boltMetaBucket)).Put([]byte(boltVersionKey), []byte(strconv.Itoa(StateVersion))); err != nil {
+			return err
+		}
+		return records.applyChanges(s.saved,
+			func(table, id string, value []byte) error {
+				return tx.Bucket([]byte(table)).Put([]byte(id), value)
+			},
+			func(table, id string) error {
+				return tx.Bucket([]byte(table)).Delete([]byte(id))
+			},
+		)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.saved = records
+	logger.Info("state-saved", lager.Data{"path": s.db.Path()})
+	return nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
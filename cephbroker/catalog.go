@@ -0,0 +1,140 @@
+package cephbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"code.cloudfoundry.org/goshims/ioutilshim"
+)
+
+const DefaultServiceDescription = "CephFS service docs: https://code.cloudfoundry.org/cephfs-bosh-release/"
+
+var (
+	ErrPlanNotFound  error = errors.New("plan not found in the service catalog")
+	ErrCatalogEmpty  error = errors.New("service catalog must describe at least one service")
+	ErrCatalogNoPlan error = errors.New("every service in the catalog must have at least one plan")
+)
+
+type Catalog struct {
+	Services []CatalogService `json:"services"`
+}
+
+type CatalogService struct {
+	ID          string        `json:"id"`
+	Name        string        `json:"name"`
+	Description string        `json:"description,omitempty"`
+	Tags        []string      `json:"tags,omitempty"`
+	Plans       []CatalogPlan `json:"plans"`
+}
+
+// CatalogPlan describes a service plan.  Parameters are the defaults applied to every instance of the plan; anything
+// given at provision, update or bind time overrides them.  Backend names the backend that the plan's shares are
+// created in, or is empty for the default backend.
+type CatalogPlan struct {
+	ID          string                 `json:"id"`
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	Free        *bool                  `json:"free,omitempty"`
+	Backend     string                 `json:"backend,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// NewCatalog builds a catalog offering a single service with a single plan
+func NewCatalog(serviceName, serviceId, planName, planId, planDesc string) Catalog {
+	return Catalog{
+		Services: []CatalogService{{
+			ID:   serviceId,
+			Name: serviceName,
+			Plans: []CatalogPlan{{
+				ID:          planId,
+				Name:        planName,
+				Description: planDesc,
+			}},
+		}},
+	}
+}
+
+func LoadCatalog(catalogFile string, ioutil ioutilshim.Ioutil) (Catalog, error) {
+	contents, err := ioutil.ReadFile(catalogFile)
+	if err != nil {
+		return Catalog{}, fmt.Errorf("failed to read catalog file '%s': %s", catalogFile, err.Error())
+	}
+
+	catalog := Catalog{}
+	if err := json.Unmarshal(contents, &catalog); err != nil {
+		return Catalog{}, fmt.Errorf("failed to parse catalog file '%s': %s", catalogFile, err.Error())
+	}
+
+	if err := catalog.Validate(); err != nil {
+		return Catalog{}, err
+	}
+	return catalog, nil
+}
+
+func (c Catalog) Validate() error {
+	if len(c.Services) == 0 {
+		return ErrCatalogEmpty
+	}
+
+	ids := map[string]bool{}
+	for _, service := range c.Services {
+		if service.ID == "" || service.Name == "" {
+			return fmt.Errorf("service '%s%s' must have both an id and a name", service.Name, service.ID)
+		}
+		if ids[service.ID] {
+			return fmt.Errorf("duplicate id '%s' in service catalog", service.ID)
+		}
+		ids[service.ID] = true
+
+		if len(service.Plans) == 0 {
+			return ErrCatalogNoPlan
+		}
+		for _, plan := range service.Plans {
+			if plan.ID == "" || plan.Name == "" {
+				return fmt.Errorf("plan '%s%s' of service '%s' must have both an id and a name", plan.Name, plan.ID, service.Name)
+			}
+			if ids[plan.ID] {
+				return fmt.Errorf("duplicate id '%s' in service catalog", plan.ID)
+			}
+			ids[plan.ID] = true
+
+			if err := validateParameters(plan.Parameters); err != nil {
+				return fmt.Errorf("plan '%s' of service '%s' has invalid default parameters: %s", plan.Name, service.Name, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Backends lists the backends the plans use, in order, with "" for the default backend
+func (c Catalog) Backends() []string {
+	backends := []string{}
+	seen := map[string]bool{}
+	for _, service := range c.Services {
+		for _, plan := range service.Plans {
+			if !seen[plan.Backend] {
+				seen[plan.Backend] = true
+				backends = append(backends, plan.Backend)
+			}
+		}
+	}
+	sort.Strings(backends)
+	return backends
+}
+
+// FindPlan looks up a plan by ID.  An empty serviceID matches any service.
+func (c Catalog) FindPlan(serviceID, planID string) (CatalogPlan, error) {
+	for _, service := range c.Services {
+		if serviceID != "" && service.ID != serviceID {
+			continue
+		}
+		for _, plan := range service.Plans {
+			if plan.ID == planID {
+				return plan, nil
+			}
+		}
+	}
+	return CatalogPlan{}, ErrPlanNotFound
+}
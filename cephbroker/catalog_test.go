@@ -0,0 +1,107 @@
+package cephbroker_test
+
+import (
+	"errors"
+
+	"code.cloudfoundry.org/cephbroker/cephbroker"
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Catalog", func() {
+	var (
+		fakeIoutil *ioutil_fake.FakeIoutil
+	)
+
+	BeforeEach(func() {
+		fakeIoutil = &ioutil_fake.FakeIoutil{}
+	})
+
+	Context(".LoadCatalog", func() {
+		It("should load services and plans with their parameters", func() {
+			fakeIoutil.ReadFileReturns([]byte(`{"services":[{"id":"service-id","name":"cephfs","plans":[`+
+				`{"id":"small-id","name":"small","parameters":{"quota":"10G"}},`+
+				`{"id":"large-id","name":"large","parameters":{"quota":"1T"}}]}]}`), nil)
+
+			catalog, err := cephbroker.LoadCatalog("/catalog.json", fakeIoutil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeIoutil.ReadFileArgsForCall(0)).To(Equal("/catalog.json"))
+			Expect(catalog.Services).To(HaveLen(1))
+			Expect(catalog.Services[0].Plans).To(HaveLen(2))
+			Expect(catalog.Services[0].Plans[1].Parameters["quota"]).To(Equal("1T"))
+		})
+
+		It("should error when the file cannot be read", func() {
+			fakeIoutil.ReadFileReturns(nil, errors.New("badness"))
+			_, err := cephbroker.LoadCatalog("/catalog.json", fakeIoutil)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should error when the file is not valid json", func() {
+			fakeIoutil.ReadFileReturns([]byte("{services:"), nil)
+			_, err := cephbroker.LoadCatalog("/catalog.json", fakeIoutil)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should error when the catalog is invalid", func() {
+			fakeIoutil.ReadFileReturns([]byte(`{"services":[]}`), nil)
+			_, err := cephbroker.LoadCatalog("/catalog.json", fakeIoutil)
+			Expect(err).To(Equal(cephbroker.ErrCatalogEmpty))
+		})
+	})
+
+	Context(".Validate", func() {
+		It("should accept the catalog built from flags", func() {
+			Expect(cephbroker.NewCatalog("name", "id", "plan", "plan-id", "desc").Validate()).To(Succeed())
+		})
+
+		It("should reject services without plans", func() {
+			catalog := cephbroker.Catalog{Services: []cephbroker.CatalogService{{ID: "id", Name: "name"}}}
+			Expect(catalog.Validate()).To(Equal(cephbroker.ErrCatalogNoPlan))
+		})
+
+		It("should reject duplicate ids", func() {
+			catalog := cephbroker.NewCatalog("name", "id", "plan", "id", "desc")
+			Expect(catalog.Validate()).To(HaveOccurred())
+		})
+
+		It("should accept valid default parameters", func() {
+			catalog := cephbroker.NewCatalog("name", "id", "plan", "plan-id", "desc")
+			catalog.Services[0].Plans[0].Parameters = map[string]interface{}{"readonly": true, "quota": "10G"}
+			Expect(catalog.Validate()).To(Succeed())
+		})
+
+		It("should reject invalid default parameters", func() {
+			catalog := cephbroker.NewCatalog("name", "id", "plan", "plan-id", "desc")
+			catalog.Services[0].Plans[0].Parameters = map[string]interface{}{"readonly": "yes"}
+			Expect(catalog.Validate()).To(MatchError(ContainSubstring("plan 'plan' of service 'name' has invalid default parameters")))
+		})
+	})
+
+	Context(".FindPlan", func() {
+		It("should find plans by service and plan id", func() {
+			plan, err := cephbroker.NewCatalog("name", "id", "plan", "plan-id", "desc").FindPlan("id", "plan-id")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(plan.Name).To(Equal("plan"))
+		})
+
+		It("should not find plans belonging to another service", func() {
+			_, err := cephbroker.NewCatalog("name", "id", "plan", "plan-id", "desc").FindPlan("other-id", "plan-id")
+			Expect(err).To(Equal(cephbroker.ErrPlanNotFound))
+		})
+	})
+
+	Context(".Backends", func() {
+		It("should list each backend the plans name once, with the default backend as ''", func() {
+			fakeIoutil.ReadFileReturns([]byte(`{"services":[{"id":"service-id","name":"cephfs","plans":[`+
+				`{"id":"small-id","name":"small"},`+
+				`{"id":"archive-id","name":"archive","backend":"archive"},`+
+				`{"id":"cold-id","name":"cold","backend":"archive"}]}]}`), nil)
+
+			catalog, err := cephbroker.LoadCatalog("/catalog.json", fakeIoutil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(catalog.Backends()).To(Equal([]string{"", "archive"}))
+		})
+	})
+})
@@ -0,0 +1,207 @@
+package cephbroker
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+)
+
+const (
+	DefaultCephCluster    = "ceph"
+	DefaultCephClientName = "admin"
+
+	// defaultKeyringSearch is where ceph looks for a keyring when ceph.conf does not name one
+	defaultKeyringSearch = "/etc/ceph/$cluster.$name.keyring,/etc/ceph/$cluster.keyring,/etc/ceph/keyring,/etc/ceph/keyring.bin"
+)
+
+// CephConfig holds the cluster settings the broker takes from ceph.conf.  Settings the file does not have are left
+// empty, apart from the cluster, client name and keyring, which get ceph's own defaults.  The keyring is only looked
+// for when there is no secret file.
+type CephConfig struct {
+	Cluster string
+	FSID    string
+	MonHost string
+	// ClientName is the cephx client, without the "client." prefix
+	ClientName string
+	Keyring    string
+	// SecretFile is the keyfile setting, a file with nothing but the client's key
+	SecretFile string
+	// RemoteMountPath is the client_mountpoint setting, the directory of the filesystem that ceph-fuse mounts
+	RemoteMountPath string
+}
+
+// LoadCephConfig reads the settings of a client from a ceph.conf file.  Each setting is looked up in the client's
+// [client.<name>] section, then in [client], then in [global], as ceph does.  When clientName is empty, the client is
+// the one with the first [client.<name>] section in the file, or the admin client if there is none.
+func LoadCephConfig(path string, clientName string, os osshim.Os, ioutil ioutilshim.Ioutil) (CephConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return CephConfig{}, err
+	}
+	sections, order, err := parseCephConf(string(data))
+	if err != nil {
+		return CephConfig{}, fmt.Errorf("failed to read ceph config '%s': %s", path, err.Error())
+	}
+
+	if clientName == "" {
+		clientName = DefaultCephClientName
+		for _, section := range order {
+			if strings.HasPrefix(section, "client.") {
+				clientName = strings.TrimPrefix(section, "client.")
+				break
+			}
+		}
+	}
+
+	config := CephConfig{
+		Cluster:    strings.TrimSuffix(filepath.Base(path), ".conf"),
+		ClientName: clientName,
+	}
+	if config.Cluster == "" || config.Cluster == "." {
+		config.Cluster = DefaultCephCluster
+	}
+
+	lookup := func(key string) string {
+		for _, section := range []string{"client." + clientName, "client", "global"} {
+			if value, ok := sections[section][key]; ok {
+				return config.expand(value)
+			}
+		}
+		return ""
+	}
+	config.FSID = lookup("fsid")
+	config.MonHost = lookup("mon_host")
+	config.RemoteMountPath = lookup("client_mountpoint")
+	config.SecretFile = lookup("keyfile")
+
+	keyrings := lookup("keyring")
+	if keyrings == "" && config.SecretFile == "" {
+		keyrings = config.expand(defaultKeyringSearch)
+	}
+	config.Keyring = findKeyring(keyrings, os)
+
+	return config, nil
+}
+
+// Override gives the broker's command line flags precedence over the settings read from ceph.conf.  set holds the
+// names of the flags that were given; flags that were not only fill in what the file does not have.  A secret file
+// given without a keyring replaces the file's keyring too, as the broker authenticates with a keyring whenever it has
+// one.
+func (c CephConfig) Override(flags CephConfig, set map[string]bool) CephConfig {
+	if set["mds"] || c.MonHost == "" {
+		c.MonHost = flags.MonHost
+	}
+	if set["keyringFile"] || (c.Keyring == "" && c.SecretFile == "") {
+		c.Keyring = flags.Keyring
+	}
+	if set["secretFile"] {
+		c.SecretFile = flags.SecretFile
+		if !set["keyringFile"] {
+			c.Keyring = ""
+		}
+	}
+	if set["baseRemoteMountPath"] || c.RemoteMountPath == "" {
+		c.RemoteMountPath = flags.RemoteMountPath
+	}
+	return c
+}
+
+// expand replaces the metavariables ceph allows in settings
+func (c CephConfig) expand(value string) string {
+	return strings.NewReplacer(
+		"$cluster", c.Cluster,
+		"$name", "client."+c.ClientName,
+		"$type", "client",
+		"$id", c.ClientName,
+	).Replace(value)
+}
+
+// findKeyring picks the first keyring in a comma separated list that exists, or the first one when none do, so that
+// the error is about the keyring that was asked for first
+func findKeyring(keyrings string, os osshim.Os) string {
+	found := ""
+	for _, keyring := range strings.Split(keyrings, ",") {
+		keyring = strings.TrimSpace(keyring)
+		if keyring == "" {
+			continue
+		}
+		if _, err := os.Stat(keyring); err == nil {
+			return keyring
+		}
+		if found == "" {
+			found = keyring
+		}
+	}
+	return found
+}
+
+// parseCephConf reads an INI style ceph.conf into its sections, and lists the sections in the order they appear.
+// Setting names are normalized, as ceph takes spaces, dashes and underscores in them to be the same.
+func parseCephConf(data string) (map[string]map[string]string, []string, error) {
+	sections := map[string]map[string]string{}
+	order := []string{}
+	section := ""
+
+	lines := strings.Split(data, "\n")
+	for i := 0; i < len(lines); i++ {
+		number := i + 1
+		line := strings.TrimRight(lines[i], "\r")
+		for strings.HasSuffix(line, "\\") && i+1 < len(lines) {
+			i++
+			line = strings.TrimSuffix(line, "\\") + strings.TrimRight(lines[i], "\r")
+		}
+		line = strings.TrimSpace(stripConfComment(line))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, nil, fmt.Errorf("line %d: invalid section header", number)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if _, ok := sections[section]; !ok {
+				sections[section] = map[string]string{}
+				order = append(order, section)
+			}
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("line %d: expected 'name = value'", number)
+		}
+		if section == "" {
+			return nil, nil, fmt.Errorf("line %d: setting outside of a section", number)
+		}
+		value := strings.TrimSpace(parts[1])
+		if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+			value = value[1 : len(value)-1]
+		}
+		sections[section][normalizeConfKey(parts[0])] = value
+	}
+	return sections, order, nil
+}
+
+// stripConfComment drops a '#' or ';' comment, unless it is quoted
+func stripConfComment(line string) string {
+	quoted := false
+	for i, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case (r == '#' || r == ';') && !quoted:
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func normalizeConfKey(key string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(key), func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '-' || r == '_'
+	}), "_")
+}
@@ -0,0 +1,171 @@
+package cephbroker_test
+
+import (
+	"errors"
+	"os"
+
+	"code.cloudfoundry.org/cephbroker/cephbroker"
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CephConfig", func() {
+	var (
+		fakeOs     *os_fake.FakeOs
+		fakeIoutil *ioutil_fake.FakeIoutil
+	)
+
+	BeforeEach(func() {
+		fakeOs = &os_fake.FakeOs{}
+		fakeIoutil = &ioutil_fake.FakeIoutil{}
+	})
+
+	Context(".LoadCephConfig", func() {
+		It("should read the cluster settings", func() {
+			fakeIoutil.ReadFileReturns([]byte(`
+# cluster settings
+[global]
+	fsid = 6f1a2a46-8b4e-4b5e-9f0c-2d7e5c3a1b10
+	mon host = [v2:10.0.0.1:3300,v1:10.0.0.1:6789] [v2:10.0.0.2:3300,v1:10.0.0.2:6789]
+	keyring = /etc/ceph/$cluster.keyring
+
+[client.cephbroker]
+	keyring = /etc/ceph/$cluster.$name.keyring ; the broker's own
+	client-mountpoint = /volumes
+`), nil)
+
+			config, err := cephbroker.LoadCephConfig("/etc/ceph/ceph.conf", "", fakeOs, fakeIoutil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeIoutil.ReadFileArgsForCall(0)).To(Equal("/etc/ceph/ceph.conf"))
+			Expect(config).To(Equal(cephbroker.CephConfig{
+				Cluster:         "ceph",
+				FSID:            "6f1a2a46-8b4e-4b5e-9f0c-2d7e5c3a1b10",
+				MonHost:         "[v2:10.0.0.1:3300,v1:10.0.0.1:6789] [v2:10.0.0.2:3300,v1:10.0.0.2:6789]",
+				ClientName:      "cephbroker",
+				Keyring:         "/etc/ceph/ceph.client.cephbroker.keyring",
+				RemoteMountPath: "/volumes",
+			}))
+		})
+
+		It("should read the settings of the client it is given, falling back to [client] and [global]", func() {
+			fakeIoutil.ReadFileReturns([]byte(`
+[global]
+mon_host = 10.0.0.1
+keyring = /etc/ceph/global.keyring
+[client]
+client_mountpoint = /shared
+[client.other]
+mon_host = 10.0.0.9
+`), nil)
+
+			config, err := cephbroker.LoadCephConfig("/etc/ceph/backup.conf", "broker", fakeOs, fakeIoutil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Cluster).To(Equal("backup"))
+			Expect(config.ClientName).To(Equal("broker"))
+			Expect(config.MonHost).To(Equal("10.0.0.1"))
+			Expect(config.Keyring).To(Equal("/etc/ceph/global.keyring"))
+			Expect(config.RemoteMountPath).To(Equal("/shared"))
+		})
+
+		It("should look for the keyring where ceph does when none is given", func() {
+			fakeIoutil.ReadFileReturns([]byte("[global]\nmon_host = 10.0.0.1\n"), nil)
+			fakeOs.StatStub = func(name string) (os.FileInfo, error) {
+				if name == "/etc/ceph/ceph.keyring" {
+					return nil, nil
+				}
+				return nil, os.ErrNotExist
+			}
+
+			config, err := cephbroker.LoadCephConfig("/etc/ceph/ceph.conf", "", fakeOs, fakeIoutil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.ClientName).To(Equal("admin"))
+			Expect(config.Keyring).To(Equal("/etc/ceph/ceph.keyring"))
+			Expect(fakeOs.StatArgsForCall(0)).To(Equal("/etc/ceph/ceph.client.admin.keyring"))
+		})
+
+		It("should not look for a keyring when there is a secret file", func() {
+			fakeIoutil.ReadFileReturns([]byte("[client.cephbroker]\nkeyfile = /etc/ceph/$id.secret\n"), nil)
+
+			config, err := cephbroker.LoadCephConfig("/etc/ceph/ceph.conf", "", fakeOs, fakeIoutil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.SecretFile).To(Equal("/etc/ceph/cephbroker.secret"))
+			Expect(config.Keyring).To(BeEmpty())
+			Expect(fakeOs.StatCallCount()).To(Equal(0))
+		})
+
+		It("should keep the first keyring when none of them exist", func() {
+			fakeIoutil.ReadFileReturns([]byte("[global]\nkeyring = /a.keyring, /b.keyring\n"), nil)
+			fakeOs.StatReturns(nil, os.ErrNotExist)
+
+			config, err := cephbroker.LoadCephConfig("/etc/ceph/ceph.conf", "", fakeOs, fakeIoutil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Keyring).To(Equal("/a.keyring"))
+		})
+
+		It("should join continued lines and unquote values", func() {
+			fakeIoutil.ReadFileReturns([]byte("[global]\nmon_host = 10.0.0.1,\\\n  10.0.0.2\nfsid = \"abc#def\"\n"), nil)
+
+			config, err := cephbroker.LoadCephConfig("/etc/ceph/ceph.conf", "", fakeOs, fakeIoutil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.MonHost).To(Equal("10.0.0.1,  10.0.0.2"))
+			Expect(config.FSID).To(Equal("abc#def"))
+		})
+
+		It("should error when the file cannot be read", func() {
+			fakeIoutil.ReadFileReturns(nil, errors.New("badness"))
+			_, err := cephbroker.LoadCephConfig("/etc/ceph/ceph.conf", "", fakeOs, fakeIoutil)
+			Expect(err).To(MatchError("badness"))
+		})
+
+		It("should error on malformed lines", func() {
+			fakeIoutil.ReadFileReturns([]byte("[global\nmon_host = 10.0.0.1\n"), nil)
+			_, err := cephbroker.LoadCephConfig("/etc/ceph/ceph.conf", "", fakeOs, fakeIoutil)
+			Expect(err).To(MatchError(ContainSubstring("line 1")))
+
+			fakeIoutil.ReadFileReturns([]byte("[global]\nmon_host\n"), nil)
+			_, err = cephbroker.LoadCephConfig("/etc/ceph/ceph.conf", "", fakeOs, fakeIoutil)
+			Expect(err).To(MatchError(ContainSubstring("line 2")))
+
+			fakeIoutil.ReadFileReturns([]byte("mon_host = 10.0.0.1\n"), nil)
+			_, err = cephbroker.LoadCephConfig("/etc/ceph/ceph.conf", "", fakeOs, fakeIoutil)
+			Expect(err).To(MatchError(ContainSubstring("outside of a section")))
+		})
+	})
+
+	Context(".Override", func() {
+		var conf cephbroker.CephConfig
+
+		BeforeEach(func() {
+			conf = cephbroker.CephConfig{MonHost: "10.0.0.1", ClientName: "cephbroker", Keyring: "/etc/ceph/ceph.client.cephbroker.keyring", RemoteMountPath: "/volumes"}
+		})
+
+		It("should keep the file's settings over flags that were not given", func() {
+			flags := cephbroker.CephConfig{MonHost: "10.0.0.9", Keyring: "/etc/ceph/ceph.client.admin.keyring", RemoteMountPath: "/"}
+			Expect(conf.Override(flags, map[string]bool{})).To(Equal(conf))
+		})
+
+		It("should take the flags that were given", func() {
+			flags := cephbroker.CephConfig{MonHost: "10.0.0.9", Keyring: "/etc/ceph/other.keyring", RemoteMountPath: "/shares"}
+			config := conf.Override(flags, map[string]bool{"mds": true, "keyringFile": true, "baseRemoteMountPath": true})
+			Expect(config.MonHost).To(Equal("10.0.0.9"))
+			Expect(config.Keyring).To(Equal("/etc/ceph/other.keyring"))
+			Expect(config.RemoteMountPath).To(Equal("/shares"))
+		})
+
+		It("should use a secret file that was given instead of the file's keyring", func() {
+			flags := cephbroker.CephConfig{SecretFile: "/etc/ceph/cephbroker.secret"}
+			config := conf.Override(flags, map[string]bool{"secretFile": true})
+			Expect(config.SecretFile).To(Equal("/etc/ceph/cephbroker.secret"))
+			Expect(config.Keyring).To(Equal(""))
+		})
+
+		It("should keep both when a keyring and a secret file were given", func() {
+			flags := cephbroker.CephConfig{Keyring: "/etc/ceph/other.keyring", SecretFile: "/etc/ceph/cephbroker.secret"}
+			config := conf.Override(flags, map[string]bool{"keyringFile": true, "secretFile": true})
+			Expect(config.Keyring).To(Equal("/etc/ceph/other.keyring"))
+			Expect(config.SecretFile).To(Equal("/etc/ceph/cephbroker.secret"))
+		})
+	})
+})
@@ -4,13 +4,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
 	"path"
-	"path/filepath"
 	"reflect"
+	"regexp"
+	"strconv"
 	"sync"
+	"time"
 
-	"code.cloudfoundry.org/goshims/ioutilshim"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/voldriver"
 	"github.com/pivotal-cf/brokerapi"
@@ -21,20 +21,19 @@ import (
 const (
 	PermissionVolumeMount = brokerapi.RequiredPermission("volume_mount")
 	DefaultContainerPath  = "/var/vcap/data"
+
+	provisionOperation   = "provision"
+	deprovisionOperation = "deprovision"
 )
 
-type staticState struct {
-	ServiceName string `json:"ServiceName"`
-	ServiceId   string `json:"ServiceId"`
-	PlanName    string `json:"PlanName"`
-	PlanId      string `json:"PlanId"`
-	PlanDesc    string `json:"PlanDesc"`
-}
+var (
+	ErrOperationInProgress   = errors.New("an operation is already in progress for this service instance")
+	ErrInvalidSnapshotName   = errors.New("snapshot names must start with a letter or digit and contain only letters, digits, '.', '_' and '-'")
+	ErrSnapshotAlreadyExists = errors.New("snapshot already exists")
+	ErrSnapshotDoesNotExist  = errors.New("snapshot does not exist")
+)
 
-type dynamicState struct {
-	InstanceMap map[string]brokerapi.ProvisionDetails
-	BindingMap  map[string]brokerapi.BindDetails
-}
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,254}$`)
 
 type lock interface {
 	Lock()
@@ -44,42 +43,41 @@ type lock interface {
 type broker struct {
 	logger     lager.Logger
 	controller Controller
-	dataDir    string
-	ioutil     ioutilshim.Ioutil
+	store      Store
+	shared     SharedStore
+	cipher     *StateCipher
 	mutex      lock
+	// operations are the asynchronous operations running in the background
+	operations sync.WaitGroup
 
-	static  staticState
-	dynamic dynamicState
+	catalog Catalog
+	dynamic State
 }
 
 func New(
 	logger lager.Logger, controller Controller,
-	serviceName, serviceId, planName, planId, planDesc, dataDir string,
-	ioutil ioutilshim.Ioutil,
-) *broker {
+	catalog Catalog, store Store, cipher *StateCipher,
+) (*broker, error) {
 
 	theBroker := broker{
 		logger:     logger,
 		controller: controller,
-		dataDir:    dataDir,
-		ioutil:     ioutil,
+		store:      store,
+		cipher:     cipher,
 		mutex:      &sync.Mutex{},
-		static: staticState{
-			ServiceName: serviceName,
-			ServiceId:   serviceId,
-			PlanName:    planName,
-			PlanId:      planId,
-			PlanDesc:    planDesc,
-		},
-		dynamic: dynamicState{
-			InstanceMap: map[string]brokerapi.ProvisionDetails{},
-			BindingMap:  map[string]brokerapi.BindDetails{},
-		},
+		catalog:    catalog,
+		dynamic:    NewState(),
+	}
+	if shared, ok := store.(SharedStore); ok {
+		theBroker.shared = shared
 	}
 
-	theBroker.restoreDynamicState()
+	if err := theBroker.restoreDynamicState(); err != nil {
+		return nil, err
+	}
+	theBroker.resumeOperations()
 
-	return &theBroker
+	return &theBroker, nil
 }
 
 func (b *broker) Services(_ context.Context) []brokerapi.Service {
@@ -87,22 +85,45 @@ func (b *broker) Services(_ context.Context) []brokerapi.Service {
 	logger.Info("start")
 	defer logger.Info("end")
 
-	return []brokerapi.Service{{
-		ID:            b.static.ServiceId,
-		Name:          b.static.ServiceName,
-		Description:   "CephFS service docs: https://code.cloudfoundry.org/cephfs-bosh-release/",
-		Bindable:      true,
-		PlanUpdatable: false,
-		Tags:          []string{"ceph"},
-		Requires:      []brokerapi.RequiredPermission{PermissionVolumeMount},
-
-		Plans: []brokerapi.ServicePlan{{
-			Name:        b.static.PlanName,
-			ID:          b.static.PlanId,
-			Description: b.static.PlanDesc,
-			Free:        new(bool),
-		}},
-	}}
+	services := []brokerapi.Service{}
+	for _, service := range b.catalog.Services {
+		plans := []brokerapi.ServicePlan{}
+		for _, plan := range service.Plans {
+			free := plan.Free
+			if free == nil {
+				free = new(bool)
+			}
+			plans = append(plans, brokerapi.ServicePlan{
+				Name:        plan.Name,
+				ID:          plan.ID,
+				Description: plan.Description,
+				Free:        free,
+			})
+		}
+
+		description := service.Description
+		if description == "" {
+			description = DefaultServiceDescription
+		}
+		tags := service.Tags
+		if len(tags) == 0 {
+			tags = []string{"ceph"}
+		}
+
+		services = append(services, brokerapi.Service{
+			ID:            service.ID,
+			Name:          service.Name,
+			Description:   description,
+			Bindable:      true,
+			PlanUpdatable: len(plans) > 1,
+			Tags:          tags,
+			Requires:      []brokerapi.RequiredPermission{PermissionVolumeMount},
+
+			Plans: plans,
+		})
+	}
+
+	return services
 }
 
 func (b *broker) Provision(context context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
@@ -110,30 +131,138 @@ func (b *broker) Provision(context context.Context, instanceID string, details b
 	logger.Info("start")
 	defer logger.Info("end")
 
+	spec, pending, err := b.beginProvision(logger, instanceID, details, asyncAllowed)
+	if err != nil || pending == nil {
+		return spec, err
+	}
+	return brokerapi.ProvisionedServiceSpec{}, b.finishProvision(logger, context, instanceID, *pending)
+}
+
+// pendingProvision is a synchronous provision that has been recorded as in progress, and still has its share to make
+type pendingProvision struct {
+	controller Controller
+	parameters map[string]interface{}
+	// existed is whether the instance was already recorded, by a provision that failed
+	existed bool
+}
+
+// beginProvision checks a provision request and records it, starting it in the background when that is allowed.  A
+// synchronous provision is returned pending, for finishProvision to make its share.
+func (b *broker) beginProvision(logger lager.Logger, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, *pendingProvision, error) {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
-	defer b.serialize(b.dynamic)
+	if err := b.lockState(logger); err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, nil, err
+	}
+	defer b.unlockState(logger)
 
 	if b.instanceConflicts(details, instanceID) {
 		logger.Error("instance-already-exists", brokerapi.ErrInstanceAlreadyExists)
-		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+		return brokerapi.ProvisionedServiceSpec{}, nil, brokerapi.ErrInstanceAlreadyExists
 	}
 
-	errResp := b.controller.Create(driverhttp.NewHttpDriverEnv(logger,context), voldriver.CreateRequest{
-		Name: instanceID,
-		Opts: map[string]interface{}{"volume_id": instanceID},
-	})
+	if b.provisioned(instanceID) {
+		// a retry, or the same request handled by another replica first
+		logger.Info("instance-already-provisioned")
+		return brokerapi.ProvisionedServiceSpec{}, nil, nil
+	}
+
+	plan, err := b.catalog.FindPlan(details.ServiceID, details.PlanID)
+	if err != nil {
+		logger.Error("plan-not-found", err, lager.Data{"service-id": details.ServiceID, "plan-id": details.PlanID})
+		return brokerapi.ProvisionedServiceSpec{}, nil, err
+	}
+	controller, err := b.controller.ForBackend(plan.Backend)
+	if err != nil {
+		logger.Error("backend-not-found", err, lager.Data{"plan-id": details.PlanID})
+		return brokerapi.ProvisionedServiceSpec{}, nil, err
+	}
+
+	parameters, err := b.effectiveParameters(details)
+	if err == nil {
+		err = validateParameters(parameters)
+	}
+	if err != nil {
+		logger.Error("invalid-parameters", err)
+		return brokerapi.ProvisionedServiceSpec{}, nil, err
+	}
+
+	if operation, ok := b.dynamic.OperationMap[instanceID]; ok && operation.State == brokerapi.InProgress {
+		if operation.Type == provisionOperation && asyncAllowed {
+			return brokerapi.ProvisionedServiceSpec{IsAsync: true, OperationData: provisionOperation}, nil, nil
+		}
+		logger.Error("operation-in-progress", ErrOperationInProgress, lager.Data{"operation": operation.Type})
+		return brokerapi.ProvisionedServiceSpec{}, nil, ErrOperationInProgress
+	}
+
+	if err := b.checkCloneSource(instanceID, details, plan.Backend, parameters); err != nil {
+		logger.Error("invalid-clone-source", err)
+		return brokerapi.ProvisionedServiceSpec{}, nil, err
+	}
+
+	if asyncAllowed {
+		b.recordInstance(instanceID, details, plan.Backend)
+		if err := b.startOperation(logger, instanceID, provisionOperation); err != nil {
+			return brokerapi.ProvisionedServiceSpec{}, nil, err
+		}
+		return brokerapi.ProvisionedServiceSpec{IsAsync: true, OperationData: provisionOperation}, nil, nil
+	}
+
+	// cloning a share can take a long time, so the share is made without holding the state; the provision is recorded
+	// as in progress meanwhile, which keeps other requests away from the instance
+	_, existed := b.dynamic.InstanceMap[instanceID]
+	b.recordInstance(instanceID, details, plan.Backend)
+	b.dynamic.OperationMap[instanceID] = OperationState{Type: provisionOperation, State: brokerapi.InProgress, Owner: b.owner()}
+	if err := b.serialize(b.dynamic); err != nil {
+		b.discardProvision(instanceID, existed, err)
+		return brokerapi.ProvisionedServiceSpec{}, nil, err
+	}
+
+	return brokerapi.ProvisionedServiceSpec{}, &pendingProvision{controller: controller, parameters: parameters, existed: existed}, nil
+}
+
+// finishProvision makes the share of a synchronous provision, then records how that went
+func (b *broker) finishProvision(logger lager.Logger, context context.Context, instanceID string, pending pendingProvision) error {
+	env := driverhttp.NewHttpDriverEnv(logger, context)
+	errResp := pending.controller.Create(env, createRequest(instanceID, pending.parameters))
+	var sharePath string
+	if errResp.Err == "" {
+		sharePath = b.sharePath(logger, pending.controller, env, instanceID)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := b.lockState(logger); err != nil {
+		// the provision stays in progress, and is run again when this replica restarts
+		logger.Error("failed-to-record-provision", err)
+		return err
+	}
+	defer b.unlockState(logger)
 
 	if errResp.Err != "" {
 		err := errors.New(errResp.Err)
 		logger.Error("provisioner-create-failed", err)
-		return brokerapi.ProvisionedServiceSpec{}, err
+		b.discardProvision(instanceID, pending.existed, err)
+		b.serialize(b.dynamic)
+		return err
 	}
 
-	b.dynamic.InstanceMap[instanceID] = details
+	b.recordSharePath(instanceID, sharePath)
+	delete(b.dynamic.OperationMap, instanceID)
 
-	return brokerapi.ProvisionedServiceSpec{}, nil
+	if err := b.serialize(b.dynamic); err != nil {
+		// the platform takes the provision to have failed, so the share goes and the instance is forgotten, leaving a
+		// retry to start afresh
+		if response := pending.controller.Remove(env, voldriver.RemoveRequest{Name: instanceID}); response.Err != "" {
+			logger.Error("failed-to-remove-unsaved-share", errors.New(response.Err))
+		}
+		b.discardProvision(instanceID, pending.existed, err)
+		return err
+	}
+
+	return nil
 }
 
 func (b *broker) Deprovision(context context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
@@ -144,13 +273,42 @@ func (b *broker) Deprovision(context context.Context, instanceID string, details
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
-	defer b.serialize(b.dynamic)
+	if err := b.lockState(logger); err != nil {
+		return brokerapi.DeprovisionServiceSpec{}, err
+	}
+	defer b.unlockState(logger)
 
 	if _, ok := b.dynamic.InstanceMap[instanceID]; !ok {
 		return brokerapi.DeprovisionServiceSpec{}, brokerapi.ErrInstanceDoesNotExist
 	}
 
-	errResp := b.controller.Remove(driverhttp.NewHttpDriverEnv(logger, context), voldriver.RemoveRequest{
+	if operation, ok := b.dynamic.OperationMap[instanceID]; ok && operation.State == brokerapi.InProgress {
+		if operation.Type == deprovisionOperation && asyncAllowed {
+			return brokerapi.DeprovisionServiceSpec{IsAsync: true, OperationData: deprovisionOperation}, nil
+		}
+		logger.Error("operation-in-progress", ErrOperationInProgress, lager.Data{"operation": operation.Type})
+		return brokerapi.DeprovisionServiceSpec{}, ErrOperationInProgress
+	}
+
+	if b.cloneInProgress(instanceID, "") {
+		logger.Error("clone-in-progress", ErrOperationInProgress)
+		return brokerapi.DeprovisionServiceSpec{}, ErrOperationInProgress
+	}
+
+	if asyncAllowed {
+		if err := b.startOperation(logger, instanceID, deprovisionOperation); err != nil {
+			return brokerapi.DeprovisionServiceSpec{}, err
+		}
+		return brokerapi.DeprovisionServiceSpec{IsAsync: true, OperationData: deprovisionOperation}, nil
+	}
+
+	controller, err := b.controllerFor(instanceID)
+	if err != nil {
+		logger.Error("backend-not-found", err)
+		return brokerapi.DeprovisionServiceSpec{}, err
+	}
+
+	errResp := controller.Remove(driverhttp.NewHttpDriverEnv(logger, context), voldriver.RemoveRequest{
 		Name: instanceID,
 	})
 
@@ -160,7 +318,11 @@ func (b *broker) Deprovision(context context.Context, instanceID string, details
 		return brokerapi.DeprovisionServiceSpec{}, err
 	}
 
-	delete(b.dynamic.InstanceMap, instanceID)
+	b.forgetInstance(instanceID)
+
+	if err := b.serialize(b.dynamic); err != nil {
+		return brokerapi.DeprovisionServiceSpec{}, err
+	}
 
 	return brokerapi.DeprovisionServiceSpec{}, nil
 }
@@ -173,7 +335,10 @@ func (b *broker) Bind(context context.Context, instanceID string, bindingID stri
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
-	defer b.serialize(b.dynamic)
+	if err := b.lockState(logger); err != nil {
+		return brokerapi.Binding{}, err
+	}
+	defer b.unlockState(logger)
 
 	if _, ok := b.dynamic.InstanceMap[instanceID]; !ok {
 		return brokerapi.Binding{}, brokerapi.ErrInstanceDoesNotExist
@@ -183,7 +348,17 @@ func (b *broker) Bind(context context.Context, instanceID string, bindingID stri
 		return brokerapi.Binding{}, brokerapi.ErrAppGuidNotProvided
 	}
 
-	mode, err := evaluateMode(details.Parameters)
+	if b.operationInProgress(instanceID) {
+		return brokerapi.Binding{}, ErrOperationInProgress
+	}
+
+	instanceParams, err := b.effectiveParameters(b.dynamic.InstanceMap[instanceID])
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	parameters := mergeParameters(instanceParams, details.Parameters)
+
+	mode, err := evaluateMode(parameters)
 	if err != nil {
 		return brokerapi.Binding{}, err
 	}
@@ -192,7 +367,13 @@ func (b *broker) Bind(context context.Context, instanceID string, bindingID stri
 		return brokerapi.Binding{}, brokerapi.ErrBindingAlreadyExists
 	}
 
-	response := b.controller.Bind(driverhttp.NewHttpDriverEnv(logger, context), instanceID)
+	controller, err := b.controllerFor(instanceID)
+	if err != nil {
+		logger.Error("backend-not-found", err)
+		return brokerapi.Binding{}, err
+	}
+
+	response := controller.Bind(driverhttp.NewHttpDriverEnv(logger, context), instanceID, bindingID, mode == "r")
 
 	if response.Err != "" {
 		err := errors.New(response.Err)
@@ -200,21 +381,43 @@ func (b *broker) Bind(context context.Context, instanceID string, bindingID stri
 		return brokerapi.Binding{}, err
 	}
 
+	_, existed := b.dynamic.BindingMap[bindingID]
+	if !existed {
+		b.dynamic.BindingInfoMap[bindingID] = BindingInfo{InstanceID: instanceID, CreatedAt: time.Now().UTC()}
+	}
 	b.dynamic.BindingMap[bindingID] = details
 
+	if err := b.serialize(b.dynamic); err != nil {
+		// a binding that was never saved must not be left behind, and neither must the key created for it
+		if !existed {
+			delete(b.dynamic.BindingMap, bindingID)
+			delete(b.dynamic.BindingInfoMap, bindingID)
+			if errResp := controller.Unbind(driverhttp.NewHttpDriverEnv(logger, context), instanceID, bindingID); errResp.Err != "" {
+				logger.Error("failed-to-revoke-unsaved-binding-key", errors.New(errResp.Err))
+			}
+		}
+		return brokerapi.Binding{}, err
+	}
+
+	// the share's owner is passed on so that the cells can map the app's user to it
+	device := response.SharedDevice
+	if ownership, err := evaluateOwnership(instanceParams); err == nil {
+		device.MountConfig = withOwnerHints(device.MountConfig, ownership)
+	}
+
 	return brokerapi.Binding{
 		Credentials: struct{}{}, // if nil, cloud controller chokes on response
 		VolumeMounts: []brokerapi.VolumeMount{{
-			ContainerDir: evaluateContainerPath(details.Parameters, instanceID),
+			ContainerDir: evaluateContainerPath(parameters, instanceID),
 			Mode:         mode,
 			Driver:       "cephdriver",
 			DeviceType:   "shared",
-			Device:       response.SharedDevice,
+			Device:       device,
 		}},
 	}, nil
 }
 
-func (b *broker) Unbind(_ context.Context, instanceID string, bindingID string, details brokerapi.UnbindDetails) error {
+func (b *broker) Unbind(context context.Context, instanceID string, bindingID string, details brokerapi.UnbindDetails) error {
 	logger := b.logger.Session("unbind")
 	logger.Info("start")
 	defer logger.Info("end")
@@ -222,7 +425,10 @@ func (b *broker) Unbind(_ context.Context, instanceID string, bindingID string,
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
-	defer b.serialize(b.dynamic)
+	if err := b.lockState(logger); err != nil {
+		return err
+	}
+	defer b.unlockState(logger)
 
 	if _, ok := b.dynamic.InstanceMap[instanceID]; !ok {
 		return brokerapi.ErrInstanceDoesNotExist
@@ -232,17 +438,689 @@ func (b *broker) Unbind(_ context.Context, instanceID string, bindingID string,
 		return brokerapi.ErrBindingDoesNotExist
 	}
 
+	controller, err := b.controllerFor(instanceID)
+	if err != nil {
+		logger.Error("backend-not-found", err)
+		return err
+	}
+
+	errResp := controller.Unbind(driverhttp.NewHttpDriverEnv(logger, context), instanceID, bindingID)
+	if errResp.Err != "" {
+		err := errors.New(errResp.Err)
+		logger.Error("provisioner-unbind-failed", err)
+		return err
+	}
+
 	delete(b.dynamic.BindingMap, bindingID)
+	delete(b.dynamic.BindingInfoMap, bindingID)
 
-	return nil
+	return b.serialize(b.dynamic)
+}
+
+func (b *broker) Update(context context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
+	logger := b.logger.Session("update")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := b.lockState(logger); err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	defer b.unlockState(logger)
+
+	existing, ok := b.dynamic.InstanceMap[instanceID]
+	if !ok {
+		return brokerapi.UpdateServiceSpec{}, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	if b.operationInProgress(instanceID) {
+		return brokerapi.UpdateServiceSpec{}, ErrOperationInProgress
+	}
+
+	settings, createSnapshot, deleteSnapshot, err := evaluateSnapshotActions(details.Parameters)
+	if err != nil {
+		logger.Error("invalid-parameters", err)
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	if createSnapshot != "" {
+		if err := b.checkNewSnapshot(instanceID, createSnapshot); err != nil {
+			return brokerapi.UpdateServiceSpec{}, err
+		}
+	}
+	if deleteSnapshot != "" {
+		if !b.snapshotExists(instanceID, deleteSnapshot) {
+			return brokerapi.UpdateServiceSpec{}, ErrSnapshotDoesNotExist
+		}
+		if b.cloneInProgress(instanceID, deleteSnapshot) {
+			return brokerapi.UpdateServiceSpec{}, ErrOperationInProgress
+		}
+	}
+
+	controller, err := b.controllerFor(instanceID)
+	if err != nil {
+		logger.Error("backend-not-found", err)
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	if details.PlanID != "" && details.PlanID != existing.PlanID {
+		plan, err := b.catalog.FindPlan(existing.ServiceID, details.PlanID)
+		if err != nil {
+			logger.Error("plan-not-found", brokerapi.ErrPlanChangeNotSupported, lager.Data{"plan-id": details.PlanID})
+			return brokerapi.UpdateServiceSpec{}, brokerapi.ErrPlanChangeNotSupported
+		}
+		// shares cannot be moved from one backend to another
+		if plan.Backend != b.dynamic.InstanceInfoMap[instanceID].Backend {
+			logger.Error("plan-in-other-backend", brokerapi.ErrPlanChangeNotSupported, lager.Data{"plan-id": details.PlanID, "backend": plan.Backend})
+			return brokerapi.UpdateServiceSpec{}, brokerapi.ErrPlanChangeNotSupported
+		}
+		existing.PlanID = details.PlanID
+	}
+
+	instanceParams, err := instanceParameters(existing)
+	if err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	parameters := mergeParameters(instanceParams, settings)
+
+	rawParameters, err := json.Marshal(parameters)
+	if err != nil {
+		logger.Error("failed-to-marshal-parameters", err)
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	existing.RawParameters = rawParameters
+
+	effective, err := b.effectiveParameters(existing)
+	if err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	if err := validateParameters(effective); err != nil {
+		logger.Error("invalid-parameters", err)
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	errResp := controller.Update(driverhttp.NewHttpDriverEnv(logger, context), UpdateRequest{
+		Name: instanceID,
+		Opts: effective,
+	})
+
+	if errResp.Err != "" {
+		err := errors.New(errResp.Err)
+		logger.Error("provisioner-update-failed", err)
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	b.dynamic.InstanceMap[instanceID] = existing
+
+	if err := b.serialize(b.dynamic); err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	if createSnapshot != "" {
+		if err := b.createSnapshot(logger, context, instanceID, createSnapshot); err != nil {
+			return brokerapi.UpdateServiceSpec{}, err
+		}
+	}
+	if deleteSnapshot != "" {
+		if err := b.deleteSnapshot(logger, context, instanceID, deleteSnapshot); err != nil {
+			return brokerapi.UpdateServiceSpec{}, err
+		}
+	}
+
+	return brokerapi.UpdateServiceSpec{}, nil
+}
+
+func (b *broker) CreateSnapshot(context context.Context, instanceID string, snapshotName string) error {
+	logger := b.logger.Session("create-snapshot", lager.Data{"instanceID": instanceID, "snapshotName": snapshotName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := b.lockState(logger); err != nil {
+		return err
+	}
+	defer b.unlockState(logger)
+
+	if _, ok := b.dynamic.InstanceMap[instanceID]; !ok {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+
+	if b.operationInProgress(instanceID) {
+		return ErrOperationInProgress
+	}
+
+	if err := b.checkNewSnapshot(instanceID, snapshotName); err != nil {
+		return err
+	}
+
+	return b.createSnapshot(logger, context, instanceID, snapshotName)
+}
+
+func (b *broker) ListSnapshots(_ context.Context, instanceID string) ([]string, error) {
+	logger := b.logger.Session("list-snapshots", lager.Data{"instanceID": instanceID})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := b.lockState(logger); err != nil {
+		return nil, err
+	}
+	defer b.unlockState(logger)
+
+	if _, ok := b.dynamic.InstanceMap[instanceID]; !ok {
+		return nil, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	return append([]string{}, b.dynamic.SnapshotMap[instanceID]...), nil
+}
+
+func (b *broker) DeleteSnapshot(context context.Context, instanceID string, snapshotName string) error {
+	logger := b.logger.Session("delete-snapshot", lager.Data{"instanceID": instanceID, "snapshotName": snapshotName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := b.lockState(logger); err != nil {
+		return err
+	}
+	defer b.unlockState(logger)
+
+	if _, ok := b.dynamic.InstanceMap[instanceID]; !ok {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+
+	if b.operationInProgress(instanceID) {
+		return ErrOperationInProgress
+	}
+
+	if !b.snapshotExists(instanceID, snapshotName) {
+		return ErrSnapshotDoesNotExist
+	}
+
+	if b.cloneInProgress(instanceID, snapshotName) {
+		return ErrOperationInProgress
+	}
+
+	return b.deleteSnapshot(logger, context, instanceID, snapshotName)
+}
+
+// ListInstances describes every service instance, along with the quota and usage of its share
+func (b *broker) ListInstances(context context.Context) ([]InstanceResponseBody, error) {
+	logger := b.logger.Session("list-instances")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	instances, err := b.describeInstances(logger, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// asking the filesystem can be slow, so it is done without holding up other requests
+	for i := range instances {
+		b.describeShare(logger, context, &instances[i])
+	}
+	return instances, nil
+}
+
+func (b *broker) GetInstance(context context.Context, instanceID string) (InstanceResponseBody, error) {
+	logger := b.logger.Session("get-instance", lager.Data{"instanceID": instanceID})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	instances, err := b.describeInstances(logger, instanceID)
+	if err != nil {
+		return InstanceResponseBody{}, err
+	}
+	if len(instances) == 0 {
+		return InstanceResponseBody{}, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	b.describeShare(logger, context, &instances[0])
+	return instances[0], nil
+}
+
+// ListBindings describes every binding
+func (b *broker) ListBindings(_ context.Context) ([]BindingResponseBody, error) {
+	logger := b.logger.Session("list-bindings")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := b.lockState(logger); err != nil {
+		return nil, err
+	}
+	defer b.unlockState(logger)
+
+	return DescribeBindings(b.dynamic, ""), nil
+}
+
+func (b *broker) GetBinding(_ context.Context, bindingID string) (BindingResponseBody, error) {
+	logger := b.logger.Session("get-binding", lager.Data{"bindingID": bindingID})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := b.lockState(logger); err != nil {
+		return BindingResponseBody{}, err
+	}
+	defer b.unlockState(logger)
+
+	bindings := DescribeBindings(b.dynamic, bindingID)
+	if len(bindings) == 0 {
+		return BindingResponseBody{}, brokerapi.ErrBindingDoesNotExist
+	}
+	return bindings[0], nil
 }
 
-func (b *broker) Update(_ context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
-	panic("not implemented")
+// CheckShares reconciles the instances with the shares in the filesystem, only reporting the differences
+func (b *broker) CheckShares(_ context.Context) (ReconcileReport, error) {
+	return b.Reconcile(b.logger.Session("check-shares"), ReconcileOptions{})
+}
+
+// describeInstances describes every instance, without their parameters, or only the given one, with them.  It leaves
+// the quota and usage to describeShare.
+func (b *broker) describeInstances(logger lager.Logger, onlyInstanceID string) ([]InstanceResponseBody, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := b.lockState(logger); err != nil {
+		return nil, err
+	}
+	defer b.unlockState(logger)
+
+	return DescribeInstances(b.dynamic, b.catalog, onlyInstanceID), nil
+}
+
+// describeShare adds the quota and usage of an instance's share, if it has been created.  Failing to get them does
+// not fail the request, so that one broken share does not hide the others.
+func (b *broker) describeShare(logger lager.Logger, context context.Context, instance *InstanceResponseBody) {
+	if operation := instance.LastOperation; operation != nil && !(operation.Type == provisionOperation && operation.State == brokerapi.Succeeded) {
+		return
+	}
+
+	controller, err := b.controller.ForBackend(instance.Backend)
+	if err != nil {
+		logger.Error("backend-not-found", err, lager.Data{"instanceID": instance.InstanceID})
+		return
+	}
+
+	response := controller.ShareUsage(driverhttp.NewHttpDriverEnv(logger, context), instance.InstanceID)
+	if response.Err != "" {
+		logger.Error("failed-to-get-share-usage", errors.New(response.Err), lager.Data{"instanceID": instance.InstanceID})
+		return
+	}
+	instance.Quota = &response.Quota
+	instance.Usage = &response.Usage
 }
 
 func (b *broker) LastOperation(_ context.Context, instanceID string, operationData string) (brokerapi.LastOperation, error) {
-	panic("not implemented")
+	logger := b.logger.Session("last-operation", lager.Data{"instanceID": instanceID, "operationData": operationData})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := b.lockState(logger); err != nil {
+		return brokerapi.LastOperation{}, err
+	}
+	defer b.unlockState(logger)
+
+	if _, ok := b.dynamic.InstanceMap[instanceID]; !ok {
+		return brokerapi.LastOperation{}, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	operation, ok := b.dynamic.OperationMap[instanceID]
+	if !ok {
+		// synchronous operations complete before returning, so there is nothing left to report
+		return brokerapi.LastOperation{State: brokerapi.Succeeded}, nil
+	}
+
+	if b.abandoned(logger, operation) {
+		// the platform polls until the operation ends, so this is where the operation of a replica that died is noticed
+		b.resumeOperation(logger, instanceID, operation)
+		operation = b.dynamic.OperationMap[instanceID]
+	}
+
+	return brokerapi.LastOperation{State: operation.State, Description: operation.Description}, nil
+}
+
+// startOperation records an in-progress operation and runs it in the background once that has been saved.  The
+// caller must hold the mutex.
+func (b *broker) startOperation(logger lager.Logger, instanceID string, operationType string) error {
+	parameters, err := b.effectiveParameters(b.dynamic.InstanceMap[instanceID])
+	if err != nil {
+		logger.Error("failed-to-start-operation", err, lager.Data{"instanceID": instanceID, "operation": operationType})
+		b.dynamic.OperationMap[instanceID] = OperationState{Type: operationType, State: brokerapi.Failed, Description: err.Error()}
+		return b.serialize(b.dynamic)
+	}
+	controller, err := b.controllerFor(instanceID)
+	if err != nil {
+		logger.Error("failed-to-start-operation", err, lager.Data{"instanceID": instanceID, "operation": operationType})
+		b.dynamic.OperationMap[instanceID] = OperationState{Type: operationType, State: brokerapi.Failed, Description: err.Error()}
+		return b.serialize(b.dynamic)
+	}
+
+	b.dynamic.OperationMap[instanceID] = OperationState{Type: operationType, State: brokerapi.InProgress, Owner: b.owner()}
+	if err := b.serialize(b.dynamic); err != nil {
+		// an operation nobody will ever finish must not be left in progress
+		b.dynamic.OperationMap[instanceID] = OperationState{Type: operationType, State: brokerapi.Failed, Description: err.Error()}
+		return err
+	}
+
+	b.operations.Add(1)
+	go func() {
+		defer b.operations.Done()
+		b.runOperation(logger, controller, instanceID, operationType, parameters)
+	}()
+	return nil
+}
+
+// createSnapshot snapshots the share of an instance and saves a record of it.  The caller must hold the mutex.
+func (b *broker) createSnapshot(logger lager.Logger, context context.Context, instanceID string, snapshotName string) error {
+	controller, err := b.controllerFor(instanceID)
+	if err != nil {
+		logger.Error("backend-not-found", err)
+		return err
+	}
+
+	errResp := controller.CreateSnapshot(driverhttp.NewHttpDriverEnv(logger, context), instanceID, snapshotName)
+	if errResp.Err != "" {
+		err := errors.New(errResp.Err)
+		logger.Error("provisioner-create-snapshot-failed", err)
+		return err
+	}
+
+	b.dynamic.SnapshotMap[instanceID] = append(b.dynamic.SnapshotMap[instanceID], snapshotName)
+	return b.serialize(b.dynamic)
+}
+
+// deleteSnapshot removes a snapshot of an instance and saves that it is gone.  The caller must hold the mutex.
+func (b *broker) deleteSnapshot(logger lager.Logger, context context.Context, instanceID string, snapshotName string) error {
+	controller, err := b.controllerFor(instanceID)
+	if err != nil {
+		logger.Error("backend-not-found", err)
+		return err
+	}
+
+	errResp := controller.DeleteSnapshot(driverhttp.NewHttpDriverEnv(logger, context), instanceID, snapshotName)
+	if errResp.Err != "" {
+		err := errors.New(errResp.Err)
+		logger.Error("provisioner-delete-snapshot-failed", err)
+		return err
+	}
+
+	snapshots := []string{}
+	for _, snapshot := range b.dynamic.SnapshotMap[instanceID] {
+		if snapshot != snapshotName {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	if len(snapshots) == 0 {
+		delete(b.dynamic.SnapshotMap, instanceID)
+	} else {
+		b.dynamic.SnapshotMap[instanceID] = snapshots
+	}
+	return b.serialize(b.dynamic)
+}
+
+func (b *broker) checkNewSnapshot(instanceID string, snapshotName string) error {
+	if !snapshotNamePattern.MatchString(snapshotName) {
+		return ErrInvalidSnapshotName
+	}
+	if b.snapshotExists(instanceID, snapshotName) {
+		return ErrSnapshotAlreadyExists
+	}
+	return nil
+}
+
+func (b *broker) snapshotExists(instanceID string, snapshotName string) bool {
+	for _, snapshot := range b.dynamic.SnapshotMap[instanceID] {
+		if snapshot == snapshotName {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCloneSource makes sure that an instance being cloned exists, is not busy and lives in the same org and space
+// as its clone, so that nobody can copy data out of a space they have no access to.  Its share must also be in the
+// backend the clone is created in.  The caller must hold the mutex.
+func (b *broker) checkCloneSource(instanceID string, details brokerapi.ProvisionDetails, backend string, parameters map[string]interface{}) error {
+	source, err := evaluateCloneSource(parameters)
+	if err != nil {
+		return brokerapi.ErrRawParamsInvalid
+	}
+	if source.Instance == "" {
+		return nil
+	}
+
+	sourceDetails, ok := b.dynamic.InstanceMap[source.Instance]
+	if !ok || source.Instance == instanceID {
+		return ErrSourceInstanceDoesNotExist
+	}
+	if sourceDetails.OrganizationGUID != details.OrganizationGUID || sourceDetails.SpaceGUID != details.SpaceGUID {
+		return ErrSourceInstanceNotInSpace
+	}
+	// shares can only be copied within a backend
+	if b.dynamic.InstanceInfoMap[source.Instance].Backend != backend {
+		return ErrSourceInstanceInOtherBackend
+	}
+	if b.operationInProgress(source.Instance) {
+		return ErrOperationInProgress
+	}
+	if source.Snapshot != "" && !b.snapshotExists(source.Instance, source.Snapshot) {
+		return ErrSnapshotDoesNotExist
+	}
+	return nil
+}
+
+// cloneInProgress reports whether an instance that is still being provisioned is copying from the given instance (and
+// snapshot, unless it is empty).  The caller must hold the mutex.
+func (b *broker) cloneInProgress(sourceInstanceID string, snapshotName string) bool {
+	for instanceID, operation := range b.dynamic.OperationMap {
+		if operation.Type != provisionOperation || operation.State != brokerapi.InProgress {
+			continue
+		}
+		parameters, err := instanceParameters(b.dynamic.InstanceMap[instanceID])
+		if err != nil {
+			continue
+		}
+		source, err := evaluateCloneSource(parameters)
+		if err == nil && source.Instance == sourceInstanceID && (snapshotName == "" || source.Snapshot == snapshotName) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordInstance adds an instance to the state, or updates its details, keeping the time it was first provisioned
+func (b *broker) recordInstance(instanceID string, details brokerapi.ProvisionDetails, backend string) {
+	b.dynamic.InstanceMap[instanceID] = details
+	info, ok := b.dynamic.InstanceInfoMap[instanceID]
+	if !ok {
+		info = InstanceInfo{CreatedAt: time.Now().UTC()}
+	}
+	info.Backend = backend
+	b.dynamic.InstanceInfoMap[instanceID] = info
+}
+
+// controllerFor is the controller of the backend an instance's share is in.  The caller must hold the mutex.
+func (b *broker) controllerFor(instanceID string) (Controller, error) {
+	return b.controller.ForBackend(b.dynamic.InstanceInfoMap[instanceID].Backend)
+}
+
+func (b *broker) recordSharePath(instanceID string, sharePath string) {
+	info := b.dynamic.InstanceInfoMap[instanceID]
+	info.SharePath = sharePath
+	b.dynamic.InstanceInfoMap[instanceID] = info
+}
+
+// sharePath asks the controller where the share of a new instance is, for the record.  It is not worth failing the
+// provision over, so an unknown path is only logged.
+func (b *broker) sharePath(logger lager.Logger, controller Controller, env voldriver.Env, instanceID string) string {
+	response := controller.SharePath(env, instanceID)
+	if response.Err != "" {
+		logger.Error("failed-to-find-share-path", errors.New(response.Err))
+	}
+	return response.Path
+}
+
+// discardProvision undoes the record of a synchronous provision that failed: a new instance is forgotten, and one
+// that was already recorded is left with its provision failed.  The caller must hold the mutex.
+func (b *broker) discardProvision(instanceID string, existed bool, err error) {
+	if !existed {
+		b.forgetInstance(instanceID)
+		return
+	}
+	b.dynamic.OperationMap[instanceID] = OperationState{Type: provisionOperation, State: brokerapi.Failed, Description: err.Error()}
+}
+
+func (b *broker) forgetInstance(instanceID string) {
+	delete(b.dynamic.InstanceMap, instanceID)
+	delete(b.dynamic.InstanceInfoMap, instanceID)
+	delete(b.dynamic.OperationMap, instanceID)
+	delete(b.dynamic.SnapshotMap, instanceID)
+}
+
+// provisioned reports whether an instance was created successfully, rather than being created or having failed to be.
+// The caller must hold the mutex.
+func (b *broker) provisioned(instanceID string) bool {
+	if _, ok := b.dynamic.InstanceMap[instanceID]; !ok {
+		return false
+	}
+	operation, ok := b.dynamic.OperationMap[instanceID]
+	return !ok || (operation.Type == provisionOperation && operation.State == brokerapi.Succeeded)
+}
+
+func (b *broker) operationInProgress(instanceID string) bool {
+	operation, ok := b.dynamic.OperationMap[instanceID]
+	return ok && operation.State == brokerapi.InProgress
+}
+
+func (b *broker) runOperation(logger lager.Logger, controller Controller, instanceID string, operationType string, parameters map[string]interface{}) {
+	logger = logger.Session("run-operation", lager.Data{"instanceID": instanceID, "operation": operationType})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	env := driverhttp.NewHttpDriverEnv(logger, context.Background())
+
+	var errResp voldriver.ErrorResponse
+	var sharePath string
+	switch operationType {
+	case provisionOperation:
+		errResp = controller.Create(env, createRequest(instanceID, parameters))
+		if errResp.Err == "" {
+			sharePath = b.sharePath(logger, controller, env, instanceID)
+		}
+	case deprovisionOperation:
+		errResp = controller.Remove(env, voldriver.RemoveRequest{Name: instanceID})
+	default:
+		errResp = voldriver.ErrorResponse{Err: fmt.Sprintf("unknown operation '%s'", operationType)}
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := b.lockState(logger); err != nil {
+		// the operation stays in progress, and is run again when this replica restarts
+		logger.Error("failed-to-record-operation-result", err)
+		return
+	}
+	defer b.unlockState(logger)
+
+	// there is no request to fail here; serialize logs its own errors, and an unsaved deprovision is simply resumed
+	// after a restart
+	if errResp.Err != "" {
+		logger.Error("operation-failed", errors.New(errResp.Err))
+		b.dynamic.OperationMap[instanceID] = OperationState{Type: operationType, State: brokerapi.Failed, Description: errResp.Err}
+		b.serialize(b.dynamic)
+		return
+	}
+
+	if operationType == deprovisionOperation {
+		b.forgetInstance(instanceID)
+		b.serialize(b.dynamic)
+		return
+	}
+
+	b.recordSharePath(instanceID, sharePath)
+	b.dynamic.OperationMap[instanceID] = OperationState{Type: operationType, State: brokerapi.Succeeded}
+	if err := b.serialize(b.dynamic); err != nil {
+		b.dynamic.OperationMap[instanceID] = OperationState{Type: operationType, State: brokerapi.Failed, Description: err.Error()}
+	}
+}
+
+// resumeOperations restarts operations that were still in progress when the broker last stopped, along with those of
+// replicas that have died since.  Create and Remove are idempotent so it is safe to run them again.
+func (b *broker) resumeOperations() {
+	logger := b.logger.Session("resume-operations")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := b.lockState(logger); err != nil {
+		logger.Error("failed-to-lock-state", err)
+		return
+	}
+	defer b.unlockState(logger)
+
+	for instanceID, operation := range b.dynamic.OperationMap {
+		if operation.State != brokerapi.InProgress {
+			continue
+		}
+		if operation.Owner != b.owner() && !b.abandoned(logger, operation) {
+			// replicas that are still running resume their own operations
+			continue
+		}
+		b.resumeOperation(logger, instanceID, operation)
+	}
+}
+
+// resumeOperation runs an in-progress operation again, in this replica; anything we don't know how to resume is marked
+// as failed.  The caller must hold the mutex.
+func (b *broker) resumeOperation(logger lager.Logger, instanceID string, operation OperationState) {
+	switch operation.Type {
+	case provisionOperation, deprovisionOperation:
+		logger.Info("resuming-operation", lager.Data{"instanceID": instanceID, "operation": operation.Type, "owner": operation.Owner})
+		if err := b.startOperation(logger, instanceID, operation.Type); err != nil {
+			logger.Error("failed-to-resume-operation", err, lager.Data{"instanceID": instanceID})
+		}
+	default:
+		err := fmt.Errorf("unable to resume operation '%s' after restart", operation.Type)
+		logger.Error("cannot-resume-operation", err, lager.Data{"instanceID": instanceID})
+		b.dynamic.OperationMap[instanceID] = OperationState{Type: operation.Type, State: brokerapi.Failed, Description: err.Error()}
+		b.serialize(b.dynamic)
+	}
+}
+
+// abandoned reports whether an operation is in progress in another replica that has died, whose lease on its name in
+// the shared store has run out.  The caller must hold the mutex.
+func (b *broker) abandoned(logger lager.Logger, operation OperationState) bool {
+	if b.shared == nil || operation.State != brokerapi.InProgress || operation.Owner == b.owner() {
+		return false
+	}
+	alive, err := b.shared.ReplicaAlive(operation.Owner)
+	if err != nil {
+		// better to leave the operation waiting than to run it twice
+		logger.Error("failed-to-check-operation-owner", err, lager.Data{"owner": operation.Owner})
+		return false
+	}
+	return !alive
 }
 
 func (b *broker) instanceConflicts(details brokerapi.ProvisionDetails, instanceID string) bool {
@@ -254,6 +1132,109 @@ func (b *broker) instanceConflicts(details brokerapi.ProvisionDetails, instanceI
 	return false
 }
 
+func createRequest(instanceID string, parameters map[string]interface{}) voldriver.CreateRequest {
+	return voldriver.CreateRequest{
+		Name: instanceID,
+		Opts: mergeParameters(parameters, map[string]interface{}{"volume_id": instanceID}),
+	}
+}
+
+// effectiveParameters layers the parameters given for an instance on top of the defaults of its plan
+func (b *broker) effectiveParameters(details brokerapi.ProvisionDetails) (map[string]interface{}, error) {
+	parameters, err := instanceParameters(details)
+	if err != nil {
+		return nil, err
+	}
+
+	plan, err := b.catalog.FindPlan(details.ServiceID, details.PlanID)
+	if err != nil {
+		// the plan may have been removed from the catalog since the instance was created
+		return parameters, nil
+	}
+	return mergeParameters(plan.Parameters, parameters), nil
+}
+
+func instanceParameters(details brokerapi.ProvisionDetails) (map[string]interface{}, error) {
+	parameters := map[string]interface{}{}
+	if len(details.RawParameters) == 0 {
+		return parameters, nil
+	}
+
+	if err := json.Unmarshal(details.RawParameters, &parameters); err != nil {
+		return nil, brokerapi.ErrRawParamsInvalid
+	}
+	if parameters == nil {
+		parameters = map[string]interface{}{}
+	}
+	return parameters, nil
+}
+
+// mergeParameters layers overrides on top of defaults without modifying either map
+func mergeParameters(defaults, overrides map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+	return merged
+}
+
+// evaluateSnapshotActions splits the "snapshot" and "delete_snapshot" actions out of update parameters, since they
+// are requests to do something rather than settings to remember
+func evaluateSnapshotActions(parameters map[string]interface{}) (map[string]interface{}, string, string, error) {
+	settings := map[string]interface{}{}
+	var createSnapshot, deleteSnapshot string
+	for k, v := range parameters {
+		switch k {
+		case "snapshot", "delete_snapshot":
+			name, ok := v.(string)
+			if !ok {
+				return nil, "", "", brokerapi.ErrRawParamsInvalid
+			}
+			if k == "snapshot" {
+				createSnapshot = name
+			} else {
+				deleteSnapshot = name
+			}
+		default:
+			settings[k] = v
+		}
+	}
+	return settings, createSnapshot, deleteSnapshot, nil
+}
+
+func validateParameters(parameters map[string]interface{}) error {
+	if _, err := evaluateMode(parameters); err != nil {
+		return err
+	}
+	if _, _, err := evaluateQuota(parameters); err != nil {
+		return brokerapi.ErrRawParamsInvalid
+	}
+	if _, err := evaluateOwnership(parameters); err != nil {
+		return brokerapi.ErrRawParamsInvalid
+	}
+	return nil
+}
+
+// withOwnerHints adds the share's uid and gid, when they were set, to a binding's mount config
+func withOwnerHints(mountConfig map[string]interface{}, ownership Ownership) map[string]interface{} {
+	if ownership.UID == nil && ownership.GID == nil {
+		return mountConfig
+	}
+	if mountConfig == nil {
+		mountConfig = map[string]interface{}{}
+	}
+	if ownership.UID != nil {
+		mountConfig["uid"] = strconv.FormatUint(uint64(*ownership.UID), 10)
+	}
+	if ownership.GID != nil {
+		mountConfig["gid"] = strconv.FormatUint(uint64(*ownership.GID), 10)
+	}
+	return mountConfig
+}
+
 func evaluateContainerPath(parameters map[string]interface{}, volId string) string {
 	if containerPath, ok := parameters["mount"]; ok && containerPath != "" {
 		return containerPath.(string)
@@ -290,47 +1271,116 @@ func (b *broker) bindingConflicts(bindingID string, details brokerapi.BindDetail
 	return false
 }
 
-func (b *broker) serialize(state interface{}) {
+// lockState takes the lock shared with the other broker replicas, if there are any, and reloads the state that they may
+// have changed since.  The caller must hold the mutex.
+func (b *broker) lockState(logger lager.Logger) error {
+	if b.shared == nil {
+		return nil
+	}
+
+	if err := b.shared.Lock(logger); err != nil {
+		return err
+	}
+	state, _, err := b.restore(logger)
+	if err != nil {
+		b.shared.Unlock(logger)
+		return fmt.Errorf("failed to load broker state: %s", err.Error())
+	}
+	b.dynamic = state
+	return nil
+}
+
+func (b *broker) unlockState(logger lager.Logger) {
+	if b.shared != nil {
+		b.shared.Unlock(logger)
+	}
+}
+
+// owner names the replica that runs the operations this broker starts, or is empty when there is only one replica
+func (b *broker) owner() string {
+	if b.shared == nil {
+		return ""
+	}
+	return b.shared.Owner()
+}
+
+func (b *broker) serialize(state State) error {
 	logger := b.logger.Session("serialize-state")
 	logger.Info("start")
 	defer logger.Info("end")
 
-	stateFile := filepath.Join(b.dataDir, fmt.Sprintf("%s-services.json", b.static.ServiceName))
+	if b.cipher != nil {
+		var err error
+		if state, err = b.cipher.sealState(state); err != nil {
+			logger.Error("failed-to-encrypt-state", err)
+			return fmt.Errorf("failed to save broker state: %s", err.Error())
+		}
+	}
 
-	stateData, err := json.Marshal(state)
+	err := b.store.Save(logger, state)
 	if err != nil {
-		b.logger.Error("failed-to-marshall-state", err)
-		return
+		logger.Error("failed-to-save-state", err)
+		return fmt.Errorf("failed to save broker state: %s", err.Error())
+	}
+	if b.cipher != nil {
+		b.keepSealedParameters(state)
+	}
+	return nil
+}
+
+// keepSealedParameters remembers what was saved for the parameters of each instance and binding, so that they are only
+// encrypted again once they change
+func (b *broker) keepSealedParameters(sealed State) {
+	for id, sealedInfo := range sealed.InstanceInfoMap {
+		if info, ok := b.dynamic.InstanceInfoMap[id]; ok {
+			info.SealedParameters = sealedInfo.SealedParameters
+			b.dynamic.InstanceInfoMap[id] = info
+		}
+	}
+	for id, sealedInfo := range sealed.BindingInfoMap {
+		if info, ok := b.dynamic.BindingInfoMap[id]; ok {
+			info.SealedParameters = sealedInfo.SealedParameters
+			b.dynamic.BindingInfoMap[id] = info
+		}
 	}
+}
 
-	err = b.ioutil.WriteFile(stateFile, stateData, os.ModePerm)
+// restore loads the saved state and decrypts it, reporting whether it needs encrypting again with the current key
+func (b *broker) restore(logger lager.Logger) (State, bool, error) {
+	state, err := b.store.Restore(logger)
 	if err != nil {
-		b.logger.Error(fmt.Sprintf("failed-to-write-state-file: %s", stateFile), err)
-		return
+		return State{}, false, err
 	}
-
-	logger.Info("state-saved", lager.Data{"state-file": stateFile})
+	return b.cipher.openState(state)
 }
 
-func (b *broker) restoreDynamicState() {
+// restoreDynamicState loads the saved state, and saves it straight back if it had to be migrated from an older format
+// or encrypted with a new key.  State that cannot be read, including state saved by a newer broker or encrypted with a
+// key we were not given, is refused rather than misread or overwritten.
+func (b *broker) restoreDynamicState() error {
 	logger := b.logger.Session("restore-services")
 	logger.Info("start")
 	defer logger.Info("end")
 
-	stateFile := filepath.Join(b.dataDir, fmt.Sprintf("%s-services.json", b.static.ServiceName))
-
-	serviceData, err := b.ioutil.ReadFile(stateFile)
+	// starting without the saved state would forget every instance as soon as anything is saved, so unreadable state
+	// must be dealt with first; see RecoverState
+	state, resealing, err := b.restore(logger)
 	if err != nil {
-		b.logger.Error(fmt.Sprintf("failed-to-read-state-file: %s", stateFile), err)
-		return
+		logger.Error("failed-to-restore-state", err)
+		return err
 	}
 
-	dynamicState := dynamicState{}
-	err = json.Unmarshal(serviceData, &dynamicState)
-	if err != nil {
-		b.logger.Error(fmt.Sprintf("failed-to-unmarshall-state from state-file: %s", stateFile), err)
-		return
+	logger.Info("state-restored", lager.Data{"version": state.Version})
+	b.dynamic = state
+
+	if state.Version < StateVersion || resealing {
+		logger.Info("migrating-state", lager.Data{"from": state.Version, "to": StateVersion, "encrypting": resealing})
+		if err := b.serialize(b.dynamic); err != nil {
+			// the state is saved in the new format by the next change that does succeed
+			logger.Error("failed-to-save-migrated-state", err)
+			return nil
+		}
+		b.dynamic.Version = StateVersion
 	}
-	logger.Info("state-restored", lager.Data{"state-file": stateFile})
-	b.dynamic = dynamicState
+	return nil
 }
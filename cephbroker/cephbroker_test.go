@@ -5,9 +5,17 @@ import (
 	"code.cloudfoundry.org/voldriver"
 	"github.com/pivotal-cf/brokerapi"
 
+	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 
 	"sync"
+	"time"
 
 	"os"
 
@@ -17,20 +25,58 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
 	"context"
 )
 
+// dynamicState is the layout of state files written before they had a version
 type dynamicState struct {
 	InstanceMap map[string]brokerapi.ProvisionDetails
 	BindingMap  map[string]brokerapi.BindDetails
 }
 
+type savedInstance struct {
+	InstanceID       string          `json:"instance_id"`
+	ServiceID        string          `json:"service_id"`
+	PlanID           string          `json:"plan_id"`
+	OrganizationGUID string          `json:"organization_guid"`
+	SpaceGUID        string          `json:"space_guid"`
+	Parameters       json.RawMessage `json:"parameters"`
+	SharePath        string          `json:"share_path"`
+	CreatedAt        time.Time       `json:"created_at"`
+}
+
+type savedBinding struct {
+	BindingID  string    `json:"binding_id"`
+	InstanceID string    `json:"instance_id"`
+	AppGUID    string    `json:"app_guid"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type savedState struct {
+	Version   int                      `json:"version"`
+	Instances map[string]savedInstance `json:"instances"`
+	Bindings  map[string]savedBinding  `json:"bindings"`
+	Snapshots map[string][]string      `json:"snapshots"`
+}
+
+func parseSavedState(data string) savedState {
+	state := savedState{}
+	Expect(json.Unmarshal([]byte(data), &state)).To(Succeed())
+	return state
+}
+
 var _ = Describe("Broker", func() {
 	var (
 		broker             brokerapi.ServiceBroker
 		fakeController     *cephfakes.FakeController
+		fakeOs             *os_fake.FakeOs
 		fakeIoutil         *ioutil_fake.FakeIoutil
+		stateDir           string
 		logger             lager.Logger
+		provisionDetails   brokerapi.ProvisionDetails
 		ctx context.Context
 		WriteFileCallCount int
 		WriteFileWrote     string
@@ -40,12 +86,215 @@ var _ = Describe("Broker", func() {
 		logger = lagertest.NewTestLogger("test-broker")
 		ctx = context.TODO()
 		fakeController = &cephfakes.FakeController{}
+		fakeController.ForBackendReturns(fakeController, nil)
+		provisionDetails = brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id"}
 		fakeIoutil = &ioutil_fake.FakeIoutil{}
 		fakeIoutil.WriteFileStub = func(filename string, data []byte, perm os.FileMode) error {
 			WriteFileCallCount++
 			WriteFileWrote = string(data)
 			return nil
 		}
+
+		var err error
+		stateDir, err = ioutil.TempDir("", "cephbroker-state")
+		Expect(err).NotTo(HaveOccurred())
+		fakeOs = &os_fake.FakeOs{}
+		// brokers start with no saved state unless a test gives them some
+		fakeIoutil.ReadFileReturns(nil, os.ErrNotExist)
+		fakeOs.IsNotExistStub = os.IsNotExist
+		// state files are synced to disk, which needs a real file to sync
+		fakeOs.OpenFileStub = func(string, int, os.FileMode) (*os.File, error) {
+			return os.Open(stateDir)
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(stateDir)
+	})
+
+	Context("when saving state to disk", func() {
+		var stateFile string
+
+		BeforeEach(func() {
+			stateFile = filepath.Join(stateDir, "service-name-services.json")
+			var err error
+			broker, err = cephbroker.New(
+				logger, fakeController,
+				cephbroker.NewCatalog("service-name", "service-id", "plan-name", "plan-id", "plan-desc"),
+				cephbroker.NewFileStore(stateFile, &osshim.OsShim{}, &ioutilshim.IoutilShim{}), nil,
+			)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should only be readable by the broker", func() {
+			_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			info, err := os.Stat(stateFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+			Expect(stateFile + ".tmp").NotTo(BeAnExistingFile())
+		})
+
+		It("should keep previous generations", func() {
+			for _, instanceID := range []string{"instance-1", "instance-2", "instance-3", "instance-4", "instance-5"} {
+				_, err := broker.Provision(ctx, instanceID, provisionDetails, false)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			for generation := 1; generation <= cephbroker.StateFileGenerations; generation++ {
+				Expect(fmt.Sprintf("%s.%d", stateFile, generation)).To(BeAnExistingFile())
+			}
+			Expect(fmt.Sprintf("%s.%d", stateFile, cephbroker.StateFileGenerations+1)).NotTo(BeAnExistingFile())
+
+			// each provision is saved as it starts and again once it is done
+			previous, err := ioutil.ReadFile(stateFile + ".2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(previous)).To(ContainSubstring("instance-4"))
+			Expect(string(previous)).NotTo(ContainSubstring("instance-5"))
+		})
+
+		It("should restore from the previous generation when the state file is missing", func() {
+			_, err := broker.Provision(ctx, "instance-1", provisionDetails, false)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = broker.Provision(ctx, "instance-2", provisionDetails, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.Remove(stateFile)).To(Succeed())
+
+			broker, err = cephbroker.New(
+				logger, fakeController,
+				cephbroker.NewCatalog("service-name", "service-id", "plan-name", "plan-id", "plan-desc"),
+				cephbroker.NewFileStore(stateFile, &osshim.OsShim{}, &ioutilshim.IoutilShim{}), nil,
+			)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = broker.Bind(ctx, "instance-1", "binding-id", brokerapi.BindDetails{AppGUID: "guid"})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Context("when encrypting state", func() {
+		var (
+			stateFile        string
+			oldKeys, newKeys string
+			bindDetails      brokerapi.BindDetails
+		)
+
+		stateKey := func(b byte) string {
+			return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+		}
+
+		newBroker := func(keys string) (brokerapi.ServiceBroker, error) {
+			var stateCipher *cephbroker.StateCipher
+			if keys != "" {
+				var err error
+				stateCipher, err = cephbroker.NewStateCipher(keys)
+				Expect(err).NotTo(HaveOccurred())
+			}
+			return cephbroker.New(
+				logger, fakeController,
+				cephbroker.NewCatalog("service-name", "service-id", "plan-name", "plan-id", "plan-desc"),
+				cephbroker.NewFileStore(stateFile, &osshim.OsShim{}, &ioutilshim.IoutilShim{}), stateCipher,
+			)
+		}
+
+		readStateFile := func() string {
+			data, err := ioutil.ReadFile(stateFile)
+			Expect(err).NotTo(HaveOccurred())
+			return string(data)
+		}
+
+		BeforeEach(func() {
+			stateFile = filepath.Join(stateDir, "service-name-services.json")
+			oldKeys = "old:" + stateKey('o')
+			newKeys = "new:" + stateKey('n') + "\nold:" + stateKey('o')
+			provisionDetails.RawParameters = json.RawMessage(`{"password":"provision-secret"}`)
+			bindDetails = brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{"password": "bind-secret"}}
+
+			var err error
+			broker, err = newBroker(oldKeys)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should not save parameters in the clear", func() {
+			state := readStateFile()
+			Expect(state).NotTo(ContainSubstring("provision-secret"))
+			Expect(state).NotTo(ContainSubstring("bind-secret"))
+			Expect(state).To(ContainSubstring(`"sealed_parameters"`))
+		})
+
+		It("should decrypt parameters when restarted", func() {
+			var err error
+			broker, err = newBroker(oldKeys)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+
+			provisionDetails.RawParameters = json.RawMessage(`{"password":"another-secret"}`)
+			_, err = broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+			Expect(err).To(Equal(brokerapi.ErrInstanceAlreadyExists))
+		})
+
+		It("should not encrypt unchanged parameters again", func() {
+			before := parseSavedState(readStateFile())
+			_, err := broker.Provision(ctx, "another-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id"}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			after := parseSavedState(readStateFile())
+			Expect(after.Instances["some-instance-id"]).To(Equal(before.Instances["some-instance-id"]))
+			Expect(after.Bindings["binding-id"]).To(Equal(before.Bindings["binding-id"]))
+		})
+
+		It("should encrypt state with the new key when keys are rotated", func() {
+			var err error
+			broker, err = newBroker(newKeys)
+			Expect(err).NotTo(HaveOccurred())
+
+			state := readStateFile()
+			Expect(state).To(ContainSubstring(`"key_id":"new"`))
+			Expect(state).NotTo(ContainSubstring(`"key_id":"old"`))
+
+			broker, err = newBroker("new:" + stateKey('n'))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should encrypt state that was saved in the clear", func() {
+			Expect(os.Remove(stateFile)).To(Succeed())
+			for generation := 1; generation <= cephbroker.StateFileGenerations; generation++ {
+				os.Remove(fmt.Sprintf("%s.%d", stateFile, generation))
+			}
+			var err error
+			broker, err = newBroker("")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(readStateFile()).To(ContainSubstring("provision-secret"))
+
+			broker, err = newBroker(oldKeys)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(readStateFile()).NotTo(ContainSubstring("provision-secret"))
+		})
+
+		It("should refuse to start without the key", func() {
+			_, err := newBroker("")
+			Expect(err).To(MatchError(ContainSubstring(cephbroker.ErrStateKeyMissing.Error())))
+		})
+
+		It("should refuse to start with the wrong key", func() {
+			_, err := newBroker("new:" + stateKey('n'))
+			Expect(err).To(MatchError(ContainSubstring("unknown state key 'old'")))
+
+			_, err = newBroker("old:" + stateKey('x'))
+			Expect(err).To(MatchError(ContainSubstring("failed to decrypt")))
+		})
 	})
 
 	Context("when recreating", func() {
@@ -64,41 +313,268 @@ var _ = Describe("Broker", func() {
 			Expect(err).NotTo(HaveOccurred())
 			fakeIoutil.ReadFileReturns(filecontents, nil)
 
-			broker = cephbroker.New(
+			broker, err = cephbroker.New(
 				logger, fakeController,
-				"service-name", "service-id",
-				"plan-name", "plan-id", "plan-desc", "/fake-dir",
-				fakeIoutil,
+				cephbroker.NewCatalog("service-name", "service-id", "plan-name", "plan-id", "plan-desc"),
+				cephbroker.NewFileStore("/fake-dir/service-name-services.json", fakeOs, fakeIoutil), nil,
 			)
+			Expect(err).NotTo(HaveOccurred())
 
 			_, err = broker.Bind(ctx, "service-name", "whatever", brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{}})
 			Expect(err).NotTo(HaveOccurred())
 		})
 
-		It("shouldn't be able to bind to service from invalid state file", func() {
+		It("should save state from older brokers in the current format", func() {
+			filecontents := `{"InstanceMap":{"service-name":{"service_id":"service-id","plan_id":"plan-id","organization_guid":"o","space_guid":"s"}},"BindingMap":{}}`
+			fakeIoutil.ReadFileReturns([]byte(filecontents), nil)
+			WriteFileCallCount = 0
+			WriteFileWrote = ""
+
+			var err error
+			broker, err = cephbroker.New(
+				logger, fakeController,
+				cephbroker.NewCatalog("service-name", "service-id", "plan-name", "plan-id", "plan-desc"),
+				cephbroker.NewFileStore("/fake-dir/service-name-services.json", fakeOs, fakeIoutil), nil,
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(WriteFileCallCount).To(Equal(1))
+			saved := parseSavedState(WriteFileWrote)
+			Expect(saved.Version).To(Equal(cephbroker.StateVersion))
+			Expect(saved.Instances["service-name"]).To(Equal(savedInstance{
+				InstanceID:       "service-name",
+				ServiceID:        "service-id",
+				PlanID:           "plan-id",
+				OrganizationGUID: "o",
+				SpaceGUID:        "s",
+				SharePath:        "/service-name",
+			}))
+		})
+
+		It("should refuse to start with state saved by a newer broker", func() {
+			fakeIoutil.ReadFileReturns([]byte(`{"version":99,"instances":{}}`), nil)
+			WriteFileCallCount = 0
+
+			_, err := cephbroker.New(
+				logger, fakeController,
+				cephbroker.NewCatalog("service-name", "service-id", "plan-name", "plan-id", "plan-desc"),
+				cephbroker.NewFileStore("/fake-dir/service-name-services.json", fakeOs, fakeIoutil), nil,
+			)
+			Expect(err).To(Equal(cephbroker.UnsupportedStateVersionError{Version: 99}))
+			Expect(WriteFileCallCount).To(Equal(0))
+		})
+
+		It("should resume operations that were in progress", func() {
+			filecontents := `{"InstanceMap":{"service-name":{"service_id":"service-id","plan_id":"plan-id","organization_guid":"o","space_guid":"s"}},` +
+				`"BindingMap":{},"OperationMap":{"service-name":{"type":"provision","state":"in progress"}}}`
+			fakeIoutil.ReadFileReturns([]byte(filecontents), nil)
+
+			var err error
+			broker, err = cephbroker.New(
+				logger, fakeController,
+				cephbroker.NewCatalog("service-name", "service-id", "plan-name", "plan-id", "plan-desc"),
+				cephbroker.NewFileStore("/fake-dir/service-name-services.json", fakeOs, fakeIoutil), nil,
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(fakeController.CreateCallCount).Should(Equal(1))
+			Eventually(func() brokerapi.LastOperationState {
+				op, err := broker.LastOperation(ctx, "service-name", "provision")
+				Expect(err).NotTo(HaveOccurred())
+				return op.State
+			}).Should(Equal(brokerapi.Succeeded))
+		})
+
+		It("should mark operations it cannot resume as failed", func() {
+			filecontents := `{"InstanceMap":{"service-name":{"service_id":"service-id","plan_id":"plan-id","organization_guid":"o","space_guid":"s"}},` +
+				`"BindingMap":{},"OperationMap":{"service-name":{"type":"something-else","state":"in progress"}}}`
+			fakeIoutil.ReadFileReturns([]byte(filecontents), nil)
+
+			var err error
+			broker, err = cephbroker.New(
+				logger, fakeController,
+				cephbroker.NewCatalog("service-name", "service-id", "plan-name", "plan-id", "plan-desc"),
+				cephbroker.NewFileStore("/fake-dir/service-name-services.json", fakeOs, fakeIoutil), nil,
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			op, err := broker.LastOperation(ctx, "service-name", "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(op.State).To(Equal(brokerapi.Failed))
+		})
+
+		It("should refuse to start from an invalid state file", func() {
 			filecontents := "{serviceName: [some invalid state]}"
 			fakeIoutil.ReadFileReturns([]byte(filecontents[:]), nil)
 
-			broker = cephbroker.New(
+			_, err := cephbroker.New(
 				logger, fakeController,
-				"service-name", "service-id",
-				"plan-name", "plan-id", "plan-desc", "/fake-dir",
-				fakeIoutil,
+				cephbroker.NewCatalog("service-name", "service-id", "plan-name", "plan-id", "plan-desc"),
+				cephbroker.NewFileStore("/fake-dir/service-name-services.json", fakeOs, fakeIoutil), nil,
 			)
+			Expect(err).To(MatchError(ContainSubstring("failed to parse state file")))
+			Expect(fakeIoutil.WriteFileCallCount()).To(Equal(0))
+		})
+
+		It("should refuse to start from an unreadable state file", func() {
+			fakeIoutil.ReadFileReturns(nil, os.ErrPermission)
 
-			_, err := broker.Bind(ctx, "service-name", "whatever", brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{}})
-			Expect(err).To(HaveOccurred())
+			_, err := cephbroker.New(
+				logger, fakeController,
+				cephbroker.NewCatalog("service-name", "service-id", "plan-name", "plan-id", "plan-desc"),
+				cephbroker.NewFileStore("/fake-dir/service-name-services.json", fakeOs, fakeIoutil), nil,
+			)
+			Expect(err).To(MatchError(ContainSubstring("failed to read state file")))
+		})
+	})
+
+	Context("when the catalog has several plans", func() {
+		BeforeEach(func() {
+			catalog := cephbroker.Catalog{
+				Services: []cephbroker.CatalogService{{
+					ID:   "service-id",
+					Name: "service-name",
+					Plans: []cephbroker.CatalogPlan{
+						{ID: "small-id", Name: "small", Parameters: map[string]interface{}{"quota": "10G"}},
+						{ID: "archive-id", Name: "readonly-archive", Parameters: map[string]interface{}{"readonly": true}},
+					},
+				}},
+			}
+			var err error
+			broker, err = cephbroker.New(logger, fakeController, catalog, cephbroker.NewFileStore("/fake-dir/service-name-services.json", fakeOs, fakeIoutil), nil)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("serves every plan and allows plan changes", func() {
+			result := broker.Services(ctx)[0]
+			Expect(result.PlanUpdatable).To(BeTrue())
+			Expect(result.Plans).To(HaveLen(2))
+			Expect(result.Plans[1].Name).To(Equal("readonly-archive"))
+			Expect(result.Plans[1].ID).To(Equal("archive-id"))
+		})
+
+		It("passes the plan defaults through to the controller", func() {
+			_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "small-id"}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, request := fakeController.CreateArgsForCall(0)
+			Expect(request.Opts["quota"]).To(Equal("10G"))
+		})
+
+		It("applies the defaults of the new plan on update", func() {
+			_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "small-id"}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{PlanID: "archive-id"}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binding.VolumeMounts[0].Mode).To(Equal("r"))
+		})
+	})
+
+	Context("when plans provision in other backends", func() {
+		var backendController *cephfakes.FakeController
+
+		BeforeEach(func() {
+			backendController = &cephfakes.FakeController{}
+			fakeController.ForBackendStub = func(name string) (cephbroker.Controller, error) {
+				switch name {
+				case "":
+					return fakeController, nil
+				case "archive":
+					return backendController, nil
+				}
+				return nil, errors.New("backend not found: '" + name + "'")
+			}
+			catalog := cephbroker.Catalog{
+				Services: []cephbroker.CatalogService{{
+					ID:   "service-id",
+					Name: "service-name",
+					Plans: []cephbroker.CatalogPlan{
+						{ID: "small-id", Name: "small"},
+						{ID: "archive-id", Name: "archive", Backend: "archive"},
+						{ID: "cold-id", Name: "cold", Backend: "archive"},
+						{ID: "missing-id", Name: "missing", Backend: "missing"},
+					},
+				}},
+			}
+			var err error
+			broker, err = cephbroker.New(logger, fakeController, catalog, cephbroker.NewFileStore("/fake-dir/service-name-services.json", fakeOs, fakeIoutil), nil)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("creates, binds and removes shares in the plan's backend", func() {
+			_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "archive-id"}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backendController.CreateCallCount()).To(Equal(1))
+			Expect(fakeController.CreateCallCount()).To(Equal(0))
+			Expect(WriteFileWrote).To(ContainSubstring(`"backend":"archive"`))
+
+			_, err = broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backendController.BindCallCount()).To(Equal(1))
+
+			_, err = broker.Deprovision(ctx, "some-instance-id", brokerapi.DeprovisionDetails{}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backendController.RemoveCallCount()).To(Equal(1))
+			Expect(fakeController.RemoveCallCount()).To(Equal(0))
+		})
+
+		It("allows plan changes within a backend", func() {
+			_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "archive-id"}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{PlanID: "cold-id"}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backendController.UpdateCallCount()).To(Equal(1))
+		})
+
+		It("rejects plan changes to another backend", func() {
+			_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "small-id"}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{PlanID: "archive-id"}, false)
+			Expect(err).To(Equal(brokerapi.ErrPlanChangeNotSupported))
+			Expect(fakeController.UpdateCallCount()).To(Equal(0))
+			Expect(backendController.UpdateCallCount()).To(Equal(0))
+		})
+
+		It("refuses to clone an instance from another backend", func() {
+			_, err := broker.Provision(ctx, "source-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "small-id"}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = broker.Provision(ctx, "clone-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "archive-id", RawParameters: json.RawMessage(`{"source_instance":"source-instance-id"}`)}, false)
+			Expect(err).To(Equal(cephbroker.ErrSourceInstanceInOtherBackend))
+			Expect(backendController.CreateCallCount()).To(Equal(0))
+		})
+
+		It("clones instances within a backend", func() {
+			_, err := broker.Provision(ctx, "source-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "archive-id"}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = broker.Provision(ctx, "clone-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "cold-id", RawParameters: json.RawMessage(`{"source_instance":"source-instance-id"}`)}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(backendController.CreateCallCount()).To(Equal(2))
+		})
+
+		It("errors when the plan's backend is unknown", func() {
+			_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "missing-id"}, false)
+			Expect(err).To(MatchError("backend not found: 'missing'"))
+			Expect(fakeController.CreateCallCount()).To(Equal(0))
 		})
 	})
 
 	Context("when creating first time", func() {
 		BeforeEach(func() {
-			broker = cephbroker.New(
+			var err error
+			broker, err = cephbroker.New(
 				logger, fakeController,
-				"service-name", "service-id",
-				"plan-name", "plan-id", "plan-desc", "/fake-dir",
-				fakeIoutil,
+				cephbroker.NewCatalog("service-name", "service-id", "plan-name", "plan-id", "plan-desc"),
+				cephbroker.NewFileStore("/fake-dir/service-name-services.json", fakeOs, fakeIoutil), nil,
 			)
+			Expect(err).NotTo(HaveOccurred())
 		})
 
 		Context(".Services", func() {
@@ -120,7 +596,7 @@ var _ = Describe("Broker", func() {
 
 		Context(".Provision", func() {
 			It("should provision the service instance", func() {
-				_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{}, false)
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(fakeController.CreateCallCount()).To(Equal(1))
 
@@ -133,10 +609,53 @@ var _ = Describe("Broker", func() {
 			It("should write state", func() {
 				WriteFileCallCount = 0
 				WriteFileWrote = ""
-				_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{}, false)
+				fakeController.SharePathReturns(cephbroker.SharePathResponse{Path: "/volumes/some-instance-id"})
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
 				Expect(err).NotTo(HaveOccurred())
-				Expect(WriteFileCallCount).To(Equal(1))
-				Expect(WriteFileWrote).To(Equal("{\"InstanceMap\":{\"some-instance-id\":{\"service_id\":\"\",\"plan_id\":\"\",\"organization_guid\":\"\",\"space_guid\":\"\"}},\"BindingMap\":{}}"))
+				Expect(WriteFileCallCount).To(Equal(2))
+
+				saved := parseSavedState(WriteFileWrote)
+				Expect(saved.Version).To(Equal(cephbroker.StateVersion))
+				Expect(saved.Instances).To(HaveLen(1))
+				instance := saved.Instances["some-instance-id"]
+				Expect(instance.CreatedAt).To(BeTemporally("~", time.Now(), time.Minute))
+				instance.CreatedAt = time.Time{}
+				Expect(instance).To(Equal(savedInstance{
+					InstanceID: "some-instance-id",
+					ServiceID:  "service-id",
+					PlanID:     "plan-id",
+					SharePath:  "/volumes/some-instance-id",
+				}))
+				Expect(saved.Bindings).To(BeEmpty())
+			})
+
+			It("should reject invalid quotas", func() {
+				provisionDetails.RawParameters = json.RawMessage(`{"quota":"lots"}`)
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+				Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
+				Expect(fakeController.CreateCallCount()).To(Equal(0))
+			})
+
+			It("should reject invalid owners and modes", func() {
+				provisionDetails.RawParameters = json.RawMessage(`{"uid":"nobody"}`)
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+				Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
+				Expect(fakeController.CreateCallCount()).To(Equal(0))
+			})
+
+			It("should pass the quota through to the controller", func() {
+				provisionDetails.RawParameters = json.RawMessage(`{"quota":"10G"}`)
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, details := fakeController.CreateArgsForCall(0)
+				Expect(details.Opts["quota"]).To(Equal("10G"))
+			})
+
+			It("should reject plans that are not in the catalog", func() {
+				_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "unknown-plan-id"}, false)
+				Expect(err).To(Equal(cephbroker.ErrPlanNotFound))
+				Expect(fakeController.CreateCallCount()).To(Equal(0))
 			})
 
 			Context("when provisioning errors", func() {
@@ -145,9 +664,21 @@ var _ = Describe("Broker", func() {
 				})
 
 				It("errors", func() {
-					_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{}, false)
+					_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
 					Expect(err).To(HaveOccurred())
 				})
+
+				It("forgets the instance, so that the provision can be tried again", func() {
+					_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+					Expect(err).To(HaveOccurred())
+					_, err = broker.LastOperation(ctx, "some-instance-id", "")
+					Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
+
+					fakeController.CreateReturns(voldriver.ErrorResponse{})
+					_, err = broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeController.CreateCallCount()).To(Equal(2))
+				})
 			})
 
 			Context("when the service instance already exists with different details", func() {
@@ -171,9 +702,89 @@ var _ = Describe("Broker", func() {
 			})
 		})
 
+		Context("when async operations are allowed", func() {
+			var lastOperationState = func(instanceID string) func() brokerapi.LastOperationState {
+				return func() brokerapi.LastOperationState {
+					op, err := broker.LastOperation(ctx, instanceID, "")
+					Expect(err).NotTo(HaveOccurred())
+					return op.State
+				}
+			}
+
+			It("should provision the service instance in the background", func() {
+				spec, err := broker.Provision(ctx, "some-instance-id", provisionDetails, true)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(spec.IsAsync).To(BeTrue())
+
+				Eventually(lastOperationState("some-instance-id")).Should(Equal(brokerapi.Succeeded))
+				Expect(fakeController.CreateCallCount()).To(Equal(1))
+			})
+
+			It("should report the operation in progress until the share is created", func() {
+				release := make(chan struct{})
+				fakeController.CreateStub = func(voldriver.Env, voldriver.CreateRequest) voldriver.ErrorResponse {
+					<-release
+					return voldriver.ErrorResponse{}
+				}
+
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, true)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(lastOperationState("some-instance-id")()).To(Equal(brokerapi.InProgress))
+
+				_, err = broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid"})
+				Expect(err).To(Equal(cephbroker.ErrOperationInProgress))
+
+				close(release)
+				Eventually(lastOperationState("some-instance-id")).Should(Equal(brokerapi.Succeeded))
+			})
+
+			It("should report failures with a description", func() {
+				fakeController.CreateReturns(voldriver.ErrorResponse{Err: "some-error"})
+
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, true)
+				Expect(err).NotTo(HaveOccurred())
+
+				Eventually(lastOperationState("some-instance-id")).Should(Equal(brokerapi.Failed))
+				op, err := broker.LastOperation(ctx, "some-instance-id", "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(op.Description).To(Equal("some-error"))
+			})
+
+			It("should deprovision the service instance in the background", func() {
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				spec, err := broker.Deprovision(ctx, "some-instance-id", brokerapi.DeprovisionDetails{}, true)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(spec.IsAsync).To(BeTrue())
+
+				Eventually(func() error {
+					_, err := broker.LastOperation(ctx, "some-instance-id", "")
+					return err
+				}).Should(Equal(brokerapi.ErrInstanceDoesNotExist))
+				Expect(fakeController.RemoveCallCount()).To(Equal(1))
+			})
+		})
+
+		Context(".LastOperation", func() {
+			It("reports success for instances provisioned synchronously", func() {
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				op, err := broker.LastOperation(ctx, "some-instance-id", "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(op.State).To(Equal(brokerapi.Succeeded))
+			})
+
+			It("errors when the service instance does not exist", func() {
+				_, err := broker.LastOperation(ctx, "nonexistant-instance-id", "")
+				Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
+			})
+		})
+
 		Context(".Deprovision", func() {
 			BeforeEach(func() {
-				_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{}, false)
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
 				Expect(err).NotTo(HaveOccurred())
 			})
 
@@ -183,7 +794,7 @@ var _ = Describe("Broker", func() {
 				Expect(fakeController.RemoveCallCount()).To(Equal(1))
 
 				By("checking that we can reprovision a slightly different service")
-				_, err = broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "different-service-id"}, false)
+				_, err = broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id", OrganizationGUID: "different-org"}, false)
 				Expect(err).NotTo(Equal(brokerapi.ErrInstanceAlreadyExists))
 			})
 
@@ -205,7 +816,7 @@ var _ = Describe("Broker", func() {
 				Expect(err).NotTo(HaveOccurred())
 
 				Expect(WriteFileCallCount).To(Equal(1))
-				Expect(WriteFileWrote).To(Equal("{\"InstanceMap\":{},\"BindingMap\":{}}"))
+				Expect(parseSavedState(WriteFileWrote).Instances).To(BeEmpty())
 			})
 
 			Context("when the provisioner fails to remove", func() {
@@ -224,7 +835,7 @@ var _ = Describe("Broker", func() {
 			var bindDetails brokerapi.BindDetails
 
 			BeforeEach(func() {
-				_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{}, false)
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
 				Expect(err).NotTo(HaveOccurred())
 
 				bindDetails = brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{}}
@@ -262,6 +873,10 @@ var _ = Describe("Broker", func() {
 				Expect(err).NotTo(HaveOccurred())
 
 				Expect(binding.VolumeMounts[0].Mode).To(Equal("r"))
+
+				_, _, bindingID, readOnly := fakeController.BindArgsForCall(0)
+				Expect(bindingID).To(Equal("binding-id"))
+				Expect(readOnly).To(BeTrue())
 			})
 
 			It("should write state", func() {
@@ -271,7 +886,39 @@ var _ = Describe("Broker", func() {
 				Expect(err).NotTo(HaveOccurred())
 
 				Expect(WriteFileCallCount).To(Equal(1))
-				Expect(WriteFileWrote).To(Equal("{\"InstanceMap\":{\"some-instance-id\":{\"service_id\":\"\",\"plan_id\":\"\",\"organization_guid\":\"\",\"space_guid\":\"\"}},\"BindingMap\":{\"binding-id\":{\"app_guid\":\"guid\",\"plan_id\":\"\",\"service_id\":\"\"}}}"))
+				saved := parseSavedState(WriteFileWrote)
+				Expect(saved.Instances).To(HaveKey("some-instance-id"))
+				Expect(saved.Bindings).To(HaveLen(1))
+				binding := saved.Bindings["binding-id"]
+				Expect(binding.CreatedAt).To(BeTemporally("~", time.Now(), time.Minute))
+				binding.CreatedAt = time.Time{}
+				Expect(binding).To(Equal(savedBinding{BindingID: "binding-id", InstanceID: "some-instance-id", AppGUID: "guid"}))
+			})
+
+			It("should revoke the key and forget the binding when the state cannot be saved", func() {
+				fakeIoutil.WriteFileReturns(errors.New("disk full"))
+				fakeIoutil.WriteFileStub = nil
+				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).To(MatchError(ContainSubstring("disk full")))
+
+				Expect(fakeController.UnbindCallCount()).To(Equal(1))
+				_, instanceID, bindingID := fakeController.UnbindArgsForCall(0)
+				Expect(instanceID).To(Equal("some-instance-id"))
+				Expect(bindingID).To(Equal("binding-id"))
+
+				err = broker.Unbind(ctx, "some-instance-id", "binding-id", brokerapi.UnbindDetails{})
+				Expect(err).To(Equal(brokerapi.ErrBindingDoesNotExist))
+			})
+
+			It("should keep a saved binding when binding it again cannot be saved", func() {
+				_, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+
+				fakeIoutil.WriteFileReturns(errors.New("disk full"))
+				fakeIoutil.WriteFileStub = nil
+				_, err = broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).To(HaveOccurred())
+				Expect(fakeController.UnbindCallCount()).To(Equal(0))
 			})
 
 			It("errors if mode is not a boolean", func() {
@@ -295,6 +942,24 @@ var _ = Describe("Broker", func() {
 				Expect(binding.VolumeMounts[0].Device.VolumeId).To(Equal("some-instance-id"))
 			})
 
+			It("passes the share's owner on to the cells", func() {
+				_, err := broker.Provision(ctx, "owned-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id", RawParameters: json.RawMessage(`{"uid":1000,"gid":"2000","mode":"0770"}`)}, false)
+				Expect(err).NotTo(HaveOccurred())
+				fakeController.BindReturns(cephbroker.BindResponse{SharedDevice: brokerapi.SharedDevice{VolumeId: "owned-instance-id", MountConfig: map[string]interface{}{"ip": "10.0.0.1"}}})
+
+				binding, err := broker.Bind(ctx, "owned-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Device.MountConfig).To(Equal(map[string]interface{}{"ip": "10.0.0.1", "uid": "1000", "gid": "2000"}))
+			})
+
+			It("gives no owner hints for shares nobody asked to own", func() {
+				fakeController.BindReturns(cephbroker.BindResponse{SharedDevice: brokerapi.SharedDevice{VolumeId: "some-instance-id", MountConfig: map[string]interface{}{"ip": "10.0.0.1"}}})
+				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", bindDetails)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Device.MountConfig).NotTo(HaveKey("uid"))
+				Expect(binding.VolumeMounts[0].Device.MountConfig).NotTo(HaveKey("gid"))
+			})
+
 			Context("when the binding already exists", func() {
 				BeforeEach(func() {
 					_, err := broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid"})
@@ -329,9 +994,390 @@ var _ = Describe("Broker", func() {
 			})
 		})
 
+		Context(".Update", func() {
+			BeforeEach(func() {
+				_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{
+					ServiceID:     "service-id",
+					PlanID:        "plan-id",
+					RawParameters: json.RawMessage(`{"readonly":false}`),
+				}, false)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("should update the service instance", func() {
+				_, err := broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{
+					PlanID:     "plan-id",
+					Parameters: map[string]interface{}{"readonly": true},
+				}, false)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeController.UpdateCallCount()).To(Equal(1))
+
+				_, request := fakeController.UpdateArgsForCall(0)
+				Expect(request.Name).To(Equal("some-instance-id"))
+				Expect(request.Opts["readonly"]).To(Equal(true))
+			})
+
+			It("should use updated parameters as binding defaults", func() {
+				_, err := broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"readonly": true},
+				}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Mode).To(Equal("r"))
+			})
+
+			It("should write state", func() {
+				WriteFileCallCount = 0
+				WriteFileWrote = ""
+				_, err := broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"readonly": true},
+				}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(WriteFileCallCount).To(Equal(1))
+				instance := parseSavedState(WriteFileWrote).Instances["some-instance-id"]
+				Expect(instance.PlanID).To(Equal("plan-id"))
+				Expect(instance.Parameters).To(MatchJSON(`{"readonly":true}`))
+			})
+
+			It("errors when the service instance does not exist", func() {
+				_, err := broker.Update(ctx, "nonexistant-instance-id", brokerapi.UpdateDetails{}, false)
+				Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
+			})
+
+			It("errors when the plan is not in the catalog", func() {
+				_, err := broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{PlanID: "unknown-plan-id"}, false)
+				Expect(err).To(Equal(brokerapi.ErrPlanChangeNotSupported))
+				Expect(fakeController.UpdateCallCount()).To(Equal(0))
+			})
+
+			It("errors if mode is not a boolean", func() {
+				_, err := broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"readonly": ""},
+				}, false)
+				Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
+			})
+
+			Context("when the controller fails to update", func() {
+				BeforeEach(func() {
+					fakeController.UpdateReturns(voldriver.ErrorResponse{Err: "some-error"})
+				})
+
+				It("should error and keep the previous parameters", func() {
+					_, err := broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{
+						Parameters: map[string]interface{}{"readonly": true},
+					}, false)
+					Expect(err).To(HaveOccurred())
+
+					binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid"})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Mode).To(Equal("rw"))
+				})
+			})
+		})
+
+		Context("snapshots", func() {
+			var adminBroker cephbroker.AdminBroker
+
+			BeforeEach(func() {
+				adminBroker = broker.(cephbroker.AdminBroker)
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("should take a snapshot when updated with a snapshot parameter", func() {
+				_, err := broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"snapshot": "snap1"},
+				}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fakeController.CreateSnapshotCallCount()).To(Equal(1))
+				_, instanceID, snapshotName := fakeController.CreateSnapshotArgsForCall(0)
+				Expect(instanceID).To(Equal("some-instance-id"))
+				Expect(snapshotName).To(Equal("snap1"))
+
+				_, request := fakeController.UpdateArgsForCall(0)
+				Expect(request.Opts).NotTo(HaveKey("snapshot"))
+
+				snapshots, err := adminBroker.ListSnapshots(ctx, "some-instance-id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(snapshots).To(Equal([]string{"snap1"}))
+			})
+
+			It("should delete a snapshot when updated with a delete_snapshot parameter", func() {
+				Expect(adminBroker.CreateSnapshot(ctx, "some-instance-id", "snap1")).To(Succeed())
+
+				_, err := broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"delete_snapshot": "snap1"},
+				}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fakeController.DeleteSnapshotCallCount()).To(Equal(1))
+				snapshots, err := adminBroker.ListSnapshots(ctx, "some-instance-id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(snapshots).To(BeEmpty())
+			})
+
+			It("should not remember snapshot actions as instance parameters", func() {
+				WriteFileWrote = ""
+				_, err := broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"snapshot": "snap1"},
+				}, false)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(parseSavedState(WriteFileWrote).Snapshots).To(Equal(map[string][]string{"some-instance-id": {"snap1"}}))
+				Expect(WriteFileWrote).NotTo(ContainSubstring(`"snapshot":"snap1"`))
+			})
+
+			It("errors if the snapshot name is not a string", func() {
+				_, err := broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"snapshot": 1},
+				}, false)
+				Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
+			})
+
+			It("errors if the snapshot name is invalid", func() {
+				for _, name := range []string{"", ".", "..", "a/b", "_snap"} {
+					Expect(adminBroker.CreateSnapshot(ctx, "some-instance-id", name)).To(Equal(cephbroker.ErrInvalidSnapshotName))
+				}
+				Expect(fakeController.CreateSnapshotCallCount()).To(Equal(0))
+			})
+
+			It("errors if the snapshot already exists", func() {
+				Expect(adminBroker.CreateSnapshot(ctx, "some-instance-id", "snap1")).To(Succeed())
+				Expect(adminBroker.CreateSnapshot(ctx, "some-instance-id", "snap1")).To(Equal(cephbroker.ErrSnapshotAlreadyExists))
+			})
+
+			It("errors if the snapshot does not exist", func() {
+				Expect(adminBroker.DeleteSnapshot(ctx, "some-instance-id", "snap1")).To(Equal(cephbroker.ErrSnapshotDoesNotExist))
+				Expect(fakeController.DeleteSnapshotCallCount()).To(Equal(0))
+			})
+
+			It("errors if the service instance does not exist", func() {
+				_, err := adminBroker.ListSnapshots(ctx, "nonexistant-instance-id")
+				Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
+			})
+
+			It("should not record snapshots the controller failed to take", func() {
+				fakeController.CreateSnapshotReturns(voldriver.ErrorResponse{Err: "some-error"})
+				Expect(adminBroker.CreateSnapshot(ctx, "some-instance-id", "snap1")).NotTo(Succeed())
+
+				snapshots, err := adminBroker.ListSnapshots(ctx, "some-instance-id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(snapshots).To(BeEmpty())
+			})
+
+			It("should forget the snapshots when the instance is deprovisioned", func() {
+				Expect(adminBroker.CreateSnapshot(ctx, "some-instance-id", "snap1")).To(Succeed())
+				_, err := broker.Deprovision(ctx, "some-instance-id", brokerapi.DeprovisionDetails{}, false)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(parseSavedState(WriteFileWrote).Snapshots).To(BeEmpty())
+			})
+		})
+
+		Context("inspecting instances and bindings", func() {
+			var adminBroker cephbroker.AdminBroker
+
+			BeforeEach(func() {
+				adminBroker = broker.(cephbroker.AdminBroker)
+				provisionDetails.OrganizationGUID = "org-guid"
+				provisionDetails.SpaceGUID = "space-guid"
+				provisionDetails.RawParameters = json.RawMessage(`{"quota":"1G"}`)
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = broker.Bind(ctx, "some-instance-id", "binding-2", brokerapi.BindDetails{AppGUID: "guid", Parameters: map[string]interface{}{"readonly": true}})
+				Expect(err).NotTo(HaveOccurred())
+				_, err = broker.Bind(ctx, "some-instance-id", "binding-1", brokerapi.BindDetails{AppGUID: "guid"})
+				Expect(err).NotTo(HaveOccurred())
+
+				fakeController.ShareUsageReturns(cephbroker.ShareUsageResponse{
+					Quota: cephbroker.Quota{MaxBytes: 1 << 30},
+					Usage: cephbroker.Usage{Bytes: 1024, Files: 3},
+				})
+			})
+
+			It("should list instances with their plan, share, quota, usage and bindings", func() {
+				instances, err := adminBroker.ListInstances(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(instances).To(HaveLen(1))
+
+				instance := instances[0]
+				Expect(instance.InstanceID).To(Equal("some-instance-id"))
+				Expect(instance.PlanName).To(Equal("plan-name"))
+				Expect(instance.OrganizationGUID).To(Equal("org-guid"))
+				Expect(instance.SpaceGUID).To(Equal("space-guid"))
+				Expect(instance.CreatedAt).NotTo(BeZero())
+				Expect(instance.Quota).To(Equal(&cephbroker.Quota{MaxBytes: 1 << 30}))
+				Expect(instance.Usage).To(Equal(&cephbroker.Usage{Bytes: 1024, Files: 3}))
+				Expect(instance.Bindings).To(Equal([]string{"binding-1", "binding-2"}))
+				Expect(instance.Parameters).To(BeNil())
+			})
+
+			It("should leave out the quota and usage of shares the filesystem cannot report on", func() {
+				fakeController.ShareUsageReturns(cephbroker.ShareUsageResponse{ErrorResponse: voldriver.ErrorResponse{Err: "badness"}})
+				instances, err := adminBroker.ListInstances(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(instances[0].Quota).To(BeNil())
+				Expect(instances[0].Usage).To(BeNil())
+			})
+
+			It("should not ask about the shares of instances that are not provisioned yet", func() {
+				release := make(chan struct{})
+				fakeController.CreateStub = func(voldriver.Env, voldriver.CreateRequest) voldriver.ErrorResponse {
+					<-release
+					return voldriver.ErrorResponse{}
+				}
+				_, err := broker.Provision(ctx, "another-instance-id", provisionDetails, true)
+				Expect(err).NotTo(HaveOccurred())
+
+				instances, err := adminBroker.ListInstances(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(instances).To(HaveLen(2))
+				Expect(instances[0].InstanceID).To(Equal("another-instance-id"))
+				Expect(instances[0].LastOperation.State).To(Equal(brokerapi.InProgress))
+				Expect(fakeController.ShareUsageCallCount()).To(Equal(1))
+
+				close(release)
+				Eventually(func() brokerapi.LastOperationState {
+					operation, _ := broker.LastOperation(ctx, "another-instance-id", "")
+					return operation.State
+				}).Should(Equal(brokerapi.Succeeded))
+			})
+
+			It("should get an instance with its parameters", func() {
+				instance, err := adminBroker.GetInstance(ctx, "some-instance-id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(instance.InstanceID).To(Equal("some-instance-id"))
+				Expect(instance.Parameters).To(MatchJSON(`{"quota":"1G"}`))
+				Expect(instance.Usage).To(Equal(&cephbroker.Usage{Bytes: 1024, Files: 3}))
+				_, instanceID := fakeController.ShareUsageArgsForCall(0)
+				Expect(instanceID).To(Equal("some-instance-id"))
+			})
+
+			It("should error when getting an instance that does not exist", func() {
+				_, err := adminBroker.GetInstance(ctx, "nonexistant-instance-id")
+				Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
+			})
+
+			It("should get a binding", func() {
+				binding, err := adminBroker.GetBinding(ctx, "binding-2")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.BindingID).To(Equal("binding-2"))
+				Expect(binding.InstanceID).To(Equal("some-instance-id"))
+				Expect(binding.AppGUID).To(Equal("guid"))
+				Expect(binding.Parameters).To(Equal(map[string]interface{}{"readonly": true}))
+				Expect(binding.CreatedAt).NotTo(BeZero())
+			})
+
+			It("should error when getting a binding that does not exist", func() {
+				_, err := adminBroker.GetBinding(ctx, "nonexistant-binding-id")
+				Expect(err).To(Equal(brokerapi.ErrBindingDoesNotExist))
+			})
+
+			It("should list bindings without their parameters", func() {
+				bindings, err := adminBroker.ListBindings(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(bindings).To(HaveLen(2))
+				Expect(bindings[0].BindingID).To(Equal("binding-1"))
+				Expect(bindings[1].BindingID).To(Equal("binding-2"))
+				Expect(bindings[1].InstanceID).To(Equal("some-instance-id"))
+				Expect(bindings[1].Parameters).To(BeNil())
+			})
+
+			It("should check shares without changing them", func() {
+				fakeController.ListSharesReturns(cephbroker.SharesResponse{Shares: []string{"some-instance-id", "orphan"}})
+				report, err := adminBroker.CheckShares(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(report.OrphanedShares).To(Equal([]string{"orphan"}))
+				Expect(fakeController.QuarantineShareCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when cloning another instance", func() {
+			var cloneDetails = func(parameters string) brokerapi.ProvisionDetails {
+				return brokerapi.ProvisionDetails{
+					ServiceID:        "service-id",
+					PlanID:           "plan-id",
+					OrganizationGUID: "org",
+					SpaceGUID:        "space",
+					RawParameters:    json.RawMessage(parameters),
+				}
+			}
+
+			BeforeEach(func() {
+				_, err := broker.Provision(ctx, "source-instance-id", cloneDetails(""), false)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(broker.(cephbroker.AdminBroker).CreateSnapshot(ctx, "source-instance-id", "snap1")).To(Succeed())
+			})
+
+			It("should pass the source instance and snapshot to the controller", func() {
+				_, err := broker.Provision(ctx, "some-instance-id", cloneDetails(`{"source_instance": "source-instance-id", "snapshot": "snap1"}`), false)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, request := fakeController.CreateArgsForCall(1)
+				Expect(request.Name).To(Equal("some-instance-id"))
+				Expect(request.Opts["source_instance"]).To(Equal("source-instance-id"))
+				Expect(request.Opts["snapshot"]).To(Equal("snap1"))
+			})
+
+			It("errors when the source instance does not exist", func() {
+				_, err := broker.Provision(ctx, "some-instance-id", cloneDetails(`{"source_instance": "nonexistant-instance-id"}`), false)
+				Expect(err).To(Equal(cephbroker.ErrSourceInstanceDoesNotExist))
+				Expect(fakeController.CreateCallCount()).To(Equal(1))
+			})
+
+			It("errors when the source instance is in another space", func() {
+				details := cloneDetails(`{"source_instance": "source-instance-id"}`)
+				details.SpaceGUID = "other-space"
+				_, err := broker.Provision(ctx, "some-instance-id", details, false)
+				Expect(err).To(Equal(cephbroker.ErrSourceInstanceNotInSpace))
+				Expect(fakeController.CreateCallCount()).To(Equal(1))
+			})
+
+			It("errors when the source instance is in another org", func() {
+				details := cloneDetails(`{"source_instance": "source-instance-id"}`)
+				details.OrganizationGUID = "other-org"
+				_, err := broker.Provision(ctx, "some-instance-id", details, false)
+				Expect(err).To(Equal(cephbroker.ErrSourceInstanceNotInSpace))
+			})
+
+			It("errors when the snapshot does not exist", func() {
+				_, err := broker.Provision(ctx, "some-instance-id", cloneDetails(`{"source_instance": "source-instance-id", "snapshot": "snap2"}`), false)
+				Expect(err).To(Equal(cephbroker.ErrSnapshotDoesNotExist))
+			})
+
+			It("errors when a snapshot is given without a source instance", func() {
+				_, err := broker.Provision(ctx, "some-instance-id", cloneDetails(`{"snapshot": "snap1"}`), false)
+				Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
+			})
+
+			It("should not deprovision the source or delete the snapshot while the clone is in progress", func() {
+				release := make(chan struct{})
+				fakeController.CreateStub = func(voldriver.Env, voldriver.CreateRequest) voldriver.ErrorResponse {
+					<-release
+					return voldriver.ErrorResponse{}
+				}
+
+				_, err := broker.Provision(ctx, "some-instance-id", cloneDetails(`{"source_instance": "source-instance-id", "snapshot": "snap1"}`), true)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = broker.Deprovision(ctx, "source-instance-id", brokerapi.DeprovisionDetails{}, false)
+				Expect(err).To(Equal(cephbroker.ErrOperationInProgress))
+				Expect(broker.(cephbroker.AdminBroker).DeleteSnapshot(ctx, "source-instance-id", "snap1")).To(Equal(cephbroker.ErrOperationInProgress))
+
+				// let the clone finish before the next test replaces the fakes it saves state through
+				close(release)
+				Eventually(func() brokerapi.LastOperationState {
+					op, _ := broker.LastOperation(ctx, "some-instance-id", "")
+					return op.State
+				}).Should(Equal(brokerapi.Succeeded))
+			})
+		})
+
 		Context(".Unbind", func() {
 			BeforeEach(func() {
-				_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{}, false)
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
 				Expect(err).NotTo(HaveOccurred())
 
 				_, err = broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid"})
@@ -343,6 +1389,26 @@ var _ = Describe("Broker", func() {
 				Expect(err).NotTo(HaveOccurred())
 			})
 
+			It("revokes the binding's credentials", func() {
+				err := broker.Unbind(ctx, "some-instance-id", "binding-id", brokerapi.UnbindDetails{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeController.UnbindCallCount()).To(Equal(1))
+
+				_, instanceID, bindingID := fakeController.UnbindArgsForCall(0)
+				Expect(instanceID).To(Equal("some-instance-id"))
+				Expect(bindingID).To(Equal("binding-id"))
+			})
+
+			It("keeps the binding when its credentials cannot be revoked", func() {
+				fakeController.UnbindReturns(voldriver.ErrorResponse{Err: "some-error"})
+				err := broker.Unbind(ctx, "some-instance-id", "binding-id", brokerapi.UnbindDetails{})
+				Expect(err).To(HaveOccurred())
+
+				fakeController.UnbindReturns(voldriver.ErrorResponse{})
+				err = broker.Unbind(ctx, "some-instance-id", "binding-id", brokerapi.UnbindDetails{})
+				Expect(err).NotTo(HaveOccurred())
+			})
+
 			It("fails when trying to unbind a instance that has not been provisioned", func() {
 				err := broker.Unbind(ctx, "some-other-instance-id", "binding-id", brokerapi.UnbindDetails{})
 				Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
@@ -359,10 +1425,64 @@ var _ = Describe("Broker", func() {
 				Expect(err).NotTo(HaveOccurred())
 
 				Expect(WriteFileCallCount).To(Equal(1))
-				Expect(WriteFileWrote).To(Equal("{\"InstanceMap\":{\"some-instance-id\":{\"service_id\":\"\",\"plan_id\":\"\",\"organization_guid\":\"\",\"space_guid\":\"\"}},\"BindingMap\":{}}"))
+				saved := parseSavedState(WriteFileWrote)
+				Expect(saved.Instances).To(HaveKey("some-instance-id"))
+				Expect(saved.Bindings).To(BeEmpty())
+			})
+
+		})
+		Context("when state cannot be saved", func() {
+			BeforeEach(func() {
+				fakeOs.RenameReturns(errors.New("disk full"))
+			})
+
+			It("should fail the operation", func() {
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+				Expect(err).To(MatchError(ContainSubstring("disk full")))
+			})
+
+			It("should remove the share and forget the instance when the provision cannot be saved", func() {
+				// the provision is saved as it starts, and the disk fills up while the share is made
+				fakeOs.RenameReturns(nil)
+				fakeController.CreateStub = func(voldriver.Env, voldriver.CreateRequest) voldriver.ErrorResponse {
+					fakeOs.RenameReturns(errors.New("disk full"))
+					return voldriver.ErrorResponse{}
+				}
+
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+				Expect(err).To(MatchError(ContainSubstring("disk full")))
+				Expect(fakeController.RemoveCallCount()).To(Equal(1))
+				_, request := fakeController.RemoveArgsForCall(0)
+				Expect(request.Name).To(Equal("some-instance-id"))
+
+				fakeOs.RenameReturns(nil)
+				fakeController.CreateStub = nil
+				_, err = broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeController.CreateCallCount()).To(Equal(2))
+			})
+
+			It("should fail async operations without starting them", func() {
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, true)
+				Expect(err).To(HaveOccurred())
+				Expect(fakeController.CreateCallCount()).To(Equal(0))
+
+				op, err := broker.LastOperation(ctx, "some-instance-id", "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(op.State).To(Equal(brokerapi.Failed))
 			})
 
+			It("should fail bindings", func() {
+				fakeOs.RenameReturns(nil)
+				_, err := broker.Provision(ctx, "some-instance-id", provisionDetails, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				fakeOs.RenameReturns(errors.New("disk full"))
+				_, err = broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid"})
+				Expect(err).To(HaveOccurred())
+			})
 		})
+
 		Context("when multiple operations happen in parallel", func() {
 			It("maintains consistency", func() {
 				var wg sync.WaitGroup
@@ -375,7 +1495,7 @@ var _ = Describe("Broker", func() {
 
 					broker.Services(ctx)
 
-					_, err := broker.Provision(ctx, uniqueName, brokerapi.ProvisionDetails{}, false)
+					_, err := broker.Provision(ctx, uniqueName, provisionDetails, false)
 					Expect(err).NotTo(HaveOccurred())
 
 					_, err = broker.Bind(ctx, uniqueName, "binding-id", brokerapi.BindDetails{AppGUID: "guid"})
@@ -396,4 +1516,176 @@ var _ = Describe("Broker", func() {
 			})
 		})
 	})
+
+	Context("when replicas share a sql store", func() {
+		var (
+			replica1, replica2 brokerapi.ServiceBroker
+			stores             []cephbroker.SharedStore
+		)
+
+		newReplica := func(name string) brokerapi.ServiceBroker {
+			store, err := cephbroker.NewSharedSqlStore(cephbroker.SqlDriverSqlite, filepath.Join(stateDir, "state.sqlite")+"?_busy_timeout=5000", name, time.Minute, 5*time.Second)
+			Expect(err).NotTo(HaveOccurred())
+			stores = append(stores, store)
+			broker, err := cephbroker.New(logger, fakeController, cephbroker.NewCatalog("service-name", "service-id", "plan-name", "plan-id", "plan-desc"), store, nil)
+			Expect(err).NotTo(HaveOccurred())
+			return broker
+		}
+
+		BeforeEach(func() {
+			stores = nil
+			replica1 = newReplica("replica-1")
+			replica2 = newReplica("replica-2")
+		})
+
+		AfterEach(func() {
+			for _, store := range stores {
+				Expect(store.Close()).To(Succeed())
+			}
+		})
+
+		It("sees instances and bindings made by the other replica", func() {
+			_, err := replica1.Provision(ctx, "some-instance-id", provisionDetails, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = replica2.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid"})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = replica1.Unbind(ctx, "some-instance-id", "binding-id", brokerapi.UnbindDetails{})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("never provisions the same instance twice", func() {
+			var wg sync.WaitGroup
+			wg.Add(2)
+
+			provision := func(replica brokerapi.ServiceBroker) {
+				defer GinkgoRecover()
+				defer wg.Done()
+
+				// the replica that comes second either finds the instance provisioned, or still being provisioned
+				_, err := replica.Provision(ctx, "some-instance-id", provisionDetails, false)
+				if err != nil {
+					Expect(err).To(Equal(cephbroker.ErrOperationInProgress))
+				}
+			}
+			go provision(replica1)
+			go provision(replica2)
+			wg.Wait()
+
+			Expect(fakeController.CreateCallCount()).To(Equal(1))
+		})
+
+		It("does not hold the state while a synchronous provision makes its share", func() {
+			release := make(chan struct{})
+			fakeController.CreateStub = func(_ voldriver.Env, request voldriver.CreateRequest) voldriver.ErrorResponse {
+				if request.Name == "slow-instance-id" {
+					<-release
+				}
+				return voldriver.ErrorResponse{}
+			}
+
+			provisioned := make(chan error, 1)
+			go func() {
+				_, err := replica1.Provision(ctx, "slow-instance-id", provisionDetails, false)
+				provisioned <- err
+			}()
+			Eventually(fakeController.CreateCallCount).Should(Equal(1))
+
+			_, err := replica2.Provision(ctx, "other-instance-id", provisionDetails, false)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = replica2.Bind(ctx, "slow-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid"})
+			Expect(err).To(Equal(cephbroker.ErrOperationInProgress))
+
+			close(release)
+			Eventually(provisioned).Should(Receive(BeNil()))
+			_, err = replica2.Bind(ctx, "slow-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid"})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("rejects conflicting instances provisioned on the other replica", func() {
+			_, err := replica1.Provision(ctx, "some-instance-id", provisionDetails, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = replica2.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "other-plan-id"}, false)
+			Expect(err).To(Equal(brokerapi.ErrInstanceAlreadyExists))
+		})
+
+		It("reports operations run by the other replica", func() {
+			_, err := replica1.Provision(ctx, "some-instance-id", provisionDetails, true)
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(func() brokerapi.LastOperationState {
+				op, _ := replica2.LastOperation(ctx, "some-instance-id", "")
+				return op.State
+			}).Should(Equal(brokerapi.Succeeded))
+		})
+
+		It("leaves resuming an operation to the replica that started it", func() {
+			release := make(chan struct{})
+			fakeController.CreateStub = func(voldriver.Env, voldriver.CreateRequest) voldriver.ErrorResponse {
+				<-release
+				return voldriver.ErrorResponse{}
+			}
+			_, err := replica1.Provision(ctx, "some-instance-id", provisionDetails, true)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(fakeController.CreateCallCount).Should(Equal(1))
+
+			newReplica("replica-2")
+			Consistently(fakeController.CreateCallCount, "100ms").Should(Equal(1))
+
+			restarted := newReplica("replica-1")
+			Eventually(fakeController.CreateCallCount).Should(Equal(2))
+
+			close(release)
+			Eventually(func() brokerapi.LastOperationState {
+				op, _ := restarted.LastOperation(ctx, "some-instance-id", "")
+				return op.State
+			}).Should(Equal(brokerapi.Succeeded))
+		})
+
+		Context("when the replica running an operation dies", func() {
+			var release chan struct{}
+
+			BeforeEach(func() {
+				release = make(chan struct{})
+				fakeController.CreateStub = func(voldriver.Env, voldriver.CreateRequest) voldriver.ErrorResponse {
+					<-release
+					return voldriver.ErrorResponse{}
+				}
+				_, err := replica1.Provision(ctx, "some-instance-id", provisionDetails, true)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(fakeController.CreateCallCount).Should(Equal(1))
+
+				db, err := sql.Open(cephbroker.SqlDriverSqlite, filepath.Join(stateDir, "state.sqlite"))
+				Expect(err).NotTo(HaveOccurred())
+				defer db.Close()
+				_, err = db.Exec("UPDATE cephbroker_locks SET expires = ? WHERE name = 'replica:replica-1'", time.Now().Add(-time.Second).UnixNano())
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("is resumed by a replica of another name when that starts", func() {
+				replica3 := newReplica("replica-3")
+				Eventually(fakeController.CreateCallCount).Should(Equal(2))
+
+				close(release)
+				Eventually(func() brokerapi.LastOperationState {
+					op, _ := replica3.LastOperation(ctx, "some-instance-id", "")
+					return op.State
+				}).Should(Equal(brokerapi.Succeeded))
+			})
+
+			It("is taken over by the replica the platform polls", func() {
+				op, err := replica2.LastOperation(ctx, "some-instance-id", "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(op.State).To(Equal(brokerapi.InProgress))
+				Eventually(fakeController.CreateCallCount).Should(Equal(2))
+
+				_, err = replica1.LastOperation(ctx, "some-instance-id", "")
+				Expect(err).NotTo(HaveOccurred())
+				Consistently(fakeController.CreateCallCount, "100ms").Should(Equal(2))
+				close(release)
+			})
+		})
+	})
 })
@@ -1,10 +1,14 @@
 package cephbroker
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"code.cloudfoundry.org/cephbroker/utils"
 	"code.cloudfoundry.org/goshims/ioutilshim"
@@ -19,11 +23,25 @@ import (
 
 type Client interface {
 	IsFilesystemMounted(voldriver.Env) bool
+	GetMountSettings(voldriver.Env) MountSettings
 	MountFileSystem(voldriver.Env, string) (string, error)
+	UnmountFileSystem(voldriver.Env) error
 	CreateShare(voldriver.Env, string) (string, error)
+	CloneShare(voldriver.Env, string, string, string) (string, error)
 	DeleteShare(voldriver.Env, string) error
+	ListShares(voldriver.Env) ([]string, error)
+	QuarantineShare(voldriver.Env, string) (string, error)
 	GetPathsForShare(voldriver.Env, string) (string, string, error)
-	GetConfigDetails(voldriver.Env) (string, string, error)
+	GetConfigDetails(voldriver.Env) (string, string, string, error)
+	SetQuota(voldriver.Env, string, Quota) error
+	SetOwnership(voldriver.Env, string, Ownership) error
+	GetQuota(voldriver.Env, string) (Quota, error)
+	GetUsage(voldriver.Env, string) (Usage, error)
+	CreateClientKey(voldriver.Env, string, string, bool) (string, error)
+	DeleteClientKey(voldriver.Env, string) error
+	CreateSnapshot(voldriver.Env, string, string) error
+	ListSnapshots(voldriver.Env, string) ([]string, error)
+	DeleteSnapshot(voldriver.Env, string, string) error
 }
 
 type cephClient struct {
@@ -32,69 +50,272 @@ type cephClient struct {
 	os                  osshim.Os
 	ioutil              ioutilshim.Ioutil
 	baseLocalMountPoint string
-	mounted             bool
-	keyring             string
+	credentials         Credentials
 	remoteMountPath     string
+	mount               MountSettings
 }
 
-const CellBasePath string = "/var/vcap/data/volumes/ceph/"
+// Credentials say which cephx client the broker acts as, and where its key is
+type Credentials struct {
+	// ClientName is the client, without the "client." prefix, and is passed to ceph with --id.  When it is empty, the
+	// client is the one in the keyring, or the admin client.
+	ClientName string
+	// Keyring is a keyring file with the client's key
+	Keyring string
+	// SecretFile is a file with nothing but the client's key.  It is used instead of the keyring when there is none,
+	// and is what the kernel client is given when there is.
+	SecretFile string
+}
+
+// MountSettings say how the filesystem is mounted, both by the broker and, through the bindings, by the cells
+type MountSettings struct {
+	// Mode is MountModeFuse to mount with ceph-fuse, or MountModeKernel to mount with the kernel client
+	Mode string
+	// Options are extra mount options, comma separated as for mount -o
+	Options string
+	// FSID is the cluster's fsid, when it is known, so that the cells can make sure they mount the right cluster
+	FSID string
+	// FSName is the ceph file system to mount, when the cluster has more than one, or empty for its default one
+	FSName string
+}
+
+const (
+	CellBasePath  string = "/var/vcap/data/volumes/ceph/"
+	SnapshotDir   string = ".snap"
+	QuarantineDir string = ".cephbroker-quarantine"
+
+	MountModeFuse   = "fuse"
+	MountModeKernel = "kernel"
+
+	// mountCheckTimeout is how long a mount may take to answer before it is taken for dead, as a hung mount can block
+	// a stat forever rather than fail it
+	mountCheckTimeout = 5 * time.Second
+)
 
 var (
 	ShareNotFound   error = errors.New("share not found, internal error")
 	KeyringNotFound error = errors.New("unable to open cephfs keyring")
+	SecretNotFound  error = errors.New("unable to open cephfs secret file")
 )
 
-func NewCephClientWithInvokerAndSystemUtil(mds string, useInvoker invoker.Invoker, os osshim.Os, ioutil ioutilshim.Ioutil, localMountPoint string, keyringFile string) Client {
+func NewCephClientWithInvokerAndSystemUtil(mds string, useInvoker invoker.Invoker, os osshim.Os, ioutil ioutilshim.Ioutil, localMountPoint string, credentials Credentials, remoteMountPath string, mount MountSettings) Client {
 	return &cephClient{
 		mds:                 mds,
 		invoker:             useInvoker,
 		os:                  os,
 		ioutil:              ioutil,
 		baseLocalMountPoint: localMountPoint,
-		mounted:             false,
-		keyring:             keyringFile,
+		credentials:         credentials,
+		remoteMountPath:     remoteMountPath,
+		mount:               mount,
 	}
 }
-func NewCephClient(mds string, localMountPoint string, keyringFile string, remoteMountPath string) Client {
-	return &cephClient{
-		mds:                 mds,
-		invoker:             invoker.NewRealInvoker(),
-		os:                  &osshim.OsShim{},
-		ioutil:              &ioutilshim.IoutilShim{},
-		baseLocalMountPoint: localMountPoint,
-		mounted:             false,
-		keyring:             keyringFile,
-		remoteMountPath:     remoteMountPath,
+func NewCephClient(mds string, localMountPoint string, credentials Credentials, remoteMountPath string, mount MountSettings) Client {
+	return NewCephClientWithInvokerAndSystemUtil(mds, NewOutputInvoker(), &osshim.OsShim{}, &ioutilshim.IoutilShim{}, localMountPoint, credentials, remoteMountPath, mount)
+}
+
+// GetMountSettings says how the filesystem is mounted, which is with ceph-fuse unless the kernel client was asked for
+func (c *cephClient) GetMountSettings(env voldriver.Env) MountSettings {
+	mount := c.mount
+	if mount.Mode == "" {
+		mount.Mode = MountModeFuse
 	}
+	return mount
 }
+
+// IsFilesystemMounted checks that there is a ceph mount at the local mount point, and that it answers.  A mount whose
+// ceph-fuse process died is still listed, but fails every access with ENOTCONN.
 func (c *cephClient) IsFilesystemMounted(env voldriver.Env) bool {
 	logger := env.Logger().Session("is-filesystem-mounted")
 	logger.Info("start")
 	defer logger.Info("end")
-	return c.mounted
+
+	mount, found, err := c.findMount()
+	if err != nil {
+		logger.Error("failed-to-read-mounts", err)
+		return false
+	}
+	if !found || !mount.isCeph() {
+		return false
+	}
+	if err := c.checkMount(); err != nil {
+		logger.Error("stale-mount", err, lager.Data{"fstype": mount.FSType})
+		return false
+	}
+	return true
 }
 
+// MountFileSystem mounts the filesystem at the local mount point, unless it is mounted there already.  A stale ceph
+// mount is unmounted first, lazily, as whatever still holds it open cannot use it anyway.
 func (c *cephClient) MountFileSystem(env voldriver.Env, remoteMountPoint string) (string, error) {
 	logger := env.Logger().Session("mount-filesystem", lager.Data{"remoteMountPoint": remoteMountPoint})
 	logger.Info("start")
 	defer logger.Info("end")
 
-	err := c.os.MkdirAll(c.baseLocalMountPoint, os.ModePerm)
+	mount, found, err := c.findMount()
+	if err != nil {
+		logger.Error("failed-to-read-mounts", err)
+		return "", fmt.Errorf("failed to read mounts: %s", err.Error())
+	}
+	if found && mount.isCeph() {
+		err := c.checkMount()
+		if err == nil {
+			logger.Info("already-mounted", lager.Data{"fstype": mount.FSType})
+			return c.baseLocalMountPoint, nil
+		}
+
+		logger.Error("stale-mount", err, lager.Data{"fstype": mount.FSType})
+		if err := c.unmount(driverhttp.EnvWithLogger(logger, env), mount, true); err != nil {
+			logger.Error("failed-to-unmount-stale-mount", err)
+			return "", fmt.Errorf("failed to unmount stale mount at '%s': %s", c.baseLocalMountPoint, err.Error())
+		}
+		logger.Info("unmounted-stale-mount")
+	}
+
+	err = c.os.MkdirAll(c.baseLocalMountPoint, os.ModePerm)
 	if err != nil {
 		logger.Error("failed-to-create-local-dir", err)
 		return "", fmt.Errorf("failed to create local directory '%s', mount filesystem failed", c.baseLocalMountPoint)
 	}
 
-	cmdArgs := []string{"-m", c.mds, "-k", c.keyring, "-r", remoteMountPoint, c.baseLocalMountPoint}
-	err = c.invokeCeph(driverhttp.EnvWithLogger(logger, env), cmdArgs)
+	// shares are created in the remote mount path, so that is the directory that gets mounted
+	if c.remoteMountPath != "" {
+		remoteMountPoint = filepath.Join(c.remoteMountPath, remoteMountPoint)
+	}
+
+	if c.GetMountSettings(env).Mode == MountModeKernel {
+		err = c.mountKernel(driverhttp.EnvWithLogger(logger, env), remoteMountPoint)
+	} else {
+		cmdArgs := append(c.authArgs(), "-r", remoteMountPoint)
+		if c.mount.FSName != "" {
+			cmdArgs = append(cmdArgs, "--client_fs", c.mount.FSName)
+		}
+		if c.mount.Options != "" {
+			cmdArgs = append(cmdArgs, "-o", c.mount.Options)
+		}
+		err = c.invokeCeph(driverhttp.EnvWithLogger(logger, env), append(cmdArgs, c.baseLocalMountPoint))
+	}
 	if err != nil {
 		logger.Error("cephfs-error", err)
 		return "", err
 	}
-	c.mounted = true
 	return c.baseLocalMountPoint, nil
 }
 
+// mountKernel mounts with the kernel client.  The kernel takes the key from a file of its own, so that it is never
+// passed on the command line: the secret file when there is one, or else the key from the keyring, written to a
+// directory only the broker can read for as long as the mount takes.  The kernel keeps the key once it has mounted.
+func (c *cephClient) mountKernel(env voldriver.Env, remoteMountPoint string) error {
+	clientName, err := c.clientName()
+	if err != nil {
+		return err
+	}
+
+	secretFile := c.credentials.SecretFile
+	if secretFile == "" {
+		keyring, err := c.ioutil.ReadFile(c.credentials.Keyring)
+		if err != nil {
+			return KeyringNotFound
+		}
+		_, key, err := parseKeyring(keyring)
+		if err != nil {
+			return fmt.Errorf("failed to read keyring '%s': %s", c.credentials.Keyring, err.Error())
+		}
+
+		secretDir, err := c.ioutil.TempDir("", "cephbroker-secret")
+		if err != nil {
+			return fmt.Errorf("failed to create a directory for the secret file: %s", err.Error())
+		}
+		defer func() {
+			if err := c.os.RemoveAll(secretDir); err != nil {
+				env.Logger().Error("failed-to-remove-secret-file", err)
+			}
+		}()
+
+		secretFile = filepath.Join(secretDir, "secret")
+		if err := c.ioutil.WriteFile(secretFile, []byte(key), 0600); err != nil {
+			return fmt.Errorf("failed to write secret file '%s': %s", secretFile, err.Error())
+		}
+	}
+
+	options := fmt.Sprintf("name=%s,secretfile=%s", clientName, secretFile)
+	if c.mount.FSName != "" {
+		options += ",mds_namespace=" + c.mount.FSName
+	}
+	if c.mount.Options != "" {
+		options += "," + c.mount.Options
+	}
+	source := fmt.Sprintf("%s:%s", c.mds, remoteMountPoint)
+	_, err = c.invoke(env, "mount", []string{"-t", "ceph", source, c.baseLocalMountPoint, "-o", options})
+	return err
+}
+
+// UnmountFileSystem unmounts the ceph mount at the local mount point, if there is one, so that it does not outlive
+// the broker
+func (c *cephClient) UnmountFileSystem(env voldriver.Env) error {
+	logger := env.Logger().Session("unmount-filesystem")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	mount, found, err := c.findMount()
+	if err != nil {
+		logger.Error("failed-to-read-mounts", err)
+		return fmt.Errorf("failed to read mounts: %s", err.Error())
+	}
+	if !found || !mount.isCeph() {
+		return nil
+	}
+
+	if err := c.unmount(driverhttp.EnvWithLogger(logger, env), mount, false); err != nil {
+		logger.Error("unmount-error", err)
+		return fmt.Errorf("failed to unmount '%s': %s", c.baseLocalMountPoint, err.Error())
+	}
+	return nil
+}
+
+// findMount finds the mount on top at the local mount point
+func (c *cephClient) findMount() (mountEntry, bool, error) {
+	mountInfo, err := c.ioutil.ReadFile(MountInfoFile)
+	if err != nil {
+		return mountEntry{}, false, err
+	}
+	mount, found := lastMountAt(parseMountInfo(mountInfo), filepath.Clean(c.baseLocalMountPoint))
+	return mount, found, nil
+}
+
+// checkMount stats the local mount point, giving up on a mount that does not answer in time
+func (c *cephClient) checkMount() error {
+	result := make(chan error, 1)
+	go func() {
+		_, err := c.os.Stat(c.baseLocalMountPoint)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(mountCheckTimeout):
+		return fmt.Errorf("mount at '%s' did not answer within %s", c.baseLocalMountPoint, mountCheckTimeout)
+	}
+}
+
+// unmount unmounts a ceph-fuse mount with fusermount, and a kernel mount with umount.  A lazy unmount detaches the
+// mount even while it is in use.
+func (c *cephClient) unmount(env voldriver.Env, mount mountEntry, lazy bool) error {
+	cmd, args := "umount", []string{}
+	if mount.isFuse() {
+		cmd, args = "fusermount", []string{"-u"}
+		if lazy {
+			args = append(args, "-z")
+		}
+	} else if lazy {
+		args = append(args, "-l")
+	}
+
+	_, err := c.invoke(env, cmd, append(args, c.baseLocalMountPoint))
+	return err
+}
+
 func (c *cephClient) CreateShare(env voldriver.Env, shareName string) (string, error) {
 	logger := env.Logger().Session("create-share", lager.Data{"shareName": shareName})
 	logger.Info("start")
@@ -106,6 +327,45 @@ func (c *cephClient) CreateShare(env voldriver.Env, shareName string) (string, e
 		logger.Error("failed-to-create-share", err)
 		return "", fmt.Errorf("failed to create share '%s'", sharePath)
 	}
+	// mkdir leaves out the bits the broker's umask masks, so new shares are made world-writable explicitly
+	err = c.os.Chmod(sharePath, os.ModePerm)
+	if err != nil {
+		logger.Error("failed-to-change-mode", err)
+		return "", fmt.Errorf("failed to change the mode of share '%s'", sharePath)
+	}
+	return sharePath, nil
+}
+
+// CloneShare creates a share holding a copy of the contents of the source share, or of one of its snapshots when
+// snapshotName is not empty
+func (c *cephClient) CloneShare(env voldriver.Env, shareName string, sourceShareName string, snapshotName string) (string, error) {
+	logger := env.Logger().Session("clone-share", lager.Data{"shareName": shareName, "sourceShareName": sourceShareName, "snapshotName": snapshotName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	sourcePath := filepath.Join(c.baseLocalMountPoint, sourceShareName)
+	if snapshotName != "" {
+		sourcePath = filepath.Join(sourcePath, SnapshotDir, snapshotName)
+	}
+	if !utils.Exists(sourcePath, c.os) {
+		logger.Error("source-not-found", ShareNotFound, lager.Data{"sourcePath": sourcePath})
+		return "", ShareNotFound
+	}
+
+	sharePath, err := c.CreateShare(driverhttp.EnvWithLogger(logger, env), shareName)
+	if err != nil {
+		return "", err
+	}
+
+	// copying "<source>/." rather than "<source>" copies the contents without nesting a directory inside the share
+	_, err = c.invoke(driverhttp.EnvWithLogger(logger, env), "cp", []string{"-a", sourcePath + "/.", sharePath})
+	if err != nil {
+		logger.Error("failed-to-copy-share", err)
+		if err := c.os.RemoveAll(sharePath); err != nil {
+			logger.Error("failed-to-clean-up-share", err)
+		}
+		return "", fmt.Errorf("failed to copy '%s' to '%s'", sourcePath, sharePath)
+	}
 	return sharePath, nil
 }
 
@@ -123,6 +383,103 @@ func (c *cephClient) DeleteShare(env voldriver.Env, shareName string) error {
 	return nil
 }
 
+// ListShares lists the share directories in the mounted filesystem.  Hidden directories, such as the quarantine
+// directory, are not shares.
+func (c *cephClient) ListShares(env voldriver.Env) ([]string, error) {
+	logger := env.Logger().Session("list-shares")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	entries, err := c.ioutil.ReadDir(c.baseLocalMountPoint)
+	if err != nil {
+		logger.Error("failed-to-list-shares", err)
+		return nil, fmt.Errorf("failed to list shares in '%s'", c.baseLocalMountPoint)
+	}
+
+	shares := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			shares = append(shares, entry.Name())
+		}
+	}
+	return shares, nil
+}
+
+// QuarantineShare moves a share into the quarantine directory, under a name that records when it was moved, and
+// returns where it went
+func (c *cephClient) QuarantineShare(env voldriver.Env, shareName string) (string, error) {
+	logger := env.Logger().Session("quarantine-share", lager.Data{"shareName": shareName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	quarantineDir := filepath.Join(c.baseLocalMountPoint, QuarantineDir)
+	err := c.os.MkdirAll(quarantineDir, os.ModePerm)
+	if err != nil {
+		logger.Error("failed-to-create-quarantine-dir", err)
+		return "", fmt.Errorf("failed to create quarantine directory '%s'", quarantineDir)
+	}
+
+	sharePath := filepath.Join(c.baseLocalMountPoint, shareName)
+	quarantinePath := filepath.Join(quarantineDir, shareName+"-"+time.Now().UTC().Format(quarantineTimeFormat))
+	err = c.os.Rename(sharePath, quarantinePath)
+	if err != nil {
+		logger.Error("failed-to-quarantine-share", err)
+		return "", fmt.Errorf("failed to move share '%s' to '%s'", sharePath, quarantinePath)
+	}
+	return quarantinePath, nil
+}
+
+// CreateSnapshot snapshots a share by creating a directory in its .snap directory
+func (c *cephClient) CreateSnapshot(env voldriver.Env, shareName string, snapshotName string) error {
+	logger := env.Logger().Session("create-snapshot", lager.Data{"shareName": shareName, "snapshotName": snapshotName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	snapshotPath := filepath.Join(c.baseLocalMountPoint, shareName, SnapshotDir, snapshotName)
+	err := c.os.Mkdir(snapshotPath, os.ModePerm)
+	if err != nil {
+		logger.Error("failed-to-create-snapshot", err)
+		return fmt.Errorf("failed to create snapshot '%s'", snapshotPath)
+	}
+	return nil
+}
+
+func (c *cephClient) ListSnapshots(env voldriver.Env, shareName string) ([]string, error) {
+	logger := env.Logger().Session("list-snapshots", lager.Data{"shareName": shareName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	snapshotDir := filepath.Join(c.baseLocalMountPoint, shareName, SnapshotDir)
+	entries, err := c.ioutil.ReadDir(snapshotDir)
+	if err != nil {
+		logger.Error("failed-to-list-snapshots", err)
+		return nil, fmt.Errorf("failed to list snapshots in '%s'", snapshotDir)
+	}
+
+	snapshots := []string{}
+	for _, entry := range entries {
+		// snapshots taken of parent directories show up as _<name>_<inode>
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), "_") {
+			snapshots = append(snapshots, entry.Name())
+		}
+	}
+	return snapshots, nil
+}
+
+func (c *cephClient) DeleteSnapshot(env voldriver.Env, shareName string, snapshotName string) error {
+	logger := env.Logger().Session("delete-snapshot", lager.Data{"shareName": shareName, "snapshotName": snapshotName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	snapshotPath := filepath.Join(c.baseLocalMountPoint, shareName, SnapshotDir, snapshotName)
+	err := c.os.Remove(snapshotPath)
+	if err != nil && !c.os.IsNotExist(err) {
+		logger.Error("failed-to-delete-snapshot", err)
+		return fmt.Errorf("failed to delete snapshot '%s'", snapshotPath)
+	}
+	return nil
+}
+
 func (c *cephClient) GetPathsForShare(env voldriver.Env, shareName string) (string, string, error) {
 	logger := env.Logger().Session("get-paths-for-share", lager.Data{shareName: shareName})
 	logger.Info("start")
@@ -140,24 +497,228 @@ func (c *cephClient) GetPathsForShare(env voldriver.Env, shareName string) (stri
 	return shareAbsPath, cellPath, nil
 }
 
-func (c *cephClient) GetConfigDetails(env voldriver.Env) (string, string, error) {
+// GetConfigDetails returns the monitors, the client the broker acts as, and that client's keyring
+func (c *cephClient) GetConfigDetails(env voldriver.Env) (string, string, string, error) {
 	logger := env.Logger().Session("get-config-details")
-	if c.mds == "" || c.keyring == "" {
-		return "", "", fmt.Errorf("Error retreiving Ceph config details")
+	if c.mds == "" || (c.credentials.Keyring == "" && c.credentials.SecretFile == "") {
+		return "", "", "", fmt.Errorf("Error retreiving Ceph config details")
+	}
+	clientName, err := c.clientName()
+	if err != nil {
+		logger.Error("failed-to-get-client-name", err)
+		return "", "", "", err
 	}
-	contents, err := c.ioutil.ReadFile(c.keyring)
+	keyring, err := c.readKeyring(clientName)
 	if err != nil {
-		logger.Error("failed-to-get-keyring", KeyringNotFound)
-		return "", "", KeyringNotFound
+		logger.Error("failed-to-get-keyring", err)
+		return "", "", "", err
 	}
-	return c.mds, string(contents), nil
+	return c.mds, clientName, keyring, nil
+}
+
+func (c *cephClient) SetQuota(env voldriver.Env, shareName string, quota Quota) error {
+	logger := env.Logger().Session("set-quota", lager.Data{"shareName": shareName, "quota": quota})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	sharePath := filepath.Join(c.baseLocalMountPoint, shareName)
+	attrs := []struct {
+		name  string
+		value uint64
+	}{{QuotaMaxBytesAttr, quota.MaxBytes}, {QuotaMaxFilesAttr, quota.MaxFiles}}
+
+	for _, attr := range attrs {
+		args := []string{"-n", attr.name, "-v", strconv.FormatUint(attr.value, 10), sharePath}
+		_, err := c.invoke(driverhttp.EnvWithLogger(logger, env), "setfattr", args)
+		if err != nil {
+			logger.Error("failed-to-set-quota", err, lager.Data{"attr": attr.name})
+			return fmt.Errorf("failed to set %s on share '%s'", attr.name, sharePath)
+		}
+	}
+	return nil
+}
+
+// SetOwnership changes the owner and permissions of the share's root directory, leaving its contents alone
+func (c *cephClient) SetOwnership(env voldriver.Env, shareName string, ownership Ownership) error {
+	logger := env.Logger().Session("set-ownership", lager.Data{"shareName": shareName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	sharePath := filepath.Join(c.baseLocalMountPoint, shareName)
+	if ownership.UID != nil || ownership.GID != nil {
+		uid, gid := -1, -1
+		if ownership.UID != nil {
+			uid = int(*ownership.UID)
+		}
+		if ownership.GID != nil {
+			gid = int(*ownership.GID)
+		}
+		if err := c.os.Chown(sharePath, uid, gid); err != nil {
+			logger.Error("failed-to-change-owner", err, lager.Data{"uid": uid, "gid": gid})
+			return fmt.Errorf("failed to change the owner of share '%s'", sharePath)
+		}
+	}
+	if ownership.Mode != nil {
+		if err := c.os.Chmod(sharePath, ownership.FileMode()); err != nil {
+			logger.Error("failed-to-change-mode", err, lager.Data{"mode": fmt.Sprintf("%04o", *ownership.Mode)})
+			return fmt.Errorf("failed to change the mode of share '%s'", sharePath)
+		}
+	}
+	return nil
+}
+
+func (c *cephClient) GetQuota(env voldriver.Env, shareName string) (Quota, error) {
+	logger := env.Logger().Session("get-quota", lager.Data{"shareName": shareName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	sharePath := filepath.Join(c.baseLocalMountPoint, shareName)
+
+	maxBytes, err := c.getCountAttr(driverhttp.EnvWithLogger(logger, env), QuotaMaxBytesAttr, sharePath)
+	if err != nil {
+		return Quota{}, err
+	}
+	maxFiles, err := c.getCountAttr(driverhttp.EnvWithLogger(logger, env), QuotaMaxFilesAttr, sharePath)
+	if err != nil {
+		return Quota{}, err
+	}
+	return Quota{MaxBytes: maxBytes, MaxFiles: maxFiles}, nil
+}
+
+func (c *cephClient) GetUsage(env voldriver.Env, shareName string) (Usage, error) {
+	logger := env.Logger().Session("get-usage", lager.Data{"shareName": shareName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	sharePath := filepath.Join(c.baseLocalMountPoint, shareName)
+
+	bytes, err := c.getCountAttr(driverhttp.EnvWithLogger(logger, env), UsageBytesAttr, sharePath)
+	if err != nil {
+		return Usage{}, err
+	}
+	files, err := c.getCountAttr(driverhttp.EnvWithLogger(logger, env), UsageFilesAttr, sharePath)
+	if err != nil {
+		return Usage{}, err
+	}
+	return Usage{Bytes: bytes, Files: files}, nil
+}
+
+// getCountAttr reads one of the numeric ceph xattrs of a share
+func (c *cephClient) getCountAttr(env voldriver.Env, attr string, sharePath string) (uint64, error) {
+	logger := env.Logger()
+
+	args := []string{"--only-values", "--absolute-names", "-n", attr, sharePath}
+	output, err := c.invoke(env, "getfattr", args)
+	if err != nil {
+		// cephfs reports quotas that were never set as missing attributes
+		if strings.Contains(err.Error(), "No such attribute") {
+			return 0, nil
+		}
+		logger.Error("failed-to-get-attr", err, lager.Data{"attr": attr})
+		return 0, fmt.Errorf("failed to get %s of share '%s'", attr, sharePath)
+	}
+
+	value, err := strconv.ParseUint(strings.TrimSpace(string(output)), 10, 64)
+	if err != nil {
+		logger.Error("invalid-attr-value", err, lager.Data{"attr": attr, "value": string(output)})
+		return 0, fmt.Errorf("invalid %s on share '%s'", attr, sharePath)
+	}
+	return value, nil
+}
+
+// CreateClientKey creates a cephx client that can only reach the share through the MDS, and only the data pools of
+// the share's file system through the OSDs
+func (c *cephClient) CreateClientKey(env voldriver.Env, clientName string, sharePath string, readOnly bool) (string, error) {
+	fsName := c.mount.FSName
+	if fsName == "" {
+		var err error
+		if fsName, err = c.defaultFSName(env); err != nil {
+			return "", err
+		}
+	}
+	return c.createClientKey(env, fsName, clientName, sharePath, readOnly)
+}
+
+func (c *cephClient) createClientKey(env voldriver.Env, fsName string, clientName string, sharePath string, readOnly bool) (string, error) {
+	logger := env.Logger().Session("create-client-key", lager.Data{"clientName": clientName, "sharePath": sharePath, "readOnly": readOnly, "fsName": fsName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	access := "rw"
+	if readOnly {
+		access = "r"
+	}
+
+	args := c.cephAdminArgs(
+		"auth", "get-or-create", "client."+clientName,
+		"mon", "allow r",
+		"mds", fmt.Sprintf("allow %s path=%s", access, sharePath),
+		"osd", fmt.Sprintf("allow %s tag cephfs data=%s", access, fsName),
+	)
+	output, err := c.invoke(driverhttp.EnvWithLogger(logger, env), "ceph", args)
+	if err != nil {
+		logger.Error("failed-to-create-client-key", err)
+		return "", fmt.Errorf("failed to create cephx client '%s'", clientName)
+	}
+	return string(output), nil
+}
+
+// defaultFSName finds the name of the file system the broker mounts when it is not given one.  That is only certain
+// when the cluster has a single file system; otherwise the file system has to be configured.
+func (c *cephClient) defaultFSName(env voldriver.Env) (string, error) {
+	logger := env.Logger().Session("default-fs-name")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	output, err := c.invoke(driverhttp.EnvWithLogger(logger, env), "ceph", c.cephAdminArgs("fs", "ls", "--format", "json"))
+	if err != nil {
+		logger.Error("failed-to-list-file-systems", err)
+		return "", fmt.Errorf("failed to list ceph file systems")
+	}
+
+	filesystems := []struct {
+		Name string `json:"name"`
+	}{}
+	if err := json.Unmarshal(output, &filesystems); err != nil {
+		logger.Error("invalid-file-system-list", err)
+		return "", fmt.Errorf("failed to parse ceph file systems")
+	}
+	if len(filesystems) != 1 {
+		return "", fmt.Errorf("the cluster has %d ceph file systems, the file system to use must be configured", len(filesystems))
+	}
+	return filesystems[0].Name, nil
+}
+
+func (c *cephClient) DeleteClientKey(env voldriver.Env, clientName string) error {
+	logger := env.Logger().Session("delete-client-key", lager.Data{"clientName": clientName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	args := c.cephAdminArgs("auth", "del", "client."+clientName)
+	_, err := c.invoke(driverhttp.EnvWithLogger(logger, env), "ceph", args)
+	if err != nil {
+		// deleting a client that is already gone is not an error
+		if isNotFound(err) {
+			return nil
+		}
+		logger.Error("failed-to-delete-client-key", err)
+		return fmt.Errorf("failed to delete cephx client '%s'", clientName)
+	}
+	return nil
+}
+
+func (c *cephClient) cephAdminArgs(args ...string) []string {
+	return append(c.authArgs(), args...)
 }
 
 func (c *cephClient) invokeCeph(env voldriver.Env, args []string) error {
+	_, err := c.invoke(env, "ceph-fuse", args)
+	return err
+}
+
+func (c *cephClient) invoke(env voldriver.Env, cmd string, args []string) ([]byte, error) {
 	logger := env.Logger().Session("invoke-ceph")
-	cmd := "ceph-fuse"
 	logger.Info("invoking-ceph", lager.Data{"cmd": cmd, "args": args})
 	defer logger.Debug("done-invoking-ceph")
-	_, err := c.invoker.Invoke(driverhttp.EnvWithLogger(logger, env), cmd, args)
-	return err
+	return c.invoker.Invoke(driverhttp.EnvWithLogger(logger, env), cmd, args)
 }
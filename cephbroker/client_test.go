@@ -2,6 +2,10 @@ package cephbroker_test
 
 import (
 	"context"
+	"errors"
+	"os"
+	"syscall"
+	"time"
 
 	"code.cloudfoundry.org/cephbroker/cephbroker"
 	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
@@ -32,13 +36,296 @@ var CephClient = Describe("CephClient", func() {
 		fakeInvoker = &voldriverfakes.FakeInvoker{}
 		fakeOs = &os_fake.FakeOs{}
 		fakeIoutil = &ioutil_fake.FakeIoutil{}
-		subject = cephbroker.NewCephClientWithInvokerAndSystemUtil("mds", fakeInvoker, fakeOs, fakeIoutil, "localMountPoint", "keyringFile")
+		subject = cephbroker.NewCephClientWithInvokerAndSystemUtil("mds", fakeInvoker, fakeOs, fakeIoutil, "localMountPoint", cephbroker.Credentials{Keyring: "keyringFile"}, "", cephbroker.MountSettings{})
 	})
-	Context(".MountFileSystem", func() {
-		It("should mount", func() {
-			localMountPoint, err := subject.MountFileSystem(env, "remoteMountPoint")
-			Expect(err).NotTo(HaveOccurred())
-			Expect(localMountPoint).To(Equal("localMountPoint"))
+	Context("mounting", func() {
+		const (
+			otherMount = "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n"
+			fuseMount  = "40 22 0:40 / localMountPoint rw,relatime shared:20 - fuse.ceph-fuse ceph-fuse rw,user_id=0\n"
+		)
+
+		var (
+			mountInfo string
+			statErr   error
+		)
+
+		BeforeEach(func() {
+			mountInfo = otherMount
+			statErr = nil
+			fakeIoutil.ReadFileStub = func(filename string) ([]byte, error) {
+				if filename == cephbroker.MountInfoFile {
+					return []byte(mountInfo), nil
+				}
+				return nil, errors.New("unexpected file")
+			}
+			fakeOs.StatStub = func(string) (os.FileInfo, error) {
+				return nil, statErr
+			}
+		})
+
+		Context(".IsFilesystemMounted", func() {
+			It("should not be mounted when there is no mount at the local mount point", func() {
+				Expect(subject.IsFilesystemMounted(env)).To(BeFalse())
+			})
+
+			It("should be mounted when there is a ceph mount that answers", func() {
+				mountInfo = otherMount + fuseMount
+				Expect(subject.IsFilesystemMounted(env)).To(BeTrue())
+			})
+
+			It("should recognise kernel mounts", func() {
+				mountInfo = otherMount + "41 22 0:41 / localMountPoint rw,relatime - ceph 10.0.0.1:6789:/ rw,name=admin\n"
+				Expect(subject.IsFilesystemMounted(env)).To(BeTrue())
+			})
+
+			It("should not be mounted when the mount at the local mount point is not ceph", func() {
+				mountInfo = otherMount + fuseMount + "42 40 0:42 / localMountPoint rw - tmpfs tmpfs rw\n"
+				Expect(subject.IsFilesystemMounted(env)).To(BeFalse())
+			})
+
+			It("should not be mounted when the ceph mount is stale", func() {
+				mountInfo = otherMount + fuseMount
+				statErr = &os.PathError{Op: "stat", Path: "localMountPoint", Err: syscall.ENOTCONN}
+				Expect(subject.IsFilesystemMounted(env)).To(BeFalse())
+			})
+
+			It("should find mount points with escaped characters", func() {
+				subject = cephbroker.NewCephClientWithInvokerAndSystemUtil("mds", fakeInvoker, fakeOs, fakeIoutil, "/var/local mount/", cephbroker.Credentials{Keyring: "keyringFile"}, "", cephbroker.MountSettings{})
+				mountInfo = otherMount + "40 22 0:40 / /var/local\\040mount rw - fuse.ceph-fuse ceph-fuse rw\n"
+				Expect(subject.IsFilesystemMounted(env)).To(BeTrue())
+			})
+
+			It("should not be mounted when the mounts cannot be read", func() {
+				fakeIoutil.ReadFileStub = nil
+				fakeIoutil.ReadFileReturns(nil, errors.New("badness"))
+				Expect(subject.IsFilesystemMounted(env)).To(BeFalse())
+			})
+		})
+
+		Context(".MountFileSystem", func() {
+			It("should mount", func() {
+				localMountPoint, err := subject.MountFileSystem(env, "remoteMountPoint")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(localMountPoint).To(Equal("localMountPoint"))
+
+				_, cmd, args := fakeInvoker.InvokeArgsForCall(0)
+				Expect(cmd).To(Equal("ceph-fuse"))
+				Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "-r", "remoteMountPoint", "localMountPoint"}))
+			})
+
+			It("should pass mount options to ceph-fuse", func() {
+				subject = cephbroker.NewCephClientWithInvokerAndSystemUtil("mds", fakeInvoker, fakeOs, fakeIoutil, "localMountPoint", cephbroker.Credentials{Keyring: "keyringFile"}, "", cephbroker.MountSettings{Mode: cephbroker.MountModeFuse, Options: "allow_other"})
+				_, err := subject.MountFileSystem(env, "/")
+				Expect(err).NotTo(HaveOccurred())
+
+				_, cmd, args := fakeInvoker.InvokeArgsForCall(0)
+				Expect(cmd).To(Equal("ceph-fuse"))
+				Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "-r", "/", "-o", "allow_other", "localMountPoint"}))
+			})
+
+			It("should mount as the client it is given, with its secret file", func() {
+				credentials := cephbroker.Credentials{ClientName: "cephbroker", SecretFile: "/etc/ceph/cephbroker.secret"}
+				subject = cephbroker.NewCephClientWithInvokerAndSystemUtil("mds", fakeInvoker, fakeOs, fakeIoutil, "localMountPoint", credentials, "", cephbroker.MountSettings{})
+				_, err := subject.MountFileSystem(env, "/")
+				Expect(err).NotTo(HaveOccurred())
+
+				_, cmd, args := fakeInvoker.InvokeArgsForCall(0)
+				Expect(cmd).To(Equal("ceph-fuse"))
+				Expect(args).To(Equal([]string{"-m", "mds", "--keyfile", "/etc/ceph/cephbroker.secret", "--id", "cephbroker", "-r", "/", "localMountPoint"}))
+			})
+
+			It("should mount the file system it is given", func() {
+				subject = cephbroker.NewCephClientWithInvokerAndSystemUtil("mds", fakeInvoker, fakeOs, fakeIoutil, "localMountPoint", cephbroker.Credentials{Keyring: "keyringFile"}, "", cephbroker.MountSettings{Mode: cephbroker.MountModeFuse, FSName: "archive"})
+				_, err := subject.MountFileSystem(env, "/")
+				Expect(err).NotTo(HaveOccurred())
+
+				_, _, args := fakeInvoker.InvokeArgsForCall(0)
+				Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "-r", "/", "--client_fs", "archive", "localMountPoint"}))
+			})
+
+			It("should mount the root path it is given, as shares are created there", func() {
+				subject = cephbroker.NewCephClientWithInvokerAndSystemUtil("mds", fakeInvoker, fakeOs, fakeIoutil, "localMountPoint", cephbroker.Credentials{Keyring: "keyringFile"}, "/volumes", cephbroker.MountSettings{})
+				_, err := subject.MountFileSystem(env, "/")
+				Expect(err).NotTo(HaveOccurred())
+
+				_, _, args := fakeInvoker.InvokeArgsForCall(0)
+				Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "-r", "/volumes", "localMountPoint"}))
+			})
+
+			Context("with the kernel client", func() {
+				BeforeEach(func() {
+					subject = cephbroker.NewCephClientWithInvokerAndSystemUtil("mds", fakeInvoker, fakeOs, fakeIoutil, "localMountPoint", cephbroker.Credentials{Keyring: "keyringFile"}, "", cephbroker.MountSettings{Mode: cephbroker.MountModeKernel, Options: "noatime"})
+					fakeIoutil.ReadFileStub = func(filename string) ([]byte, error) {
+						switch filename {
+						case cephbroker.MountInfoFile:
+							return []byte(mountInfo), nil
+						case "keyringFile":
+							return []byte("[client.broker]\n\tkey = c2VjcmV0\n\tcaps mds = \"allow *\"\n"), nil
+						}
+						return nil, errors.New("unexpected file")
+					}
+					fakeIoutil.TempDirReturns("/tmp/cephbroker-secret123", nil)
+				})
+
+				It("should mount with mount -t ceph, as the client in the keyring", func() {
+					_, err := subject.MountFileSystem(env, "/")
+					Expect(err).NotTo(HaveOccurred())
+
+					dir, prefix := fakeIoutil.TempDirArgsForCall(0)
+					Expect(dir).To(Equal(""))
+					Expect(prefix).To(Equal("cephbroker-secret"))
+
+					secretFile, secret, mode := fakeIoutil.WriteFileArgsForCall(0)
+					Expect(secretFile).To(Equal("/tmp/cephbroker-secret123/secret"))
+					Expect(string(secret)).To(Equal("c2VjcmV0"))
+					Expect(mode).To(Equal(os.FileMode(0600)))
+
+					_, cmd, args := fakeInvoker.InvokeArgsForCall(0)
+					Expect(cmd).To(Equal("mount"))
+					Expect(args).To(Equal([]string{"-t", "ceph", "mds:/", "localMountPoint", "-o", "name=broker,secretfile=/tmp/cephbroker-secret123/secret,noatime"}))
+				})
+
+				It("should remove the secret it wrote once the kernel has mounted", func() {
+					_, err := subject.MountFileSystem(env, "/")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeOs.RemoveAllCallCount()).To(Equal(1))
+					Expect(fakeOs.RemoveAllArgsForCall(0)).To(Equal("/tmp/cephbroker-secret123"))
+				})
+
+				It("should remove the secret it wrote when the mount fails", func() {
+					fakeInvoker.InvokeReturns(nil, errors.New("badness"))
+					_, err := subject.MountFileSystem(env, "/")
+					Expect(err).To(HaveOccurred())
+					Expect(fakeOs.RemoveAllArgsForCall(0)).To(Equal("/tmp/cephbroker-secret123"))
+				})
+
+				It("should error when the keyring has no client key", func() {
+					fakeIoutil.ReadFileStub = func(filename string) ([]byte, error) {
+						if filename == "keyringFile" {
+							return []byte("[mon.]\n\tkey = c2VjcmV0\n"), nil
+						}
+						return []byte(mountInfo), nil
+					}
+					_, err := subject.MountFileSystem(env, "/")
+					Expect(err).To(MatchError(ContainSubstring("no client key")))
+					Expect(fakeInvoker.InvokeCallCount()).To(Equal(0))
+				})
+
+				It("should mount as the client it is given, rather than the one in the keyring", func() {
+					credentials := cephbroker.Credentials{ClientName: "cephbroker", Keyring: "keyringFile"}
+					subject = cephbroker.NewCephClientWithInvokerAndSystemUtil("mds", fakeInvoker, fakeOs, fakeIoutil, "localMountPoint", credentials, "", cephbroker.MountSettings{Mode: cephbroker.MountModeKernel})
+					_, err := subject.MountFileSystem(env, "/")
+					Expect(err).NotTo(HaveOccurred())
+
+					_, _, args := fakeInvoker.InvokeArgsForCall(0)
+					Expect(args).To(Equal([]string{"-t", "ceph", "mds:/", "localMountPoint", "-o", "name=cephbroker,secretfile=/tmp/cephbroker-secret123/secret"}))
+				})
+
+				It("should give the kernel the secret file when there is one", func() {
+					credentials := cephbroker.Credentials{ClientName: "cephbroker", Keyring: "keyringFile", SecretFile: "/etc/ceph/cephbroker.secret"}
+					subject = cephbroker.NewCephClientWithInvokerAndSystemUtil("mds", fakeInvoker, fakeOs, fakeIoutil, "localMountPoint", credentials, "", cephbroker.MountSettings{Mode: cephbroker.MountModeKernel})
+					_, err := subject.MountFileSystem(env, "/")
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(fakeIoutil.WriteFileCallCount()).To(Equal(0))
+					Expect(fakeOs.RemoveAllCallCount()).To(Equal(0))
+					_, _, args := fakeInvoker.InvokeArgsForCall(0)
+					Expect(args).To(Equal([]string{"-t", "ceph", "mds:/", "localMountPoint", "-o", "name=cephbroker,secretfile=/etc/ceph/cephbroker.secret"}))
+				})
+
+				It("should mount the file system it is given", func() {
+					credentials := cephbroker.Credentials{ClientName: "cephbroker", SecretFile: "/etc/ceph/cephbroker.secret"}
+					subject = cephbroker.NewCephClientWithInvokerAndSystemUtil("mds", fakeInvoker, fakeOs, fakeIoutil, "localMountPoint", credentials, "", cephbroker.MountSettings{Mode: cephbroker.MountModeKernel, FSName: "archive", Options: "noatime"})
+					_, err := subject.MountFileSystem(env, "/")
+					Expect(err).NotTo(HaveOccurred())
+
+					_, _, args := fakeInvoker.InvokeArgsForCall(0)
+					Expect(args).To(Equal([]string{"-t", "ceph", "mds:/", "localMountPoint", "-o", "name=cephbroker,secretfile=/etc/ceph/cephbroker.secret,mds_namespace=archive,noatime"}))
+				})
+
+				It("should mount the root path it is given", func() {
+					credentials := cephbroker.Credentials{ClientName: "cephbroker", SecretFile: "/etc/ceph/cephbroker.secret"}
+					subject = cephbroker.NewCephClientWithInvokerAndSystemUtil("mds", fakeInvoker, fakeOs, fakeIoutil, "localMountPoint", credentials, "/volumes", cephbroker.MountSettings{Mode: cephbroker.MountModeKernel})
+					_, err := subject.MountFileSystem(env, "/")
+					Expect(err).NotTo(HaveOccurred())
+
+					_, _, args := fakeInvoker.InvokeArgsForCall(0)
+					Expect(args).To(Equal([]string{"-t", "ceph", "mds:/volumes", "localMountPoint", "-o", "name=cephbroker,secretfile=/etc/ceph/cephbroker.secret"}))
+				})
+
+				It("should advertise the kernel client", func() {
+					Expect(subject.GetMountSettings(env)).To(Equal(cephbroker.MountSettings{Mode: cephbroker.MountModeKernel, Options: "noatime"}))
+				})
+			})
+
+			It("should mount with ceph-fuse when no mode is given", func() {
+				Expect(subject.GetMountSettings(env).Mode).To(Equal(cephbroker.MountModeFuse))
+			})
+
+			It("should use a ceph mount that is already there", func() {
+				mountInfo = otherMount + fuseMount
+				localMountPoint, err := subject.MountFileSystem(env, "remoteMountPoint")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(localMountPoint).To(Equal("localMountPoint"))
+				Expect(fakeInvoker.InvokeCallCount()).To(Equal(0))
+			})
+
+			It("should unmount a stale ceph-fuse mount before mounting again", func() {
+				mountInfo = otherMount + fuseMount
+				statErr = &os.PathError{Op: "stat", Path: "localMountPoint", Err: syscall.ENOTCONN}
+				_, err := subject.MountFileSystem(env, "remoteMountPoint")
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fakeInvoker.InvokeCallCount()).To(Equal(2))
+				_, cmd, args := fakeInvoker.InvokeArgsForCall(0)
+				Expect(cmd).To(Equal("fusermount"))
+				Expect(args).To(Equal([]string{"-u", "-z", "localMountPoint"}))
+				_, cmd, _ = fakeInvoker.InvokeArgsForCall(1)
+				Expect(cmd).To(Equal("ceph-fuse"))
+			})
+
+			It("should unmount a stale kernel mount lazily", func() {
+				mountInfo = otherMount + "41 22 0:41 / localMountPoint rw,relatime - ceph 10.0.0.1:6789:/ rw,name=admin\n"
+				statErr = errors.New("input/output error")
+				_, err := subject.MountFileSystem(env, "remoteMountPoint")
+				Expect(err).NotTo(HaveOccurred())
+
+				_, cmd, args := fakeInvoker.InvokeArgsForCall(0)
+				Expect(cmd).To(Equal("umount"))
+				Expect(args).To(Equal([]string{"-l", "localMountPoint"}))
+			})
+
+			It("should not mount over a stale mount it cannot unmount", func() {
+				mountInfo = otherMount + fuseMount
+				statErr = &os.PathError{Op: "stat", Path: "localMountPoint", Err: syscall.ENOTCONN}
+				fakeInvoker.InvokeReturns(nil, errors.New("badness"))
+				_, err := subject.MountFileSystem(env, "remoteMountPoint")
+				Expect(err).To(MatchError(ContainSubstring("stale mount")))
+				Expect(fakeInvoker.InvokeCallCount()).To(Equal(1))
+			})
+		})
+
+		Context(".UnmountFileSystem", func() {
+			It("should unmount the ceph mount", func() {
+				mountInfo = otherMount + fuseMount
+				Expect(subject.UnmountFileSystem(env)).To(Succeed())
+
+				_, cmd, args := fakeInvoker.InvokeArgsForCall(0)
+				Expect(cmd).To(Equal("fusermount"))
+				Expect(args).To(Equal([]string{"-u", "localMountPoint"}))
+			})
+
+			It("should do nothing when the filesystem is not mounted", func() {
+				Expect(subject.UnmountFileSystem(env)).To(Succeed())
+				Expect(fakeInvoker.InvokeCallCount()).To(Equal(0))
+			})
+
+			It("should error when the filesystem cannot be unmounted", func() {
+				mountInfo = otherMount + fuseMount
+				fakeInvoker.InvokeReturns(nil, errors.New("device is busy"))
+				err := subject.UnmountFileSystem(env)
+				Expect(err).To(MatchError(ContainSubstring("device is busy")))
+			})
 		})
 	})
 	Context(".CreateShare", func() {
@@ -46,6 +333,49 @@ var CephClient = Describe("CephClient", func() {
 			share, err := subject.CreateShare(env, "shareName")
 			Expect(err).NotTo(HaveOccurred())
 			Expect(share).To(Equal("localMountPoint/shareName"))
+
+			path, mode := fakeOs.ChmodArgsForCall(0)
+			Expect(path).To(Equal("localMountPoint/shareName"))
+			Expect(mode).To(Equal(os.FileMode(0777)))
+		})
+
+		It("should error when the share cannot be made world-writable", func() {
+			fakeOs.ChmodReturns(errors.New("badness"))
+			_, err := subject.CreateShare(env, "shareName")
+			Expect(err).To(MatchError("failed to change the mode of share 'localMountPoint/shareName'"))
+		})
+	})
+	Context(".CloneShare", func() {
+		It("should copy the source share into the new share", func() {
+			share, err := subject.CloneShare(env, "shareName", "sourceName", "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(share).To(Equal("localMountPoint/shareName"))
+
+			_, cmd, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(cmd).To(Equal("cp"))
+			Expect(args).To(Equal([]string{"-a", "localMountPoint/sourceName/.", "localMountPoint/shareName"}))
+		})
+
+		It("should copy from a snapshot of the source share", func() {
+			_, err := subject.CloneShare(env, "shareName", "sourceName", "snap1")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(args).To(Equal([]string{"-a", "localMountPoint/sourceName/.snap/snap1/.", "localMountPoint/shareName"}))
+		})
+
+		It("should error when the source does not exist", func() {
+			fakeOs.IsNotExistReturns(true)
+			_, err := subject.CloneShare(env, "shareName", "sourceName", "")
+			Expect(err).To(Equal(cephbroker.ShareNotFound))
+			Expect(fakeOs.MkdirAllCallCount()).To(Equal(0))
+		})
+
+		It("should remove the new share when the copy fails", func() {
+			fakeInvoker.InvokeReturns(nil, errors.New("badness"))
+			_, err := subject.CloneShare(env, "shareName", "sourceName", "")
+			Expect(err).To(HaveOccurred())
+			Expect(fakeOs.RemoveAllArgsForCall(0)).To(Equal("localMountPoint/shareName"))
 		})
 	})
 	Context(".DeleteShare", func() {
@@ -54,6 +384,45 @@ var CephClient = Describe("CephClient", func() {
 			Expect(err).NotTo(HaveOccurred())
 		})
 	})
+	Context(".ListShares", func() {
+		It("should list the share directories, skipping hidden directories and files", func() {
+			fakeIoutil.ReadDirReturns([]os.FileInfo{
+				fakeDirInfo{name: "share1"},
+				fakeDirInfo{name: cephbroker.QuarantineDir},
+				fakeDirInfo{name: "some-file", file: true},
+				fakeDirInfo{name: "share2"},
+			}, nil)
+			shares, err := subject.ListShares(env)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(shares).To(Equal([]string{"share1", "share2"}))
+			Expect(fakeIoutil.ReadDirArgsForCall(0)).To(Equal("localMountPoint"))
+		})
+
+		It("should error when the mount cannot be read", func() {
+			fakeIoutil.ReadDirReturns(nil, errors.New("badness"))
+			_, err := subject.ListShares(env)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Context(".QuarantineShare", func() {
+		It("should move the share into the quarantine directory", func() {
+			path, err := subject.QuarantineShare(env, "shareName")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(path).To(HavePrefix("localMountPoint/.cephbroker-quarantine/shareName-"))
+
+			dir, _ := fakeOs.MkdirAllArgsForCall(0)
+			Expect(dir).To(Equal("localMountPoint/.cephbroker-quarantine"))
+			from, to := fakeOs.RenameArgsForCall(0)
+			Expect(from).To(Equal("localMountPoint/shareName"))
+			Expect(to).To(Equal(path))
+		})
+
+		It("should error when the share cannot be moved", func() {
+			fakeOs.RenameReturns(errors.New("badness"))
+			_, err := subject.QuarantineShare(env, "shareName")
+			Expect(err).To(HaveOccurred())
+		})
+	})
 	Context(".GetPathsForShare", func() {
 		It("should be able to get paths", func() {
 			path1, path2, err := subject.GetPathsForShare(env, "sharename")
@@ -61,13 +430,304 @@ var CephClient = Describe("CephClient", func() {
 			Expect(path1).To(Equal("sharename"))
 			Expect(path2).To(Equal("/var/vcap/data/volumes/ceph/sharename"))
 		})
+
+		It("should give the path of the share under the root path", func() {
+			subject = cephbroker.NewCephClientWithInvokerAndSystemUtil("mds", fakeInvoker, fakeOs, fakeIoutil, "localMountPoint", cephbroker.Credentials{Keyring: "keyringFile"}, "/volumes", cephbroker.MountSettings{})
+			path1, _, err := subject.GetPathsForShare(env, "sharename")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(path1).To(Equal("/volumes/sharename"))
+		})
+	})
+	Context(".SetQuota", func() {
+		It("should set the quota xattrs on the share", func() {
+			err := subject.SetQuota(env, "shareName", cephbroker.Quota{MaxBytes: 1024, MaxFiles: 10})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(2))
+
+			_, cmd, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(cmd).To(Equal("setfattr"))
+			Expect(args).To(Equal([]string{"-n", "ceph.quota.max_bytes", "-v", "1024", "localMountPoint/shareName"}))
+
+			_, cmd, args = fakeInvoker.InvokeArgsForCall(1)
+			Expect(cmd).To(Equal("setfattr"))
+			Expect(args).To(Equal([]string{"-n", "ceph.quota.max_files", "-v", "10", "localMountPoint/shareName"}))
+		})
+
+		It("should error when the xattr cannot be set", func() {
+			fakeInvoker.InvokeReturns(nil, errors.New("badness"))
+			err := subject.SetQuota(env, "shareName", cephbroker.Quota{MaxBytes: 1024})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Context(".SetOwnership", func() {
+		It("should change the owner and mode of the share's directory", func() {
+			uid, gid, mode := uint32(1000), uint32(2000), uint32(02770)
+			err := subject.SetOwnership(env, "shareName", cephbroker.Ownership{UID: &uid, GID: &gid, Mode: &mode})
+			Expect(err).NotTo(HaveOccurred())
+
+			name, chownUID, chownGID := fakeOs.ChownArgsForCall(0)
+			Expect(name).To(Equal("localMountPoint/shareName"))
+			Expect(chownUID).To(Equal(1000))
+			Expect(chownGID).To(Equal(2000))
+
+			name, fileMode := fakeOs.ChmodArgsForCall(0)
+			Expect(name).To(Equal("localMountPoint/shareName"))
+			Expect(fileMode).To(Equal(os.ModeSetgid | 0770))
+		})
+
+		It("should leave what it is not given alone", func() {
+			gid := uint32(2000)
+			err := subject.SetOwnership(env, "shareName", cephbroker.Ownership{GID: &gid})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, chownUID, chownGID := fakeOs.ChownArgsForCall(0)
+			Expect(chownUID).To(Equal(-1))
+			Expect(chownGID).To(Equal(2000))
+			Expect(fakeOs.ChmodCallCount()).To(Equal(0))
+		})
+
+		It("should error when the owner cannot be changed", func() {
+			uid := uint32(1000)
+			fakeOs.ChownReturns(errors.New("badness"))
+			err := subject.SetOwnership(env, "shareName", cephbroker.Ownership{UID: &uid})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Context(".GetQuota", func() {
+		It("should read the quota xattrs of the share", func() {
+			fakeInvoker.InvokeStub = func(_ voldriver.Env, _ string, args []string) ([]byte, error) {
+				if args[3] == "ceph.quota.max_bytes" {
+					return []byte("1024\n"), nil
+				}
+				return nil, errors.New("exit status 1 - details:\nlocalMountPoint/shareName: ceph.quota.max_files: No such attribute")
+			}
+			quota, err := subject.GetQuota(env, "shareName")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(quota).To(Equal(cephbroker.Quota{MaxBytes: 1024}))
+
+			_, cmd, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(cmd).To(Equal("getfattr"))
+			Expect(args).To(Equal([]string{"--only-values", "--absolute-names", "-n", "ceph.quota.max_bytes", "localMountPoint/shareName"}))
+		})
+
+		It("should error when the xattr cannot be read", func() {
+			fakeInvoker.InvokeReturns(nil, errors.New("badness"))
+			_, err := subject.GetQuota(env, "shareName")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Context(".GetUsage", func() {
+		It("should read the recursive usage xattrs of the share", func() {
+			fakeInvoker.InvokeStub = func(_ voldriver.Env, _ string, args []string) ([]byte, error) {
+				if args[3] == "ceph.dir.rbytes" {
+					return []byte("512\n"), nil
+				}
+				return []byte("2\n"), nil
+			}
+			usage, err := subject.GetUsage(env, "shareName")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(usage).To(Equal(cephbroker.Usage{Bytes: 512, Files: 2}))
+
+			_, cmd, args := fakeInvoker.InvokeArgsForCall(1)
+			Expect(cmd).To(Equal("getfattr"))
+			Expect(args).To(Equal([]string{"--only-values", "--absolute-names", "-n", "ceph.dir.rfiles", "localMountPoint/shareName"}))
+		})
+
+		It("should error when the xattr cannot be read", func() {
+			fakeInvoker.InvokeReturns(nil, errors.New("badness"))
+			_, err := subject.GetUsage(env, "shareName")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Context(".CreateClientKey", func() {
+		BeforeEach(func() {
+			fakeInvoker.InvokeStub = func(_ voldriver.Env, _ string, args []string) ([]byte, error) {
+				if args[4] == "fs" {
+					return []byte(`[{"name":"cephfs","metadata_pool":"cephfs_metadata","data_pools":["cephfs_data"]}]`), nil
+				}
+				return []byte("[client.binding]\n\tkey = secret\n"), nil
+			}
+		})
+
+		It("should create a cephx client restricted to the share and the file system's data", func() {
+			keyring, err := subject.CreateClientKey(env, "binding", "/share", false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(keyring).To(Equal("[client.binding]\n\tkey = secret\n"))
+
+			_, cmd, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(cmd).To(Equal("ceph"))
+			Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "fs", "ls", "--format", "json"}))
+
+			_, cmd, args = fakeInvoker.InvokeArgsForCall(1)
+			Expect(cmd).To(Equal("ceph"))
+			Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "auth", "get-or-create", "client.binding",
+				"mon", "allow r", "mds", "allow rw path=/share", "osd", "allow rw tag cephfs data=cephfs"}))
+		})
+
+		It("should restrict it to the file system the broker mounts", func() {
+			subject = cephbroker.NewCephClientWithInvokerAndSystemUtil("mds", fakeInvoker, fakeOs, fakeIoutil, "localMountPoint", cephbroker.Credentials{Keyring: "keyringFile"}, "", cephbroker.MountSettings{FSName: "archive"})
+			_, err := subject.CreateClientKey(env, "binding", "/share", false)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(1))
+			_, _, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(args).To(ContainElement("allow rw tag cephfs data=archive"))
+		})
+
+		It("should create it as the client it is given", func() {
+			subject = cephbroker.NewCephClientWithInvokerAndSystemUtil("mds", fakeInvoker, fakeOs, fakeIoutil, "localMountPoint", cephbroker.Credentials{ClientName: "cephbroker", Keyring: "keyringFile"}, "", cephbroker.MountSettings{FSName: "cephfs"})
+			_, err := subject.CreateClientKey(env, "binding", "/share", false)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(args[:6]).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "--id", "cephbroker"}))
+		})
+
+		It("should use read-only caps for read-only bindings", func() {
+			_, err := subject.CreateClientKey(env, "binding", "/share", true)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, args := fakeInvoker.InvokeArgsForCall(1)
+			Expect(args).To(ContainElement("allow r path=/share"))
+			Expect(args).To(ContainElement("allow r tag cephfs data=cephfs"))
+			Expect(args).NotTo(ContainElement("allow rw tag cephfs data=cephfs"))
+		})
+
+		It("should error when the cluster has several file systems and none is configured", func() {
+			fakeInvoker.InvokeStub = nil
+			fakeInvoker.InvokeReturns([]byte(`[{"name":"cephfs"},{"name":"archive"}]`), nil)
+			_, err := subject.CreateClientKey(env, "binding", "/share", false)
+			Expect(err).To(MatchError(ContainSubstring("must be configured")))
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(1))
+		})
+
+		It("should error when ceph fails", func() {
+			fakeInvoker.InvokeStub = nil
+			fakeInvoker.InvokeReturns(nil, errors.New("badness"))
+			_, err := subject.CreateClientKey(env, "binding", "/share", false)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Context(".DeleteClientKey", func() {
+		It("should delete the cephx client", func() {
+			err := subject.DeleteClientKey(env, "binding")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, cmd, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(cmd).To(Equal("ceph"))
+			Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "auth", "del", "client.binding"}))
+		})
+
+		It("should not error when the client is already gone", func() {
+			fakeInvoker.InvokeReturns(nil, errors.New("Error ENOENT: failed to find client.binding in keyring"))
+			Expect(subject.DeleteClientKey(env, "binding")).To(Succeed())
+		})
+
+		It("should error when ceph fails", func() {
+			fakeInvoker.InvokeReturns(nil, errors.New("badness"))
+			Expect(subject.DeleteClientKey(env, "binding")).NotTo(Succeed())
+		})
+	})
+	Context(".CreateSnapshot", func() {
+		It("should create a directory in the share's .snap directory", func() {
+			err := subject.CreateSnapshot(env, "shareName", "snap1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeOs.MkdirCallCount()).To(Equal(1))
+			path, _ := fakeOs.MkdirArgsForCall(0)
+			Expect(path).To(Equal("localMountPoint/shareName/.snap/snap1"))
+		})
+
+		It("should error when the directory cannot be created", func() {
+			fakeOs.MkdirReturns(errors.New("badness"))
+			Expect(subject.CreateSnapshot(env, "shareName", "snap1")).NotTo(Succeed())
+		})
+	})
+	Context(".ListSnapshots", func() {
+		It("should list the snapshots of the share, skipping those of parent directories", func() {
+			fakeIoutil.ReadDirReturns([]os.FileInfo{
+				fakeDirInfo{name: "snap1"},
+				fakeDirInfo{name: "_parent_1099511627776"},
+				fakeDirInfo{name: "snap2"},
+			}, nil)
+			snapshots, err := subject.ListSnapshots(env, "shareName")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(snapshots).To(Equal([]string{"snap1", "snap2"}))
+			Expect(fakeIoutil.ReadDirArgsForCall(0)).To(Equal("localMountPoint/shareName/.snap"))
+		})
+
+		It("should error when the snapshot directory cannot be read", func() {
+			fakeIoutil.ReadDirReturns(nil, errors.New("badness"))
+			_, err := subject.ListSnapshots(env, "shareName")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Context(".DeleteSnapshot", func() {
+		It("should remove the snapshot directory", func() {
+			err := subject.DeleteSnapshot(env, "shareName", "snap1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeOs.RemoveArgsForCall(0)).To(Equal("localMountPoint/shareName/.snap/snap1"))
+		})
+
+		It("should not error when the snapshot is already gone", func() {
+			fakeOs.RemoveReturns(errors.New("no such file"))
+			fakeOs.IsNotExistReturns(true)
+			Expect(subject.DeleteSnapshot(env, "shareName", "snap1")).To(Succeed())
+		})
+
+		It("should error when the directory cannot be removed", func() {
+			fakeOs.RemoveReturns(errors.New("badness"))
+			Expect(subject.DeleteSnapshot(env, "shareName", "snap1")).NotTo(Succeed())
+		})
 	})
 	Context(".GetConfigDetails", func() {
 		It("should be able to get config details", func() {
-			detail1, detail2, err := subject.GetConfigDetails(env)
+			detail1, detail2, detail3, err := subject.GetConfigDetails(env)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(detail1).To(Equal("mds"))
-			Expect(detail2).To(Equal(""))
+			Expect(detail2).To(Equal("admin"))
+			Expect(detail3).To(Equal(""))
+		})
+
+		It("should name the client in the keyring", func() {
+			fakeIoutil.ReadFileReturns([]byte("[client.broker]\n\tkey = c2VjcmV0\n"), nil)
+			_, clientName, keyring, err := subject.GetConfigDetails(env)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(clientName).To(Equal("broker"))
+			Expect(keyring).To(Equal("[client.broker]\n\tkey = c2VjcmV0\n"))
+		})
+
+		It("should make a keyring for the client it is given from its secret file", func() {
+			subject = cephbroker.NewCephClientWithInvokerAndSystemUtil("mds", fakeInvoker, fakeOs, fakeIoutil, "localMountPoint", cephbroker.Credentials{ClientName: "cephbroker", SecretFile: "secretFile"}, "", cephbroker.MountSettings{})
+			fakeIoutil.ReadFileReturns([]byte("c2VjcmV0\n"), nil)
+			_, clientName, keyring, err := subject.GetConfigDetails(env)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeIoutil.ReadFileArgsForCall(0)).To(Equal("secretFile"))
+			Expect(clientName).To(Equal("cephbroker"))
+			Expect(keyring).To(Equal("[client.cephbroker]\n\tkey = c2VjcmV0\n"))
+		})
+
+		It("should error when the secret file cannot be read", func() {
+			subject = cephbroker.NewCephClientWithInvokerAndSystemUtil("mds", fakeInvoker, fakeOs, fakeIoutil, "localMountPoint", cephbroker.Credentials{SecretFile: "secretFile"}, "", cephbroker.MountSettings{})
+			fakeIoutil.ReadFileReturns(nil, errors.New("badness"))
+			_, _, _, err := subject.GetConfigDetails(env)
+			Expect(err).To(Equal(cephbroker.SecretNotFound))
 		})
 	})
 })
+
+type fakeDirInfo struct {
+	name string
+	file bool
+}
+
+func (f fakeDirInfo) Name() string { return f.name }
+func (f fakeDirInfo) Size() int64  { return 0 }
+func (f fakeDirInfo) Mode() os.FileMode {
+	if f.file {
+		return 0
+	}
+	return os.ModeDir
+}
+func (f fakeDirInfo) ModTime() time.Time { return time.Time{} }
+func (f fakeDirInfo) IsDir() bool        { return !f.file }
+func (f fakeDirInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,39 @@
+package cephbroker
+
+import (
+	"errors"
+)
+
+var (
+	ErrSourceInstanceDoesNotExist   = errors.New("source_instance does not exist")
+	ErrSourceInstanceNotInSpace     = errors.New("source_instance must belong to the same organization and space as the new service instance")
+	ErrSourceInstanceInOtherBackend = errors.New("source_instance must be in the same backend as the plan of the new service instance")
+	ErrInvalidCloneSource           = errors.New("source_instance must be a service instance id, and snapshot may only be given with a source_instance")
+)
+
+// CloneSource is the instance, and optionally the snapshot of it, that a new instance is copied from
+type CloneSource struct {
+	Instance string
+	Snapshot string
+}
+
+// evaluateCloneSource reads the "source_instance" and "snapshot" provision parameters.  A snapshot can only be given
+// together with a source instance.
+func evaluateCloneSource(parameters map[string]interface{}) (CloneSource, error) {
+	source := CloneSource{}
+	if value, ok := parameters["source_instance"]; ok {
+		instance, ok := value.(string)
+		if !ok || instance == "" {
+			return CloneSource{}, ErrInvalidCloneSource
+		}
+		source.Instance = instance
+	}
+	if value, ok := parameters["snapshot"]; ok {
+		snapshot, ok := value.(string)
+		if !ok || source.Instance == "" {
+			return CloneSource{}, ErrInvalidCloneSource
+		}
+		source.Snapshot = snapshot
+	}
+	return source, nil
+}
@@ -1,6 +1,9 @@
 package cephbroker
 
 import (
+	"errors"
+	"fmt"
+	"sort"
 	"strings"
 
 	"code.cloudfoundry.org/lager"
@@ -9,24 +12,86 @@ import (
 	"code.cloudfoundry.org/voldriver/driverhttp"
 )
 
+var ErrBackendNotFound = errors.New("backend not found")
+
 type BindResponse struct {
 	voldriver.ErrorResponse
 	SharedDevice brokerapi.SharedDevice
 }
 
+type UpdateRequest struct {
+	Name string
+	Opts map[string]interface{}
+}
+
+type SnapshotsResponse struct {
+	voldriver.ErrorResponse
+	Snapshots []string
+}
+
+type SharePathResponse struct {
+	voldriver.ErrorResponse
+	Path string
+}
+
+type ShareUsageResponse struct {
+	voldriver.ErrorResponse
+	Quota Quota
+	Usage Usage
+}
+
+type SharesResponse struct {
+	voldriver.ErrorResponse
+	Shares []string
+}
+
 //go:generate counterfeiter -o ../cephfakes/fake_controller.go . Controller
 
 type Controller interface {
 	voldriver.Provisioner
-	Bind(env voldriver.Env, instanceID string) BindResponse
+	Update(env voldriver.Env, updateRequest UpdateRequest) voldriver.ErrorResponse
+	Bind(env voldriver.Env, instanceID string, bindingID string, readOnly bool) BindResponse
+	Unbind(env voldriver.Env, instanceID string, bindingID string) voldriver.ErrorResponse
+	CreateSnapshot(env voldriver.Env, instanceID string, snapshotName string) voldriver.ErrorResponse
+	ListSnapshots(env voldriver.Env, instanceID string) SnapshotsResponse
+	DeleteSnapshot(env voldriver.Env, instanceID string, snapshotName string) voldriver.ErrorResponse
+	SharePath(env voldriver.Env, instanceID string) SharePathResponse
+	ShareUsage(env voldriver.Env, instanceID string) ShareUsageResponse
+	ListShares(env voldriver.Env) SharesResponse
+	QuarantineShare(env voldriver.Env, instanceID string) SharePathResponse
+	UnmountFileSystem(env voldriver.Env) voldriver.ErrorResponse
+	ForBackend(name string) (Controller, error)
 }
 
 type controller struct {
 	cephClient Client
+	backends   map[string]Controller
 }
 
 func NewController(cephClient Client) Controller {
-	return &controller{cephClient: cephClient}
+	return NewBackendController(cephClient, nil)
+}
+
+// NewBackendController manages shares in the default backend through cephClient, and in each named backend through
+// its own client
+func NewBackendController(cephClient Client, backends map[string]Client) Controller {
+	p := &controller{cephClient: cephClient, backends: map[string]Controller{}}
+	for name, client := range backends {
+		p.backends[name] = &controller{cephClient: client}
+	}
+	return p
+}
+
+// ForBackend is the controller for the shares in a named backend, or in the default backend when the name is empty
+func (p *controller) ForBackend(name string) (Controller, error) {
+	if name == "" {
+		return p, nil
+	}
+	backend, ok := p.backends[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: '%s'", ErrBackendNotFound.Error(), name)
+	}
+	return backend, nil
 }
 
 func (p *controller) Create(env voldriver.Env, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
@@ -34,20 +99,49 @@ func (p *controller) Create(env voldriver.Env, createRequest voldriver.CreateReq
 	logger.Info("start")
 	defer logger.Info("end")
 
-	mounted := p.cephClient.IsFilesystemMounted(driverhttp.EnvWithLogger(logger,env))
-	if !mounted {
-		_, err := p.cephClient.MountFileSystem(driverhttp.EnvWithLogger(logger,env), "/")
-		if err != nil {
-			return voldriver.ErrorResponse{Err: err.Error()}
-		}
+	if err := p.ensureMounted(driverhttp.EnvWithLogger(logger, env)); err != nil {
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+	quota, hasQuota, err := evaluateQuota(createRequest.Opts)
+	if err != nil {
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+	ownership, err := evaluateOwnership(createRequest.Opts)
+	if err != nil {
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+
+	source, err := evaluateCloneSource(createRequest.Opts)
+	if err != nil {
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+
+	var mountpoint string
+	if source.Instance != "" {
+		mountpoint, err = p.cephClient.CloneShare(driverhttp.EnvWithLogger(logger, env), createRequest.Name, source.Instance, source.Snapshot)
+	} else {
+		mountpoint, err = p.cephClient.CreateShare(driverhttp.EnvWithLogger(logger,env), createRequest.Name)
 	}
-	mountpoint, err := p.cephClient.CreateShare(driverhttp.EnvWithLogger(logger,env), createRequest.Name)
 	if err != nil {
 		return voldriver.ErrorResponse{Err: err.Error()}
 	}
 
 	logger.Info("mountpoint-created", lager.Data{mountpoint: mountpoint})
 
+	if hasQuota {
+		err = p.cephClient.SetQuota(driverhttp.EnvWithLogger(logger, env), createRequest.Name, quota)
+		if err != nil {
+			return voldriver.ErrorResponse{Err: err.Error()}
+		}
+	}
+
+	if ownership.IsSet() {
+		err = p.cephClient.SetOwnership(driverhttp.EnvWithLogger(logger, env), createRequest.Name, ownership)
+		if err != nil {
+			return voldriver.ErrorResponse{Err: err.Error()}
+		}
+	}
+
 	return voldriver.ErrorResponse{}
 }
 
@@ -55,7 +149,25 @@ func (p *controller) Remove(env voldriver.Env, removeRequest voldriver.RemoveReq
 	logger := env.Logger().Session("remove")
 	logger.Info("start")
 	defer logger.Info("end")
-	err := p.cephClient.DeleteShare(driverhttp.EnvWithLogger(logger,env), removeRequest.Name)
+
+	if err := p.ensureMounted(driverhttp.EnvWithLogger(logger, env)); err != nil {
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+
+	// snapshots keep a share's data alive (and stop subvolumes from being removed), so they go first
+	snapshots, err := p.cephClient.ListSnapshots(driverhttp.EnvWithLogger(logger, env), removeRequest.Name)
+	if err != nil {
+		logger.Info("unable-to-list-snapshots", lager.Data{"error": err.Error()})
+	}
+	for _, snapshot := range snapshots {
+		err = p.cephClient.DeleteSnapshot(driverhttp.EnvWithLogger(logger, env), removeRequest.Name, snapshot)
+		if err != nil {
+			logger.Error("failed-to-delete-snapshot", err)
+			return voldriver.ErrorResponse{Err: err.Error()}
+		}
+	}
+
+	err = p.cephClient.DeleteShare(driverhttp.EnvWithLogger(logger,env), removeRequest.Name)
 	if err != nil {
 		logger.Error("Error deleting share", err)
 		return voldriver.ErrorResponse{Err: err.Error()}
@@ -63,7 +175,50 @@ func (p *controller) Remove(env voldriver.Env, removeRequest voldriver.RemoveReq
 	return voldriver.ErrorResponse{}
 }
 
-func (p *controller) Bind(env voldriver.Env, instanceID string) BindResponse {
+func (p *controller) Update(env voldriver.Env, updateRequest UpdateRequest) voldriver.ErrorResponse {
+	logger := env.Logger().Session("update")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if err := p.ensureMounted(driverhttp.EnvWithLogger(logger, env)); err != nil {
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+
+	_, _, err := p.cephClient.GetPathsForShare(driverhttp.EnvWithLogger(logger, env), updateRequest.Name)
+	if err != nil {
+		logger.Error("failed-getting-paths-for-share", err)
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+
+	quota, hasQuota, err := evaluateQuota(updateRequest.Opts)
+	if err != nil {
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+	ownership, err := evaluateOwnership(updateRequest.Opts)
+	if err != nil {
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+
+	if hasQuota {
+		err = p.cephClient.SetQuota(driverhttp.EnvWithLogger(logger, env), updateRequest.Name, quota)
+		if err != nil {
+			logger.Error("failed-to-apply-quota", err)
+			return voldriver.ErrorResponse{Err: err.Error()}
+		}
+	}
+
+	if ownership.IsSet() {
+		err = p.cephClient.SetOwnership(driverhttp.EnvWithLogger(logger, env), updateRequest.Name, ownership)
+		if err != nil {
+			logger.Error("failed-to-apply-ownership", err)
+			return voldriver.ErrorResponse{Err: err.Error()}
+		}
+	}
+
+	return voldriver.ErrorResponse{}
+}
+
+func (p *controller) Bind(env voldriver.Env, instanceID string, bindingID string, readOnly bool) BindResponse {
 	logger := env.Logger().Session("bind-service-instance")
 	logger.Info("start")
 	defer logger.Info("end")
@@ -76,24 +231,238 @@ func (p *controller) Bind(env voldriver.Env, instanceID string) BindResponse {
 		return response
 	}
 
-	mds, keyring, err := p.cephClient.GetConfigDetails(driverhttp.EnvWithLogger(logger,env))
+	mds, _, _, err := p.cephClient.GetConfigDetails(driverhttp.EnvWithLogger(logger,env))
 	if err != nil {
 		logger.Error("failed-to-determine-container-mountpath", err)
 		response.Err = err.Error()
 		return response
 	}
 
-	mdsParts := strings.Split(mds, ":")
+	monitors, err := ParseMonitors(mds)
+	if err != nil {
+		logger.Error("invalid-monitor-addresses", err)
+		response.Err = err.Error()
+		return response
+	}
+
+	clientName := bindingClientName(bindingID)
+	keyring, err := p.cephClient.CreateClientKey(driverhttp.EnvWithLogger(logger, env), clientName, remoteSharePath, readOnly)
+	if err != nil {
+		logger.Error("failed-to-create-client-key", err)
+		response.Err = err.Error()
+		return response
+	}
+
+	// cells are told to mount the same way as the broker.  "ip" is only the host of the first monitor, for drivers
+	// that predate the monitor list.
+	mount := p.cephClient.GetMountSettings(env)
+	mountConfig := map[string]interface{}{
+		"ip":                 MonitorHost(monitors[0]),
+		"monitors":           monitors,
+		"keyring":            keyring,
+		"client_name":        clientName,
+		"remote_mount_point": remoteSharePath,
+		"local_mount_point":  localMountPoint,
+		"mount_mode":         mount.Mode,
+	}
+	if mount.Options != "" {
+		mountConfig["mount_options"] = mount.Options
+	}
+	if mount.FSID != "" {
+		mountConfig["fsid"] = mount.FSID
+	}
+	if mount.FSName != "" {
+		mountConfig["fs_name"] = mount.FSName
+	}
 
 	return BindResponse{
 		SharedDevice: brokerapi.SharedDevice{
-			VolumeId: instanceID,
-			MountConfig: map[string]interface{}{
-				"ip":                 mdsParts[0],
-				"keyring":            keyring,
-				"remote_mount_point": remoteSharePath,
-				"local_mount_point":  localMountPoint,
-			},
+			VolumeId:    instanceID,
+			MountConfig: mountConfig,
 		},
 	}
 }
+
+func (p *controller) Unbind(env voldriver.Env, instanceID string, bindingID string) voldriver.ErrorResponse {
+	logger := env.Logger().Session("unbind-service-instance", lager.Data{"instanceID": instanceID, "bindingID": bindingID})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	err := p.cephClient.DeleteClientKey(driverhttp.EnvWithLogger(logger, env), bindingClientName(bindingID))
+	if err != nil {
+		logger.Error("failed-to-delete-client-key", err)
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+	return voldriver.ErrorResponse{}
+}
+
+func (p *controller) CreateSnapshot(env voldriver.Env, instanceID string, snapshotName string) voldriver.ErrorResponse {
+	logger := env.Logger().Session("create-snapshot", lager.Data{"instanceID": instanceID, "snapshotName": snapshotName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if err := p.ensureMounted(driverhttp.EnvWithLogger(logger, env)); err != nil {
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+
+	err := p.cephClient.CreateSnapshot(driverhttp.EnvWithLogger(logger, env), instanceID, snapshotName)
+	if err != nil {
+		logger.Error("failed-to-create-snapshot", err)
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+	return voldriver.ErrorResponse{}
+}
+
+func (p *controller) ListSnapshots(env voldriver.Env, instanceID string) SnapshotsResponse {
+	logger := env.Logger().Session("list-snapshots", lager.Data{"instanceID": instanceID})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if err := p.ensureMounted(driverhttp.EnvWithLogger(logger, env)); err != nil {
+		return SnapshotsResponse{ErrorResponse: voldriver.ErrorResponse{Err: err.Error()}}
+	}
+
+	snapshots, err := p.cephClient.ListSnapshots(driverhttp.EnvWithLogger(logger, env), instanceID)
+	if err != nil {
+		logger.Error("failed-to-list-snapshots", err)
+		return SnapshotsResponse{ErrorResponse: voldriver.ErrorResponse{Err: err.Error()}}
+	}
+	return SnapshotsResponse{Snapshots: snapshots}
+}
+
+func (p *controller) DeleteSnapshot(env voldriver.Env, instanceID string, snapshotName string) voldriver.ErrorResponse {
+	logger := env.Logger().Session("delete-snapshot", lager.Data{"instanceID": instanceID, "snapshotName": snapshotName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if err := p.ensureMounted(driverhttp.EnvWithLogger(logger, env)); err != nil {
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+
+	err := p.cephClient.DeleteSnapshot(driverhttp.EnvWithLogger(logger, env), instanceID, snapshotName)
+	if err != nil {
+		logger.Error("failed-to-delete-snapshot", err)
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+	return voldriver.ErrorResponse{}
+}
+
+func (p *controller) SharePath(env voldriver.Env, instanceID string) SharePathResponse {
+	logger := env.Logger().Session("share-path", lager.Data{"instanceID": instanceID})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if err := p.ensureMounted(driverhttp.EnvWithLogger(logger, env)); err != nil {
+		return SharePathResponse{ErrorResponse: voldriver.ErrorResponse{Err: err.Error()}}
+	}
+
+	remoteSharePath, _, err := p.cephClient.GetPathsForShare(driverhttp.EnvWithLogger(logger, env), instanceID)
+	if err != nil {
+		logger.Error("failed-getting-paths-for-share", err)
+		return SharePathResponse{ErrorResponse: voldriver.ErrorResponse{Err: err.Error()}}
+	}
+	return SharePathResponse{Path: remoteSharePath}
+}
+
+// ShareUsage reports the quota of an instance's share, and how much of it is in use
+func (p *controller) ShareUsage(env voldriver.Env, instanceID string) ShareUsageResponse {
+	logger := env.Logger().Session("share-usage", lager.Data{"instanceID": instanceID})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if err := p.ensureMounted(driverhttp.EnvWithLogger(logger, env)); err != nil {
+		return ShareUsageResponse{ErrorResponse: voldriver.ErrorResponse{Err: err.Error()}}
+	}
+
+	quota, err := p.cephClient.GetQuota(driverhttp.EnvWithLogger(logger, env), instanceID)
+	if err != nil {
+		logger.Error("failed-to-get-quota", err)
+		return ShareUsageResponse{ErrorResponse: voldriver.ErrorResponse{Err: err.Error()}}
+	}
+	usage, err := p.cephClient.GetUsage(driverhttp.EnvWithLogger(logger, env), instanceID)
+	if err != nil {
+		logger.Error("failed-to-get-usage", err)
+		return ShareUsageResponse{ErrorResponse: voldriver.ErrorResponse{Err: err.Error()}}
+	}
+	return ShareUsageResponse{Quota: quota, Usage: usage}
+}
+
+// ListShares lists the shares in the filesystem, which are named after the instances they were created for
+func (p *controller) ListShares(env voldriver.Env) SharesResponse {
+	logger := env.Logger().Session("list-shares")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if err := p.ensureMounted(driverhttp.EnvWithLogger(logger, env)); err != nil {
+		return SharesResponse{ErrorResponse: voldriver.ErrorResponse{Err: err.Error()}}
+	}
+
+	shares, err := p.cephClient.ListShares(driverhttp.EnvWithLogger(logger, env))
+	if err != nil {
+		logger.Error("failed-to-list-shares", err)
+		return SharesResponse{ErrorResponse: voldriver.ErrorResponse{Err: err.Error()}}
+	}
+	return SharesResponse{Shares: shares}
+}
+
+// QuarantineShare moves the share of an instance the broker does not know about out of the way, and returns where it went
+func (p *controller) QuarantineShare(env voldriver.Env, instanceID string) SharePathResponse {
+	logger := env.Logger().Session("quarantine-share", lager.Data{"instanceID": instanceID})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if err := p.ensureMounted(driverhttp.EnvWithLogger(logger, env)); err != nil {
+		return SharePathResponse{ErrorResponse: voldriver.ErrorResponse{Err: err.Error()}}
+	}
+
+	path, err := p.cephClient.QuarantineShare(driverhttp.EnvWithLogger(logger, env), instanceID)
+	if err != nil {
+		logger.Error("failed-to-quarantine-share", err)
+		return SharePathResponse{ErrorResponse: voldriver.ErrorResponse{Err: err.Error()}}
+	}
+	return SharePathResponse{Path: path}
+}
+
+// UnmountFileSystem unmounts the filesystem of every backend, stale or not, if it is mounted.  A backend that fails to
+// unmount does not stop the others from being unmounted.
+func (p *controller) UnmountFileSystem(env voldriver.Env) voldriver.ErrorResponse {
+	logger := env.Logger().Session("unmount-filesystem")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	failures := []string{}
+	if err := p.cephClient.UnmountFileSystem(env); err != nil {
+		logger.Error("failed-to-unmount-filesystem", err)
+		failures = append(failures, err.Error())
+	}
+
+	names := []string{}
+	for name := range p.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		response := p.backends[name].UnmountFileSystem(driverhttp.EnvWithLogger(logger.Session("backend", lager.Data{"backend": name}), env))
+		if response.Err != "" {
+			failures = append(failures, fmt.Sprintf("backend '%s': %s", name, response.Err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return voldriver.ErrorResponse{Err: strings.Join(failures, "; ")}
+	}
+	return voldriver.ErrorResponse{}
+}
+
+func (p *controller) ensureMounted(env voldriver.Env) error {
+	if p.cephClient.IsFilesystemMounted(env) {
+		return nil
+	}
+	_, err := p.cephClient.MountFileSystem(env, "/")
+	return err
+}
+
+// bindingClientName is the cephx client (without the "client." prefix) that holds the credentials of a binding
+func bindingClientName(bindingID string) string {
+	return "cephbroker-" + bindingID
+}
@@ -2,9 +2,12 @@ package cephbroker_test
 
 import (
 	"encoding/json"
+	"errors"
 
 	"code.cloudfoundry.org/cephbroker/cephbroker"
 	"code.cloudfoundry.org/cephbroker/cephfakes"
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/lager/lagertest"
 	"code.cloudfoundry.org/voldriver"
@@ -12,6 +15,7 @@ import (
 	. "github.com/onsi/gomega"
 	"context"
 	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
 )
 
 var Controller = Describe("Controller", func() {
@@ -36,6 +40,78 @@ var Controller = Describe("Controller", func() {
 				Name: "InstanceID",
 			})
 			Expect(resp.Err).To(Equal(""))
+			Expect(fakeClient.(*cephfakes.FakeClient).SetQuotaCallCount()).To(Equal(0))
+		})
+		It("should apply the requested quota", func() {
+			resp := subject.Create(env, voldriver.CreateRequest{
+				Name: "InstanceID",
+				Opts: map[string]interface{}{"quota": "10G"},
+			})
+			Expect(resp.Err).To(Equal(""))
+			_, share, quota := fakeClient.(*cephfakes.FakeClient).SetQuotaArgsForCall(0)
+			Expect(share).To(Equal("InstanceID"))
+			Expect(quota).To(Equal(cephbroker.Quota{MaxBytes: 10 * 1024 * 1024 * 1024}))
+		})
+		It("should clone the source instance when one is given", func() {
+			resp := subject.Create(env, voldriver.CreateRequest{
+				Name: "InstanceID",
+				Opts: map[string]interface{}{"source_instance": "SourceID", "snapshot": "snap1"},
+			})
+			Expect(resp.Err).To(Equal(""))
+			Expect(fakeClient.(*cephfakes.FakeClient).CreateShareCallCount()).To(Equal(0))
+			_, share, source, snapshot := fakeClient.(*cephfakes.FakeClient).CloneShareArgsForCall(0)
+			Expect(share).To(Equal("InstanceID"))
+			Expect(source).To(Equal("SourceID"))
+			Expect(snapshot).To(Equal("snap1"))
+		})
+		It("should error when the clone fails", func() {
+			fakeClient.(*cephfakes.FakeClient).CloneShareReturns("", errors.New("badness"))
+			resp := subject.Create(env, voldriver.CreateRequest{
+				Name: "InstanceID",
+				Opts: map[string]interface{}{"source_instance": "SourceID"},
+			})
+			Expect(resp.Err).To(Equal("badness"))
+		})
+		It("should error when the quota cannot be applied", func() {
+			fakeClient.(*cephfakes.FakeClient).SetQuotaReturns(errors.New("badness"))
+			resp := subject.Create(env, voldriver.CreateRequest{
+				Name: "InstanceID",
+				Opts: map[string]interface{}{"quota": map[string]interface{}{"max_files": float64(100)}},
+			})
+			Expect(resp.Err).To(Equal("badness"))
+		})
+		It("should apply the requested owner and mode once the share exists", func() {
+			resp := subject.Create(env, voldriver.CreateRequest{
+				Name: "InstanceID",
+				Opts: map[string]interface{}{"uid": float64(1000), "gid": "2000", "mode": "0770"},
+			})
+			Expect(resp.Err).To(Equal(""))
+			Expect(fakeClient.(*cephfakes.FakeClient).CreateShareCallCount()).To(Equal(1))
+			_, share, ownership := fakeClient.(*cephfakes.FakeClient).SetOwnershipArgsForCall(0)
+			Expect(share).To(Equal("InstanceID"))
+			Expect(*ownership.UID).To(Equal(uint32(1000)))
+			Expect(*ownership.GID).To(Equal(uint32(2000)))
+			Expect(*ownership.Mode).To(Equal(uint32(0770)))
+		})
+		It("should leave the owner and mode alone when none are requested", func() {
+			resp := subject.Create(env, voldriver.CreateRequest{Name: "InstanceID"})
+			Expect(resp.Err).To(Equal(""))
+			Expect(fakeClient.(*cephfakes.FakeClient).SetOwnershipCallCount()).To(Equal(0))
+		})
+		It("should error, without creating the share, when the owner or mode is invalid", func() {
+			for _, opts := range []map[string]interface{}{{"uid": float64(-1)}, {"gid": "staff"}, {"mode": float64(770)}, {"mode": "0789"}, {"mode": "17777"}} {
+				resp := subject.Create(env, voldriver.CreateRequest{Name: "InstanceID", Opts: opts})
+				Expect(resp.Err).To(Equal(cephbroker.ErrInvalidOwnership.Error()))
+			}
+			Expect(fakeClient.(*cephfakes.FakeClient).CreateShareCallCount()).To(Equal(0))
+		})
+		It("should error when the owner or mode cannot be applied", func() {
+			fakeClient.(*cephfakes.FakeClient).SetOwnershipReturns(errors.New("badness"))
+			resp := subject.Create(env, voldriver.CreateRequest{
+				Name: "InstanceID",
+				Opts: map[string]interface{}{"mode": "0700"},
+			})
+			Expect(resp.Err).To(Equal("badness"))
 		})
 	})
 	Context(".Remove", func() {
@@ -43,15 +119,311 @@ var Controller = Describe("Controller", func() {
 			resp := subject.Remove(env, voldriver.RemoveRequest{Name: "InstanceId"})
 			Expect(resp.Err).To(Equal(""))
 		})
+		It("should delete the share's snapshots first", func() {
+			fakeClient.(*cephfakes.FakeClient).ListSnapshotsReturns([]string{"snap1", "snap2"}, nil)
+			resp := subject.Remove(env, voldriver.RemoveRequest{Name: "InstanceId"})
+			Expect(resp.Err).To(Equal(""))
+			Expect(fakeClient.(*cephfakes.FakeClient).DeleteSnapshotCallCount()).To(Equal(2))
+			_, share, snapshot := fakeClient.(*cephfakes.FakeClient).DeleteSnapshotArgsForCall(1)
+			Expect(share).To(Equal("InstanceId"))
+			Expect(snapshot).To(Equal("snap2"))
+			Expect(fakeClient.(*cephfakes.FakeClient).DeleteShareCallCount()).To(Equal(1))
+		})
+		It("should keep the share when a snapshot cannot be deleted", func() {
+			fakeClient.(*cephfakes.FakeClient).ListSnapshotsReturns([]string{"snap1"}, nil)
+			fakeClient.(*cephfakes.FakeClient).DeleteSnapshotReturns(errors.New("badness"))
+			resp := subject.Remove(env, voldriver.RemoveRequest{Name: "InstanceId"})
+			Expect(resp.Err).To(Equal("badness"))
+			Expect(fakeClient.(*cephfakes.FakeClient).DeleteShareCallCount()).To(Equal(0))
+		})
+	})
+	Context(".Update", func() {
+		It("should be able to update mount", func() {
+			resp := subject.Update(env, cephbroker.UpdateRequest{Name: "InstanceId"})
+			Expect(resp.Err).To(Equal(""))
+		})
+		It("should re-apply the quota", func() {
+			resp := subject.Update(env, cephbroker.UpdateRequest{Name: "InstanceId", Opts: map[string]interface{}{"quota": float64(1024)}})
+			Expect(resp.Err).To(Equal(""))
+			_, _, quota := fakeClient.(*cephfakes.FakeClient).SetQuotaArgsForCall(0)
+			Expect(quota).To(Equal(cephbroker.Quota{MaxBytes: 1024}))
+		})
+		It("should clear the quota when it is set to null", func() {
+			resp := subject.Update(env, cephbroker.UpdateRequest{Name: "InstanceId", Opts: map[string]interface{}{"quota": nil}})
+			Expect(resp.Err).To(Equal(""))
+			_, _, quota := fakeClient.(*cephfakes.FakeClient).SetQuotaArgsForCall(0)
+			Expect(quota).To(Equal(cephbroker.Quota{}))
+		})
+		It("should re-apply the owner and mode", func() {
+			resp := subject.Update(env, cephbroker.UpdateRequest{Name: "InstanceId", Opts: map[string]interface{}{"gid": float64(2000)}})
+			Expect(resp.Err).To(Equal(""))
+			_, _, ownership := fakeClient.(*cephfakes.FakeClient).SetOwnershipArgsForCall(0)
+			Expect(ownership.UID).To(BeNil())
+			Expect(*ownership.GID).To(Equal(uint32(2000)))
+		})
+		It("should error when the share cannot be found", func() {
+			fakeClient.(*cephfakes.FakeClient).GetPathsForShareReturns("", "", cephbroker.ShareNotFound)
+			resp := subject.Update(env, cephbroker.UpdateRequest{Name: "InstanceId"})
+			Expect(resp.Err).To(Equal(cephbroker.ShareNotFound.Error()))
+		})
 	})
 	Context(".Bind", func() {
+		BeforeEach(func() {
+			fakeClient.(*cephfakes.FakeClient).GetConfigDetailsReturns("10.0.0.1:6789", "admin", "admin-keyring", nil)
+		})
 		It("should be able to bind", func() {
-			resp := subject.Bind(env, "InstanceId")
+			resp := subject.Bind(env, "InstanceId", "BindingId", false)
 			Expect(resp.Err).To(Equal(""))
 			Expect(json.Marshal(resp)).To(ContainSubstring(
 				"{\"Err\":\"\",\"SharedDevice\":{\"volume_id\":\"InstanceId\",\"mount_config\":" +
-					"{\"ip\":\"\",\"keyring\":\"\",\"local_mount_point\":\"\",\"remote_mount_point\":\"\"}}}",
+					"{\"client_name\":\"cephbroker-BindingId\",\"ip\":\"10.0.0.1\",\"keyring\":\"\",\"local_mount_point\":\"\",\"monitors\":[\"10.0.0.1:6789\"],\"mount_mode\":\"\",\"remote_mount_point\":\"\"}}}",
 			))
 		})
+		It("should hand out a key restricted to the share instead of the admin keyring", func() {
+			fakeClient.(*cephfakes.FakeClient).GetPathsForShareReturns("/remote/InstanceId", "/local/InstanceId", nil)
+			fakeClient.(*cephfakes.FakeClient).CreateClientKeyReturns("binding-keyring", nil)
+
+			resp := subject.Bind(env, "InstanceId", "BindingId", true)
+			Expect(resp.Err).To(Equal(""))
+			Expect(resp.SharedDevice.MountConfig["keyring"]).To(Equal("binding-keyring"))
+
+			_, clientName, sharePath, readOnly := fakeClient.(*cephfakes.FakeClient).CreateClientKeyArgsForCall(0)
+			Expect(clientName).To(Equal("cephbroker-BindingId"))
+			Expect(sharePath).To(Equal("/remote/InstanceId"))
+			Expect(readOnly).To(BeTrue())
+		})
+		It("should tell the cells to mount the way the broker does", func() {
+			fakeClient.(*cephfakes.FakeClient).GetMountSettingsReturns(cephbroker.MountSettings{Mode: cephbroker.MountModeKernel, Options: "noatime"})
+			resp := subject.Bind(env, "InstanceId", "BindingId", false)
+			Expect(resp.Err).To(Equal(""))
+			Expect(resp.SharedDevice.MountConfig["mount_mode"]).To(Equal("kernel"))
+			Expect(resp.SharedDevice.MountConfig["mount_options"]).To(Equal("noatime"))
+			Expect(resp.SharedDevice.MountConfig).NotTo(HaveKey("fsid"))
+		})
+		It("should tell the cells the cluster's fsid when it is known", func() {
+			fakeClient.(*cephfakes.FakeClient).GetMountSettingsReturns(cephbroker.MountSettings{Mode: cephbroker.MountModeFuse, FSID: "cluster-fsid"})
+			resp := subject.Bind(env, "InstanceId", "BindingId", false)
+			Expect(resp.Err).To(Equal(""))
+			Expect(resp.SharedDevice.MountConfig["fsid"]).To(Equal("cluster-fsid"))
+		})
+		It("should tell the cells which file system to mount when it is not the default one", func() {
+			fakeClient.(*cephfakes.FakeClient).GetMountSettingsReturns(cephbroker.MountSettings{Mode: cephbroker.MountModeFuse, FSName: "archive"})
+			resp := subject.Bind(env, "InstanceId", "BindingId", false)
+			Expect(resp.Err).To(Equal(""))
+			Expect(resp.SharedDevice.MountConfig["fs_name"]).To(Equal("archive"))
+		})
+		It("should publish every monitor, with its port", func() {
+			fakeClient.(*cephfakes.FakeClient).GetConfigDetailsReturns("10.0.0.1:6789,10.0.0.2:3300,[2001:db8::3]:6789", "admin", "admin-keyring", nil)
+			resp := subject.Bind(env, "InstanceId", "BindingId", false)
+			Expect(resp.Err).To(Equal(""))
+			Expect(resp.SharedDevice.MountConfig["ip"]).To(Equal("10.0.0.1"))
+			Expect(resp.SharedDevice.MountConfig["monitors"]).To(Equal([]string{"10.0.0.1:6789", "10.0.0.2:3300", "[2001:db8::3]:6789"}))
+		})
+		It("should give the host of an IPv6 monitor without brackets", func() {
+			fakeClient.(*cephfakes.FakeClient).GetConfigDetailsReturns("[2001:db8::1]:6789", "admin", "admin-keyring", nil)
+			resp := subject.Bind(env, "InstanceId", "BindingId", false)
+			Expect(resp.Err).To(Equal(""))
+			Expect(resp.SharedDevice.MountConfig["ip"]).To(Equal("2001:db8::1"))
+		})
+		It("should error, without creating a key, when the monitor addresses are invalid", func() {
+			fakeClient.(*cephfakes.FakeClient).GetConfigDetailsReturns("10.0.0.1:notaport", "admin", "admin-keyring", nil)
+			resp := subject.Bind(env, "InstanceId", "BindingId", false)
+			Expect(resp.Err).To(ContainSubstring("invalid port"))
+			Expect(fakeClient.(*cephfakes.FakeClient).CreateClientKeyCallCount()).To(Equal(0))
+		})
+		It("should error when the key cannot be created", func() {
+			fakeClient.(*cephfakes.FakeClient).CreateClientKeyReturns("", errors.New("badness"))
+			resp := subject.Bind(env, "InstanceId", "BindingId", false)
+			Expect(resp.Err).To(Equal("badness"))
+		})
+	})
+	Context(".Unbind", func() {
+		It("should revoke the binding's key", func() {
+			resp := subject.Unbind(env, "InstanceId", "BindingId")
+			Expect(resp.Err).To(Equal(""))
+			_, clientName := fakeClient.(*cephfakes.FakeClient).DeleteClientKeyArgsForCall(0)
+			Expect(clientName).To(Equal("cephbroker-BindingId"))
+		})
+		It("should error when the key cannot be revoked", func() {
+			fakeClient.(*cephfakes.FakeClient).DeleteClientKeyReturns(errors.New("badness"))
+			resp := subject.Unbind(env, "InstanceId", "BindingId")
+			Expect(resp.Err).To(Equal("badness"))
+		})
+	})
+	Context(".CreateSnapshot", func() {
+		It("should snapshot the share", func() {
+			resp := subject.CreateSnapshot(env, "InstanceId", "snap1")
+			Expect(resp.Err).To(Equal(""))
+			_, share, snapshot := fakeClient.(*cephfakes.FakeClient).CreateSnapshotArgsForCall(0)
+			Expect(share).To(Equal("InstanceId"))
+			Expect(snapshot).To(Equal("snap1"))
+		})
+		It("should error when the snapshot cannot be created", func() {
+			fakeClient.(*cephfakes.FakeClient).CreateSnapshotReturns(errors.New("badness"))
+			resp := subject.CreateSnapshot(env, "InstanceId", "snap1")
+			Expect(resp.Err).To(Equal("badness"))
+		})
+	})
+	Context(".ListSnapshots", func() {
+		It("should list the share's snapshots", func() {
+			fakeClient.(*cephfakes.FakeClient).ListSnapshotsReturns([]string{"snap1"}, nil)
+			resp := subject.ListSnapshots(env, "InstanceId")
+			Expect(resp.Err).To(Equal(""))
+			Expect(resp.Snapshots).To(Equal([]string{"snap1"}))
+		})
+	})
+	Context(".DeleteSnapshot", func() {
+		It("should delete the snapshot", func() {
+			resp := subject.DeleteSnapshot(env, "InstanceId", "snap1")
+			Expect(resp.Err).To(Equal(""))
+			_, share, snapshot := fakeClient.(*cephfakes.FakeClient).DeleteSnapshotArgsForCall(0)
+			Expect(share).To(Equal("InstanceId"))
+			Expect(snapshot).To(Equal("snap1"))
+		})
+	})
+	Context(".SharePath", func() {
+		It("should report the share's remote path", func() {
+			fakeClient.(*cephfakes.FakeClient).GetPathsForShareReturns("/volumes/InstanceId", "/local/InstanceId", nil)
+			resp := subject.SharePath(env, "InstanceId")
+			Expect(resp.Err).To(Equal(""))
+			Expect(resp.Path).To(Equal("/volumes/InstanceId"))
+		})
+		It("should error when the share cannot be found", func() {
+			fakeClient.(*cephfakes.FakeClient).GetPathsForShareReturns("", "", errors.New("not found"))
+			resp := subject.SharePath(env, "InstanceId")
+			Expect(resp.Err).To(Equal("not found"))
+		})
+	})
+	Context(".ShareUsage", func() {
+		It("should report the share's quota and usage", func() {
+			fakeClient.(*cephfakes.FakeClient).GetQuotaReturns(cephbroker.Quota{MaxBytes: 1024}, nil)
+			fakeClient.(*cephfakes.FakeClient).GetUsageReturns(cephbroker.Usage{Bytes: 512, Files: 2}, nil)
+			resp := subject.ShareUsage(env, "InstanceId")
+			Expect(resp.Err).To(Equal(""))
+			Expect(resp.Quota).To(Equal(cephbroker.Quota{MaxBytes: 1024}))
+			Expect(resp.Usage).To(Equal(cephbroker.Usage{Bytes: 512, Files: 2}))
+		})
+		It("should error when the usage cannot be read", func() {
+			fakeClient.(*cephfakes.FakeClient).GetUsageReturns(cephbroker.Usage{}, errors.New("badness"))
+			resp := subject.ShareUsage(env, "InstanceId")
+			Expect(resp.Err).To(Equal("badness"))
+		})
+	})
+	Context(".UnmountFileSystem", func() {
+		It("should unmount the filesystem, even when it is stale", func() {
+			resp := subject.UnmountFileSystem(env)
+			Expect(resp.Err).To(Equal(""))
+			Expect(fakeClient.(*cephfakes.FakeClient).UnmountFileSystemCallCount()).To(Equal(1))
+		})
+		It("should error when the filesystem cannot be unmounted", func() {
+			fakeClient.(*cephfakes.FakeClient).UnmountFileSystemReturns(errors.New("badness"))
+			resp := subject.UnmountFileSystem(env)
+			Expect(resp.Err).To(Equal("badness"))
+		})
+	})
+	Context("with backends", func() {
+		var backendClient *cephfakes.FakeClient
+
+		BeforeEach(func() {
+			backendClient = &cephfakes.FakeClient{}
+			subject = cephbroker.NewBackendController(fakeClient, map[string]cephbroker.Client{"archive": backendClient})
+		})
+		It("should manage the shares of the default backend itself", func() {
+			controller, err := subject.ForBackend("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(controller).To(BeIdenticalTo(subject))
+		})
+		It("should manage the shares of a named backend through its client", func() {
+			controller, err := subject.ForBackend("archive")
+			Expect(err).NotTo(HaveOccurred())
+			resp := controller.Create(env, voldriver.CreateRequest{Name: "InstanceID"})
+			Expect(resp.Err).To(Equal(""))
+			Expect(backendClient.CreateShareCallCount()).To(Equal(1))
+			Expect(fakeClient.(*cephfakes.FakeClient).CreateShareCallCount()).To(Equal(0))
+		})
+		It("should error on a backend it does not have", func() {
+			_, err := subject.ForBackend("missing")
+			Expect(err).To(MatchError("backend not found: 'missing'"))
+		})
+		It("should unmount every backend, reporting each one that fails", func() {
+			backendClient.UnmountFileSystemReturns(errors.New("badness"))
+			resp := subject.UnmountFileSystem(env)
+			Expect(resp.Err).To(Equal("backend 'archive': badness"))
+			Expect(fakeClient.(*cephfakes.FakeClient).UnmountFileSystemCallCount()).To(Equal(1))
+			Expect(backendClient.UnmountFileSystemCallCount()).To(Equal(1))
+		})
+	})
+	Context("ensuring the filesystem is mounted", func() {
+		It("should mount the filesystem again when it is not mounted, or stale", func() {
+			fakeClient.(*cephfakes.FakeClient).IsFilesystemMountedReturns(false)
+			resp := subject.ListShares(env)
+			Expect(resp.Err).To(Equal(""))
+			Expect(fakeClient.(*cephfakes.FakeClient).MountFileSystemCallCount()).To(Equal(1))
+		})
+		It("should not mount a filesystem that is mounted", func() {
+			fakeClient.(*cephfakes.FakeClient).IsFilesystemMountedReturns(true)
+			resp := subject.ListShares(env)
+			Expect(resp.Err).To(Equal(""))
+			Expect(fakeClient.(*cephfakes.FakeClient).MountFileSystemCallCount()).To(Equal(0))
+		})
+	})
+	Context(".ListShares", func() {
+		It("should list the shares", func() {
+			fakeClient.(*cephfakes.FakeClient).ListSharesReturns([]string{"InstanceId"}, nil)
+			resp := subject.ListShares(env)
+			Expect(resp.Err).To(Equal(""))
+			Expect(resp.Shares).To(Equal([]string{"InstanceId"}))
+		})
+		It("should error when the shares cannot be listed", func() {
+			fakeClient.(*cephfakes.FakeClient).ListSharesReturns(nil, errors.New("badness"))
+			resp := subject.ListShares(env)
+			Expect(resp.Err).To(Equal("badness"))
+		})
+	})
+	Context(".QuarantineShare", func() {
+		It("should report where the share went", func() {
+			fakeClient.(*cephfakes.FakeClient).QuarantineShareReturns("/quarantine/InstanceId", nil)
+			resp := subject.QuarantineShare(env, "InstanceId")
+			Expect(resp.Err).To(Equal(""))
+			Expect(resp.Path).To(Equal("/quarantine/InstanceId"))
+			_, name := fakeClient.(*cephfakes.FakeClient).QuarantineShareArgsForCall(0)
+			Expect(name).To(Equal("InstanceId"))
+		})
+		It("should error when the share cannot be moved", func() {
+			fakeClient.(*cephfakes.FakeClient).QuarantineShareReturns("", errors.New("badness"))
+			resp := subject.QuarantineShare(env, "InstanceId")
+			Expect(resp.Err).To(Equal("badness"))
+		})
+	})
+	Context("with a backend rooted below the top of the file system", func() {
+		var fakeInvoker *voldriverfakes.FakeInvoker
+
+		BeforeEach(func() {
+			fakeInvoker = &voldriverfakes.FakeInvoker{}
+			fakeInvoker.InvokeStub = func(_ voldriver.Env, cmd string, args []string) ([]byte, error) {
+				if cmd == "ceph" && args[4] == "fs" {
+					return []byte(`[{"name":"cephfs","metadata_pool":"cephfs_metadata","data_pools":["cephfs_data"]}]`), nil
+				}
+				return []byte("[client.cephbroker-binding]\n\tkey = secret\n"), nil
+			}
+			client := cephbroker.NewCephClientWithInvokerAndSystemUtil("mds", fakeInvoker, &os_fake.FakeOs{}, &ioutil_fake.FakeIoutil{}, "localMountPoint", cephbroker.Credentials{Keyring: "keyringFile"}, "/volumes", cephbroker.MountSettings{})
+			subject = cephbroker.NewController(client)
+		})
+
+		It("should create shares in the root path, and bind to them there", func() {
+			resp := subject.Create(env, voldriver.CreateRequest{Name: "InstanceID"})
+			Expect(resp.Err).To(Equal(""))
+
+			_, cmd, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(cmd).To(Equal("ceph-fuse"))
+			Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "-r", "/volumes", "localMountPoint"}))
+
+			bindResp := subject.Bind(env, "InstanceID", "binding", false)
+			Expect(bindResp.Err).To(Equal(""))
+			Expect(bindResp.SharedDevice.MountConfig["remote_mount_point"]).To(Equal("/volumes/InstanceID"))
+
+			_, _, args = fakeInvoker.InvokeArgsForCall(fakeInvoker.InvokeCallCount() - 1)
+			Expect(args).To(ContainElement("allow rw path=/volumes/InstanceID"))
+		})
 	})
 })
@@ -0,0 +1,239 @@
+package cephbroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager"
+)
+
+// StateFileGenerations is how many previous versions of the state file are kept next to it, as <file>.1 (newest)
+// through <file>.N (oldest)
+const StateFileGenerations = 3
+
+const (
+	stateFileMode     os.FileMode = 0600
+	stateFileSyncFlag             = os.O_RDONLY
+
+	stateFileVersionKey = "version"
+
+	quarantineTimeFormat = "20060102T150405Z"
+)
+
+// legacyStateFileKeys are the names unversioned state files gave each table
+var legacyStateFileKeys = map[string]string{
+	instancesTable:  "InstanceMap",
+	bindingsTable:   "BindingMap",
+	operationsTable: "OperationMap",
+	snapshotsTable:  "SnapshotMap",
+}
+
+type fileStore struct {
+	stateFile string
+	os        osshim.Os
+	ioutil    ioutilshim.Ioutil
+}
+
+// NewFileStore keeps the broker's state in a single JSON file
+func NewFileStore(stateFile string, os osshim.Os, ioutil ioutilshim.Ioutil) Store {
+	return &fileStore{stateFile: stateFile, os: os, ioutil: ioutil}
+}
+
+func (s *fileStore) Restore(logger lager.Logger) (State, error) {
+	logger = logger.Session("file-store-restore", lager.Data{"state-file": s.stateFile})
+
+	stateData, stateFile, err := readStateFile(s.os, s.ioutil, s.stateFile)
+	if err != nil {
+		if s.os.IsNotExist(err) {
+			logger.Info("no-saved-state")
+			return NewState(), nil
+		}
+		return State{}, fmt.Errorf("failed to read state file '%s': %s", stateFile, err.Error())
+	}
+
+	version, records, err := parseStateFile(stateData)
+	if err != nil {
+		return State{}, fmt.Errorf("failed to parse state file '%s': %s", stateFile, err.Error())
+	}
+	state, err := recordsToState(version, records)
+	if err != nil {
+		return State{}, err
+	}
+
+	logger.Info("state-read", lager.Data{"read-from": stateFile, "version": version})
+	return state, nil
+}
+
+func (s *fileStore) Save(logger lager.Logger, state State) error {
+	stateData, err := marshalStateFile(state)
+	if err != nil {
+		return err
+	}
+
+	if err := writeStateFile(s.os, s.ioutil, s.stateFile, stateData); err != nil {
+		return err
+	}
+
+	logger.Info("state-saved", lager.Data{"state-file": s.stateFile})
+	return nil
+}
+
+func (s *fileStore) Close() error {
+	return nil
+}
+
+// Quarantine renames the state file that Restore reads to <file>.corrupt-<time>, where the next save cannot touch it
+func (s *fileStore) Quarantine(logger lager.Logger) (string, error) {
+	_, stateFile, err := readStateFile(s.os, s.ioutil, s.stateFile)
+	if err != nil && s.os.IsNotExist(err) {
+		return "", fmt.Errorf("no state file to quarantine")
+	}
+
+	quarantined := fmt.Sprintf("%s.corrupt-%s", stateFile, time.Now().UTC().Format(quarantineTimeFormat))
+	if err := s.os.Rename(stateFile, quarantined); err != nil {
+		return "", fmt.Errorf("failed to quarantine state file '%s': %s", stateFile, err.Error())
+	}
+
+	logger.Info("state-file-quarantined", lager.Data{"state-file": stateFile, "quarantined-to": quarantined})
+	return quarantined, nil
+}
+
+// parseStateFile splits a state file into records.  A state file is a JSON object with the format version and an object
+// of records for each table; unversioned files are a dump of the State of older brokers.
+func parseStateFile(stateData []byte) (int, stateRecords, error) {
+	document := map[string]json.RawMessage{}
+	if err := json.Unmarshal(stateData, &document); err != nil {
+		return 0, nil, err
+	}
+
+	version := legacyStateVersion
+	keys := legacyStateFileKeys
+	if versionData, ok := document[stateFileVersionKey]; ok {
+		if err := json.Unmarshal(versionData, &version); err != nil {
+			return 0, nil, fmt.Errorf("invalid version: %s", err.Error())
+		}
+		keys = map[string]string{}
+		for _, table := range stateTables {
+			keys[table] = table
+		}
+	}
+
+	records := newStateRecords()
+	for _, table := range stateTables {
+		tableData, ok := document[keys[table]]
+		if !ok || string(tableData) == "null" {
+			continue
+		}
+		values := map[string]json.RawMessage{}
+		if err := json.Unmarshal(tableData, &values); err != nil {
+			return 0, nil, fmt.Errorf("invalid %s: %s", table, err.Error())
+		}
+		for id, value := range values {
+			records[table][id] = value
+		}
+	}
+	return version, records, nil
+}
+
+// marshalStateFile encodes state as a state file of the current StateVersion
+func marshalStateFile(state State) ([]byte, error) {
+	records, err := stateToRecords(state)
+	if err != nil {
+		return nil, err
+	}
+
+	document := map[string]interface{}{stateFileVersionKey: StateVersion}
+	for _, table := range stateTables {
+		values := map[string]json.RawMessage{}
+		for id, value := range records[table] {
+			values[id] = value
+		}
+		document[table] = values
+	}
+	return json.Marshal(document)
+}
+
+// writeStateFile replaces the state file without ever leaving a partially written one behind: the new contents go to
+// a temporary file which is synced to disk before being renamed over the old one.  The old file is kept as the newest
+// previous generation.
+func writeStateFile(os osshim.Os, ioutil ioutilshim.Ioutil, stateFile string, data []byte) error {
+	tempFile := stateFile + ".tmp"
+
+	// a temp file left behind by a crash may have been created with other permissions
+	if err := os.Remove(tempFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale temp file '%s': %s", tempFile, err.Error())
+	}
+	if err := ioutil.WriteFile(tempFile, data, stateFileMode); err != nil {
+		return fmt.Errorf("failed to write temp file '%s': %s", tempFile, err.Error())
+	}
+	if err := syncPath(os, tempFile); err != nil {
+		return fmt.Errorf("failed to sync temp file '%s': %s", tempFile, err.Error())
+	}
+
+	if err := rotateStateFile(os, stateFile); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tempFile, stateFile); err != nil {
+		return fmt.Errorf("failed to rename '%s' to '%s': %s", tempFile, stateFile, err.Error())
+	}
+
+	// the rename is only durable once the directory entry is on disk too
+	if err := syncPath(os, filepath.Dir(stateFile)); err != nil {
+		return fmt.Errorf("failed to sync directory of '%s': %s", stateFile, err.Error())
+	}
+	return nil
+}
+
+// readStateFile reads the state file, falling back to the newest previous generation if it is missing, which happens
+// when the broker stopped between rotating the old file away and renaming the new one into place, or when unreadable
+// files were quarantined
+func readStateFile(os osshim.Os, ioutil ioutilshim.Ioutil, stateFile string) ([]byte, string, error) {
+	data, err := ioutil.ReadFile(stateFile)
+	if err == nil || !os.IsNotExist(err) {
+		return data, stateFile, err
+	}
+
+	for n := 1; n <= StateFileGenerations; n++ {
+		generation := stateFileGeneration(stateFile, n)
+		previous, previousErr := ioutil.ReadFile(generation)
+		if previousErr == nil || !os.IsNotExist(previousErr) {
+			return previous, generation, previousErr
+		}
+	}
+	return nil, stateFile, err
+}
+
+// rotateStateFile moves every generation of the state file one step older, dropping the oldest
+func rotateStateFile(os osshim.Os, stateFile string) error {
+	for generation := StateFileGenerations; generation > 0; generation-- {
+		from := stateFile
+		if generation > 1 {
+			from = stateFileGeneration(stateFile, generation-1)
+		}
+		to := stateFileGeneration(stateFile, generation)
+
+		if err := os.Rename(from, to); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rename '%s' to '%s': %s", from, to, err.Error())
+		}
+	}
+	return nil
+}
+
+func stateFileGeneration(stateFile string, generation int) string {
+	return fmt.Sprintf("%s.%d", stateFile, generation)
+}
+
+func syncPath(os osshim.Os, path string) error {
+	file, err := os.OpenFile(path, stateFileSyncFlag, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
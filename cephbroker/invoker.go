@@ -0,0 +1,36 @@
+package cephbroker
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/invoker"
+)
+
+type outputInvoker struct{}
+
+// NewOutputInvoker runs commands like voldriver's invoker, but returns only what they write to stdout, so that
+// warnings ceph writes to stderr never end up in the keyrings and json the broker reads from it.  When a command
+// fails, its stderr is logged and given in the error.
+func NewOutputInvoker() invoker.Invoker {
+	return &outputInvoker{}
+}
+
+func (i *outputInvoker) Invoke(env voldriver.Env, executable string, args []string) ([]byte, error) {
+	logger := env.Logger().Session("invoking-command", lager.Data{"executable": executable, "args": args})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(env.Context(), executable, args...)
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if err != nil {
+		logger.Error("invocation-failed", err, lager.Data{"stderr": stderr.String()})
+		return nil, fmt.Errorf("%s - details:\n%s", err.Error(), stderr.String())
+	}
+	return output, nil
+}
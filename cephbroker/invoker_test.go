@@ -0,0 +1,43 @@
+package cephbroker_test
+
+import (
+	"context"
+
+	"code.cloudfoundry.org/cephbroker/cephbroker"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OutputInvoker", func() {
+	var (
+		logger *lagertest.TestLogger
+		env    voldriver.Env
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test-invoker")
+		env = driverhttp.NewHttpDriverEnv(logger, context.TODO())
+	})
+
+	It("should return only what the command writes to stdout", func() {
+		output, err := cephbroker.NewOutputInvoker().Invoke(env, "sh", []string{"-c", "echo '[client.binding]'; echo 'warning: clock skew' >&2"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(output)).To(Equal("[client.binding]\n"))
+	})
+
+	It("should give and log what the command writes to stderr when it fails", func() {
+		_, err := cephbroker.NewOutputInvoker().Invoke(env, "sh", []string{"-c", "echo 'Error ENOENT: no such subvolume' >&2; exit 2"})
+		Expect(err).To(MatchError(ContainSubstring("Error ENOENT: no such subvolume")))
+
+		stderr := []interface{}{}
+		for _, log := range logger.Logs() {
+			if value, ok := log.Data["stderr"]; ok {
+				stderr = append(stderr, value)
+			}
+		}
+		Expect(stderr).To(ConsistOf("Error ENOENT: no such subvolume\n"))
+	})
+})
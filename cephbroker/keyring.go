@@ -0,0 +1,80 @@
+package cephbroker
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseKeyring finds the first client in a ceph keyring, and returns its name, without the "client." prefix, and its
+// key
+func parseKeyring(data []byte) (string, string, error) {
+	name := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section := strings.TrimSpace(line[1 : len(line)-1])
+			name = ""
+			if strings.HasPrefix(section, "client.") {
+				name = strings.TrimPrefix(section, "client.")
+			}
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if name != "" && len(parts) == 2 && strings.TrimSpace(parts[0]) == "key" {
+			return name, strings.TrimSpace(parts[1]), nil
+		}
+	}
+	return "", "", fmt.Errorf("no client key found in keyring")
+}
+
+// authArgs are the arguments that tell ceph and ceph-fuse which monitors to talk to, and as which client
+func (c *cephClient) authArgs() []string {
+	args := []string{"-m", c.mds}
+	if c.credentials.Keyring != "" {
+		args = append(args, "-k", c.credentials.Keyring)
+	} else {
+		args = append(args, "--keyfile", c.credentials.SecretFile)
+	}
+	if c.credentials.ClientName != "" {
+		args = append(args, "--id", c.credentials.ClientName)
+	}
+	return args
+}
+
+// clientName is the client the broker acts as: the one it was given, or else the one in the keyring, or else the
+// admin client
+func (c *cephClient) clientName() (string, error) {
+	if c.credentials.ClientName != "" {
+		return c.credentials.ClientName, nil
+	}
+	if c.credentials.Keyring == "" {
+		return DefaultCephClientName, nil
+	}
+	keyring, err := c.ioutil.ReadFile(c.credentials.Keyring)
+	if err != nil {
+		return "", KeyringNotFound
+	}
+	name, _, err := parseKeyring(keyring)
+	if err != nil {
+		return DefaultCephClientName, nil
+	}
+	return name, nil
+}
+
+// readKeyring returns the keyring, or, when there is only a secret file, a keyring made from it
+func (c *cephClient) readKeyring(clientName string) (string, error) {
+	if c.credentials.Keyring != "" {
+		keyring, err := c.ioutil.ReadFile(c.credentials.Keyring)
+		if err != nil {
+			return "", KeyringNotFound
+		}
+		return string(keyring), nil
+	}
+
+	secret, err := c.ioutil.ReadFile(c.credentials.SecretFile)
+	if err != nil {
+		return "", SecretNotFound
+	}
+	return fmt.Sprintf("[client.%s]\n\tkey = %s\n", clientName, strings.TrimSpace(string(secret))), nil
+}
@@ -0,0 +1,157 @@
+package cephbroker
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultMonitorPort is the port of the v1 protocol, which ceph-fuse and the kernel client both speak
+const DefaultMonitorPort = "6789"
+
+var monitorHostPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?$`)
+
+// ParseMonitors reads a list of ceph monitor addresses, written as in the mon_host setting of ceph.conf: addresses
+// separated by commas, semicolons or spaces, each either host[:port], an IPv6 address in brackets with an optional
+// port, or an address vector such as [v2:10.0.0.1:3300,v1:10.0.0.1:6789].  The v1 address of an address vector is
+// used when it has one.  Each monitor is returned as host:port, with IPv6 addresses in brackets and the port defaulting
+// to DefaultMonitorPort.
+func ParseMonitors(monHost string) ([]string, error) {
+	entries, err := splitMonitorList(monHost, func(r rune) bool { return r == ',' || r == ';' || r == ' ' || r == '\t' })
+	if err != nil {
+		return nil, err
+	}
+
+	monitors := []string{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry, "[v1:") || strings.HasPrefix(entry, "[v2:") {
+			entry, err = pickFromAddressVector(entry)
+			if err != nil {
+				return nil, err
+			}
+		}
+		monitor, err := parseMonitor(entry)
+		if err != nil {
+			return nil, err
+		}
+		monitors = append(monitors, monitor)
+	}
+
+	if len(monitors) == 0 {
+		return nil, fmt.Errorf("no monitor addresses given")
+	}
+	return monitors, nil
+}
+
+// MonitorHost is the host of a monitor address returned by ParseMonitors, without brackets
+func MonitorHost(monitor string) string {
+	host, _, err := net.SplitHostPort(monitor)
+	if err != nil {
+		return monitor
+	}
+	return host
+}
+
+// splitMonitorList splits at separators outside brackets, dropping empty entries
+func splitMonitorList(list string, separator func(rune) bool) ([]string, error) {
+	entries := []string{}
+	depth, start := 0, 0
+	for i, r := range list {
+		switch {
+		case r == '[':
+			depth++
+		case r == ']':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("invalid monitor list '%s': unbalanced ']'", list)
+			}
+		case depth == 0 && separator(r):
+			if entry := strings.TrimSpace(list[start:i]); entry != "" {
+				entries = append(entries, entry)
+			}
+			start = i + 1
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("invalid monitor list '%s': unbalanced '['", list)
+	}
+	if entry := strings.TrimSpace(list[start:]); entry != "" {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// pickFromAddressVector returns the v1 address of an address vector, or its first address if it has no v1 one
+func pickFromAddressVector(vector string) (string, error) {
+	if !strings.HasSuffix(vector, "]") {
+		return "", fmt.Errorf("invalid monitor address vector '%s'", vector)
+	}
+	addresses, err := splitMonitorList(vector[1:len(vector)-1], func(r rune) bool { return r == ',' })
+	if err != nil {
+		return "", err
+	}
+
+	picked := ""
+	for _, address := range addresses {
+		if strings.HasPrefix(address, "v1:") {
+			return address, nil
+		}
+		if picked == "" {
+			picked = address
+		}
+	}
+	if picked == "" {
+		return "", fmt.Errorf("invalid monitor address vector '%s'", vector)
+	}
+	return picked, nil
+}
+
+// parseMonitor reads a single monitor address, with an optional v1: or v2: prefix, and an optional /nonce suffix
+func parseMonitor(address string) (string, error) {
+	entry := address
+	entry = strings.TrimPrefix(strings.TrimPrefix(entry, "v1:"), "v2:")
+	if i := strings.LastIndex(entry, "/"); i >= 0 {
+		entry = entry[:i]
+	}
+
+	host, port := entry, DefaultMonitorPort
+	switch {
+	case strings.HasPrefix(entry, "["):
+		end := strings.Index(entry, "]")
+		if end < 0 {
+			return "", fmt.Errorf("invalid monitor address '%s'", address)
+		}
+		host = entry[1:end]
+		if rest := entry[end+1:]; rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return "", fmt.Errorf("invalid monitor address '%s'", address)
+			}
+			port = rest[1:]
+		}
+		if ip := net.ParseIP(host); ip == nil || ip.To4() != nil {
+			return "", fmt.Errorf("invalid monitor address '%s': only IPv6 addresses go in brackets", address)
+		}
+	case strings.Count(entry, ":") > 1:
+		// an IPv6 address without brackets cannot have a port
+		if net.ParseIP(entry) == nil {
+			return "", fmt.Errorf("invalid monitor address '%s'", address)
+		}
+	case strings.Contains(entry, ":"):
+		parts := strings.SplitN(entry, ":", 2)
+		host, port = parts[0], parts[1]
+		if net.ParseIP(host) == nil && !monitorHostPattern.MatchString(host) {
+			return "", fmt.Errorf("invalid monitor address '%s': invalid host", address)
+		}
+	default:
+		if net.ParseIP(host) == nil && !monitorHostPattern.MatchString(host) {
+			return "", fmt.Errorf("invalid monitor address '%s': invalid host", address)
+		}
+	}
+
+	if value, err := strconv.Atoi(port); err != nil || value < 1 || value > 65535 {
+		return "", fmt.Errorf("invalid monitor address '%s': invalid port", address)
+	}
+	return net.JoinHostPort(host, port), nil
+}
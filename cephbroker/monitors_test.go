@@ -0,0 +1,68 @@
+package cephbroker_test
+
+import (
+	"code.cloudfoundry.org/cephbroker/cephbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Monitors", func() {
+	Context(".ParseMonitors", func() {
+		It("should default the port", func() {
+			monitors, err := cephbroker.ParseMonitors("10.0.0.1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(monitors).To(Equal([]string{"10.0.0.1:6789"}))
+		})
+
+		It("should keep the port of each monitor in a list", func() {
+			monitors, err := cephbroker.ParseMonitors("10.0.0.1:6789, mon-b.example.com:3300;10.0.0.3")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(monitors).To(Equal([]string{"10.0.0.1:6789", "mon-b.example.com:3300", "10.0.0.3:6789"}))
+		})
+
+		It("should read IPv6 addresses, with or without brackets", func() {
+			monitors, err := cephbroker.ParseMonitors("[2001:db8::1]:6790,[2001:db8::2],2001:db8::3")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(monitors).To(Equal([]string{"[2001:db8::1]:6790", "[2001:db8::2]:6789", "[2001:db8::3]:6789"}))
+		})
+
+		It("should prefer the v1 address of an address vector", func() {
+			monitors, err := cephbroker.ParseMonitors("[v2:10.0.0.1:3300/0,v1:10.0.0.1:6789/0] [v2:[2001:db8::2]:3300]")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(monitors).To(Equal([]string{"10.0.0.1:6789", "[2001:db8::2]:3300"}))
+		})
+
+		It("should error on an empty list", func() {
+			_, err := cephbroker.ParseMonitors(" , ")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should error on invalid ports", func() {
+			_, err := cephbroker.ParseMonitors("10.0.0.1:0")
+			Expect(err).To(HaveOccurred())
+			_, err = cephbroker.ParseMonitors("10.0.0.1:http")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should error on invalid hosts", func() {
+			_, err := cephbroker.ParseMonitors("mon_a:6789")
+			Expect(err).To(HaveOccurred())
+			_, err = cephbroker.ParseMonitors("[10.0.0.1]:6789")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should error on unbalanced brackets", func() {
+			_, err := cephbroker.ParseMonitors("[2001:db8::1:6789")
+			Expect(err).To(HaveOccurred())
+			_, err = cephbroker.ParseMonitors("2001:db8::1]:6789")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context(".MonitorHost", func() {
+		It("should drop the port and brackets", func() {
+			Expect(cephbroker.MonitorHost("10.0.0.1:6789")).To(Equal("10.0.0.1"))
+			Expect(cephbroker.MonitorHost("[2001:db8::1]:6789")).To(Equal("2001:db8::1"))
+		})
+	})
+})
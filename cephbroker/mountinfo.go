@@ -0,0 +1,82 @@
+package cephbroker
+
+import (
+	"strconv"
+	"strings"
+)
+
+// MountInfoFile lists the mounts the broker can see, one per line, in the format described in proc(5)
+const MountInfoFile = "/proc/self/mountinfo"
+
+// cephFilesystemTypes are the filesystem types of ceph mounts: ceph-fuse, and the kernel client
+var cephFilesystemTypes = map[string]bool{
+	"fuse.ceph-fuse": true,
+	"ceph":           true,
+}
+
+type mountEntry struct {
+	MountPoint string
+	FSType     string
+	Source     string
+}
+
+func (m mountEntry) isCeph() bool {
+	return cephFilesystemTypes[m.FSType]
+}
+
+func (m mountEntry) isFuse() bool {
+	return strings.HasPrefix(m.FSType, "fuse")
+}
+
+// parseMountInfo reads the entries of a mountinfo file, in mount order.  Lines it cannot make sense of are skipped.
+func parseMountInfo(data []byte) []mountEntry {
+	entries := []mountEntry{}
+	for _, line := range strings.Split(string(data), "\n") {
+		// optional fields come between the mount options and the separator, so the line is split at the separator
+		halves := strings.SplitN(line, " - ", 2)
+		if len(halves) != 2 {
+			continue
+		}
+		fields := strings.Fields(halves[0])
+		filesystem := strings.Fields(halves[1])
+		if len(fields) < 5 || len(filesystem) < 2 {
+			continue
+		}
+		entries = append(entries, mountEntry{
+			MountPoint: unescapeMountPath(fields[4]),
+			FSType:     filesystem[0],
+			Source:     unescapeMountPath(filesystem[1]),
+		})
+	}
+	return entries
+}
+
+// unescapeMountPath undoes the octal escapes the kernel writes for spaces, tabs, newlines and backslashes in paths
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+
+	unescaped := []byte{}
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+4 <= len(path) {
+			if value, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				unescaped = append(unescaped, byte(value))
+				i += 3
+				continue
+			}
+		}
+		unescaped = append(unescaped, path[i])
+	}
+	return string(unescaped)
+}
+
+// lastMountAt is the mount on top at the given mount point, the one that paths under it resolve to
+func lastMountAt(entries []mountEntry, mountPoint string) (mountEntry, bool) {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].MountPoint == mountPoint {
+			return entries[i], true
+		}
+	}
+	return mountEntry{}, false
+}
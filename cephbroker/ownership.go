@@ -0,0 +1,91 @@
+package cephbroker
+
+import (
+	"errors"
+	"os"
+	"strconv"
+)
+
+// maxID is the largest uid or gid; (uint32)(-1) is left out, as chown takes it to mean "unchanged"
+const maxID = 1<<32 - 2
+
+var ErrInvalidOwnership error = errors.New("uid and gid must be whole numbers, and mode an octal permission string such as \"0770\"")
+
+// Ownership is who owns the root directory of a share, and its permissions.  Fields that are nil are left as they
+// are, so that a share nobody asked about stays a world-writable directory owned by the broker's user.
+type Ownership struct {
+	UID *uint32
+	GID *uint32
+	// Mode holds the permission bits as chmod takes them in octal, including the setuid, setgid and sticky bits
+	Mode *uint32
+}
+
+// IsSet reports whether there is anything to change
+func (o Ownership) IsSet() bool {
+	return o.UID != nil || o.GID != nil || o.Mode != nil
+}
+
+// FileMode is the mode in the form os.Chmod takes it
+func (o Ownership) FileMode() os.FileMode {
+	mode := os.FileMode(*o.Mode & 0777)
+	if *o.Mode&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if *o.Mode&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if *o.Mode&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// evaluateOwnership reads the "uid", "gid" and "mode" parameters.  Ids may be numbers or strings of digits; the mode
+// must be a string, as a JSON number would be read as decimal.
+func evaluateOwnership(parameters map[string]interface{}) (Ownership, error) {
+	ownership := Ownership{}
+	var err error
+	if value, ok := parameters["uid"]; ok && value != nil {
+		if ownership.UID, err = parseID(value); err != nil {
+			return Ownership{}, err
+		}
+	}
+	if value, ok := parameters["gid"]; ok && value != nil {
+		if ownership.GID, err = parseID(value); err != nil {
+			return Ownership{}, err
+		}
+	}
+	if value, ok := parameters["mode"]; ok && value != nil {
+		text, ok := value.(string)
+		if !ok {
+			return Ownership{}, ErrInvalidOwnership
+		}
+		mode, err := strconv.ParseUint(text, 8, 32)
+		if err != nil || mode > 07777 {
+			return Ownership{}, ErrInvalidOwnership
+		}
+		bits := uint32(mode)
+		ownership.Mode = &bits
+	}
+	return ownership, nil
+}
+
+func parseID(value interface{}) (*uint32, error) {
+	var id uint64
+	switch value := value.(type) {
+	case float64:
+		if value < 0 || value > maxID || value != float64(uint64(value)) {
+			return nil, ErrInvalidOwnership
+		}
+		id = uint64(value)
+	case string:
+		var err error
+		if id, err = strconv.ParseUint(value, 10, 32); err != nil || id > maxID {
+			return nil, ErrInvalidOwnership
+		}
+	default:
+		return nil, ErrInvalidOwnership
+	}
+	result := uint32(id)
+	return &result, nil
+}
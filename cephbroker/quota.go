@@ -0,0 +1,88 @@
+package cephbroker
+
+import (
+	"errors"
+	"strconv"
+
+	"code.cloudfoundry.org/bytefmt"
+)
+
+const (
+	QuotaMaxBytesAttr = "ceph.quota.max_bytes"
+	QuotaMaxFilesAttr = "ceph.quota.max_files"
+
+	// UsageBytesAttr and UsageFilesAttr are the recursive statistics CephFS keeps for every directory
+	UsageBytesAttr = "ceph.dir.rbytes"
+	UsageFilesAttr = "ceph.dir.rfiles"
+)
+
+var ErrInvalidQuota error = errors.New("quota must be a size such as \"10G\", a number of bytes, or an object with max_bytes and max_files")
+
+// Quota limits the size of a share.  Zero means unlimited.
+type Quota struct {
+	MaxBytes uint64 `json:"max_bytes"`
+	MaxFiles uint64 `json:"max_files"`
+}
+
+// Usage is how much of a share is in use.  Files are not counted for subvolume shares.
+type Usage struct {
+	Bytes uint64 `json:"bytes"`
+	Files uint64 `json:"files"`
+}
+
+// evaluateQuota reads the "quota" parameter, which may be a size ("10G"), a number of bytes, or an object with
+// "max_bytes" and "max_files".  The boolean reports whether the parameter was given at all; an explicit null clears
+// the quota.
+func evaluateQuota(parameters map[string]interface{}) (Quota, bool, error) {
+	value, ok := parameters["quota"]
+	if !ok {
+		return Quota{}, false, nil
+	}
+
+	switch value := value.(type) {
+	case nil:
+		return Quota{}, true, nil
+	case map[string]interface{}:
+		quota := Quota{}
+		var err error
+		if maxBytes, ok := value["max_bytes"]; ok {
+			if quota.MaxBytes, err = parseSize(maxBytes); err != nil {
+				return Quota{}, true, err
+			}
+		}
+		if maxFiles, ok := value["max_files"]; ok {
+			if quota.MaxFiles, err = parseCount(maxFiles); err != nil {
+				return Quota{}, true, err
+			}
+		}
+		return quota, true, nil
+	default:
+		maxBytes, err := parseSize(value)
+		if err != nil {
+			return Quota{}, true, err
+		}
+		return Quota{MaxBytes: maxBytes}, true, nil
+	}
+}
+
+func parseSize(value interface{}) (uint64, error) {
+	if size, ok := value.(string); ok {
+		if bytes, err := strconv.ParseUint(size, 10, 64); err == nil {
+			return bytes, nil
+		}
+		bytes, err := bytefmt.ToBytes(size)
+		if err != nil {
+			return 0, ErrInvalidQuota
+		}
+		return bytes, nil
+	}
+	return parseCount(value)
+}
+
+func parseCount(value interface{}) (uint64, error) {
+	count, ok := value.(float64)
+	if !ok || count < 0 || count != float64(uint64(count)) {
+		return 0, ErrInvalidQuota
+	}
+	return uint64(count), nil
+}
@@ -0,0 +1,239 @@
+package cephbroker
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"github.com/tedsuo/ifrit"
+)
+
+// ReconcileOptions say what to do about the differences a reconciliation finds, beyond reporting them
+type ReconcileOptions struct {
+	// RecreateMissingShares creates empty shares again for instances whose shares are gone
+	RecreateMissingShares bool
+	// QuarantineOrphanedShares moves shares that belong to no instance into the quarantine directory
+	QuarantineOrphanedShares bool
+}
+
+// ReconcileReport lists what a reconciliation found, and what it fixed
+type ReconcileReport struct {
+	// OrphanedShares are shares in the filesystem that belong to no instance, or to an instance in another backend.
+	// Shares outside the default backend are given as <backend>/<share>.
+	OrphanedShares []string `json:"orphaned_shares"`
+	// MissingShares are instances that were provisioned but whose shares are not in the filesystem
+	MissingShares     []string `json:"missing_shares"`
+	QuarantinedShares []string `json:"quarantined_shares"`
+	RecreatedShares   []string `json:"recreated_shares"`
+}
+
+//go:generate counterfeiter -o ../cephfakes/fake_reconcilable.go . Reconcilable
+
+type Reconcilable interface {
+	Reconcile(logger lager.Logger, options ReconcileOptions) (ReconcileReport, error)
+}
+
+// NewReconciler reconciles the broker's state with the filesystem every interval, until it is signalled to stop
+func NewReconciler(logger lager.Logger, reconcilable Reconcilable, interval time.Duration, options ReconcileOptions) ifrit.Runner {
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		logger := logger.Session("reconciler", lager.Data{"interval": interval.String()})
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		close(ready)
+		for {
+			select {
+			case <-signals:
+				return nil
+			case <-ticker.C:
+				// failures are logged and retried on the next tick
+				reconcilable.Reconcile(logger, options)
+			}
+		}
+	})
+}
+
+// orphanedShare is a share that belongs to no instance in the backend it was found in
+type orphanedShare struct {
+	backend string
+	share   string
+}
+
+func (o orphanedShare) String() string {
+	if o.backend == "" {
+		return o.share
+	}
+	return o.backend + "/" + o.share
+}
+
+// Reconcile compares the instances the broker knows about with the shares in the filesystem of every backend that a
+// plan or an instance uses.  Shares are listed before the state is looked at, under the mutex, so that the shares of
+// instances being provisioned in the meantime are not taken for orphans; an instance only counts as missing its share
+// if it was already provisioned before the shares were listed.
+func (b *broker) Reconcile(logger lager.Logger, options ReconcileOptions) (ReconcileReport, error) {
+	logger = logger.Session("reconcile")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	env := driverhttp.NewHttpDriverEnv(logger, context.Background())
+
+	provisionedBefore, err := b.provisionedInstances(logger)
+	if err != nil {
+		logger.Error("failed-to-load-state", err)
+		return ReconcileReport{}, err
+	}
+
+	backends := map[string]bool{}
+	for _, backend := range b.catalog.Backends() {
+		backends[backend] = true
+	}
+	for _, backend := range provisionedBefore {
+		backends[backend] = true
+	}
+
+	controllers := map[string]Controller{}
+	shares := map[string]map[string]bool{}
+	shareCount := 0
+	for backend := range backends {
+		controller, err := b.controller.ForBackend(backend)
+		if err != nil {
+			logger.Error("backend-not-found", err)
+			return ReconcileReport{}, err
+		}
+		response := controller.ListShares(env)
+		if response.Err != "" {
+			err := errors.New(response.Err)
+			logger.Error("failed-to-list-shares", err, lager.Data{"backend": backend})
+			return ReconcileReport{}, err
+		}
+
+		controllers[backend] = controller
+		shares[backend] = map[string]bool{}
+		for _, share := range response.Shares {
+			shares[backend][share] = true
+		}
+		shareCount += len(response.Shares)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := b.lockState(logger); err != nil {
+		logger.Error("failed-to-lock-state", err)
+		return ReconcileReport{}, err
+	}
+	defer b.unlockState(logger)
+
+	report := ReconcileReport{}
+	orphans := []orphanedShare{}
+	for backend, backendShares := range shares {
+		for share := range backendShares {
+			if _, ok := b.dynamic.InstanceMap[share]; !ok || b.dynamic.InstanceInfoMap[share].Backend != backend {
+				orphans = append(orphans, orphanedShare{backend: backend, share: share})
+			}
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].String() < orphans[j].String() })
+	for _, orphan := range orphans {
+		report.OrphanedShares = append(report.OrphanedShares, orphan.String())
+	}
+	for instanceID, backend := range provisionedBefore {
+		if !shares[backend][instanceID] && b.provisioned(instanceID) && b.dynamic.InstanceInfoMap[instanceID].Backend == backend {
+			report.MissingShares = append(report.MissingShares, instanceID)
+		}
+	}
+	sort.Strings(report.MissingShares)
+
+	for _, orphan := range orphans {
+		logger.Info("orphaned-share", lager.Data{"share": orphan.share, "backend": orphan.backend})
+		if !options.QuarantineOrphanedShares {
+			continue
+		}
+		response := controllers[orphan.backend].QuarantineShare(env, orphan.share)
+		if response.Err != "" {
+			logger.Error("failed-to-quarantine-share", errors.New(response.Err), lager.Data{"share": orphan.share, "backend": orphan.backend})
+			continue
+		}
+		logger.Info("quarantined-share", lager.Data{"share": orphan.share, "backend": orphan.backend, "path": response.Path})
+		report.QuarantinedShares = append(report.QuarantinedShares, orphan.String())
+	}
+
+	for _, instanceID := range report.MissingShares {
+		logger.Info("missing-share", lager.Data{"instanceID": instanceID})
+		if !options.RecreateMissingShares {
+			continue
+		}
+		if err := b.recreateShare(logger, env, instanceID); err != nil {
+			logger.Error("failed-to-recreate-share", err, lager.Data{"instanceID": instanceID})
+			continue
+		}
+		logger.Info("recreated-share", lager.Data{"instanceID": instanceID})
+		report.RecreatedShares = append(report.RecreatedShares, instanceID)
+	}
+
+	if len(report.RecreatedShares) > 0 {
+		if err := b.serialize(b.dynamic); err != nil {
+			// the shares are there, only their new paths are not recorded
+			logger.Error("failed-to-save-share-paths", err)
+		}
+	}
+
+	logger.Info("reconciled", lager.Data{
+		"shares":             shareCount,
+		"instances":          len(b.dynamic.InstanceMap),
+		"orphaned-shares":    len(report.OrphanedShares),
+		"missing-shares":     len(report.MissingShares),
+		"quarantined-shares": len(report.QuarantinedShares),
+		"recreated-shares":   len(report.RecreatedShares),
+	})
+	return report, nil
+}
+
+// provisionedInstances are the instances that have been provisioned successfully, with their backends
+func (b *broker) provisionedInstances(logger lager.Logger) (map[string]string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := b.lockState(logger); err != nil {
+		return nil, err
+	}
+	defer b.unlockState(logger)
+
+	provisioned := map[string]string{}
+	for instanceID := range b.dynamic.InstanceMap {
+		if b.provisioned(instanceID) {
+			provisioned[instanceID] = b.dynamic.InstanceInfoMap[instanceID].Backend
+		}
+	}
+	return provisioned, nil
+}
+
+// recreateShare creates an empty share for an instance whose share is gone, with the instance's parameters.  Instances
+// that were cloned get an empty share too, rather than a fresh copy of a source that may have changed or gone since.
+// The caller must hold the mutex.
+func (b *broker) recreateShare(logger lager.Logger, env voldriver.Env, instanceID string) error {
+	parameters, err := b.effectiveParameters(b.dynamic.InstanceMap[instanceID])
+	if err != nil {
+		return err
+	}
+	delete(parameters, "source_instance")
+	delete(parameters, "snapshot")
+
+	controller, err := b.controllerFor(instanceID)
+	if err != nil {
+		return err
+	}
+	response := controller.Create(env, createRequest(instanceID, parameters))
+	if response.Err != "" {
+		return errors.New(response.Err)
+	}
+
+	// subvolumes are created at a new path
+	b.recordSharePath(instanceID, b.sharePath(logger, controller, env, instanceID))
+	return nil
+}
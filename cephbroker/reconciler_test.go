@@ -0,0 +1,193 @@
+package cephbroker_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/cephbroker/cephbroker"
+	"code.cloudfoundry.org/cephbroker/cephfakes"
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/tedsuo/ifrit"
+)
+
+var _ = Describe("Reconcile", func() {
+	var (
+		logger         lager.Logger
+		ctx            context.Context
+		fakeController *cephfakes.FakeController
+		stateDir       string
+		broker         brokerapi.ServiceBroker
+		reconcilable   cephbroker.Reconcilable
+		details        brokerapi.ProvisionDetails
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test-reconcile")
+		ctx = context.TODO()
+		fakeController = &cephfakes.FakeController{}
+		fakeController.ForBackendReturns(fakeController, nil)
+		details = brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id"}
+
+		var err error
+		stateDir, err = ioutil.TempDir("", "cephbroker-reconcile")
+		Expect(err).NotTo(HaveOccurred())
+
+		subject, err := cephbroker.New(
+			logger, fakeController,
+			cephbroker.NewCatalog("service-name", "service-id", "plan-name", "plan-id", "plan-desc"),
+			cephbroker.NewFileStore(filepath.Join(stateDir, "state.json"), &osshim.OsShim{}, &ioutilshim.IoutilShim{}), nil,
+		)
+		Expect(err).NotTo(HaveOccurred())
+		broker, reconcilable = subject, subject
+
+		_, err = broker.Provision(ctx, "instance-1", details, false)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(stateDir)
+	})
+
+	It("should report shares that belong to no instance", func() {
+		fakeController.ListSharesReturns(cephbroker.SharesResponse{Shares: []string{"instance-1", "orphan"}})
+
+		report, err := reconcilable.Reconcile(logger, cephbroker.ReconcileOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.OrphanedShares).To(Equal([]string{"orphan"}))
+		Expect(report.MissingShares).To(BeEmpty())
+		Expect(fakeController.QuarantineShareCallCount()).To(Equal(0))
+	})
+
+	It("should report instances whose shares are missing", func() {
+		report, err := reconcilable.Reconcile(logger, cephbroker.ReconcileOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.MissingShares).To(Equal([]string{"instance-1"}))
+		Expect(fakeController.CreateCallCount()).To(Equal(1))
+	})
+
+	It("should quarantine orphaned shares when asked to", func() {
+		fakeController.ListSharesReturns(cephbroker.SharesResponse{Shares: []string{"instance-1", "orphan"}})
+		fakeController.QuarantineShareReturns(cephbroker.SharePathResponse{Path: "/quarantine/orphan"})
+
+		report, err := reconcilable.Reconcile(logger, cephbroker.ReconcileOptions{QuarantineOrphanedShares: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.QuarantinedShares).To(Equal([]string{"orphan"}))
+		_, share := fakeController.QuarantineShareArgsForCall(0)
+		Expect(share).To(Equal("orphan"))
+	})
+
+	It("should not count shares that could not be quarantined", func() {
+		fakeController.ListSharesReturns(cephbroker.SharesResponse{Shares: []string{"orphan"}})
+		fakeController.QuarantineShareReturns(cephbroker.SharePathResponse{ErrorResponse: voldriver.ErrorResponse{Err: "badness"}})
+
+		report, err := reconcilable.Reconcile(logger, cephbroker.ReconcileOptions{QuarantineOrphanedShares: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.OrphanedShares).To(Equal([]string{"orphan"}))
+		Expect(report.QuarantinedShares).To(BeEmpty())
+	})
+
+	It("should recreate missing shares empty, with the instance's parameters, when asked to", func() {
+		clone := details
+		clone.RawParameters = json.RawMessage(`{"source_instance": "instance-1", "quota": "1G"}`)
+		_, err := broker.Provision(ctx, "instance-2", clone, false)
+		Expect(err).NotTo(HaveOccurred())
+		fakeController.ListSharesReturns(cephbroker.SharesResponse{Shares: []string{"instance-1"}})
+		fakeController.SharePathReturns(cephbroker.SharePathResponse{Path: "/volumes/instance-2/new"})
+
+		report, err := reconcilable.Reconcile(logger, cephbroker.ReconcileOptions{RecreateMissingShares: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.RecreatedShares).To(Equal([]string{"instance-2"}))
+
+		Expect(fakeController.CreateCallCount()).To(Equal(3))
+		_, request := fakeController.CreateArgsForCall(2)
+		Expect(request.Name).To(Equal("instance-2"))
+		Expect(request.Opts).To(Equal(map[string]interface{}{"quota": "1G", "volume_id": "instance-2"}))
+	})
+
+	It("should leave instances that are still being provisioned alone", func() {
+		release := make(chan struct{})
+		fakeController.CreateStub = func(voldriver.Env, voldriver.CreateRequest) voldriver.ErrorResponse {
+			<-release
+			return voldriver.ErrorResponse{}
+		}
+		fakeController.ListSharesReturns(cephbroker.SharesResponse{Shares: []string{"instance-1"}})
+
+		_, err := broker.Provision(ctx, "instance-2", details, true)
+		Expect(err).NotTo(HaveOccurred())
+
+		report, err := reconcilable.Reconcile(logger, cephbroker.ReconcileOptions{RecreateMissingShares: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.MissingShares).To(BeEmpty())
+		Expect(report.OrphanedShares).To(BeEmpty())
+
+		close(release)
+		Eventually(func() brokerapi.LastOperationState {
+			operation, _ := broker.LastOperation(ctx, "instance-2", "")
+			return operation.State
+		}).Should(Equal(brokerapi.Succeeded))
+	})
+
+	It("should compare the shares of each backend with the instances in it", func() {
+		backendController := &cephfakes.FakeController{}
+		fakeController.ForBackendStub = func(name string) (cephbroker.Controller, error) {
+			if name == "archive" {
+				return backendController, nil
+			}
+			return fakeController, nil
+		}
+		catalog := cephbroker.NewCatalog("service-name", "service-id", "plan-name", "plan-id", "plan-desc")
+		catalog.Services[0].Plans = append(catalog.Services[0].Plans, cephbroker.CatalogPlan{ID: "archive-id", Name: "archive", Backend: "archive"})
+		subject, err := cephbroker.New(
+			logger, fakeController, catalog,
+			cephbroker.NewFileStore(filepath.Join(stateDir, "state.json"), &osshim.OsShim{}, &ioutilshim.IoutilShim{}), nil,
+		)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = subject.Provision(ctx, "instance-2", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "archive-id"}, false)
+		Expect(err).NotTo(HaveOccurred())
+
+		fakeController.ListSharesReturns(cephbroker.SharesResponse{Shares: []string{"instance-1", "instance-2"}})
+		backendController.ListSharesReturns(cephbroker.SharesResponse{Shares: []string{"orphan", "instance-1"}})
+		backendController.QuarantineShareReturns(cephbroker.SharePathResponse{Path: "/quarantine/orphan"})
+
+		report, err := subject.Reconcile(logger, cephbroker.ReconcileOptions{QuarantineOrphanedShares: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.OrphanedShares).To(Equal([]string{"archive/instance-1", "archive/orphan", "instance-2"}))
+		Expect(report.MissingShares).To(Equal([]string{"instance-2"}))
+		Expect(backendController.QuarantineShareCallCount()).To(Equal(2))
+		Expect(fakeController.QuarantineShareCallCount()).To(Equal(1))
+	})
+
+	It("should error when the shares cannot be listed", func() {
+		fakeController.ListSharesReturns(cephbroker.SharesResponse{ErrorResponse: voldriver.ErrorResponse{Err: "badness"}})
+		_, err := reconcilable.Reconcile(logger, cephbroker.ReconcileOptions{})
+		Expect(err).To(MatchError("badness"))
+	})
+})
+
+var _ = Describe("Reconciler", func() {
+	It("should reconcile every interval until it is signalled", func() {
+		fakeReconcilable := &cephfakes.FakeReconcilable{}
+		fakeReconcilable.ReconcileReturns(cephbroker.ReconcileReport{}, errors.New("failures are only logged"))
+		options := cephbroker.ReconcileOptions{RecreateMissingShares: true}
+
+		process := ifrit.Invoke(cephbroker.NewReconciler(lagertest.NewTestLogger("test-reconciler"), fakeReconcilable, 10*time.Millisecond, options))
+		Eventually(fakeReconcilable.ReconcileCallCount).Should(BeNumerically(">=", 2))
+		_, reconciledWith := fakeReconcilable.ReconcileArgsForCall(0)
+		Expect(reconciledWith).To(Equal(options))
+
+		process.Signal(os.Interrupt)
+		Eventually(process.Wait()).Should(Receive(BeNil()))
+	})
+})
@@ -0,0 +1,256 @@
+package cephbroker
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	DefaultLeaseDuration = 30 * time.Second
+	DefaultLockTimeout   = time.Minute
+
+	locksTable     = "locks"
+	stateLockName  = "state"
+	lockRetryDelay = 100 * time.Millisecond
+	// replicaLockPrefix names the lease rows that say a replica is still running
+	replicaLockPrefix = "replica:"
+)
+
+type sharedSqlStore struct {
+	*sqlStore
+
+	owner         string
+	leaseDuration time.Duration
+	lockTimeout   time.Duration
+
+	stopRenewing chan struct{}
+	renewing     sync.WaitGroup
+
+	stopHeartbeat chan struct{}
+	heartbeat     sync.WaitGroup
+}
+
+// NewSharedSqlStore is a SQL store for broker replicas that share a database.  The state lock is a lease row that the
+// holder renews every third of leaseDuration, so that the lock of a replica that dies is taken over once its lease has
+// expired.  Each replica also holds a lease on its own name for as long as its store is open, so that the others can
+// tell when it has died and take over its operations.  owner must be different for every replica; leases are compared
+// against each replica's own clock, so leaseDuration should be well above the clock skew between them.
+func NewSharedSqlStore(driver string, dataSourceName string, owner string, leaseDuration time.Duration, lockTimeout time.Duration) (SharedStore, error) {
+	if owner == "" {
+		return nil, fmt.Errorf("a shared sql store needs a replica name")
+	}
+
+	store, err := NewSqlStore(driver, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	s := &sharedSqlStore{
+		sqlStore:      store.(*sqlStore),
+		owner:         owner,
+		leaseDuration: leaseDuration,
+		lockTimeout:   lockTimeout,
+	}
+
+	if err := createLocksTable(s.db); err != nil {
+		s.sqlStore.Close()
+		return nil, err
+	}
+	if err := s.renewPresence(); err != nil {
+		s.sqlStore.Close()
+		return nil, fmt.Errorf("failed to register replica %s: %s", owner, err.Error())
+	}
+
+	s.stopHeartbeat = make(chan struct{})
+	s.heartbeat.Add(1)
+	go s.beat(s.stopHeartbeat)
+	return s, nil
+}
+
+func createLocksTable(db *sql.DB) error {
+	_, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (name VARCHAR(255) PRIMARY KEY, owner VARCHAR(255) NOT NULL, expires BIGINT NOT NULL)", sqlTable(locksTable)))
+	if err != nil {
+		return fmt.Errorf("failed to create table %s: %s", sqlTable(locksTable), err.Error())
+	}
+
+	// as with the generation row, another replica may be inserting the lock row too
+	db.Exec(fmt.Sprintf("INSERT INTO %s (name, owner, expires) VALUES ('%s', '', 0)", sqlTable(locksTable), stateLockName))
+
+	var rows int
+	err = db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE name = '%s'", sqlTable(locksTable), stateLockName)).Scan(&rows)
+	if err != nil || rows != 1 {
+		return fmt.Errorf("failed to initialize table %s", sqlTable(locksTable))
+	}
+	return nil
+}
+
+func (s *sharedSqlStore) Owner() string {
+	return s.owner
+}
+
+// Close gives up this replica's presence, so that the others take over the operations it leaves unfinished
+func (s *sharedSqlStore) Close() error {
+	close(s.stopHeartbeat)
+	s.heartbeat.Wait()
+
+	s.db.Exec(s.rebind(fmt.Sprintf("DELETE FROM %s WHERE name = ?", sqlTable(locksTable))), replicaLockPrefix+s.owner)
+	return s.sqlStore.Close()
+}
+
+// ReplicaAlive reports whether the lease of the named replica is still being renewed.  Replicas that never held one,
+// such as those of brokers that predate it, are taken to be gone.
+func (s *sharedSqlStore) ReplicaAlive(owner string) (bool, error) {
+	if owner == s.owner {
+		return true, nil
+	}
+
+	var expires int64
+	err := s.db.QueryRow(s.rebind(fmt.Sprintf("SELECT expires FROM %s WHERE name = ?", sqlTable(locksTable))), replicaLockPrefix+owner).Scan(&expires)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to look up replica %s: %s", owner, err.Error())
+	}
+	return expires >= time.Now().UnixNano(), nil
+}
+
+// LiveReplicas lists the other replicas whose leases are still being renewed, in order
+func (s *sharedSqlStore) LiveReplicas() ([]string, error) {
+	rows, err := s.db.Query(
+		s.rebind(fmt.Sprintf("SELECT owner FROM %s WHERE name LIKE ? AND owner <> ? AND expires >= ? ORDER BY owner", sqlTable(locksTable))),
+		replicaLockPrefix+"%", s.owner, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list replicas: %s", err.Error())
+	}
+	defer rows.Close()
+
+	replicas := []string{}
+	for rows.Next() {
+		var owner string
+		if err := rows.Scan(&owner); err != nil {
+			return nil, fmt.Errorf("failed to list replicas: %s", err.Error())
+		}
+		replicas = append(replicas, owner)
+	}
+	return replicas, rows.Err()
+}
+
+// renewPresence extends this replica's lease on its own name, creating it the first time
+func (s *sharedSqlStore) renewPresence() error {
+	expires := time.Now().Add(s.leaseDuration).UnixNano()
+	result, err := s.db.Exec(s.rebind(fmt.Sprintf("UPDATE %s SET owner = ?, expires = ? WHERE name = ?", sqlTable(locksTable))), s.owner, expires, replicaLockPrefix+s.owner)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 1 {
+		return nil
+	}
+	_, err = s.db.Exec(s.rebind(fmt.Sprintf("INSERT INTO %s (name, owner, expires) VALUES (?, ?, ?)", sqlTable(locksTable))), replicaLockPrefix+s.owner, s.owner, expires)
+	return err
+}
+
+func (s *sharedSqlStore) beat(stop chan struct{}) {
+	defer s.heartbeat.Done()
+
+	ticker := time.NewTicker(s.leaseDuration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			// a missed beat is made up by the next one, well before the lease runs out
+			s.renewPresence()
+		}
+	}
+}
+
+func (s *sharedSqlStore) Lock(logger lager.Logger) error {
+	logger = logger.Session("lock-state", lager.Data{"owner": s.owner})
+
+	deadline := time.Now().Add(s.lockTimeout)
+	for {
+		acquired, err := s.tryLock()
+		if err != nil {
+			logger.Error("failed-to-lock-state", err)
+			return fmt.Errorf("failed to lock broker state: %s", err.Error())
+		}
+		if acquired {
+			break
+		}
+		if time.Now().After(deadline) {
+			logger.Info("timed-out")
+			return ErrStateLocked
+		}
+		time.Sleep(lockRetryDelay)
+	}
+
+	s.stopRenewing = make(chan struct{})
+	s.renewing.Add(1)
+	go s.renewLease(logger, s.stopRenewing)
+	return nil
+}
+
+func (s *sharedSqlStore) Unlock(logger lager.Logger) {
+	logger = logger.Session("unlock-state", lager.Data{"owner": s.owner})
+
+	close(s.stopRenewing)
+	s.renewing.Wait()
+
+	_, err := s.db.Exec(s.rebind(fmt.Sprintf("UPDATE %s SET owner = '', expires = 0 WHERE name = ? AND owner = ?", sqlTable(locksTable))), stateLockName, s.owner)
+	if err != nil {
+		// the lease runs out by itself
+		logger.Error("failed-to-unlock-state", err)
+	}
+}
+
+// tryLock takes the lease if nobody holds it, its holder let it expire, or we already hold it after a restart
+func (s *sharedSqlStore) tryLock() (bool, error) {
+	now := time.Now()
+	result, err := s.db.Exec(
+		s.rebind(fmt.Sprintf("UPDATE %s SET owner = ?, expires = ? WHERE name = ? AND (owner = '' OR owner = ? OR expires < ?)", sqlTable(locksTable))),
+		s.owner, now.Add(s.leaseDuration).UnixNano(), stateLockName, s.owner, now.UnixNano(),
+	)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return updated == 1, nil
+}
+
+func (s *sharedSqlStore) renewLease(logger lager.Logger, stop chan struct{}) {
+	defer s.renewing.Done()
+
+	ticker := time.NewTicker(s.leaseDuration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			result, err := s.db.Exec(
+				s.rebind(fmt.Sprintf("UPDATE %s SET expires = ? WHERE name = ? AND owner = ?", sqlTable(locksTable))),
+				time.Now().Add(s.leaseDuration).UnixNano(), stateLockName, s.owner,
+			)
+			if err != nil {
+				logger.Error("failed-to-renew-lease", err)
+				continue
+			}
+			if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+				// another replica has taken over; whatever we save now fails with ErrStateConflict if it has saved too
+				logger.Error("lost-lease", fmt.Errorf("the lease of %s was taken over by another replica", s.owner))
+				return
+			}
+		}
+	}
+}
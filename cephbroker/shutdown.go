@@ -0,0 +1,66 @@
+package cephbroker
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"github.com/tedsuo/ifrit"
+)
+
+//go:generate counterfeiter -o ../cephfakes/fake_drainable.go . Drainable
+
+type Drainable interface {
+	// Drain waits for the operations running in the background to finish, and reports whether they did in time
+	Drain(logger lager.Logger, timeout time.Duration) bool
+}
+
+// NewShutdown waits until it is signalled, then drains the broker and unmounts the filesystem.  It belongs ahead of
+// the broker API in an ordered group, so that it is signalled after the API has stopped taking and finished serving
+// requests.  If the broker does not drain in time the filesystem is left mounted, as unmounting it would fail the
+// operations still using it; those are resumed when the broker restarts.
+func NewShutdown(logger lager.Logger, drainable Drainable, controller Controller, drainTimeout time.Duration) ifrit.Runner {
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		close(ready)
+		<-signals
+
+		logger := logger.Session("shutdown", lager.Data{"drain-timeout": drainTimeout.String()})
+		logger.Info("start")
+		defer logger.Info("end")
+
+		if !drainable.Drain(logger, drainTimeout) {
+			logger.Info("operations-still-running-leaving-filesystem-mounted")
+			return nil
+		}
+
+		response := controller.UnmountFileSystem(driverhttp.NewHttpDriverEnv(logger, context.Background()))
+		if response.Err != "" {
+			// failing here would only stop the state store from being closed cleanly
+			logger.Error("failed-to-unmount-filesystem", errors.New(response.Err))
+		}
+		return nil
+	})
+}
+
+// Drain waits for the broker's asynchronous operations to finish
+func (b *broker) Drain(logger lager.Logger, timeout time.Duration) bool {
+	logger = logger.Session("drain")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	drained := make(chan struct{})
+	go func() {
+		b.operations.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,124 @@
+package cephbroker_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/cephbroker/cephbroker"
+	"code.cloudfoundry.org/cephbroker/cephfakes"
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/tedsuo/ifrit"
+)
+
+var _ = Describe("Shutdown", func() {
+	var (
+		fakeDrainable  *cephfakes.FakeDrainable
+		fakeController *cephfakes.FakeController
+		process        ifrit.Process
+	)
+
+	BeforeEach(func() {
+		fakeDrainable = &cephfakes.FakeDrainable{}
+		fakeController = &cephfakes.FakeController{}
+	})
+
+	JustBeforeEach(func() {
+		process = ifrit.Invoke(cephbroker.NewShutdown(lagertest.NewTestLogger("test-shutdown"), fakeDrainable, fakeController, time.Minute))
+	})
+
+	It("should do nothing until it is signalled", func() {
+		Consistently(fakeDrainable.DrainCallCount).Should(Equal(0))
+		Expect(fakeController.UnmountFileSystemCallCount()).To(Equal(0))
+		process.Signal(os.Interrupt)
+		Eventually(process.Wait()).Should(Receive(BeNil()))
+	})
+
+	Context("when the broker drains", func() {
+		BeforeEach(func() {
+			fakeDrainable.DrainReturns(true)
+		})
+
+		It("should unmount the filesystem", func() {
+			process.Signal(os.Interrupt)
+			Eventually(process.Wait()).Should(Receive(BeNil()))
+
+			_, timeout := fakeDrainable.DrainArgsForCall(0)
+			Expect(timeout).To(Equal(time.Minute))
+			Expect(fakeController.UnmountFileSystemCallCount()).To(Equal(1))
+		})
+
+		It("should still stop when the filesystem cannot be unmounted", func() {
+			fakeController.UnmountFileSystemReturns(voldriver.ErrorResponse{Err: "device is busy"})
+			process.Signal(os.Interrupt)
+			Eventually(process.Wait()).Should(Receive(BeNil()))
+		})
+	})
+
+	Context("when the broker does not drain in time", func() {
+		It("should leave the filesystem mounted", func() {
+			process.Signal(os.Interrupt)
+			Eventually(process.Wait()).Should(Receive(BeNil()))
+			Expect(fakeController.UnmountFileSystemCallCount()).To(Equal(0))
+		})
+	})
+})
+
+var _ = Describe("Drain", func() {
+	var (
+		stateDir       string
+		fakeController *cephfakes.FakeController
+		drainable      cephbroker.Drainable
+		broker         brokerapi.ServiceBroker
+	)
+
+	BeforeEach(func() {
+		var err error
+		stateDir, err = ioutil.TempDir("", "cephbroker-drain")
+		Expect(err).NotTo(HaveOccurred())
+
+		fakeController = &cephfakes.FakeController{}
+		fakeController.ForBackendReturns(fakeController, nil)
+		subject, err := cephbroker.New(
+			lagertest.NewTestLogger("test-drain"), fakeController,
+			cephbroker.NewCatalog("service-name", "service-id", "plan-name", "plan-id", "plan-desc"),
+			cephbroker.NewFileStore(filepath.Join(stateDir, "state.json"), &osshim.OsShim{}, &ioutilshim.IoutilShim{}), nil,
+		)
+		Expect(err).NotTo(HaveOccurred())
+		broker, drainable = subject, subject
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(stateDir)
+	})
+
+	It("should drain at once when nothing is running", func() {
+		Expect(drainable.Drain(lagertest.NewTestLogger("test-drain"), time.Millisecond)).To(BeTrue())
+	})
+
+	It("should wait for asynchronous operations to finish", func() {
+		release := make(chan struct{})
+		fakeController.CreateStub = func(voldriver.Env, voldriver.CreateRequest) voldriver.ErrorResponse {
+			<-release
+			return voldriver.ErrorResponse{}
+		}
+		_, err := broker.Provision(context.TODO(), "instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id"}, true)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(drainable.Drain(lagertest.NewTestLogger("test-drain"), 10*time.Millisecond)).To(BeFalse())
+
+		close(release)
+		Expect(drainable.Drain(lagertest.NewTestLogger("test-drain"), time.Minute)).To(BeTrue())
+		operation, err := broker.LastOperation(context.TODO(), "instance-id", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(operation.State).To(Equal(brokerapi.Succeeded))
+	})
+})
@@ -0,0 +1,229 @@
+package cephbroker
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	SqlDriverSqlite   = "sqlite3"
+	SqlDriverMysql    = "mysql"
+	SqlDriverPostgres = "postgres"
+
+	sqlTablePrefix = "cephbroker_"
+	// the generation table holds a single row counting the saves, which tells a store whether anyone else has saved
+	// since it last read the state
+	generationTable = "generation"
+	// the version table holds a single row with the StateVersion of the records
+	versionTable = "version"
+)
+
+type sqlStore struct {
+	db     *sql.DB
+	driver string
+	saved  stateRecords
+
+	generation int64
+	// version is the one in the version table, or 0 before it has one
+	version int
+}
+
+// NewSqlStore keeps the broker's state in a SQL database, with a table per kind of record.  dataSourceName is passed
+// to the driver unchanged: a file name for sqlite3, or a DSN for mysql and postgres.
+func NewSqlStore(driver string, dataSourceName string) (Store, error) {
+	switch driver {
+	case SqlDriverSqlite, SqlDriverMysql, SqlDriverPostgres:
+	default:
+		return nil, fmt.Errorf("unsupported sql driver '%s'", driver)
+	}
+
+	db, err := sql.Open(driver, dataSourceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s database: %s", driver, err.Error())
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to %s database: %s", driver, err.Error())
+	}
+
+	for _, table := range stateTables {
+		_, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id VARCHAR(255) PRIMARY KEY, value TEXT NOT NULL)", sqlTable(table)))
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create table %s: %s", sqlTable(table), err.Error())
+		}
+	}
+
+	_, err = db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id INTEGER PRIMARY KEY, version INTEGER NOT NULL)", sqlTable(versionTable)))
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create table %s: %s", sqlTable(versionTable), err.Error())
+	}
+
+	if err := createGenerationTable(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqlStore{db: db, driver: driver, saved: newStateRecords()}, nil
+}
+
+func createGenerationTable(db *sql.DB) error {
+	_, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id INTEGER PRIMARY KEY, generation BIGINT NOT NULL)", sqlTable(generationTable)))
+	if err != nil {
+		return fmt.Errorf("failed to create table %s: %s", sqlTable(generationTable), err.Error())
+	}
+
+	// another replica may insert the row at the same time, so only its absence afterwards is an error
+	db.Exec(fmt.Sprintf("INSERT INTO %s (id, generation) VALUES (1, 0)", sqlTable(generationTable)))
+
+	var rows int
+	if err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id = 1", sqlTable(generationTable))).Scan(&rows); err != nil || rows != 1 {
+		return fmt.Errorf("failed to initialize table %s", sqlTable(generationTable))
+	}
+	return nil
+}
+
+func (s *sqlStore) Restore(logger lager.Logger) (State, error) {
+	logger = logger.Session("sql-store-restore", lager.Data{"driver": s.driver})
+
+	var generation int64
+	err := s.db.QueryRow(fmt.Sprintf("SELECT generation FROM %s WHERE id = 1", sqlTable(generationTable))).Scan(&generation)
+	if err != nil {
+		return State{}, fmt.Errorf("failed to read table %s: %s", sqlTable(generationTable), err.Error())
+	}
+
+	records := newStateRecords()
+	for _, table := range stateTables {
+		rows, err := s.db.Query(fmt.Sprintf("SELECT id, value FROM %s", sqlTable(table)))
+		if err != nil {
+			return State{}, fmt.Errorf("failed to read table %s: %s", sqlTable(table), err.Error())
+		}
+
+		for rows.Next() {
+			var id, value string
+			if err := rows.Scan(&id, &value); err != nil {
+				rows.Close()
+				return State{}, fmt.Errorf("failed to read table %s: %s", sqlTable(table), err.Error())
+			}
+			records[table][id] = []byte(value)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return State{}, fmt.Errorf("failed to read table %s: %s", sqlTable(table), err.Error())
+		}
+	}
+
+	var savedVersion int
+	err = s.db.QueryRow(fmt.Sprintf("SELECT version FROM %s WHERE id = 1", sqlTable(versionTable))).Scan(&savedVersion)
+	if err != nil && err != sql.ErrNoRows {
+		return State{}, fmt.Errorf("failed to read table %s: %s", sqlTable(versionTable), err.Error())
+	}
+	version := savedVersion
+	if err == sql.ErrNoRows {
+		version = unversionedStateVersion(records)
+	}
+
+	state, err := recordsToState(version, records)
+	if err != nil {
+		return State{}, err
+	}
+
+	s.saved = records
+	s.generation = generation
+	s.version = savedVersion
+	logger.Info("state-read", lager.Data{"generation": generation, "version": version})
+	return state, nil
+}
+
+func (s *sqlStore) Save(logger lager.Logger, state State) error {
+	records, err := stateToRecords(state)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// saving over state that someone else saved after we read it would silently undo their changes
+	result, err := tx.Exec(s.rebind(fmt.Sprintf("UPDATE %s SET generation = ? WHERE id = 1 AND generation = ?", sqlTable(generationTable))), s.generation+1, s.generation)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated != 1 {
+		tx.Rollback()
+		return ErrStateConflict
+	}
+
+	if s.version != StateVersion {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = 1", sqlTable(versionTable))); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(s.rebind(fmt.Sprintf("INSERT INTO %s (id, version) VALUES (1, ?)", sqlTable(versionTable))), StateVersion); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = records.applyChanges(s.saved,
+		func(table, id string, value []byte) error {
+			// delete and insert rather than upsert, which every database spells differently
+			if _, err := tx.Exec(s.rebind(fmt.Sprintf("DELETE FROM %s WHERE id = ?", sqlTable(table))), id); err != nil {
+				return err
+			}
+			_, err := tx.Exec(s.rebind(fmt.Sprintf("INSERT INTO %s (id, value) VALUES (?, ?)", sqlTable(table))), id, string(value))
+			return err
+		},
+		func(table, id string) error {
+			_, err := tx.Exec(s.rebind(fmt.Sprintf("DELETE FROM %s WHERE id = ?", sqlTable(table))), id)
+			return err
+		},
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.saved = records
+	s.generation++
+	s.version = StateVersion
+	logger.Info("state-saved", lager.Data{"driver": s.driver, "generation": s.generation})
+	return nil
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// rebind turns ? placeholders into the $1, $2... that postgres expects
+func (s *sqlStore) rebind(query string) string {
+	if s.driver != SqlDriverPostgres {
+		return query
+	}
+
+	parts := strings.Split(query, "?")
+	rebound := parts[0]
+	for i, part := range parts[1:] {
+		rebound += fmt.Sprintf("$%d%s", i+1, part)
+	}
+	return rebound
+}
+
+func sqlTable(table string) string {
+	return sqlTablePrefix + table
+}
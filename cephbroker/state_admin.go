@@ -0,0 +1,169 @@
+package cephbroker
+
+import (
+	"path/filepath"
+	"sort"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// StateName is where in dataDir the stores keep the broker's state, less the extension each store adds.  State is
+// named after the first service so that brokers for different services can share a dataDir.
+func StateName(dataDir string, catalog Catalog) string {
+	return filepath.Join(dataDir, catalog.Services[0].Name+"-services")
+}
+
+// ReadState restores the saved state to be looked at outside the broker.  Encrypted parameters are decrypted when a
+// cipher is given, and left out otherwise.
+func ReadState(logger lager.Logger, store Store, cipher *StateCipher) (State, error) {
+	state, err := store.Restore(logger)
+	if err != nil || cipher == nil {
+		return state, err
+	}
+	state, _, err = cipher.openState(state)
+	return state, err
+}
+
+// EditState changes the saved state outside the broker, holding the lock of a shared store while it does so that no
+// replica works from a stale copy.  Brokers that do not share their store must be stopped first, or they overwrite the
+// change with the state they hold.  Parameters are saved as they were found, encrypted or not, so no keys are needed.
+func EditState(logger lager.Logger, store Store, edit func(State) (State, error)) error {
+	logger = logger.Session("edit-state")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if shared, ok := store.(SharedStore); ok {
+		if err := shared.Lock(logger); err != nil {
+			return err
+		}
+		defer shared.Unlock(logger)
+	}
+
+	state, err := store.Restore(logger)
+	if err != nil {
+		return err
+	}
+	if state, err = edit(state); err != nil {
+		return err
+	}
+	return store.Save(logger, state)
+}
+
+// ExportState encodes state in the state file format, whichever store it came from
+func ExportState(state State) ([]byte, error) {
+	return marshalStateFile(state)
+}
+
+// ImportState decodes exported state, or a state file, migrating it from older formats
+func ImportState(data []byte) (State, error) {
+	version, records, err := parseStateFile(data)
+	if err != nil {
+		return State{}, err
+	}
+	return recordsToState(version, records)
+}
+
+// PurgeBinding removes a binding from the state without revoking its client key, for bindings that cannot be unbound
+func PurgeBinding(state State, bindingID string) error {
+	if _, ok := state.BindingMap[bindingID]; !ok {
+		return brokerapi.ErrBindingDoesNotExist
+	}
+	delete(state.BindingMap, bindingID)
+	delete(state.BindingInfoMap, bindingID)
+	return nil
+}
+
+// ForceDeleteInstance removes an instance and its bindings from the state, whatever operation it is stuck in, without
+// deleting its share.  It returns the bindings that went with it.
+func ForceDeleteInstance(state State, instanceID string) ([]string, error) {
+	if _, ok := state.InstanceMap[instanceID]; !ok {
+		return nil, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	bindings := []string{}
+	for bindingID, info := range state.BindingInfoMap {
+		if info.InstanceID == instanceID {
+			bindings = append(bindings, bindingID)
+			delete(state.BindingMap, bindingID)
+			delete(state.BindingInfoMap, bindingID)
+		}
+	}
+	sort.Strings(bindings)
+
+	delete(state.InstanceMap, instanceID)
+	delete(state.InstanceInfoMap, instanceID)
+	delete(state.OperationMap, instanceID)
+	delete(state.SnapshotMap, instanceID)
+	return bindings, nil
+}
+
+// DescribeInstances describes every instance in the state, without their parameters, or only the given one, with
+// them.  The quota and usage of their shares are left out, as only the filesystem knows them.
+func DescribeInstances(state State, catalog Catalog, onlyInstanceID string) []InstanceResponseBody {
+	bindings := map[string][]string{}
+	for bindingID, info := range state.BindingInfoMap {
+		bindings[info.InstanceID] = append(bindings[info.InstanceID], bindingID)
+	}
+
+	instances := []InstanceResponseBody{}
+	for instanceID, details := range state.InstanceMap {
+		if onlyInstanceID != "" && instanceID != onlyInstanceID {
+			continue
+		}
+
+		info := state.InstanceInfoMap[instanceID]
+		instance := InstanceResponseBody{
+			InstanceID:       instanceID,
+			ServiceID:        details.ServiceID,
+			PlanID:           details.PlanID,
+			OrganizationGUID: details.OrganizationGUID,
+			SpaceGUID:        details.SpaceGUID,
+			SharePath:        info.SharePath,
+			Backend:          info.Backend,
+			CreatedAt:        info.CreatedAt,
+			Bindings:         append([]string{}, bindings[instanceID]...),
+		}
+		if onlyInstanceID != "" {
+			instance.Parameters = details.RawParameters
+		}
+		if plan, err := catalog.FindPlan(details.ServiceID, details.PlanID); err == nil {
+			instance.PlanName = plan.Name
+		}
+		if operation, ok := state.OperationMap[instanceID]; ok {
+			instance.LastOperation = &operation
+		}
+		sort.Strings(instance.Bindings)
+		instances = append(instances, instance)
+	}
+
+	sort.Slice(instances, func(i, j int) bool { return instances[i].InstanceID < instances[j].InstanceID })
+	return instances
+}
+
+// DescribeBindings describes every binding in the state, without their parameters, or only the given one, with them
+func DescribeBindings(state State, onlyBindingID string) []BindingResponseBody {
+	bindings := []BindingResponseBody{}
+	for bindingID, details := range state.BindingMap {
+		if onlyBindingID != "" && bindingID != onlyBindingID {
+			continue
+		}
+
+		info := state.BindingInfoMap[bindingID]
+		binding := BindingResponseBody{
+			BindingID:  bindingID,
+			InstanceID: info.InstanceID,
+			AppGUID:    details.AppGUID,
+			ServiceID:  details.ServiceID,
+			PlanID:     details.PlanID,
+			CreatedAt:  info.CreatedAt,
+		}
+		if onlyBindingID != "" {
+			binding.Parameters = details.Parameters
+		}
+		bindings = append(bindings, binding)
+	}
+
+	sort.Slice(bindings, func(i, j int) bool { return bindings[i].BindingID < bindings[j].BindingID })
+	return bindings
+}
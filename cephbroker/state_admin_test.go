@@ -0,0 +1,153 @@
+package cephbroker_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/cephbroker/cephbroker"
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var _ = Describe("State administration", func() {
+	var (
+		logger   lager.Logger
+		stateDir string
+		store    cephbroker.Store
+		state    cephbroker.State
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test-state-admin")
+
+		var err error
+		stateDir, err = ioutil.TempDir("", "cephbroker-state-admin")
+		Expect(err).NotTo(HaveOccurred())
+		store = cephbroker.NewFileStore(filepath.Join(stateDir, "state.json"), &osshim.OsShim{}, &ioutilshim.IoutilShim{})
+
+		state = cephbroker.NewState()
+		state.InstanceMap["instance-1"] = brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id", RawParameters: json.RawMessage(`{"quota":"10G"}`)}
+		state.InstanceMap["instance-2"] = brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id"}
+		state.InstanceInfoMap["instance-1"] = cephbroker.InstanceInfo{SharePath: "/volumes/instance-1", CreatedAt: time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)}
+		state.InstanceInfoMap["instance-2"] = cephbroker.InstanceInfo{CreatedAt: time.Date(2016, 10, 2, 12, 0, 0, 0, time.UTC)}
+		state.BindingMap["binding-1"] = brokerapi.BindDetails{AppGUID: "app-guid", Parameters: map[string]interface{}{"readonly": true}}
+		state.BindingInfoMap["binding-1"] = cephbroker.BindingInfo{InstanceID: "instance-1", CreatedAt: time.Date(2016, 10, 3, 12, 0, 0, 0, time.UTC)}
+		state.BindingMap["binding-2"] = brokerapi.BindDetails{AppGUID: "app-guid"}
+		state.BindingInfoMap["binding-2"] = cephbroker.BindingInfo{InstanceID: "instance-2", CreatedAt: time.Date(2016, 10, 4, 12, 0, 0, 0, time.UTC)}
+		state.OperationMap["instance-1"] = cephbroker.OperationState{Type: "deprovision", State: brokerapi.Failed}
+		state.SnapshotMap["instance-1"] = []string{"snap1"}
+		Expect(store.Save(logger, state)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(stateDir)
+	})
+
+	It("should export state and import it again", func() {
+		data, err := cephbroker.ExportState(state)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring(`"version":5`))
+
+		imported, err := cephbroker.ImportState(data)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(imported).To(Equal(state))
+	})
+
+	It("should import state saved in older formats", func() {
+		imported, err := cephbroker.ImportState([]byte(`{"InstanceMap": {"instance-1": {"service_id": "service-id", "plan_id": "plan-id"}}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(imported.InstanceMap).To(HaveKey("instance-1"))
+	})
+
+	It("should save edits to the state", func() {
+		err := cephbroker.EditState(logger, store, func(state cephbroker.State) (cephbroker.State, error) {
+			return state, cephbroker.PurgeBinding(state, "binding-1")
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		restored, err := store.Restore(logger)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(restored.BindingMap).NotTo(HaveKey("binding-1"))
+		Expect(restored.BindingInfoMap).NotTo(HaveKey("binding-1"))
+		Expect(restored.BindingMap).To(HaveKey("binding-2"))
+	})
+
+	It("should not save edits that fail", func() {
+		err := cephbroker.EditState(logger, store, func(state cephbroker.State) (cephbroker.State, error) {
+			delete(state.InstanceMap, "instance-2")
+			return state, errors.New("badness")
+		})
+		Expect(err).To(MatchError("badness"))
+
+		restored, err := store.Restore(logger)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(restored).To(Equal(state))
+	})
+
+	It("should error when purging a binding that does not exist", func() {
+		Expect(cephbroker.PurgeBinding(state, "nonexistant-binding-id")).To(Equal(brokerapi.ErrBindingDoesNotExist))
+	})
+
+	It("should force delete an instance along with its bindings", func() {
+		bindings, err := cephbroker.ForceDeleteInstance(state, "instance-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bindings).To(Equal([]string{"binding-1"}))
+
+		Expect(state.InstanceMap).NotTo(HaveKey("instance-1"))
+		Expect(state.InstanceInfoMap).NotTo(HaveKey("instance-1"))
+		Expect(state.OperationMap).NotTo(HaveKey("instance-1"))
+		Expect(state.SnapshotMap).NotTo(HaveKey("instance-1"))
+		Expect(state.BindingMap).To(HaveLen(1))
+		Expect(state.BindingMap).To(HaveKey("binding-2"))
+	})
+
+	It("should error when force deleting an instance that does not exist", func() {
+		_, err := cephbroker.ForceDeleteInstance(state, "nonexistant-instance-id")
+		Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
+	})
+
+	It("should describe the instances and bindings in the state", func() {
+		catalog := cephbroker.NewCatalog("service-name", "service-id", "plan-name", "plan-id", "plan-desc")
+		instances := cephbroker.DescribeInstances(state, catalog, "")
+		Expect(instances).To(HaveLen(2))
+		Expect(instances[0].InstanceID).To(Equal("instance-1"))
+		Expect(instances[0].PlanName).To(Equal("plan-name"))
+		Expect(instances[0].Bindings).To(Equal([]string{"binding-1"}))
+		Expect(instances[0].LastOperation.State).To(Equal(brokerapi.Failed))
+		Expect(instances[0].Parameters).To(BeNil())
+
+		bindings := cephbroker.DescribeBindings(state, "")
+		Expect(bindings).To(HaveLen(2))
+		Expect(bindings[0].Parameters).To(BeNil())
+
+		bindings = cephbroker.DescribeBindings(state, "binding-1")
+		Expect(bindings).To(HaveLen(1))
+		Expect(bindings[0].Parameters).To(Equal(map[string]interface{}{"readonly": true}))
+	})
+
+	It("should leave encrypted parameters out when read without the keys", func() {
+		stateCipher, err := cephbroker.NewStateCipher("key1:" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32))))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = cephbroker.New(logger, nil, cephbroker.NewCatalog("service-name", "service-id", "plan-name", "plan-id", "plan-desc"), store, stateCipher)
+		Expect(err).NotTo(HaveOccurred())
+
+		read, err := cephbroker.ReadState(logger, store, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(read.InstanceMap["instance-1"].RawParameters).To(BeEmpty())
+
+		read, err = cephbroker.ReadState(logger, store, stateCipher)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(read.InstanceMap["instance-1"].RawParameters).To(MatchJSON(`{"quota":"10G"}`))
+	})
+})
@@ -0,0 +1,254 @@
+package cephbroker
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// StateKeysEnv is the environment variable the broker reads its state keys from when no key file is given
+const StateKeysEnv = "CEPHBROKER_STATE_KEYS"
+
+var ErrStateKeyMissing = errors.New("the broker state is encrypted, but no state key was given")
+
+// StateCipher encrypts the parameters of instances and bindings before they are saved, as they may hold secrets.
+// Each value is encrypted with its own random data key using AES-GCM, and the data key is in turn encrypted with the
+// current state key.  Older keys are only used to decrypt what was saved before the keys were rotated.
+type StateCipher struct {
+	currentKeyID string
+	keys         map[string]cipher.AEAD
+}
+
+// sealedValue is how an encrypted value is saved.  Nonces are kept in front of the ciphertexts they belong to.
+type sealedValue struct {
+	KeyID   string `json:"key_id"`
+	DataKey []byte `json:"data_key"`
+	Data    []byte `json:"data"`
+}
+
+// NewStateCipher reads state keys given one per line as '<key id>:<base64 encoded AES key>'.  The first key is the
+// current one; blank lines and lines starting with '#' are ignored.
+func NewStateCipher(keys string) (*StateCipher, error) {
+	c := &StateCipher{keys: map[string]cipher.AEAD{}}
+	for n, line := range strings.Split(keys, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("state key on line %d is not of the form '<key id>:<base64 key>'", n+1)
+		}
+		keyID := parts[0]
+		if _, ok := c.keys[keyID]; ok {
+			return nil, fmt.Errorf("state key '%s' is given more than once", keyID)
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("state key '%s' is not valid base64: %s", keyID, err.Error())
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("state key '%s' is not a valid AES key: %s", keyID, err.Error())
+		}
+
+		c.keys[keyID] = aead
+		if c.currentKeyID == "" {
+			c.currentKeyID = keyID
+		}
+	}
+
+	if c.currentKeyID == "" {
+		return nil, errors.New("no state keys given")
+	}
+	return c, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts a value.  The context, which names the record the value belongs to, is authenticated along with it,
+// so that sealed values cannot be moved from one record to another.
+func (c *StateCipher) seal(value []byte, context string) (json.RawMessage, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := sealWith(dataAEAD, value, context)
+	if err != nil {
+		return nil, err
+	}
+	sealedDataKey, err := sealWith(c.keys[c.currentKeyID], dataKey, c.currentKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(sealedValue{KeyID: c.currentKeyID, DataKey: sealedDataKey, Data: data})
+}
+
+// open decrypts a sealed value, and reports whether it was sealed with a key other than the current one
+func (c *StateCipher) open(sealed json.RawMessage, context string) ([]byte, bool, error) {
+	value := sealedValue{}
+	if err := json.Unmarshal(sealed, &value); err != nil {
+		return nil, false, fmt.Errorf("failed to decode sealed value: %s", err.Error())
+	}
+
+	keyAEAD, ok := c.keys[value.KeyID]
+	if !ok {
+		return nil, false, fmt.Errorf("value was sealed with unknown state key '%s'", value.KeyID)
+	}
+	dataKey, err := openWith(keyAEAD, value.DataKey, value.KeyID)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to decrypt data key with state key '%s': %s", value.KeyID, err.Error())
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, false, err
+	}
+	data, err := openWith(dataAEAD, value.Data, context)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to decrypt value: %s", err.Error())
+	}
+
+	return data, value.KeyID != c.currentKeyID, nil
+}
+
+func sealWith(aead cipher.AEAD, plaintext []byte, additionalData string) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(additionalData)), nil
+}
+
+func openWith(aead cipher.AEAD, ciphertext []byte, additionalData string) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce := ciphertext[:aead.NonceSize()]
+	return aead.Open(nil, nonce, ciphertext[aead.NonceSize():], []byte(additionalData))
+}
+
+// sealState returns a copy of the state in which the parameters of instances and bindings are sealed.  Values that
+// are still sealed with the current key from when they were restored are kept as they are, so that saving does not
+// rewrite records that have not changed.
+func (c *StateCipher) sealState(state State) (State, error) {
+	sealed := state
+	sealed.InstanceMap = map[string]brokerapi.ProvisionDetails{}
+	sealed.InstanceInfoMap = map[string]InstanceInfo{}
+	sealed.BindingMap = map[string]brokerapi.BindDetails{}
+	sealed.BindingInfoMap = map[string]BindingInfo{}
+
+	for id, details := range state.InstanceMap {
+		info := state.InstanceInfoMap[id]
+		sealedParameters, err := c.reseal(info.SealedParameters, details.RawParameters, instancesTable+"/"+id)
+		if err != nil {
+			return State{}, fmt.Errorf("failed to encrypt parameters of instance '%s': %s", id, err.Error())
+		}
+		details.RawParameters = nil
+		info.SealedParameters = sealedParameters
+		sealed.InstanceMap[id] = details
+		sealed.InstanceInfoMap[id] = info
+	}
+
+	for id, details := range state.BindingMap {
+		info := state.BindingInfoMap[id]
+		var parameters []byte
+		if details.Parameters != nil {
+			var err error
+			if parameters, err = json.Marshal(details.Parameters); err != nil {
+				return State{}, fmt.Errorf("failed to encode parameters of binding '%s': %s", id, err.Error())
+			}
+		}
+		sealedParameters, err := c.reseal(info.SealedParameters, parameters, bindingsTable+"/"+id)
+		if err != nil {
+			return State{}, fmt.Errorf("failed to encrypt parameters of binding '%s': %s", id, err.Error())
+		}
+		details.Parameters = nil
+		info.SealedParameters = sealedParameters
+		sealed.BindingMap[id] = details
+		sealed.BindingInfoMap[id] = info
+	}
+	return sealed, nil
+}
+
+// reseal seals parameters, unless the previously sealed value already holds them under the current key
+func (c *StateCipher) reseal(previous json.RawMessage, parameters []byte, context string) (json.RawMessage, error) {
+	if len(parameters) == 0 {
+		return nil, nil
+	}
+	if previous != nil {
+		if opened, stale, err := c.open(previous, context); err == nil && !stale && bytes.Equal(opened, parameters) {
+			return previous, nil
+		}
+	}
+	return c.seal(parameters, context)
+}
+
+// openState decrypts the parameters that sealState sealed, and reports whether any of them need sealing again: because
+// they were sealed with an older key, or saved before encryption was turned on.  The sealed values are kept alongside
+// the parameters so that unchanged ones can be saved again as they are.  A nil cipher can only open state that holds
+// no sealed values.
+func (c *StateCipher) openState(state State) (State, bool, error) {
+	resealing := false
+	open := func(sealed json.RawMessage, context string) ([]byte, error) {
+		if c == nil {
+			return nil, ErrStateKeyMissing
+		}
+		parameters, stale, err := c.open(sealed, context)
+		resealing = resealing || stale
+		return parameters, err
+	}
+
+	for id, info := range state.InstanceInfoMap {
+		details := state.InstanceMap[id]
+		if info.SealedParameters == nil {
+			resealing = resealing || (c != nil && len(details.RawParameters) > 0)
+			continue
+		}
+		parameters, err := open(info.SealedParameters, instancesTable+"/"+id)
+		if err != nil {
+			return State{}, false, fmt.Errorf("failed to decrypt parameters of instance '%s': %s", id, err.Error())
+		}
+		details.RawParameters = parameters
+		state.InstanceMap[id] = details
+	}
+
+	for id, info := range state.BindingInfoMap {
+		details := state.BindingMap[id]
+		if info.SealedParameters == nil {
+			resealing = resealing || (c != nil && details.Parameters != nil)
+			continue
+		}
+		parameters, err := open(info.SealedParameters, bindingsTable+"/"+id)
+		if err != nil {
+			return State{}, false, fmt.Errorf("failed to decrypt parameters of binding '%s': %s", id, err.Error())
+		}
+		details.Parameters = nil
+		if err := json.Unmarshal(parameters, &details.Parameters); err != nil {
+			return State{}, false, fmt.Errorf("failed to decode parameters of binding '%s': %s", id, err.Error())
+		}
+		state.BindingMap[id] = details
+	}
+	return state, resealing, nil
+}
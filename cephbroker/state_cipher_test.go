@@ -0,0 +1,46 @@
+package cephbroker_test
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"code.cloudfoundry.org/cephbroker/cephbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("StateCipher", func() {
+	var key string
+
+	BeforeEach(func() {
+		key = base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+	})
+
+	It("should accept keys one per line, ignoring comments and blank lines", func() {
+		_, err := cephbroker.NewStateCipher("# current key first\n\nnew:" + key + "\n  old:" + key + "  \n")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should refuse no keys", func() {
+		_, err := cephbroker.NewStateCipher("# nothing here\n")
+		Expect(err).To(MatchError("no state keys given"))
+	})
+
+	It("should refuse malformed lines", func() {
+		_, err := cephbroker.NewStateCipher("key:" + key + "\n" + key)
+		Expect(err).To(MatchError(ContainSubstring("line 2")))
+	})
+
+	It("should refuse keys that are given twice", func() {
+		_, err := cephbroker.NewStateCipher("key:" + key + "\nkey:" + key)
+		Expect(err).To(MatchError(ContainSubstring("more than once")))
+	})
+
+	It("should refuse keys that are not base64 encoded AES keys", func() {
+		_, err := cephbroker.NewStateCipher("key:not base64")
+		Expect(err).To(MatchError(ContainSubstring("not valid base64")))
+
+		_, err = cephbroker.NewStateCipher("key:" + base64.StdEncoding.EncodeToString([]byte("short")))
+		Expect(err).To(MatchError(ContainSubstring("not a valid AES key")))
+	})
+})
@@ -0,0 +1,122 @@
+package cephbroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+)
+
+// stateMigrations upgrade state one version at a time: stateMigrations[v] turns records of version v into records of
+// version v+1.  Migrations must not modify the records they are given.
+var stateMigrations = map[int]func(stateRecords) (stateRecords, error){
+	legacyStateVersion: migrateFromLegacyRecords,
+	2:                  migrateToSealableRecords,
+	3:                  migrateToBackendRecords,
+	4:                  migrateToRootedSharePaths,
+}
+
+// migrateFromLegacyRecords rewrites instances and bindings saved as brokerapi's ProvisionDetails and BindDetails into
+// our own records.  Creation times and share paths were not kept, and neither was the instance a binding belongs to.
+func migrateFromLegacyRecords(records stateRecords) (stateRecords, error) {
+	migrated := newStateRecords()
+	for _, table := range []string{operationsTable, snapshotsTable} {
+		for id, data := range records[table] {
+			migrated[table][id] = data
+		}
+	}
+
+	for id, data := range records[instancesTable] {
+		var legacy struct {
+			ServiceID        string          `json:"service_id"`
+			PlanID           string          `json:"plan_id"`
+			OrganizationGUID string          `json:"organization_guid"`
+			SpaceGUID        string          `json:"space_guid"`
+			RawParameters    json.RawMessage `json:"parameters"`
+		}
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return nil, fmt.Errorf("failed to decode instance '%s': %s", id, err.Error())
+		}
+
+		record, err := json.Marshal(instanceRecord{
+			InstanceID:       id,
+			ServiceID:        legacy.ServiceID,
+			PlanID:           legacy.PlanID,
+			OrganizationGUID: legacy.OrganizationGUID,
+			SpaceGUID:        legacy.SpaceGUID,
+			Parameters:       legacy.RawParameters,
+		})
+		if err != nil {
+			return nil, err
+		}
+		migrated[instancesTable][id] = record
+	}
+
+	for id, data := range records[bindingsTable] {
+		var legacy struct {
+			AppGUID    string                 `json:"app_guid"`
+			PlanID     string                 `json:"plan_id"`
+			ServiceID  string                 `json:"service_id"`
+			Parameters map[string]interface{} `json:"parameters"`
+		}
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return nil, fmt.Errorf("failed to decode binding '%s': %s", id, err.Error())
+		}
+
+		record, err := json.Marshal(bindingRecord{
+			BindingID:  id,
+			AppGUID:    legacy.AppGUID,
+			ServiceID:  legacy.ServiceID,
+			PlanID:     legacy.PlanID,
+			Parameters: legacy.Parameters,
+		})
+		if err != nil {
+			return nil, err
+		}
+		migrated[bindingsTable][id] = record
+	}
+
+	return migrated, nil
+}
+
+// migrateToSealableRecords changes nothing: version 3 only adds encrypted parameters to instances and bindings, which
+// version 2 brokers would silently drop
+func migrateToSealableRecords(records stateRecords) (stateRecords, error) {
+	return records, nil
+}
+
+// migrateToBackendRecords changes nothing: version 4 adds the backend of instances outside the default one, which
+// version 3 brokers would look for in the default backend
+func migrateToBackendRecords(records stateRecords) (stateRecords, error) {
+	return records, nil
+}
+
+// migrateToRootedSharePaths records where the directory shares of the default backend really are.  Brokers before
+// version 5 mounted the top of the file system and made shares there, whatever the remote mount path, but recorded
+// them under the remote mount path, or not at all.  Subvolume shares, whose paths end in the subvolume's own ID rather
+// than the instance's, are left as they are.
+func migrateToRootedSharePaths(records stateRecords) (stateRecords, error) {
+	migrated := newStateRecords()
+	for _, table := range stateTables {
+		for id, data := range records[table] {
+			migrated[table][id] = data
+		}
+	}
+
+	for id, data := range records[instancesTable] {
+		record := instanceRecord{}
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, fmt.Errorf("failed to decode instance '%s': %s", id, err.Error())
+		}
+		if record.Backend != "" || (record.SharePath != "" && path.Base(record.SharePath) != id) {
+			continue
+		}
+
+		record.SharePath = "/" + id
+		updated, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		migrated[instancesTable][id] = updated
+	}
+	return migrated, nil
+}
@@ -0,0 +1,245 @@
+package cephbroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// StateVersion is the format of the records this broker saves.  Bump it whenever a record changes shape, and add a
+// migration from the previous version to stateMigrations.
+const StateVersion = 5
+
+// legacyStateVersion is state saved before records had a version, as brokerapi's own ProvisionDetails and BindDetails
+const legacyStateVersion = 1
+
+// UnsupportedStateVersionError is returned for state saved by a newer broker, which this one can neither read nor
+// safely overwrite
+type UnsupportedStateVersionError struct {
+	Version int
+}
+
+func (e UnsupportedStateVersionError) Error() string {
+	return fmt.Sprintf("broker state has format version %d, but this broker only understands up to version %d", e.Version, StateVersion)
+}
+
+const (
+	instancesTable  = "instances"
+	bindingsTable   = "bindings"
+	operationsTable = "operations"
+	snapshotsTable  = "snapshots"
+)
+
+var stateTables = []string{instancesTable, bindingsTable, operationsTable, snapshotsTable}
+
+// instanceRecord is how a service instance is saved.  It is deliberately separate from brokerapi.ProvisionDetails so
+// that upgrading brokerapi cannot change what we write, or stop us reading what we wrote before.
+type instanceRecord struct {
+	InstanceID       string          `json:"instance_id"`
+	ServiceID        string          `json:"service_id"`
+	PlanID           string          `json:"plan_id"`
+	OrganizationGUID string          `json:"organization_guid"`
+	SpaceGUID        string          `json:"space_guid"`
+	Parameters       json.RawMessage `json:"parameters,omitempty"`
+	SharePath        string          `json:"share_path,omitempty"`
+	Backend          string          `json:"backend,omitempty"`
+	CreatedAt        time.Time       `json:"created_at"`
+	SealedParameters json.RawMessage `json:"sealed_parameters,omitempty"`
+}
+
+// bindingRecord is how a binding is saved.  Bindings saved before version 2 have no instance ID.
+type bindingRecord struct {
+	BindingID        string                 `json:"binding_id"`
+	InstanceID       string                 `json:"instance_id,omitempty"`
+	AppGUID          string                 `json:"app_guid"`
+	ServiceID        string                 `json:"service_id"`
+	PlanID           string                 `json:"plan_id"`
+	Parameters       map[string]interface{} `json:"parameters,omitempty"`
+	CreatedAt        time.Time              `json:"created_at"`
+	SealedParameters json.RawMessage        `json:"sealed_parameters,omitempty"`
+}
+
+// stateRecords is State broken down into JSON encoded records keyed by table and ID, which is how the stores keep it,
+// so that saving only has to touch the records that changed
+type stateRecords map[string]map[string][]byte
+
+func newStateRecords() stateRecords {
+	records := stateRecords{}
+	for _, table := range stateTables {
+		records[table] = map[string][]byte{}
+	}
+	return records
+}
+
+func (r stateRecords) empty() bool {
+	for _, table := range stateTables {
+		if len(r[table]) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// unversionedStateVersion is the version of records saved without one: either nothing was saved yet, or the records
+// predate versioning
+func unversionedStateVersion(records stateRecords) int {
+	if records.empty() {
+		return StateVersion
+	}
+	return legacyStateVersion
+}
+
+// stateToRecords encodes state as records of the current StateVersion
+func stateToRecords(state State) (stateRecords, error) {
+	records := newStateRecords()
+	add := func(table string, id string, value interface{}) error {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s record '%s': %s", table, id, err.Error())
+		}
+		records[table][id] = data
+		return nil
+	}
+
+	for id, details := range state.InstanceMap {
+		info := state.InstanceInfoMap[id]
+		record := instanceRecord{
+			InstanceID:       id,
+			ServiceID:        details.ServiceID,
+			PlanID:           details.PlanID,
+			OrganizationGUID: details.OrganizationGUID,
+			SpaceGUID:        details.SpaceGUID,
+			Parameters:       details.RawParameters,
+			SharePath:        info.SharePath,
+			Backend:          info.Backend,
+			CreatedAt:        info.CreatedAt,
+			SealedParameters: info.SealedParameters,
+		}
+		if err := add(instancesTable, id, record); err != nil {
+			return nil, err
+		}
+	}
+	for id, details := range state.BindingMap {
+		info := state.BindingInfoMap[id]
+		record := bindingRecord{
+			BindingID:        id,
+			InstanceID:       info.InstanceID,
+			AppGUID:          details.AppGUID,
+			ServiceID:        details.ServiceID,
+			PlanID:           details.PlanID,
+			Parameters:       details.Parameters,
+			CreatedAt:        info.CreatedAt,
+			SealedParameters: info.SealedParameters,
+		}
+		if err := add(bindingsTable, id, record); err != nil {
+			return nil, err
+		}
+	}
+	for id, operation := range state.OperationMap {
+		if err := add(operationsTable, id, operation); err != nil {
+			return nil, err
+		}
+	}
+	for id, snapshots := range state.SnapshotMap {
+		if err := add(snapshotsTable, id, snapshots); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// recordsToState upgrades records saved in the given version to the current one, and decodes them.  The records
+// themselves are left alone, as stores compare them with what they save next.
+func recordsToState(version int, records stateRecords) (State, error) {
+	if version > StateVersion {
+		return State{}, UnsupportedStateVersionError{Version: version}
+	}
+	if version < legacyStateVersion {
+		return State{}, fmt.Errorf("invalid broker state format version %d", version)
+	}
+
+	for v := version; v < StateVersion; v++ {
+		migrated, err := stateMigrations[v](records)
+		if err != nil {
+			return State{}, fmt.Errorf("failed to migrate broker state from version %d: %s", v, err.Error())
+		}
+		records = migrated
+	}
+
+	state := NewState()
+	state.Version = version
+	decode := func(table string, id string, value interface{}) error {
+		if err := json.Unmarshal(records[table][id], value); err != nil {
+			return fmt.Errorf("failed to decode %s record '%s': %s", table, id, err.Error())
+		}
+		return nil
+	}
+
+	for id := range records[instancesTable] {
+		record := instanceRecord{}
+		if err := decode(instancesTable, id, &record); err != nil {
+			return State{}, err
+		}
+		state.InstanceMap[id] = brokerapi.ProvisionDetails{
+			ServiceID:        record.ServiceID,
+			PlanID:           record.PlanID,
+			OrganizationGUID: record.OrganizationGUID,
+			SpaceGUID:        record.SpaceGUID,
+			RawParameters:    record.Parameters,
+		}
+		state.InstanceInfoMap[id] = InstanceInfo{SharePath: record.SharePath, Backend: record.Backend, CreatedAt: record.CreatedAt, SealedParameters: record.SealedParameters}
+	}
+	for id := range records[bindingsTable] {
+		record := bindingRecord{}
+		if err := decode(bindingsTable, id, &record); err != nil {
+			return State{}, err
+		}
+		state.BindingMap[id] = brokerapi.BindDetails{
+			AppGUID:    record.AppGUID,
+			ServiceID:  record.ServiceID,
+			PlanID:     record.PlanID,
+			Parameters: record.Parameters,
+		}
+		state.BindingInfoMap[id] = BindingInfo{InstanceID: record.InstanceID, CreatedAt: record.CreatedAt, SealedParameters: record.SealedParameters}
+	}
+	for id := range records[operationsTable] {
+		operation := OperationState{}
+		if err := decode(operationsTable, id, &operation); err != nil {
+			return State{}, err
+		}
+		state.OperationMap[id] = operation
+	}
+	for id := range records[snapshotsTable] {
+		snapshots := []string{}
+		if err := decode(snapshotsTable, id, &snapshots); err != nil {
+			return State{}, err
+		}
+		state.SnapshotMap[id] = snapshots
+	}
+	return state, nil
+}
+
+// applyChanges calls put for every record that is new or different from the previous records, and remove for every
+// previous record that is gone
+func (r stateRecords) applyChanges(previous stateRecords, put func(table, id string, value []byte) error, remove func(table, id string) error) error {
+	for _, table := range stateTables {
+		for id, value := range r[table] {
+			if old, ok := previous[table][id]; ok && string(old) == string(value) {
+				continue
+			}
+			if err := put(table, id, value); err != nil {
+				return err
+			}
+		}
+		for id := range previous[table] {
+			if _, ok := r[table][id]; !ok {
+				if err := remove(table, id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
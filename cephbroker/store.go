@@ -0,0 +1,149 @@
+package cephbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	StoreTypeFile = "file"
+	StoreTypeBolt = "bolt"
+	StoreTypeSql  = "sql"
+)
+
+var (
+	ErrStateConflict = errors.New("the broker state was changed by another broker replica")
+	ErrStateLocked   = errors.New("timed out waiting for another broker replica to release the broker state")
+)
+
+// State is everything the broker knows about its service instances and bindings
+type State struct {
+	// Version is the format the state was saved in; stores always save it in the current StateVersion
+	Version int
+
+	InstanceMap     map[string]brokerapi.ProvisionDetails
+	InstanceInfoMap map[string]InstanceInfo
+	BindingMap      map[string]brokerapi.BindDetails
+	BindingInfoMap  map[string]BindingInfo
+	OperationMap    map[string]OperationState
+	SnapshotMap     map[string][]string
+}
+
+// InstanceInfo is what the broker learns about a service instance while creating it
+type InstanceInfo struct {
+	SharePath string
+	// Backend is the backend the instance's share is in, or empty for the default backend
+	Backend   string
+	CreatedAt time.Time
+	// SealedParameters are the instance's parameters encrypted with the state key, when the state is encrypted
+	SealedParameters json.RawMessage
+}
+
+// BindingInfo is what the broker knows about a binding beyond the details it was created with
+type BindingInfo struct {
+	InstanceID string
+	CreatedAt  time.Time
+	// SealedParameters are the binding's parameters encrypted with the state key, when the state is encrypted
+	SealedParameters json.RawMessage
+}
+
+type OperationState struct {
+	Type        string                       `json:"type"`
+	State       brokerapi.LastOperationState `json:"state"`
+	Description string                       `json:"description,omitempty"`
+	// Owner is the replica running the operation, when several broker replicas share a store
+	Owner string `json:"owner,omitempty"`
+}
+
+// Store persists the broker's state between restarts
+type Store interface {
+	// Restore returns the saved state, or an empty state if nothing has been saved yet
+	Restore(logger lager.Logger) (State, error)
+	// Save replaces the saved state with the given one, all or nothing
+	Save(logger lager.Logger, state State) error
+	Close() error
+}
+
+// SharedStore is a Store that several broker replicas can use at once.  A replica holds its lock while it reloads,
+// changes and saves the state, so that it never works from a stale copy.
+type SharedStore interface {
+	Store
+	// Lock waits for the other replicas to release the state, and fails if that takes too long
+	Lock(logger lager.Logger) error
+	Unlock(logger lager.Logger)
+	// Owner names this replica, which resumes the operations it started after a restart
+	Owner() string
+	// ReplicaAlive reports whether the named replica is still running, or has died and left its operations to the
+	// others
+	ReplicaAlive(owner string) (bool, error)
+	// LiveReplicas names the other replicas that are still running
+	LiveReplicas() ([]string, error)
+}
+
+// RecoverableStore is a Store that can set aside saved state it cannot read, so that the broker can start without it
+type RecoverableStore interface {
+	Store
+	// Quarantine moves the state that Restore reads out of the way, and returns where it went
+	Quarantine(logger lager.Logger) (string, error)
+}
+
+// RecoverState quarantines saved state until what is left can be restored, which may be nothing at all.  State saved by
+// a newer broker is not corrupt, and is left alone.
+func RecoverState(logger lager.Logger, store Store) error {
+	logger = logger.Session("recover-state")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	for {
+		_, err := store.Restore(logger)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(UnsupportedStateVersionError); ok {
+			return err
+		}
+
+		recoverable, ok := store.(RecoverableStore)
+		if !ok {
+			return fmt.Errorf("unable to recover state from this store: %s", err.Error())
+		}
+		quarantined, quarantineErr := recoverable.Quarantine(logger)
+		if quarantineErr != nil {
+			return quarantineErr
+		}
+		logger.Error("quarantined-unreadable-state", err, lager.Data{"quarantined-to": quarantined})
+	}
+}
+
+// TopLevelShares reports whether the default backend has shares at the top of its file system, where brokers before
+// state version 5 made them whatever the remote mount path.  Such a backend has to keep mounting the top of the file
+// system for its shares to be found.
+func TopLevelShares(logger lager.Logger, store Store) (bool, error) {
+	state, err := store.Restore(logger)
+	if err != nil {
+		return false, err
+	}
+	for id, info := range state.InstanceInfoMap {
+		if info.Backend == "" && info.SharePath == "/"+id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func NewState() State {
+	return State{
+		Version:         StateVersion,
+		InstanceMap:     map[string]brokerapi.ProvisionDetails{},
+		InstanceInfoMap: map[string]InstanceInfo{},
+		BindingMap:      map[string]brokerapi.BindDetails{},
+		BindingInfoMap:  map[string]BindingInfo{},
+		OperationMap:    map[string]OperationState{},
+		SnapshotMap:     map[string][]string{},
+	}
+}
@@ -0,0 +1,403 @@
+package cephbroker_test
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/cephbroker/cephbroker"
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var _ = Describe("Store", func() {
+	var (
+		logger   lager.Logger
+		stateDir string
+		state    cephbroker.State
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test-store")
+
+		var err error
+		stateDir, err = ioutil.TempDir("", "cephbroker-store")
+		Expect(err).NotTo(HaveOccurred())
+
+		state = cephbroker.NewState()
+		state.InstanceMap["instance-1"] = brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id", RawParameters: json.RawMessage(`{"quota":"10G"}`)}
+		state.InstanceMap["instance-2"] = brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id"}
+		state.InstanceInfoMap["instance-1"] = cephbroker.InstanceInfo{SharePath: "/volumes/instance-1", CreatedAt: time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)}
+		state.InstanceInfoMap["instance-2"] = cephbroker.InstanceInfo{CreatedAt: time.Date(2016, 10, 2, 12, 0, 0, 0, time.UTC)}
+		state.BindingMap["binding-1"] = brokerapi.BindDetails{AppGUID: "app-guid"}
+		state.BindingInfoMap["binding-1"] = cephbroker.BindingInfo{InstanceID: "instance-1", CreatedAt: time.Date(2016, 10, 3, 12, 0, 0, 0, time.UTC)}
+		state.OperationMap["instance-2"] = cephbroker.OperationState{Type: "provision", State: brokerapi.InProgress}
+		state.SnapshotMap["instance-1"] = []string{"snap1", "snap2"}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(stateDir)
+	})
+
+	behavesLikeAStore := func(newStore func() cephbroker.Store) {
+		var store cephbroker.Store
+
+		BeforeEach(func() {
+			store = newStore()
+		})
+
+		AfterEach(func() {
+			Expect(store.Close()).To(Succeed())
+		})
+
+		It("restores an empty state when nothing has been saved", func() {
+			restored, err := store.Restore(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored).To(Equal(cephbroker.NewState()))
+		})
+
+		It("restores what was saved", func() {
+			Expect(store.Save(logger, state)).To(Succeed())
+			Expect(store.Close()).To(Succeed())
+
+			store = newStore()
+			restored, err := store.Restore(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored).To(Equal(state))
+		})
+
+		It("saves changes and removals", func() {
+			Expect(store.Save(logger, state)).To(Succeed())
+
+			delete(state.InstanceMap, "instance-2")
+			delete(state.InstanceInfoMap, "instance-2")
+			delete(state.OperationMap, "instance-2")
+			state.SnapshotMap["instance-1"] = []string{"snap2"}
+			state.BindingMap["binding-2"] = brokerapi.BindDetails{AppGUID: "other-app-guid"}
+			state.BindingInfoMap["binding-2"] = cephbroker.BindingInfo{InstanceID: "instance-1", CreatedAt: time.Date(2016, 10, 4, 12, 0, 0, 0, time.UTC)}
+			Expect(store.Save(logger, state)).To(Succeed())
+			Expect(store.Close()).To(Succeed())
+
+			store = newStore()
+			restored, err := store.Restore(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored).To(Equal(state))
+		})
+	}
+
+	Context("file store", func() {
+		newFileStore := func() cephbroker.Store {
+			return cephbroker.NewFileStore(filepath.Join(stateDir, "state.json"), &osshim.OsShim{}, &ioutilshim.IoutilShim{})
+		}
+
+		behavesLikeAStore(newFileStore)
+
+		It("migrates unversioned state files", func() {
+			legacy := `{"InstanceMap":{"instance-1":{"service_id":"service-id","plan_id":"plan-id","organization_guid":"org","space_guid":"space","parameters":{"quota":"10G"}}},` +
+				`"BindingMap":{"binding-1":{"app_guid":"app-guid","plan_id":"","service_id":""}},` +
+				`"OperationMap":{"instance-1":{"type":"provision","state":"succeeded"}},"SnapshotMap":{"instance-1":["snap1"]}}`
+			Expect(ioutil.WriteFile(filepath.Join(stateDir, "state.json"), []byte(legacy), 0600)).To(Succeed())
+
+			store := newFileStore()
+			restored, err := store.Restore(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored.Version).To(Equal(1))
+			Expect(restored.InstanceMap).To(Equal(map[string]brokerapi.ProvisionDetails{
+				"instance-1": {ServiceID: "service-id", PlanID: "plan-id", OrganizationGUID: "org", SpaceGUID: "space", RawParameters: json.RawMessage(`{"quota":"10G"}`)},
+			}))
+			Expect(restored.BindingMap).To(Equal(map[string]brokerapi.BindDetails{"binding-1": {AppGUID: "app-guid"}}))
+			Expect(restored.OperationMap["instance-1"].State).To(Equal(brokerapi.Succeeded))
+			Expect(restored.SnapshotMap["instance-1"]).To(Equal([]string{"snap1"}))
+
+			Expect(store.Save(logger, restored)).To(Succeed())
+			saved, err := ioutil.ReadFile(filepath.Join(stateDir, "state.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(saved)).To(ContainSubstring(`"version":5`))
+			Expect(string(saved)).To(ContainSubstring(`"instance_id":"instance-1"`))
+
+			migrated, err := store.Restore(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(migrated.Version).To(Equal(cephbroker.StateVersion))
+			restored.Version = cephbroker.StateVersion
+			Expect(migrated).To(Equal(restored))
+		})
+
+		It("records that directory shares saved before version 5 are at the top of the file system", func() {
+			saved := `{"version":4,"instances":{` +
+				`"legacy":{"instance_id":"legacy","service_id":"s","plan_id":"p","organization_guid":"","space_guid":"","created_at":"2020-01-01T00:00:00Z"},` +
+				`"rooted":{"instance_id":"rooted","service_id":"s","plan_id":"p","organization_guid":"","space_guid":"","share_path":"/volumes/rooted","created_at":"2020-01-01T00:00:00Z"},` +
+				`"subvolume":{"instance_id":"subvolume","service_id":"s","plan_id":"p","organization_guid":"","space_guid":"","share_path":"/volumes/_nogroup/subvolume/5f8e","created_at":"2020-01-01T00:00:00Z"},` +
+				`"archived":{"instance_id":"archived","service_id":"s","plan_id":"p","organization_guid":"","space_guid":"","share_path":"/archive/archived","backend":"archive","created_at":"2020-01-01T00:00:00Z"}}}`
+			Expect(ioutil.WriteFile(filepath.Join(stateDir, "state.json"), []byte(saved), 0600)).To(Succeed())
+
+			store := newFileStore()
+			restored, err := store.Restore(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored.InstanceInfoMap["legacy"].SharePath).To(Equal("/legacy"))
+			Expect(restored.InstanceInfoMap["rooted"].SharePath).To(Equal("/rooted"))
+			Expect(restored.InstanceInfoMap["subvolume"].SharePath).To(Equal("/volumes/_nogroup/subvolume/5f8e"))
+			Expect(restored.InstanceInfoMap["archived"].SharePath).To(Equal("/archive/archived"))
+
+			Expect(cephbroker.TopLevelShares(logger, store)).To(BeTrue())
+		})
+
+		It("finds no top level shares in state saved since version 5", func() {
+			state := cephbroker.NewState()
+			state.InstanceMap["rooted"] = brokerapi.ProvisionDetails{ServiceID: "s", PlanID: "p"}
+			state.InstanceInfoMap["rooted"] = cephbroker.InstanceInfo{SharePath: "/volumes/rooted"}
+			store := newFileStore()
+			Expect(store.Save(logger, state)).To(Succeed())
+
+			Expect(cephbroker.TopLevelShares(logger, store)).To(BeFalse())
+		})
+
+		It("refuses state saved by a newer broker", func() {
+			Expect(ioutil.WriteFile(filepath.Join(stateDir, "state.json"), []byte(`{"version":99,"instances":{}}`), 0600)).To(Succeed())
+
+			_, err := newFileStore().Restore(logger)
+			Expect(err).To(Equal(cephbroker.UnsupportedStateVersionError{Version: 99}))
+		})
+
+		Context("when the state file cannot be read", func() {
+			var stateFile string
+
+			BeforeEach(func() {
+				stateFile = filepath.Join(stateDir, "state.json")
+				Expect(ioutil.WriteFile(stateFile, []byte("{not json"), 0600)).To(Succeed())
+			})
+
+			It("fails to restore", func() {
+				_, err := newFileStore().Restore(logger)
+				Expect(err).To(MatchError(ContainSubstring("failed to parse state file")))
+			})
+
+			It("recovers from the newest previous generation that can be read, quarantining the rest", func() {
+				// saving rotates the unreadable file to generation 1
+				store := newFileStore()
+				Expect(store.Save(logger, state)).To(Succeed())
+				Expect(os.Rename(stateFile, stateFile+".2")).To(Succeed())
+				Expect(ioutil.WriteFile(stateFile, []byte("{not json"), 0600)).To(Succeed())
+
+				Expect(cephbroker.RecoverState(logger, store)).To(Succeed())
+
+				restored, err := store.Restore(logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(restored).To(Equal(state))
+
+				quarantined, err := filepath.Glob(filepath.Join(stateDir, "*.corrupt-*"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(quarantined).To(HaveLen(2))
+				Expect(stateFile).NotTo(BeAnExistingFile())
+				Expect(stateFile + ".1").NotTo(BeAnExistingFile())
+			})
+
+			It("recovers with no state when no generation can be read", func() {
+				store := newFileStore()
+				Expect(cephbroker.RecoverState(logger, store)).To(Succeed())
+
+				restored, err := store.Restore(logger)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(restored).To(Equal(cephbroker.NewState()))
+
+				quarantined, err := filepath.Glob(stateFile + ".corrupt-*")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(quarantined).To(HaveLen(1))
+				contents, err := ioutil.ReadFile(quarantined[0])
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(contents)).To(Equal("{not json"))
+			})
+
+			It("leaves state from a newer broker alone", func() {
+				Expect(ioutil.WriteFile(stateFile, []byte(`{"version":99}`), 0600)).To(Succeed())
+
+				err := cephbroker.RecoverState(logger, newFileStore())
+				Expect(err).To(Equal(cephbroker.UnsupportedStateVersionError{Version: 99}))
+				Expect(stateFile).To(BeAnExistingFile())
+			})
+		})
+	})
+
+	Context("bolt store", func() {
+		behavesLikeAStore(func() cephbroker.Store {
+			store, err := cephbroker.NewBoltStore(filepath.Join(stateDir, "state.db"))
+			Expect(err).NotTo(HaveOccurred())
+			return store
+		})
+	})
+
+	Context("sql store", func() {
+		behavesLikeAStore(func() cephbroker.Store {
+			store, err := cephbroker.NewSqlStore(cephbroker.SqlDriverSqlite, filepath.Join(stateDir, "state.sqlite"))
+			Expect(err).NotTo(HaveOccurred())
+			return store
+		})
+
+		It("migrates unversioned records", func() {
+			store, err := cephbroker.NewSqlStore(cephbroker.SqlDriverSqlite, filepath.Join(stateDir, "state.sqlite"))
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+
+			db, err := sql.Open(cephbroker.SqlDriverSqlite, filepath.Join(stateDir, "state.sqlite"))
+			Expect(err).NotTo(HaveOccurred())
+			defer db.Close()
+			_, err = db.Exec(`INSERT INTO cephbroker_instances (id, value) VALUES ('instance-1', '{"service_id":"service-id","plan_id":"plan-id","organization_guid":"org","space_guid":"space"}')`)
+			Expect(err).NotTo(HaveOccurred())
+
+			restored, err := store.Restore(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored.Version).To(Equal(1))
+			Expect(restored.InstanceMap["instance-1"]).To(Equal(brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "plan-id", OrganizationGUID: "org", SpaceGUID: "space"}))
+
+			Expect(store.Save(logger, restored)).To(Succeed())
+			migrated, err := store.Restore(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(migrated.Version).To(Equal(cephbroker.StateVersion))
+
+			var value string
+			Expect(db.QueryRow("SELECT value FROM cephbroker_instances WHERE id = 'instance-1'").Scan(&value)).To(Succeed())
+			Expect(value).To(ContainSubstring(`"instance_id":"instance-1"`))
+		})
+
+		It("refuses state saved by a newer broker", func() {
+			store, err := cephbroker.NewSqlStore(cephbroker.SqlDriverSqlite, filepath.Join(stateDir, "state.sqlite"))
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+
+			db, err := sql.Open(cephbroker.SqlDriverSqlite, filepath.Join(stateDir, "state.sqlite"))
+			Expect(err).NotTo(HaveOccurred())
+			defer db.Close()
+			_, err = db.Exec("INSERT INTO cephbroker_version (id, version) VALUES (1, 99)")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = store.Restore(logger)
+			Expect(err).To(Equal(cephbroker.UnsupportedStateVersionError{Version: 99}))
+		})
+
+		It("rejects unknown drivers", func() {
+			_, err := cephbroker.NewSqlStore("oracle", "")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("refuses to save over state that another store saved since it was restored", func() {
+			store, err := cephbroker.NewSqlStore(cephbroker.SqlDriverSqlite, filepath.Join(stateDir, "state.sqlite"))
+			Expect(err).NotTo(HaveOccurred())
+			defer store.Close()
+			other, err := cephbroker.NewSqlStore(cephbroker.SqlDriverSqlite, filepath.Join(stateDir, "state.sqlite"))
+			Expect(err).NotTo(HaveOccurred())
+			defer other.Close()
+
+			_, err = store.Restore(logger)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = other.Restore(logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(other.Save(logger, state)).To(Succeed())
+			Expect(store.Save(logger, cephbroker.NewState())).To(Equal(cephbroker.ErrStateConflict))
+
+			restored, err := store.Restore(logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored).To(Equal(state))
+			Expect(store.Save(logger, cephbroker.NewState())).To(Succeed())
+		})
+	})
+
+	Context("shared sql store", func() {
+		var dataSource string
+
+		newSharedStore := func(owner string, leaseDuration time.Duration) cephbroker.SharedStore {
+			store, err := cephbroker.NewSharedSqlStore(cephbroker.SqlDriverSqlite, dataSource, owner, leaseDuration, 200*time.Millisecond)
+			Expect(err).NotTo(HaveOccurred())
+			return store
+		}
+
+		BeforeEach(func() {
+			dataSource = filepath.Join(stateDir, "state.sqlite") + "?_busy_timeout=5000"
+		})
+
+		behavesLikeAStore(func() cephbroker.Store {
+			return newSharedStore("replica-1", time.Minute)
+		})
+
+		It("needs a replica name", func() {
+			_, err := cephbroker.NewSharedSqlStore(cephbroker.SqlDriverSqlite, dataSource, "", time.Minute, time.Minute)
+			Expect(err).To(HaveOccurred())
+		})
+
+		Context("with two replicas", func() {
+			var store, other cephbroker.SharedStore
+
+			BeforeEach(func() {
+				store = newSharedStore("replica-1", time.Minute)
+				other = newSharedStore("replica-2", time.Minute)
+			})
+
+			AfterEach(func() {
+				Expect(store.Close()).To(Succeed())
+				Expect(other.Close()).To(Succeed())
+			})
+
+			It("lets one replica hold the lock at a time", func() {
+				Expect(store.Lock(logger)).To(Succeed())
+				Expect(other.Lock(logger)).To(Equal(cephbroker.ErrStateLocked))
+
+				store.Unlock(logger)
+				Expect(other.Lock(logger)).To(Succeed())
+				other.Unlock(logger)
+			})
+
+			It("takes over the lock once its holder stops renewing it", func() {
+				db, err := sql.Open(cephbroker.SqlDriverSqlite, dataSource)
+				Expect(err).NotTo(HaveOccurred())
+				defer db.Close()
+				_, err = db.Exec("UPDATE cephbroker_locks SET owner = 'crashed-replica', expires = ?", time.Now().Add(-time.Second).UnixNano())
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(store.Lock(logger)).To(Succeed())
+				store.Unlock(logger)
+			})
+
+			It("knows which replicas are still running", func() {
+				Expect(store.ReplicaAlive("replica-2")).To(BeTrue())
+				Expect(store.ReplicaAlive("replica-1")).To(BeTrue())
+				Expect(store.ReplicaAlive("unknown-replica")).To(BeFalse())
+				Expect(store.LiveReplicas()).To(Equal([]string{"replica-2"}))
+
+				shortLived := newSharedStore("replica-3", time.Minute)
+				Expect(store.ReplicaAlive("replica-3")).To(BeTrue())
+				Expect(store.LiveReplicas()).To(Equal([]string{"replica-2", "replica-3"}))
+				Expect(shortLived.Close()).To(Succeed())
+				Expect(store.ReplicaAlive("replica-3")).To(BeFalse())
+				Expect(store.LiveReplicas()).To(Equal([]string{"replica-2"}))
+			})
+
+			It("takes a replica that stops renewing its lease to be gone", func() {
+				db, err := sql.Open(cephbroker.SqlDriverSqlite, dataSource)
+				Expect(err).NotTo(HaveOccurred())
+				defer db.Close()
+				_, err = db.Exec("UPDATE cephbroker_locks SET expires = ? WHERE name = 'replica:replica-2'", time.Now().Add(-time.Second).UnixNano())
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(store.ReplicaAlive("replica-2")).To(BeFalse())
+				Expect(store.LiveReplicas()).To(BeEmpty())
+			})
+
+			It("keeps the lock past its lease while the holder is alive", func() {
+				shortLease := newSharedStore("replica-3", 150*time.Millisecond)
+				defer shortLease.Close()
+
+				Expect(shortLease.Lock(logger)).To(Succeed())
+				time.Sleep(300 * time.Millisecond)
+				Expect(other.Lock(logger)).To(Equal(cephbroker.ErrStateLocked))
+				shortLease.Unlock(logger)
+			})
+		})
+	})
+})
@@ -0,0 +1,474 @@
+package cephbroker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/invoker"
+)
+
+const (
+	ShareBackendDirectory = "directory"
+	ShareBackendSubvolume = "subvolume"
+
+	// DefaultCloneTimeout is how long a clone may take to copy before it is cancelled
+	DefaultCloneTimeout = 30 * time.Minute
+)
+
+// subvolumeClient provisions shares as CephFS subvolumes through the ceph CLI, so unlike cephClient it never needs a
+// local mount of the filesystem.  Credentials and config details are shared with cephClient.
+type subvolumeClient struct {
+	*cephClient
+	fsName            string
+	groupName         string
+	clonePollInterval time.Duration
+	cloneTimeout      time.Duration
+}
+
+type cloneStatus struct {
+	Status struct {
+		State string `json:"state"`
+	} `json:"status"`
+}
+
+type subvolumeInfo struct {
+	BytesQuota interface{} `json:"bytes_quota"`
+	BytesUsed  uint64      `json:"bytes_used"`
+}
+
+func NewSubvolumeClientWithInvokerAndSystemUtil(mds string, useInvoker invoker.Invoker, os osshim.Os, ioutil ioutilshim.Ioutil, credentials Credentials, fsName string, groupName string, cloneTimeout time.Duration, mount MountSettings) Client {
+	if cloneTimeout <= 0 {
+		cloneTimeout = DefaultCloneTimeout
+	}
+	return &subvolumeClient{
+		cephClient: &cephClient{
+			mds:         mds,
+			invoker:     useInvoker,
+			os:          os,
+			ioutil:      ioutil,
+			credentials: credentials,
+			mount:       mount,
+		},
+		fsName:            fsName,
+		groupName:         groupName,
+		clonePollInterval: time.Second,
+		cloneTimeout:      cloneTimeout,
+	}
+}
+
+func NewSubvolumeClient(mds string, credentials Credentials, fsName string, groupName string, cloneTimeout time.Duration, mount MountSettings) Client {
+	return NewSubvolumeClientWithInvokerAndSystemUtil(mds, NewOutputInvoker(), &osshim.OsShim{}, &ioutilshim.IoutilShim{}, credentials, fsName, groupName, cloneTimeout, mount)
+}
+
+func (c *subvolumeClient) IsFilesystemMounted(env voldriver.Env) bool {
+	return true
+}
+
+func (c *subvolumeClient) MountFileSystem(env voldriver.Env, remoteMountPoint string) (string, error) {
+	return "", nil
+}
+
+func (c *subvolumeClient) UnmountFileSystem(env voldriver.Env) error {
+	return nil
+}
+
+func (c *subvolumeClient) CreateShare(env voldriver.Env, shareName string) (string, error) {
+	logger := env.Logger().Session("create-subvolume", lager.Data{"shareName": shareName, "group": c.groupName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if c.groupName != "" {
+		args := c.cephAdminArgs("fs", "subvolumegroup", "create", c.fsName, c.groupName)
+		_, err := c.invoke(driverhttp.EnvWithLogger(logger, env), "ceph", args)
+		if err != nil {
+			logger.Error("failed-to-create-subvolume-group", err)
+			return "", fmt.Errorf("failed to create subvolume group '%s'", c.groupName)
+		}
+	}
+
+	args := c.subvolumeArgs("create", shareName)
+	_, err := c.invoke(driverhttp.EnvWithLogger(logger, env), "ceph", args)
+	if err != nil {
+		logger.Error("failed-to-create-subvolume", err)
+		return "", fmt.Errorf("failed to create subvolume '%s'", shareName)
+	}
+
+	return c.subvolumePath(driverhttp.EnvWithLogger(logger, env), shareName)
+}
+
+// CloneShare creates a subvolume from a snapshot of the source subvolume.  Subvolumes can only be cloned from
+// snapshots, so when snapshotName is empty a temporary snapshot is taken and removed again once the clone is done.
+func (c *subvolumeClient) CloneShare(env voldriver.Env, shareName string, sourceShareName string, snapshotName string) (string, error) {
+	logger := env.Logger().Session("clone-subvolume", lager.Data{"shareName": shareName, "sourceShareName": sourceShareName, "snapshotName": snapshotName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	snapshot := snapshotName
+	if snapshot == "" {
+		snapshot = "cephbroker-clone-" + shareName
+		if err := c.CreateSnapshot(driverhttp.EnvWithLogger(logger, env), sourceShareName, snapshot); err != nil {
+			return "", err
+		}
+		defer func() {
+			if err := c.DeleteSnapshot(cleanupEnv(logger), sourceShareName, snapshot); err != nil {
+				logger.Error("failed-to-delete-clone-snapshot", err)
+			}
+		}()
+	}
+
+	args := c.snapshotArgs("clone", sourceShareName, snapshot, shareName)
+	if c.groupName != "" {
+		args = append(args, "--target_group_name", c.groupName)
+	}
+	_, err := c.invoke(driverhttp.EnvWithLogger(logger, env), "ceph", args)
+	if err != nil {
+		logger.Error("failed-to-clone-subvolume", err)
+		return "", fmt.Errorf("failed to clone subvolume '%s' into '%s'", sourceShareName, shareName)
+	}
+
+	if err := c.waitForClone(driverhttp.EnvWithLogger(logger, env), shareName); err != nil {
+		// failed clones stay behind as subvolumes that can only be removed with --force, even when the request that
+		// made them was given up on
+		if _, err := c.invoke(cleanupEnv(logger), "ceph", c.subvolumeArgs("rm", shareName, "--force")); err != nil {
+			logger.Error("failed-to-clean-up-clone", err)
+		}
+		return "", err
+	}
+
+	return c.subvolumePath(driverhttp.EnvWithLogger(logger, env), shareName)
+}
+
+func (c *subvolumeClient) DeleteShare(env voldriver.Env, shareName string) error {
+	logger := env.Logger().Session("delete-subvolume", lager.Data{"shareName": shareName, "group": c.groupName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	args := c.subvolumeArgs("rm", shareName)
+	_, err := c.invoke(driverhttp.EnvWithLogger(logger, env), "ceph", args)
+	if err != nil && !isNotFound(err) {
+		logger.Error("failed-to-delete-subvolume", err)
+		return fmt.Errorf("failed to delete subvolume '%s'", shareName)
+	}
+	return nil
+}
+
+// ListShares lists the subvolumes in the broker's subvolume group
+func (c *subvolumeClient) ListShares(env voldriver.Env) ([]string, error) {
+	logger := env.Logger().Session("list-subvolumes", lager.Data{"group": c.groupName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	args := c.cephAdminArgs("fs", "subvolume", "ls", c.fsName, "--format", "json")
+	if c.groupName != "" {
+		args = append(args, "--group_name", c.groupName)
+	}
+	output, err := c.invoke(driverhttp.EnvWithLogger(logger, env), "ceph", args)
+	if err != nil {
+		logger.Error("failed-to-list-subvolumes", err)
+		return nil, fmt.Errorf("failed to list subvolumes of '%s'", c.fsName)
+	}
+
+	subvolumes := []struct {
+		Name string `json:"name"`
+	}{}
+	if err := json.Unmarshal(output, &subvolumes); err != nil {
+		logger.Error("invalid-subvolume-list", err)
+		return nil, fmt.Errorf("failed to parse subvolumes of '%s'", c.fsName)
+	}
+
+	shares := []string{}
+	for _, subvolume := range subvolumes {
+		shares = append(shares, subvolume.Name)
+	}
+	return shares, nil
+}
+
+// QuarantineShare is not supported for subvolumes, which ceph cannot move or rename
+func (c *subvolumeClient) QuarantineShare(env voldriver.Env, shareName string) (string, error) {
+	return "", fmt.Errorf("subvolume '%s' cannot be quarantined, it can only be removed", shareName)
+}
+
+func (c *subvolumeClient) GetPathsForShare(env voldriver.Env, shareName string) (string, string, error) {
+	logger := env.Logger().Session("get-paths-for-subvolume", lager.Data{"shareName": shareName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	remotePath, err := c.subvolumePath(driverhttp.EnvWithLogger(logger, env), shareName)
+	if err != nil {
+		return "", "", err
+	}
+
+	cellPath := filepath.Join(CellBasePath, shareName)
+	return remotePath, cellPath, nil
+}
+
+// SetQuota resizes the subvolume.  Subvolumes only support a size limit, not a file count limit.
+func (c *subvolumeClient) SetQuota(env voldriver.Env, shareName string, quota Quota) error {
+	logger := env.Logger().Session("resize-subvolume", lager.Data{"shareName": shareName, "quota": quota})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if quota.MaxFiles != 0 {
+		logger.Error("unsupported-quota", ErrInvalidQuota)
+		return fmt.Errorf("subvolume shares do not support limiting the number of files")
+	}
+
+	size := "inf"
+	if quota.MaxBytes != 0 {
+		size = fmt.Sprintf("%d", quota.MaxBytes)
+	}
+
+	args := c.subvolumeArgs("resize", shareName, size)
+	_, err := c.invoke(driverhttp.EnvWithLogger(logger, env), "ceph", args)
+	if err != nil {
+		logger.Error("failed-to-resize-subvolume", err)
+		return fmt.Errorf("failed to resize subvolume '%s'", shareName)
+	}
+	return nil
+}
+
+// SetOwnership creates the subvolume again with the owner and mode it should have, which ceph applies to a subvolume
+// that already exists
+func (c *subvolumeClient) SetOwnership(env voldriver.Env, shareName string, ownership Ownership) error {
+	logger := env.Logger().Session("set-subvolume-ownership", lager.Data{"shareName": shareName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	extra := []string{}
+	if ownership.UID != nil {
+		extra = append(extra, "--uid", fmt.Sprintf("%d", *ownership.UID))
+	}
+	if ownership.GID != nil {
+		extra = append(extra, "--gid", fmt.Sprintf("%d", *ownership.GID))
+	}
+	if ownership.Mode != nil {
+		extra = append(extra, "--mode", fmt.Sprintf("%o", *ownership.Mode))
+	}
+
+	args := c.subvolumeArgs("create", shareName, extra...)
+	_, err := c.invoke(driverhttp.EnvWithLogger(logger, env), "ceph", args)
+	if err != nil {
+		logger.Error("failed-to-set-subvolume-ownership", err)
+		return fmt.Errorf("failed to change the owner or mode of subvolume '%s'", shareName)
+	}
+	return nil
+}
+
+// CreateClientKey restricts the client to the data pools of the file system the subvolumes are in
+func (c *subvolumeClient) CreateClientKey(env voldriver.Env, clientName string, sharePath string, readOnly bool) (string, error) {
+	return c.createClientKey(env, c.fsName, clientName, sharePath, readOnly)
+}
+
+func (c *subvolumeClient) GetQuota(env voldriver.Env, shareName string) (Quota, error) {
+	logger := env.Logger().Session("get-subvolume-quota", lager.Data{"shareName": shareName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	info, err := c.subvolumeInfo(driverhttp.EnvWithLogger(logger, env), shareName)
+	if err != nil {
+		return Quota{}, err
+	}
+
+	// bytes_quota is the string "infinite" when the subvolume has no size limit
+	if maxBytes, ok := info.BytesQuota.(float64); ok {
+		return Quota{MaxBytes: uint64(maxBytes)}, nil
+	}
+	return Quota{}, nil
+}
+
+func (c *subvolumeClient) GetUsage(env voldriver.Env, shareName string) (Usage, error) {
+	logger := env.Logger().Session("get-subvolume-usage", lager.Data{"shareName": shareName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	info, err := c.subvolumeInfo(driverhttp.EnvWithLogger(logger, env), shareName)
+	if err != nil {
+		return Usage{}, err
+	}
+	return Usage{Bytes: info.BytesUsed}, nil
+}
+
+func (c *subvolumeClient) CreateSnapshot(env voldriver.Env, shareName string, snapshotName string) error {
+	logger := env.Logger().Session("create-subvolume-snapshot", lager.Data{"shareName": shareName, "snapshotName": snapshotName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	_, err := c.invoke(driverhttp.EnvWithLogger(logger, env), "ceph", c.snapshotArgs("create", shareName, snapshotName))
+	if err != nil {
+		logger.Error("failed-to-create-snapshot", err)
+		return fmt.Errorf("failed to create snapshot '%s' of subvolume '%s'", snapshotName, shareName)
+	}
+	return nil
+}
+
+func (c *subvolumeClient) ListSnapshots(env voldriver.Env, shareName string) ([]string, error) {
+	logger := env.Logger().Session("list-subvolume-snapshots", lager.Data{"shareName": shareName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	output, err := c.invoke(driverhttp.EnvWithLogger(logger, env), "ceph", append(c.snapshotArgs("ls", shareName), "--format", "json"))
+	if err != nil {
+		logger.Error("failed-to-list-snapshots", err)
+		return nil, fmt.Errorf("failed to list snapshots of subvolume '%s'", shareName)
+	}
+
+	entries := []struct {
+		Name string `json:"name"`
+	}{}
+	if err := json.Unmarshal(output, &entries); err != nil {
+		logger.Error("invalid-snapshot-list", err)
+		return nil, fmt.Errorf("failed to parse snapshots of subvolume '%s'", shareName)
+	}
+
+	snapshots := []string{}
+	for _, entry := range entries {
+		snapshots = append(snapshots, entry.Name)
+	}
+	return snapshots, nil
+}
+
+func (c *subvolumeClient) DeleteSnapshot(env voldriver.Env, shareName string, snapshotName string) error {
+	logger := env.Logger().Session("delete-subvolume-snapshot", lager.Data{"shareName": shareName, "snapshotName": snapshotName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	_, err := c.invoke(driverhttp.EnvWithLogger(logger, env), "ceph", c.snapshotArgs("rm", shareName, snapshotName))
+	if err != nil && !isNotFound(err) {
+		logger.Error("failed-to-delete-snapshot", err)
+		return fmt.Errorf("failed to delete snapshot '%s' of subvolume '%s'", snapshotName, shareName)
+	}
+	return nil
+}
+
+func (c *subvolumeClient) subvolumePath(env voldriver.Env, shareName string) (string, error) {
+	logger := env.Logger()
+
+	output, err := c.invoke(env, "ceph", c.subvolumeArgs("getpath", shareName))
+	if err != nil {
+		if isNotFound(err) {
+			logger.Error("share-not-found", ShareNotFound)
+			return "", ShareNotFound
+		}
+		logger.Error("failed-to-get-subvolume-path", err)
+		return "", fmt.Errorf("failed to get path of subvolume '%s'", shareName)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// waitForClone polls the status of a clone, which ceph copies in the background, until it has finished.  A clone that
+// does not finish within the clone timeout, or before the request is given up on, is cancelled.
+func (c *subvolumeClient) waitForClone(env voldriver.Env, shareName string) error {
+	logger := env.Logger()
+
+	args := c.cephAdminArgs("fs", "clone", "status", c.fsName, shareName)
+	if c.groupName != "" {
+		args = append(args, "--group_name", c.groupName)
+	}
+
+	deadline := time.Now().Add(c.cloneTimeout)
+	for {
+		output, err := c.invoke(env, "ceph", args)
+		if err != nil {
+			logger.Error("failed-to-get-clone-status", err)
+			return fmt.Errorf("failed to get clone status of subvolume '%s'", shareName)
+		}
+
+		status := cloneStatus{}
+		if err := json.Unmarshal(output, &status); err != nil {
+			logger.Error("invalid-clone-status", err)
+			return fmt.Errorf("failed to parse clone status of subvolume '%s'", shareName)
+		}
+
+		switch status.Status.State {
+		case "complete":
+			return nil
+		case "failed", "canceled":
+			return fmt.Errorf("clone of subvolume '%s' %s", shareName, status.Status.State)
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			c.cancelClone(env, shareName)
+			return fmt.Errorf("clone of subvolume '%s' did not finish within %s", shareName, c.cloneTimeout)
+		}
+		if wait > c.clonePollInterval {
+			wait = c.clonePollInterval
+		}
+
+		logger.Debug("waiting-for-clone", lager.Data{"state": status.Status.State})
+		select {
+		case <-env.Context().Done():
+			c.cancelClone(env, shareName)
+			return fmt.Errorf("clone of subvolume '%s' was given up on: %s", shareName, env.Context().Err())
+		case <-time.After(wait):
+		}
+	}
+}
+
+// cancelClone stops a clone that is still copying, so that it can be removed
+func (c *subvolumeClient) cancelClone(env voldriver.Env, shareName string) {
+	args := c.cephAdminArgs("fs", "clone", "cancel", c.fsName, shareName)
+	if c.groupName != "" {
+		args = append(args, "--group_name", c.groupName)
+	}
+	if _, err := c.invoke(cleanupEnv(env.Logger()), "ceph", args); err != nil {
+		env.Logger().Error("failed-to-cancel-clone", err)
+	}
+}
+
+// cleanupEnv is for cleaning up after a request, which has to carry on when the request's context is done
+func cleanupEnv(logger lager.Logger) voldriver.Env {
+	return driverhttp.NewHttpDriverEnv(logger, context.Background())
+}
+
+func (c *subvolumeClient) subvolumeInfo(env voldriver.Env, shareName string) (subvolumeInfo, error) {
+	logger := env.Logger()
+
+	output, err := c.invoke(env, "ceph", append(c.subvolumeArgs("info", shareName), "--format", "json"))
+	if err != nil {
+		if isNotFound(err) {
+			logger.Error("share-not-found", ShareNotFound)
+			return subvolumeInfo{}, ShareNotFound
+		}
+		logger.Error("failed-to-get-subvolume-info", err)
+		return subvolumeInfo{}, fmt.Errorf("failed to get info of subvolume '%s'", shareName)
+	}
+
+	info := subvolumeInfo{}
+	if err := json.Unmarshal(output, &info); err != nil {
+		logger.Error("invalid-subvolume-info", err)
+		return subvolumeInfo{}, fmt.Errorf("failed to parse info of subvolume '%s'", shareName)
+	}
+	return info, nil
+}
+
+// subvolumeArgs builds "ceph fs subvolume <command> <fs> <share> [extra...] [--group_name <group>]"
+func (c *subvolumeClient) subvolumeArgs(command string, shareName string, extra ...string) []string {
+	args := c.cephAdminArgs(append([]string{"fs", "subvolume", command, c.fsName, shareName}, extra...)...)
+	if c.groupName != "" {
+		args = append(args, "--group_name", c.groupName)
+	}
+	return args
+}
+
+// snapshotArgs builds "ceph fs subvolume snapshot <command> <fs> <share> [extra...] [--group_name <group>]"
+func (c *subvolumeClient) snapshotArgs(command string, shareName string, extra ...string) []string {
+	args := c.cephAdminArgs(append([]string{"fs", "subvolume", "snapshot", command, c.fsName, shareName}, extra...)...)
+	if c.groupName != "" {
+		args = append(args, "--group_name", c.groupName)
+	}
+	return args
+}
+
+func isNotFound(err error) bool {
+	return strings.Contains(err.Error(), "ENOENT") || strings.Contains(err.Error(), "does not exist")
+}
@@ -0,0 +1,353 @@
+package cephbroker_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"code.cloudfoundry.org/cephbroker/cephbroker"
+	"code.cloudfoundry.org/goshims/ioutilshim/ioutil_fake"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/voldriver/voldriverfakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SubvolumeClient", func() {
+	var (
+		logger      lager.Logger
+		ctx         context.Context
+		env         voldriver.Env
+		subject     cephbroker.Client
+		fakeInvoker *voldriverfakes.FakeInvoker
+		fakeOs      *os_fake.FakeOs
+		fakeIoutil  *ioutil_fake.FakeIoutil
+		groupName   string
+	)
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("test-broker")
+		ctx = context.TODO()
+		env = driverhttp.NewHttpDriverEnv(logger, ctx)
+		fakeInvoker = &voldriverfakes.FakeInvoker{}
+		fakeOs = &os_fake.FakeOs{}
+		fakeIoutil = &ioutil_fake.FakeIoutil{}
+		groupName = ""
+	})
+	JustBeforeEach(func() {
+		subject = cephbroker.NewSubvolumeClientWithInvokerAndSystemUtil("mds", fakeInvoker, fakeOs, fakeIoutil, cephbroker.Credentials{Keyring: "keyringFile"}, "cephfs", groupName, 0, cephbroker.MountSettings{})
+	})
+	Context(".MountFileSystem", func() {
+		It("should not need a local mount", func() {
+			Expect(subject.IsFilesystemMounted(env)).To(BeTrue())
+			_, err := subject.MountFileSystem(env, "remoteMountPoint")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(0))
+		})
+	})
+	Context(".CreateShare", func() {
+		It("should create a subvolume and return its path", func() {
+			fakeInvoker.InvokeReturns([]byte("/volumes/_nogroup/shareName/uuid\n"), nil)
+			share, err := subject.CreateShare(env, "shareName")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(share).To(Equal("/volumes/_nogroup/shareName/uuid"))
+
+			_, cmd, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(cmd).To(Equal("ceph"))
+			Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "fs", "subvolume", "create", "cephfs", "shareName"}))
+		})
+
+		Context("when a subvolume group is configured", func() {
+			BeforeEach(func() {
+				groupName = "cf"
+			})
+
+			It("should create the subvolume in the group", func() {
+				_, err := subject.CreateShare(env, "shareName")
+				Expect(err).NotTo(HaveOccurred())
+
+				_, _, args := fakeInvoker.InvokeArgsForCall(0)
+				Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "fs", "subvolumegroup", "create", "cephfs", "cf"}))
+				_, _, args = fakeInvoker.InvokeArgsForCall(1)
+				Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "fs", "subvolume", "create", "cephfs", "shareName", "--group_name", "cf"}))
+			})
+		})
+
+		It("should error when ceph fails", func() {
+			fakeInvoker.InvokeReturns(nil, errors.New("badness"))
+			_, err := subject.CreateShare(env, "shareName")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Context(".CloneShare", func() {
+		var responses map[string]string
+
+		BeforeEach(func() {
+			responses = map[string]string{
+				"status":  `{"status": {"state": "complete"}}`,
+				"getpath": "/volumes/_nogroup/shareName/uuid\n",
+			}
+			fakeInvoker.InvokeStub = func(_ voldriver.Env, _ string, args []string) ([]byte, error) {
+				for _, arg := range args {
+					if response, ok := responses[arg]; ok {
+						return []byte(response), nil
+					}
+				}
+				return nil, nil
+			}
+		})
+
+		It("should clone a snapshot of the source subvolume and wait for it to finish", func() {
+			share, err := subject.CloneShare(env, "shareName", "sourceName", "snap1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(share).To(Equal("/volumes/_nogroup/shareName/uuid"))
+
+			_, _, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "fs", "subvolume", "snapshot", "clone", "cephfs", "sourceName", "snap1", "shareName"}))
+			_, _, args = fakeInvoker.InvokeArgsForCall(1)
+			Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "fs", "clone", "status", "cephfs", "shareName"}))
+		})
+
+		It("should clone through a temporary snapshot when none is given", func() {
+			_, err := subject.CloneShare(env, "shareName", "sourceName", "")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "fs", "subvolume", "snapshot", "create", "cephfs", "sourceName", "cephbroker-clone-shareName"}))
+			_, _, args = fakeInvoker.InvokeArgsForCall(fakeInvoker.InvokeCallCount() - 1)
+			Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "fs", "subvolume", "snapshot", "rm", "cephfs", "sourceName", "cephbroker-clone-shareName"}))
+		})
+
+		Context("when a subvolume group is configured", func() {
+			BeforeEach(func() {
+				groupName = "group"
+			})
+
+			It("should clone into the same group", func() {
+				_, err := subject.CloneShare(env, "shareName", "sourceName", "snap1")
+				Expect(err).NotTo(HaveOccurred())
+
+				_, _, args := fakeInvoker.InvokeArgsForCall(0)
+				Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "fs", "subvolume", "snapshot", "clone", "cephfs", "sourceName", "snap1", "shareName", "--group_name", "group", "--target_group_name", "group"}))
+			})
+		})
+
+		It("should cancel and remove a clone that does not finish in time", func() {
+			responses["status"] = `{"status": {"state": "in-progress"}}`
+			subject = cephbroker.NewSubvolumeClientWithInvokerAndSystemUtil("mds", fakeInvoker, fakeOs, fakeIoutil, cephbroker.Credentials{Keyring: "keyringFile"}, "cephfs", groupName, time.Millisecond, cephbroker.MountSettings{})
+			_, err := subject.CloneShare(env, "shareName", "sourceName", "snap1")
+			Expect(err).To(MatchError(ContainSubstring("did not finish within 1ms")))
+
+			count := fakeInvoker.InvokeCallCount()
+			_, _, args := fakeInvoker.InvokeArgsForCall(count - 2)
+			Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "fs", "clone", "cancel", "cephfs", "shareName"}))
+			_, _, args = fakeInvoker.InvokeArgsForCall(count - 1)
+			Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "fs", "subvolume", "rm", "cephfs", "shareName", "--force"}))
+		})
+
+		It("should cancel a clone when the request is given up on", func() {
+			responses["status"] = `{"status": {"state": "pending"}}`
+			cancelled, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := subject.CloneShare(driverhttp.NewHttpDriverEnv(lagertest.NewTestLogger("test"), cancelled), "shareName", "sourceName", "snap1")
+			Expect(err).To(MatchError(ContainSubstring("given up on")))
+
+			_, _, args := fakeInvoker.InvokeArgsForCall(fakeInvoker.InvokeCallCount() - 2)
+			Expect(args).To(ContainElement("cancel"))
+		})
+
+		It("should remove the clone when it fails", func() {
+			responses["status"] = `{"status": {"state": "failed"}}`
+			_, err := subject.CloneShare(env, "shareName", "sourceName", "snap1")
+			Expect(err).To(HaveOccurred())
+
+			_, _, args := fakeInvoker.InvokeArgsForCall(fakeInvoker.InvokeCallCount() - 1)
+			Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "fs", "subvolume", "rm", "cephfs", "shareName", "--force"}))
+		})
+	})
+	Context(".DeleteShare", func() {
+		It("should remove the subvolume", func() {
+			err := subject.DeleteShare(env, "shareName")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "fs", "subvolume", "rm", "cephfs", "shareName"}))
+		})
+
+		It("should not error when the subvolume is already gone", func() {
+			fakeInvoker.InvokeReturns(nil, errors.New("Error ENOENT: subvolume 'shareName' does not exist"))
+			Expect(subject.DeleteShare(env, "shareName")).To(Succeed())
+		})
+	})
+	Context(".ListShares", func() {
+		It("should list the subvolumes", func() {
+			fakeInvoker.InvokeReturns([]byte(`[{"name": "share1"}, {"name": "share2"}]`), nil)
+			shares, err := subject.ListShares(env)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(shares).To(Equal([]string{"share1", "share2"}))
+
+			_, _, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "fs", "subvolume", "ls", "cephfs", "--format", "json"}))
+		})
+
+		It("should error on unexpected output", func() {
+			fakeInvoker.InvokeReturns([]byte("garbage"), nil)
+			_, err := subject.ListShares(env)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Context(".QuarantineShare", func() {
+		It("should refuse, as subvolumes cannot be moved", func() {
+			_, err := subject.QuarantineShare(env, "shareName")
+			Expect(err).To(HaveOccurred())
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(0))
+		})
+	})
+	Context(".GetPathsForShare", func() {
+		It("should return the real subvolume path", func() {
+			fakeInvoker.InvokeReturns([]byte("/volumes/_nogroup/shareName/uuid\n"), nil)
+			remotePath, cellPath, err := subject.GetPathsForShare(env, "shareName")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(remotePath).To(Equal("/volumes/_nogroup/shareName/uuid"))
+			Expect(cellPath).To(Equal("/var/vcap/data/volumes/ceph/shareName"))
+		})
+
+		It("should report missing subvolumes as share not found", func() {
+			fakeInvoker.InvokeReturns(nil, errors.New("Error ENOENT: subvolume 'shareName' does not exist"))
+			_, _, err := subject.GetPathsForShare(env, "shareName")
+			Expect(err).To(Equal(cephbroker.ShareNotFound))
+		})
+	})
+	Context(".SetQuota", func() {
+		It("should resize the subvolume", func() {
+			err := subject.SetQuota(env, "shareName", cephbroker.Quota{MaxBytes: 1024})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "fs", "subvolume", "resize", "cephfs", "shareName", "1024"}))
+		})
+
+		It("should remove the size limit when the quota is cleared", func() {
+			err := subject.SetQuota(env, "shareName", cephbroker.Quota{})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(args[len(args)-1]).To(Equal("inf"))
+		})
+
+		It("should reject file count limits", func() {
+			err := subject.SetQuota(env, "shareName", cephbroker.Quota{MaxFiles: 10})
+			Expect(err).To(HaveOccurred())
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(0))
+		})
+	})
+	Context(".SetOwnership", func() {
+		It("should create the subvolume again with its owner and mode", func() {
+			uid, mode := uint32(1000), uint32(0750)
+			err := subject.SetOwnership(env, "shareName", cephbroker.Ownership{UID: &uid, Mode: &mode})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "fs", "subvolume", "create", "cephfs", "shareName", "--uid", "1000", "--mode", "750"}))
+		})
+
+		It("should error when ceph fails", func() {
+			gid := uint32(2000)
+			fakeInvoker.InvokeReturns(nil, errors.New("badness"))
+			err := subject.SetOwnership(env, "shareName", cephbroker.Ownership{GID: &gid})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Context(".CreateClientKey", func() {
+		It("should restrict the client to the data of the subvolumes' file system", func() {
+			_, err := subject.CreateClientKey(env, "binding", "/volumes/_nogroup/shareName", false)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(1))
+			_, _, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(args).To(ContainElement("allow rw path=/volumes/_nogroup/shareName"))
+			Expect(args).To(ContainElement("allow rw tag cephfs data=cephfs"))
+		})
+	})
+	Context(".GetQuota", func() {
+		It("should read the size limit from the subvolume info", func() {
+			fakeInvoker.InvokeReturns([]byte(`{"bytes_quota": 1024, "bytes_used": 10}`), nil)
+			quota, err := subject.GetQuota(env, "shareName")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(quota).To(Equal(cephbroker.Quota{MaxBytes: 1024}))
+		})
+
+		It("should treat infinite subvolumes as unlimited", func() {
+			fakeInvoker.InvokeReturns([]byte(`{"bytes_quota": "infinite", "bytes_used": 10}`), nil)
+			quota, err := subject.GetQuota(env, "shareName")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(quota).To(Equal(cephbroker.Quota{}))
+		})
+	})
+	Context(".GetUsage", func() {
+		It("should read the bytes used from the subvolume info", func() {
+			fakeInvoker.InvokeReturns([]byte(`{"bytes_quota": 1024, "bytes_used": 10}`), nil)
+			usage, err := subject.GetUsage(env, "shareName")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(usage).To(Equal(cephbroker.Usage{Bytes: 10}))
+		})
+	})
+	Context(".CreateSnapshot", func() {
+		It("should create a subvolume snapshot", func() {
+			err := subject.CreateSnapshot(env, "shareName", "snap1")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, cmd, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(cmd).To(Equal("ceph"))
+			Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "fs", "subvolume", "snapshot", "create", "cephfs", "shareName", "snap1"}))
+		})
+
+		Context("when a subvolume group is configured", func() {
+			BeforeEach(func() {
+				groupName = "group"
+			})
+
+			It("should create the snapshot in the group", func() {
+				err := subject.CreateSnapshot(env, "shareName", "snap1")
+				Expect(err).NotTo(HaveOccurred())
+
+				_, _, args := fakeInvoker.InvokeArgsForCall(0)
+				Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "fs", "subvolume", "snapshot", "create", "cephfs", "shareName", "snap1", "--group_name", "group"}))
+			})
+		})
+	})
+	Context(".ListSnapshots", func() {
+		It("should list the subvolume snapshots", func() {
+			fakeInvoker.InvokeReturns([]byte(`[{"name": "snap1"}, {"name": "snap2"}]`), nil)
+			snapshots, err := subject.ListSnapshots(env, "shareName")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(snapshots).To(Equal([]string{"snap1", "snap2"}))
+
+			_, _, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "fs", "subvolume", "snapshot", "ls", "cephfs", "shareName", "--format", "json"}))
+		})
+
+		It("should error on unexpected output", func() {
+			fakeInvoker.InvokeReturns([]byte("garbage"), nil)
+			_, err := subject.ListSnapshots(env, "shareName")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Context(".DeleteSnapshot", func() {
+		It("should remove the subvolume snapshot", func() {
+			err := subject.DeleteSnapshot(env, "shareName", "snap1")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(args).To(Equal([]string{"-m", "mds", "-k", "keyringFile", "fs", "subvolume", "snapshot", "rm", "cephfs", "shareName", "snap1"}))
+		})
+
+		It("should not error when the snapshot is already gone", func() {
+			fakeInvoker.InvokeReturns(nil, errors.New("Error ENOENT: snapshot 'snap1' does not exist"))
+			Expect(subject.DeleteSnapshot(env, "shareName", "snap1")).To(Succeed())
+		})
+	})
+})
@@ -0,0 +1,404 @@
+// This file was generated by counterfeiter
+package cephfakes
+
+import (
+	"context"
+	"sync"
+
+	"code.cloudfoundry.org/cephbroker/cephbroker"
+)
+
+type FakeAdminBroker struct {
+	ListInstancesStub        func(ctx context.Context) ([]cephbroker.InstanceResponseBody, error)
+	listInstancesMutex       sync.RWMutex
+	listInstancesArgsForCall []struct {
+		ctx context.Context
+	}
+	listInstancesReturns struct {
+		result1 []cephbroker.InstanceResponseBody
+		result2 error
+	}
+	GetInstanceStub        func(ctx context.Context, instanceID string) (cephbroker.InstanceResponseBody, error)
+	getInstanceMutex       sync.RWMutex
+	getInstanceArgsForCall []struct {
+		ctx        context.Context
+		instanceID string
+	}
+	getInstanceReturns struct {
+		result1 cephbroker.InstanceResponseBody
+		result2 error
+	}
+	ListBindingsStub        func(ctx context.Context) ([]cephbroker.BindingResponseBody, error)
+	listBindingsMutex       sync.RWMutex
+	listBindingsArgsForCall []struct {
+		ctx context.Context
+	}
+	listBindingsReturns struct {
+		result1 []cephbroker.BindingResponseBody
+		result2 error
+	}
+	GetBindingStub        func(ctx context.Context, bindingID string) (cephbroker.BindingResponseBody, error)
+	getBindingMutex       sync.RWMutex
+	getBindingArgsForCall []struct {
+		ctx       context.Context
+		bindingID string
+	}
+	getBindingReturns struct {
+		result1 cephbroker.BindingResponseBody
+		result2 error
+	}
+	CheckSharesStub        func(ctx context.Context) (cephbroker.ReconcileReport, error)
+	checkSharesMutex       sync.RWMutex
+	checkSharesArgsForCall []struct {
+		ctx context.Context
+	}
+	checkSharesReturns struct {
+		result1 cephbroker.ReconcileReport
+		result2 error
+	}
+	CreateSnapshotStub        func(ctx context.Context, instanceID string, snapshotName string) error
+	createSnapshotMutex       sync.RWMutex
+	createSnapshotArgsForCall []struct {
+		ctx          context.Context
+		instanceID   string
+		snapshotName string
+	}
+	createSnapshotReturns struct {
+		result1 error
+	}
+	ListSnapshotsStub        func(ctx context.Context, instanceID string) ([]string, error)
+	listSnapshotsMutex       sync.RWMutex
+	listSnapshotsArgsForCall []struct {
+		ctx        context.Context
+		instanceID string
+	}
+	listSnapshotsReturns struct {
+		result1 []string
+		result2 error
+	}
+	DeleteSnapshotStub        func(ctx context.Context, instanceID string, snapshotName string) error
+	deleteSnapshotMutex       sync.RWMutex
+	deleteSnapshotArgsForCall []struct {
+		ctx          context.Context
+		instanceID   string
+		snapshotName string
+	}
+	deleteSnapshotReturns struct {
+		result1 error
+	}
+	invocations      map[string][][]interface{}
+	invocationsMutex sync.RWMutex
+}
+
+func (fake *FakeAdminBroker) ListInstances(ctx context.Context) ([]cephbroker.InstanceResponseBody, error) {
+	fake.listInstancesMutex.Lock()
+	fake.listInstancesArgsForCall = append(fake.listInstancesArgsForCall, struct {
+		ctx context.Context
+	}{ctx})
+	fake.recordInvocation("ListInstances", []interface{}{ctx})
+	fake.listInstancesMutex.Unlock()
+	if fake.ListInstancesStub != nil {
+		return fake.ListInstancesStub(ctx)
+	} else {
+		return fake.listInstancesReturns.result1, fake.listInstancesReturns.result2
+	}
+}
+
+func (fake *FakeAdminBroker) ListInstancesCallCount() int {
+	fake.listInstancesMutex.RLock()
+	defer fake.listInstancesMutex.RUnlock()
+	return len(fake.listInstancesArgsForCall)
+}
+
+func (fake *FakeAdminBroker) ListInstancesArgsForCall(i int) context.Context {
+	fake.listInstancesMutex.RLock()
+	defer fake.listInstancesMutex.RUnlock()
+	return fake.listInstancesArgsForCall[i].ctx
+}
+
+func (fake *FakeAdminBroker) ListInstancesReturns(result1 []cephbroker.InstanceResponseBody, result2 error) {
+	fake.ListInstancesStub = nil
+	fake.listInstancesReturns = struct {
+		result1 []cephbroker.InstanceResponseBody
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeAdminBroker) GetInstance(ctx context.Context, instanceID string) (cephbroker.InstanceResponseBody, error) {
+	fake.getInstanceMutex.Lock()
+	fake.getInstanceArgsForCall = append(fake.getInstanceArgsForCall, struct {
+		ctx        context.Context
+		instanceID string
+	}{ctx, instanceID})
+	fake.recordInvocation("GetInstance", []interface{}{ctx, instanceID})
+	fake.getInstanceMutex.Unlock()
+	if fake.GetInstanceStub != nil {
+		return fake.GetInstanceStub(ctx, instanceID)
+	} else {
+		return fake.getInstanceReturns.result1, fake.getInstanceReturns.result2
+	}
+}
+
+func (fake *FakeAdminBroker) GetInstanceCallCount() int {
+	fake.getInstanceMutex.RLock()
+	defer fake.getInstanceMutex.RUnlock()
+	return len(fake.getInstanceArgsForCall)
+}
+
+func (fake *FakeAdminBroker) GetInstanceArgsForCall(i int) (context.Context, string) {
+	fake.getInstanceMutex.RLock()
+	defer fake.getInstanceMutex.RUnlock()
+	return fake.getInstanceArgsForCall[i].ctx, fake.getInstanceArgsForCall[i].instanceID
+}
+
+func (fake *FakeAdminBroker) GetInstanceReturns(result1 cephbroker.InstanceResponseBody, result2 error) {
+	fake.GetInstanceStub = nil
+	fake.getInstanceReturns = struct {
+		result1 cephbroker.InstanceResponseBody
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeAdminBroker) ListBindings(ctx context.Context) ([]cephbroker.BindingResponseBody, error) {
+	fake.listBindingsMutex.Lock()
+	fake.listBindingsArgsForCall = append(fake.listBindingsArgsForCall, struct {
+		ctx context.Context
+	}{ctx})
+	fake.recordInvocation("ListBindings", []interface{}{ctx})
+	fake.listBindingsMutex.Unlock()
+	if fake.ListBindingsStub != nil {
+		return fake.ListBindingsStub(ctx)
+	} else {
+		return fake.listBindingsReturns.result1, fake.listBindingsReturns.result2
+	}
+}
+
+func (fake *FakeAdminBroker) ListBindingsCallCount() int {
+	fake.listBindingsMutex.RLock()
+	defer fake.listBindingsMutex.RUnlock()
+	return len(fake.listBindingsArgsForCall)
+}
+
+func (fake *FakeAdminBroker) ListBindingsArgsForCall(i int) context.Context {
+	fake.listBindingsMutex.RLock()
+	defer fake.listBindingsMutex.RUnlock()
+	return fake.listBindingsArgsForCall[i].ctx
+}
+
+func (fake *FakeAdminBroker) ListBindingsReturns(result1 []cephbroker.BindingResponseBody, result2 error) {
+	fake.ListBindingsStub = nil
+	fake.listBindingsReturns = struct {
+		result1 []cephbroker.BindingResponseBody
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeAdminBroker) GetBinding(ctx context.Context, bindingID string) (cephbroker.BindingResponseBody, error) {
+	fake.getBindingMutex.Lock()
+	fake.getBindingArgsForCall = append(fake.getBindingArgsForCall, struct {
+		ctx       context.Context
+		bindingID string
+	}{ctx, bindingID})
+	fake.recordInvocation("GetBinding", []interface{}{ctx, bindingID})
+	fake.getBindingMutex.Unlock()
+	if fake.GetBindingStub != nil {
+		return fake.GetBindingStub(ctx, bindingID)
+	} else {
+		return fake.getBindingReturns.result1, fake.getBindingReturns.result2
+	}
+}
+
+func (fake *FakeAdminBroker) GetBindingCallCount() int {
+	fake.getBindingMutex.RLock()
+	defer fake.getBindingMutex.RUnlock()
+	return len(fake.getBindingArgsForCall)
+}
+
+func (fake *FakeAdminBroker) GetBindingArgsForCall(i int) (context.Context, string) {
+	fake.getBindingMutex.RLock()
+	defer fake.getBindingMutex.RUnlock()
+	return fake.getBindingArgsForCall[i].ctx, fake.getBindingArgsForCall[i].bindingID
+}
+
+func (fake *FakeAdminBroker) GetBindingReturns(result1 cephbroker.BindingResponseBody, result2 error) {
+	fake.GetBindingStub = nil
+	fake.getBindingReturns = struct {
+		result1 cephbroker.BindingResponseBody
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeAdminBroker) CheckShares(ctx context.Context) (cephbroker.ReconcileReport, error) {
+	fake.checkSharesMutex.Lock()
+	fake.checkSharesArgsForCall = append(fake.checkSharesArgsForCall, struct {
+		ctx context.Context
+	}{ctx})
+	fake.recordInvocation("CheckShares", []interface{}{ctx})
+	fake.checkSharesMutex.Unlock()
+	if fake.CheckSharesStub != nil {
+		return fake.CheckSharesStub(ctx)
+	} else {
+		return fake.checkSharesReturns.result1, fake.checkSharesReturns.result2
+	}
+}
+
+func (fake *FakeAdminBroker) CheckSharesCallCount() int {
+	fake.checkSharesMutex.RLock()
+	defer fake.checkSharesMutex.RUnlock()
+	return len(fake.checkSharesArgsForCall)
+}
+
+func (fake *FakeAdminBroker) CheckSharesArgsForCall(i int) context.Context {
+	fake.checkSharesMutex.RLock()
+	defer fake.checkSharesMutex.RUnlock()
+	return fake.checkSharesArgsForCall[i].ctx
+}
+
+func (fake *FakeAdminBroker) CheckSharesReturns(result1 cephbroker.ReconcileReport, result2 error) {
+	fake.CheckSharesStub = nil
+	fake.checkSharesReturns = struct {
+		result1 cephbroker.ReconcileReport
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeAdminBroker) CreateSnapshot(ctx context.Context, instanceID string, snapshotName string) error {
+	fake.createSnapshotMutex.Lock()
+	fake.createSnapshotArgsForCall = append(fake.createSnapshotArgsForCall, struct {
+		ctx          context.Context
+		instanceID   string
+		snapshotName string
+	}{ctx, instanceID, snapshotName})
+	fake.recordInvocation("CreateSnapshot", []interface{}{ctx, instanceID, snapshotName})
+	fake.createSnapshotMutex.Unlock()
+	if fake.CreateSnapshotStub != nil {
+		return fake.CreateSnapshotStub(ctx, instanceID, snapshotName)
+	} else {
+		return fake.createSnapshotReturns.result1
+	}
+}
+
+func (fake *FakeAdminBroker) CreateSnapshotCallCount() int {
+	fake.createSnapshotMutex.RLock()
+	defer fake.createSnapshotMutex.RUnlock()
+	return len(fake.createSnapshotArgsForCall)
+}
+
+func (fake *FakeAdminBroker) CreateSnapshotArgsForCall(i int) (context.Context, string, string) {
+	fake.createSnapshotMutex.RLock()
+	defer fake.createSnapshotMutex.RUnlock()
+	return fake.createSnapshotArgsForCall[i].ctx, fake.createSnapshotArgsForCall[i].instanceID, fake.createSnapshotArgsForCall[i].snapshotName
+}
+
+func (fake *FakeAdminBroker) CreateSnapshotReturns(result1 error) {
+	fake.CreateSnapshotStub = nil
+	fake.createSnapshotReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeAdminBroker) ListSnapshots(ctx context.Context, instanceID string) ([]string, error) {
+	fake.listSnapshotsMutex.Lock()
+	fake.listSnapshotsArgsForCall = append(fake.listSnapshotsArgsForCall, struct {
+		ctx        context.Context
+		instanceID string
+	}{ctx, instanceID})
+	fake.recordInvocation("ListSnapshots", []interface{}{ctx, instanceID})
+	fake.listSnapshotsMutex.Unlock()
+	if fake.ListSnapshotsStub != nil {
+		return fake.ListSnapshotsStub(ctx, instanceID)
+	} else {
+		return fake.listSnapshotsReturns.result1, fake.listSnapshotsReturns.result2
+	}
+}
+
+func (fake *FakeAdminBroker) ListSnapshotsCallCount() int {
+	fake.listSnapshotsMutex.RLock()
+	defer fake.listSnapshotsMutex.RUnlock()
+	return len(fake.listSnapshotsArgsForCall)
+}
+
+func (fake *FakeAdminBroker) ListSnapshotsArgsForCall(i int) (context.Context, string) {
+	fake.listSnapshotsMutex.RLock()
+	defer fake.listSnapshotsMutex.RUnlock()
+	return fake.listSnapshotsArgsForCall[i].ctx, fake.listSnapshotsArgsForCall[i].instanceID
+}
+
+func (fake *FakeAdminBroker) ListSnapshotsReturns(result1 []string, result2 error) {
+	fake.ListSnapshotsStub = nil
+	fake.listSnapshotsReturns = struct {
+		result1 []string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeAdminBroker) DeleteSnapshot(ctx context.Context, instanceID string, snapshotName string) error {
+	fake.deleteSnapshotMutex.Lock()
+	fake.deleteSnapshotArgsForCall = append(fake.deleteSnapshotArgsForCall, struct {
+		ctx          context.Context
+		instanceID   string
+		snapshotName string
+	}{ctx, instanceID, snapshotName})
+	fake.recordInvocation("DeleteSnapshot", []interface{}{ctx, instanceID, snapshotName})
+	fake.deleteSnapshotMutex.Unlock()
+	if fake.DeleteSnapshotStub != nil {
+		return fake.DeleteSnapshotStub(ctx, instanceID, snapshotName)
+	} else {
+		return fake.deleteSnapshotReturns.result1
+	}
+}
+
+func (fake *FakeAdminBroker) DeleteSnapshotCallCount() int {
+	fake.deleteSnapshotMutex.RLock()
+	defer fake.deleteSnapshotMutex.RUnlock()
+	return len(fake.deleteSnapshotArgsForCall)
+}
+
+func (fake *FakeAdminBroker) DeleteSnapshotArgsForCall(i int) (context.Context, string, string) {
+	fake.deleteSnapshotMutex.RLock()
+	defer fake.deleteSnapshotMutex.RUnlock()
+	return fake.deleteSnapshotArgsForCall[i].ctx, fake.deleteSnapshotArgsForCall[i].instanceID, fake.deleteSnapshotArgsForCall[i].snapshotName
+}
+
+func (fake *FakeAdminBroker) DeleteSnapshotReturns(result1 error) {
+	fake.DeleteSnapshotStub = nil
+	fake.deleteSnapshotReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeAdminBroker) Invocations() map[string][][]interface{} {
+	fake.invocationsMutex.RLock()
+	defer fake.invocationsMutex.RUnlock()
+	fake.listInstancesMutex.RLock()
+	defer fake.listInstancesMutex.RUnlock()
+	fake.getInstanceMutex.RLock()
+	defer fake.getInstanceMutex.RUnlock()
+	fake.listBindingsMutex.RLock()
+	defer fake.listBindingsMutex.RUnlock()
+	fake.getBindingMutex.RLock()
+	defer fake.getBindingMutex.RUnlock()
+	fake.checkSharesMutex.RLock()
+	defer fake.checkSharesMutex.RUnlock()
+	fake.createSnapshotMutex.RLock()
+	defer fake.createSnapshotMutex.RUnlock()
+	fake.listSnapshotsMutex.RLock()
+	defer fake.listSnapshotsMutex.RUnlock()
+	fake.deleteSnapshotMutex.RLock()
+	defer fake.deleteSnapshotMutex.RUnlock()
+	return fake.invocations
+}
+
+func (fake *FakeAdminBroker) recordInvocation(key string, args []interface{}) {
+	fake.invocationsMutex.Lock()
+	defer fake.invocationsMutex.Unlock()
+	if fake.invocations == nil {
+		fake.invocations = map[string][][]interface{}{}
+	}
+	if fake.invocations[key] == nil {
+		fake.invocations[key] = [][]interface{}{}
+	}
+	fake.invocations[key] = append(fake.invocations[key], args)
+}
+
+var _ cephbroker.AdminBroker = new(FakeAdminBroker)
@@ -17,6 +17,14 @@ type FakeClient struct {
 	isFilesystemMountedReturns struct {
 		result1 bool
 	}
+	GetMountSettingsStub        func(voldriver.Env) cephbroker.MountSettings
+	getMountSettingsMutex       sync.RWMutex
+	getMountSettingsArgsForCall []struct {
+		arg1 voldriver.Env
+	}
+	getMountSettingsReturns struct {
+		result1 cephbroker.MountSettings
+	}
 	MountFileSystemStub        func(voldriver.Env, string) (string, error)
 	mountFileSystemMutex       sync.RWMutex
 	mountFileSystemArgsForCall []struct {
@@ -27,6 +35,14 @@ type FakeClient struct {
 		result1 string
 		result2 error
 	}
+	UnmountFileSystemStub        func(voldriver.Env) error
+	unmountFileSystemMutex       sync.RWMutex
+	unmountFileSystemArgsForCall []struct {
+		arg1 voldriver.Env
+	}
+	unmountFileSystemReturns struct {
+		result1 error
+	}
 	CreateShareStub        func(voldriver.Env, string) (string, error)
 	createShareMutex       sync.RWMutex
 	createShareArgsForCall []struct {
@@ -37,6 +53,18 @@ type FakeClient struct {
 		result1 string
 		result2 error
 	}
+	CloneShareStub        func(voldriver.Env, string, string, string) (string, error)
+	cloneShareMutex       sync.RWMutex
+	cloneShareArgsForCall []struct {
+		arg1 voldriver.Env
+		arg2 string
+		arg3 string
+		arg4 string
+	}
+	cloneShareReturns struct {
+		result1 string
+		result2 error
+	}
 	DeleteShareStub        func(voldriver.Env, string) error
 	deleteShareMutex       sync.RWMutex
 	deleteShareArgsForCall []struct {
@@ -46,6 +74,25 @@ type FakeClient struct {
 	deleteShareReturns struct {
 		result1 error
 	}
+	ListSharesStub        func(voldriver.Env) ([]string, error)
+	listSharesMutex       sync.RWMutex
+	listSharesArgsForCall []struct {
+		arg1 voldriver.Env
+	}
+	listSharesReturns struct {
+		result1 []string
+		result2 error
+	}
+	QuarantineShareStub        func(voldriver.Env, string) (string, error)
+	quarantineShareMutex       sync.RWMutex
+	quarantineShareArgsForCall []struct {
+		arg1 voldriver.Env
+		arg2 string
+	}
+	quarantineShareReturns struct {
+		result1 string
+		result2 error
+	}
 	GetPathsForShareStub        func(voldriver.Env, string) (string, string, error)
 	getPathsForShareMutex       sync.RWMutex
 	getPathsForShareArgsForCall []struct {
@@ -57,7 +104,7 @@ type FakeClient struct {
 		result2 string
 		result3 error
 	}
-	GetConfigDetailsStub        func(voldriver.Env) (string, string, error)
+	GetConfigDetailsStub        func(voldriver.Env) (string, string, string, error)
 	getConfigDetailsMutex       sync.RWMutex
 	getConfigDetailsArgsForCall []struct {
 		arg1 voldriver.Env
@@ -65,7 +112,99 @@ type FakeClient struct {
 	getConfigDetailsReturns struct {
 		result1 string
 		result2 string
-		result3 error
+		result3 string
+		result4 error
+	}
+	SetQuotaStub        func(voldriver.Env, string, cephbroker.Quota) error
+	setQuotaMutex       sync.RWMutex
+	setQuotaArgsForCall []struct {
+		arg1 voldriver.Env
+		arg2 string
+		arg3 cephbroker.Quota
+	}
+	setQuotaReturns struct {
+		result1 error
+	}
+	SetOwnershipStub        func(voldriver.Env, string, cephbroker.Ownership) error
+	setOwnershipMutex       sync.RWMutex
+	setOwnershipArgsForCall []struct {
+		arg1 voldriver.Env
+		arg2 string
+		arg3 cephbroker.Ownership
+	}
+	setOwnershipReturns struct {
+		result1 error
+	}
+	GetQuotaStub        func(voldriver.Env, string) (cephbroker.Quota, error)
+	getQuotaMutex       sync.RWMutex
+	getQuotaArgsForCall []struct {
+		arg1 voldriver.Env
+		arg2 string
+	}
+	getQuotaReturns struct {
+		result1 cephbroker.Quota
+		result2 error
+	}
+	GetUsageStub        func(voldriver.Env, string) (cephbroker.Usage, error)
+	getUsageMutex       sync.RWMutex
+	getUsageArgsForCall []struct {
+		arg1 voldriver.Env
+		arg2 string
+	}
+	getUsageReturns struct {
+		result1 cephbroker.Usage
+		result2 error
+	}
+	CreateClientKeyStub        func(voldriver.Env, string, string, bool) (string, error)
+	createClientKeyMutex       sync.RWMutex
+	createClientKeyArgsForCall []struct {
+		arg1 voldriver.Env
+		arg2 string
+		arg3 string
+		arg4 bool
+	}
+	createClientKeyReturns struct {
+		result1 string
+		result2 error
+	}
+	DeleteClientKeyStub        func(voldriver.Env, string) error
+	deleteClientKeyMutex       sync.RWMutex
+	deleteClientKeyArgsForCall []struct {
+		arg1 voldriver.Env
+		arg2 string
+	}
+	deleteClientKeyReturns struct {
+		result1 error
+	}
+	CreateSnapshotStub        func(voldriver.Env, string, string) error
+	createSnapshotMutex       sync.RWMutex
+	createSnapshotArgsForCall []struct {
+		arg1 voldriver.Env
+		arg2 string
+		arg3 string
+	}
+	createSnapshotReturns struct {
+		result1 error
+	}
+	ListSnapshotsStub        func(voldriver.Env, string) ([]string, error)
+	listSnapshotsMutex       sync.RWMutex
+	listSnapshotsArgsForCall []struct {
+		arg1 voldriver.Env
+		arg2 string
+	}
+	listSnapshotsReturns struct {
+		result1 []string
+		result2 error
+	}
+	DeleteSnapshotStub        func(voldriver.Env, string, string) error
+	deleteSnapshotMutex       sync.RWMutex
+	deleteSnapshotArgsForCall []struct {
+		arg1 voldriver.Env
+		arg2 string
+		arg3 string
+	}
+	deleteSnapshotReturns struct {
+		result1 error
 	}
 	invocations      map[string][][]interface{}
 	invocationsMutex sync.RWMutex
@@ -104,6 +243,39 @@ func (fake *FakeClient) IsFilesystemMountedReturns(result1 bool) {
 	}{result1}
 }
 
+func (fake *FakeClient) GetMountSettings(arg1 voldriver.Env) cephbroker.MountSettings {
+	fake.getMountSettingsMutex.Lock()
+	fake.getMountSettingsArgsForCall = append(fake.getMountSettingsArgsForCall, struct {
+		arg1 voldriver.Env
+	}{arg1})
+	fake.recordInvocation("GetMountSettings", []interface{}{arg1})
+	fake.getMountSettingsMutex.Unlock()
+	if fake.GetMountSettingsStub != nil {
+		return fake.GetMountSettingsStub(arg1)
+	} else {
+		return fake.getMountSettingsReturns.result1
+	}
+}
+
+func (fake *FakeClient) GetMountSettingsCallCount() int {
+	fake.getMountSettingsMutex.RLock()
+	defer fake.getMountSettingsMutex.RUnlock()
+	return len(fake.getMountSettingsArgsForCall)
+}
+
+func (fake *FakeClient) GetMountSettingsArgsForCall(i int) voldriver.Env {
+	fake.getMountSettingsMutex.RLock()
+	defer fake.getMountSettingsMutex.RUnlock()
+	return fake.getMountSettingsArgsForCall[i].arg1
+}
+
+func (fake *FakeClient) GetMountSettingsReturns(result1 cephbroker.MountSettings) {
+	fake.GetMountSettingsStub = nil
+	fake.getMountSettingsReturns = struct {
+		result1 cephbroker.MountSettings
+	}{result1}
+}
+
 func (fake *FakeClient) MountFileSystem(arg1 voldriver.Env, arg2 string) (string, error) {
 	fake.mountFileSystemMutex.Lock()
 	fake.mountFileSystemArgsForCall = append(fake.mountFileSystemArgsForCall, struct {
@@ -139,6 +311,39 @@ func (fake *FakeClient) MountFileSystemReturns(result1 string, result2 error) {
 	}{result1, result2}
 }
 
+func (fake *FakeClient) UnmountFileSystem(arg1 voldriver.Env) error {
+	fake.unmountFileSystemMutex.Lock()
+	fake.unmountFileSystemArgsForCall = append(fake.unmountFileSystemArgsForCall, struct {
+		arg1 voldriver.Env
+	}{arg1})
+	fake.recordInvocation("UnmountFileSystem", []interface{}{arg1})
+	fake.unmountFileSystemMutex.Unlock()
+	if fake.UnmountFileSystemStub != nil {
+		return fake.UnmountFileSystemStub(arg1)
+	} else {
+		return fake.unmountFileSystemReturns.result1
+	}
+}
+
+func (fake *FakeClient) UnmountFileSystemCallCount() int {
+	fake.unmountFileSystemMutex.RLock()
+	defer fake.unmountFileSystemMutex.RUnlock()
+	return len(fake.unmountFileSystemArgsForCall)
+}
+
+func (fake *FakeClient) UnmountFileSystemArgsForCall(i int) voldriver.Env {
+	fake.unmountFileSystemMutex.RLock()
+	defer fake.unmountFileSystemMutex.RUnlock()
+	return fake.unmountFileSystemArgsForCall[i].arg1
+}
+
+func (fake *FakeClient) UnmountFileSystemReturns(result1 error) {
+	fake.UnmountFileSystemStub = nil
+	fake.unmountFileSystemReturns = struct {
+		result1 error
+	}{result1}
+}
+
 func (fake *FakeClient) CreateShare(arg1 voldriver.Env, arg2 string) (string, error) {
 	fake.createShareMutex.Lock()
 	fake.createShareArgsForCall = append(fake.createShareArgsForCall, struct {
@@ -174,6 +379,43 @@ func (fake *FakeClient) CreateShareReturns(result1 string, result2 error) {
 	}{result1, result2}
 }
 
+func (fake *FakeClient) CloneShare(arg1 voldriver.Env, arg2 string, arg3 string, arg4 string) (string, error) {
+	fake.cloneShareMutex.Lock()
+	fake.cloneShareArgsForCall = append(fake.cloneShareArgsForCall, struct {
+		arg1 voldriver.Env
+		arg2 string
+		arg3 string
+		arg4 string
+	}{arg1, arg2, arg3, arg4})
+	fake.recordInvocation("CloneShare", []interface{}{arg1, arg2, arg3, arg4})
+	fake.cloneShareMutex.Unlock()
+	if fake.CloneShareStub != nil {
+		return fake.CloneShareStub(arg1, arg2, arg3, arg4)
+	} else {
+		return fake.cloneShareReturns.result1, fake.cloneShareReturns.result2
+	}
+}
+
+func (fake *FakeClient) CloneShareCallCount() int {
+	fake.cloneShareMutex.RLock()
+	defer fake.cloneShareMutex.RUnlock()
+	return len(fake.cloneShareArgsForCall)
+}
+
+func (fake *FakeClient) CloneShareArgsForCall(i int) (voldriver.Env, string, string, string) {
+	fake.cloneShareMutex.RLock()
+	defer fake.cloneShareMutex.RUnlock()
+	return fake.cloneShareArgsForCall[i].arg1, fake.cloneShareArgsForCall[i].arg2, fake.cloneShareArgsForCall[i].arg3, fake.cloneShareArgsForCall[i].arg4
+}
+
+func (fake *FakeClient) CloneShareReturns(result1 string, result2 error) {
+	fake.CloneShareStub = nil
+	fake.cloneShareReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
 func (fake *FakeClient) DeleteShare(arg1 voldriver.Env, arg2 string) error {
 	fake.deleteShareMutex.Lock()
 	fake.deleteShareArgsForCall = append(fake.deleteShareArgsForCall, struct {
@@ -208,6 +450,75 @@ func (fake *FakeClient) DeleteShareReturns(result1 error) {
 	}{result1}
 }
 
+func (fake *FakeClient) ListShares(arg1 voldriver.Env) ([]string, error) {
+	fake.listSharesMutex.Lock()
+	fake.listSharesArgsForCall = append(fake.listSharesArgsForCall, struct {
+		arg1 voldriver.Env
+	}{arg1})
+	fake.recordInvocation("ListShares", []interface{}{arg1})
+	fake.listSharesMutex.Unlock()
+	if fake.ListSharesStub != nil {
+		return fake.ListSharesStub(arg1)
+	} else {
+		return fake.listSharesReturns.result1, fake.listSharesReturns.result2
+	}
+}
+
+func (fake *FakeClient) ListSharesCallCount() int {
+	fake.listSharesMutex.RLock()
+	defer fake.listSharesMutex.RUnlock()
+	return len(fake.listSharesArgsForCall)
+}
+
+func (fake *FakeClient) ListSharesArgsForCall(i int) voldriver.Env {
+	fake.listSharesMutex.RLock()
+	defer fake.listSharesMutex.RUnlock()
+	return fake.listSharesArgsForCall[i].arg1
+}
+
+func (fake *FakeClient) ListSharesReturns(result1 []string, result2 error) {
+	fake.ListSharesStub = nil
+	fake.listSharesReturns = struct {
+		result1 []string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeClient) QuarantineShare(arg1 voldriver.Env, arg2 string) (string, error) {
+	fake.quarantineShareMutex.Lock()
+	fake.quarantineShareArgsForCall = append(fake.quarantineShareArgsForCall, struct {
+		arg1 voldriver.Env
+		arg2 string
+	}{arg1, arg2})
+	fake.recordInvocation("QuarantineShare", []interface{}{arg1, arg2})
+	fake.quarantineShareMutex.Unlock()
+	if fake.QuarantineShareStub != nil {
+		return fake.QuarantineShareStub(arg1, arg2)
+	} else {
+		return fake.quarantineShareReturns.result1, fake.quarantineShareReturns.result2
+	}
+}
+
+func (fake *FakeClient) QuarantineShareCallCount() int {
+	fake.quarantineShareMutex.RLock()
+	defer fake.quarantineShareMutex.RUnlock()
+	return len(fake.quarantineShareArgsForCall)
+}
+
+func (fake *FakeClient) QuarantineShareArgsForCall(i int) (voldriver.Env, string) {
+	fake.quarantineShareMutex.RLock()
+	defer fake.quarantineShareMutex.RUnlock()
+	return fake.quarantineShareArgsForCall[i].arg1, fake.quarantineShareArgsForCall[i].arg2
+}
+
+func (fake *FakeClient) QuarantineShareReturns(result1 string, result2 error) {
+	fake.QuarantineShareStub = nil
+	fake.quarantineShareReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
 func (fake *FakeClient) GetPathsForShare(arg1 voldriver.Env, arg2 string) (string, string, error) {
 	fake.getPathsForShareMutex.Lock()
 	fake.getPathsForShareArgsForCall = append(fake.getPathsForShareArgsForCall, struct {
@@ -244,7 +555,7 @@ func (fake *FakeClient) GetPathsForShareReturns(result1 string, result2 string,
 	}{result1, result2, result3}
 }
 
-func (fake *FakeClient) GetConfigDetails(arg1 voldriver.Env) (string, string, error) {
+func (fake *FakeClient) GetConfigDetails(arg1 voldriver.Env) (string, string, string, error) {
 	fake.getConfigDetailsMutex.Lock()
 	fake.getConfigDetailsArgsForCall = append(fake.getConfigDetailsArgsForCall, struct {
 		arg1 voldriver.Env
@@ -254,7 +565,7 @@ func (fake *FakeClient) GetConfigDetails(arg1 voldriver.Env) (string, string, er
 	if fake.GetConfigDetailsStub != nil {
 		return fake.GetConfigDetailsStub(arg1)
 	} else {
-		return fake.getConfigDetailsReturns.result1, fake.getConfigDetailsReturns.result2, fake.getConfigDetailsReturns.result3
+		return fake.getConfigDetailsReturns.result1, fake.getConfigDetailsReturns.result2, fake.getConfigDetailsReturns.result3, fake.getConfigDetailsReturns.result4
 	}
 }
 
@@ -270,13 +581,330 @@ func (fake *FakeClient) GetConfigDetailsArgsForCall(i int) voldriver.Env {
 	return fake.getConfigDetailsArgsForCall[i].arg1
 }
 
-func (fake *FakeClient) GetConfigDetailsReturns(result1 string, result2 string, result3 error) {
+func (fake *FakeClient) GetConfigDetailsReturns(result1 string, result2 string, result3 string, result4 error) {
 	fake.GetConfigDetailsStub = nil
 	fake.getConfigDetailsReturns = struct {
 		result1 string
 		result2 string
-		result3 error
-	}{result1, result2, result3}
+		result3 string
+		result4 error
+	}{result1, result2, result3, result4}
+}
+
+func (fake *FakeClient) SetQuota(arg1 voldriver.Env, arg2 string, arg3 cephbroker.Quota) error {
+	fake.setQuotaMutex.Lock()
+	fake.setQuotaArgsForCall = append(fake.setQuotaArgsForCall, struct {
+		arg1 voldriver.Env
+		arg2 string
+		arg3 cephbroker.Quota
+	}{arg1, arg2, arg3})
+	fake.recordInvocation("SetQuota", []interface{}{arg1, arg2, arg3})
+	fake.setQuotaMutex.Unlock()
+	if fake.SetQuotaStub != nil {
+		return fake.SetQuotaStub(arg1, arg2, arg3)
+	} else {
+		return fake.setQuotaReturns.result1
+	}
+}
+
+func (fake *FakeClient) SetQuotaCallCount() int {
+	fake.setQuotaMutex.RLock()
+	defer fake.setQuotaMutex.RUnlock()
+	return len(fake.setQuotaArgsForCall)
+}
+
+func (fake *FakeClient) SetQuotaArgsForCall(i int) (voldriver.Env, string, cephbroker.Quota) {
+	fake.setQuotaMutex.RLock()
+	defer fake.setQuotaMutex.RUnlock()
+	return fake.setQuotaArgsForCall[i].arg1, fake.setQuotaArgsForCall[i].arg2, fake.setQuotaArgsForCall[i].arg3
+}
+
+func (fake *FakeClient) SetQuotaReturns(result1 error) {
+	fake.SetQuotaStub = nil
+	fake.setQuotaReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeClient) SetOwnership(arg1 voldriver.Env, arg2 string, arg3 cephbroker.Ownership) error {
+	fake.setOwnershipMutex.Lock()
+	fake.setOwnershipArgsForCall = append(fake.setOwnershipArgsForCall, struct {
+		arg1 voldriver.Env
+		arg2 string
+		arg3 cephbroker.Ownership
+	}{arg1, arg2, arg3})
+	fake.recordInvocation("SetOwnership", []interface{}{arg1, arg2, arg3})
+	fake.setOwnershipMutex.Unlock()
+	if fake.SetOwnershipStub != nil {
+		return fake.SetOwnershipStub(arg1, arg2, arg3)
+	} else {
+		return fake.setOwnershipReturns.result1
+	}
+}
+
+func (fake *FakeClient) SetOwnershipCallCount() int {
+	fake.setOwnershipMutex.RLock()
+	defer fake.setOwnershipMutex.RUnlock()
+	return len(fake.setOwnershipArgsForCall)
+}
+
+func (fake *FakeClient) SetOwnershipArgsForCall(i int) (voldriver.Env, string, cephbroker.Ownership) {
+	fake.setOwnershipMutex.RLock()
+	defer fake.setOwnershipMutex.RUnlock()
+	return fake.setOwnershipArgsForCall[i].arg1, fake.setOwnershipArgsForCall[i].arg2, fake.setOwnershipArgsForCall[i].arg3
+}
+
+func (fake *FakeClient) SetOwnershipReturns(result1 error) {
+	fake.SetOwnershipStub = nil
+	fake.setOwnershipReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeClient) GetQuota(arg1 voldriver.Env, arg2 string) (cephbroker.Quota, error) {
+	fake.getQuotaMutex.Lock()
+	fake.getQuotaArgsForCall = append(fake.getQuotaArgsForCall, struct {
+		arg1 voldriver.Env
+		arg2 string
+	}{arg1, arg2})
+	fake.recordInvocation("GetQuota", []interface{}{arg1, arg2})
+	fake.getQuotaMutex.Unlock()
+	if fake.GetQuotaStub != nil {
+		return fake.GetQuotaStub(arg1, arg2)
+	} else {
+		return fake.getQuotaReturns.result1, fake.getQuotaReturns.result2
+	}
+}
+
+func (fake *FakeClient) GetQuotaCallCount() int {
+	fake.getQuotaMutex.RLock()
+	defer fake.getQuotaMutex.RUnlock()
+	return len(fake.getQuotaArgsForCall)
+}
+
+func (fake *FakeClient) GetQuotaArgsForCall(i int) (voldriver.Env, string) {
+	fake.getQuotaMutex.RLock()
+	defer fake.getQuotaMutex.RUnlock()
+	return fake.getQuotaArgsForCall[i].arg1, fake.getQuotaArgsForCall[i].arg2
+}
+
+func (fake *FakeClient) GetQuotaReturns(result1 cephbroker.Quota, result2 error) {
+	fake.GetQuotaStub = nil
+	fake.getQuotaReturns = struct {
+		result1 cephbroker.Quota
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeClient) GetUsage(arg1 voldriver.Env, arg2 string) (cephbroker.Usage, error) {
+	fake.getUsageMutex.Lock()
+	fake.getUsageArgsForCall = append(fake.getUsageArgsForCall, struct {
+		arg1 voldriver.Env
+		arg2 string
+	}{arg1, arg2})
+	fake.recordInvocation("GetUsage", []interface{}{arg1, arg2})
+	fake.getUsageMutex.Unlock()
+	if fake.GetUsageStub != nil {
+		return fake.GetUsageStub(arg1, arg2)
+	} else {
+		return fake.getUsageReturns.result1, fake.getUsageReturns.result2
+	}
+}
+
+func (fake *FakeClient) GetUsageCallCount() int {
+	fake.getUsageMutex.RLock()
+	defer fake.getUsageMutex.RUnlock()
+	return len(fake.getUsageArgsForCall)
+}
+
+func (fake *FakeClient) GetUsageArgsForCall(i int) (voldriver.Env, string) {
+	fake.getUsageMutex.RLock()
+	defer fake.getUsageMutex.RUnlock()
+	return fake.getUsageArgsForCall[i].arg1, fake.getUsageArgsForCall[i].arg2
+}
+
+func (fake *FakeClient) GetUsageReturns(result1 cephbroker.Usage, result2 error) {
+	fake.GetUsageStub = nil
+	fake.getUsageReturns = struct {
+		result1 cephbroker.Usage
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeClient) CreateClientKey(arg1 voldriver.Env, arg2 string, arg3 string, arg4 bool) (string, error) {
+	fake.createClientKeyMutex.Lock()
+	fake.createClientKeyArgsForCall = append(fake.createClientKeyArgsForCall, struct {
+		arg1 voldriver.Env
+		arg2 string
+		arg3 string
+		arg4 bool
+	}{arg1, arg2, arg3, arg4})
+	fake.recordInvocation("CreateClientKey", []interface{}{arg1, arg2, arg3, arg4})
+	fake.createClientKeyMutex.Unlock()
+	if fake.CreateClientKeyStub != nil {
+		return fake.CreateClientKeyStub(arg1, arg2, arg3, arg4)
+	} else {
+		return fake.createClientKeyReturns.result1, fake.createClientKeyReturns.result2
+	}
+}
+
+func (fake *FakeClient) CreateClientKeyCallCount() int {
+	fake.createClientKeyMutex.RLock()
+	defer fake.createClientKeyMutex.RUnlock()
+	return len(fake.createClientKeyArgsForCall)
+}
+
+func (fake *FakeClient) CreateClientKeyArgsForCall(i int) (voldriver.Env, string, string, bool) {
+	fake.createClientKeyMutex.RLock()
+	defer fake.createClientKeyMutex.RUnlock()
+	return fake.createClientKeyArgsForCall[i].arg1, fake.createClientKeyArgsForCall[i].arg2, fake.createClientKeyArgsForCall[i].arg3, fake.createClientKeyArgsForCall[i].arg4
+}
+
+func (fake *FakeClient) CreateClientKeyReturns(result1 string, result2 error) {
+	fake.CreateClientKeyStub = nil
+	fake.createClientKeyReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeClient) DeleteClientKey(arg1 voldriver.Env, arg2 string) error {
+	fake.deleteClientKeyMutex.Lock()
+	fake.deleteClientKeyArgsForCall = append(fake.deleteClientKeyArgsForCall, struct {
+		arg1 voldriver.Env
+		arg2 string
+	}{arg1, arg2})
+	fake.recordInvocation("DeleteClientKey", []interface{}{arg1, arg2})
+	fake.deleteClientKeyMutex.Unlock()
+	if fake.DeleteClientKeyStub != nil {
+		return fake.DeleteClientKeyStub(arg1, arg2)
+	} else {
+		return fake.deleteClientKeyReturns.result1
+	}
+}
+
+func (fake *FakeClient) DeleteClientKeyCallCount() int {
+	fake.deleteClientKeyMutex.RLock()
+	defer fake.deleteClientKeyMutex.RUnlock()
+	return len(fake.deleteClientKeyArgsForCall)
+}
+
+func (fake *FakeClient) DeleteClientKeyArgsForCall(i int) (voldriver.Env, string) {
+	fake.deleteClientKeyMutex.RLock()
+	defer fake.deleteClientKeyMutex.RUnlock()
+	return fake.deleteClientKeyArgsForCall[i].arg1, fake.deleteClientKeyArgsForCall[i].arg2
+}
+
+func (fake *FakeClient) DeleteClientKeyReturns(result1 error) {
+	fake.DeleteClientKeyStub = nil
+	fake.deleteClientKeyReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeClient) CreateSnapshot(arg1 voldriver.Env, arg2 string, arg3 string) error {
+	fake.createSnapshotMutex.Lock()
+	fake.createSnapshotArgsForCall = append(fake.createSnapshotArgsForCall, struct {
+		arg1 voldriver.Env
+		arg2 string
+		arg3 string
+	}{arg1, arg2, arg3})
+	fake.recordInvocation("CreateSnapshot", []interface{}{arg1, arg2, arg3})
+	fake.createSnapshotMutex.Unlock()
+	if fake.CreateSnapshotStub != nil {
+		return fake.CreateSnapshotStub(arg1, arg2, arg3)
+	} else {
+		return fake.createSnapshotReturns.result1
+	}
+}
+
+func (fake *FakeClient) CreateSnapshotCallCount() int {
+	fake.createSnapshotMutex.RLock()
+	defer fake.createSnapshotMutex.RUnlock()
+	return len(fake.createSnapshotArgsForCall)
+}
+
+func (fake *FakeClient) CreateSnapshotArgsForCall(i int) (voldriver.Env, string, string) {
+	fake.createSnapshotMutex.RLock()
+	defer fake.createSnapshotMutex.RUnlock()
+	return fake.createSnapshotArgsForCall[i].arg1, fake.createSnapshotArgsForCall[i].arg2, fake.createSnapshotArgsForCall[i].arg3
+}
+
+func (fake *FakeClient) CreateSnapshotReturns(result1 error) {
+	fake.CreateSnapshotStub = nil
+	fake.createSnapshotReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeClient) ListSnapshots(arg1 voldriver.Env, arg2 string) ([]string, error) {
+	fake.listSnapshotsMutex.Lock()
+	fake.listSnapshotsArgsForCall = append(fake.listSnapshotsArgsForCall, struct {
+		arg1 voldriver.Env
+		arg2 string
+	}{arg1, arg2})
+	fake.recordInvocation("ListSnapshots", []interface{}{arg1, arg2})
+	fake.listSnapshotsMutex.Unlock()
+	if fake.ListSnapshotsStub != nil {
+		return fake.ListSnapshotsStub(arg1, arg2)
+	} else {
+		return fake.listSnapshotsReturns.result1, fake.listSnapshotsReturns.result2
+	}
+}
+
+func (fake *FakeClient) ListSnapshotsCallCount() int {
+	fake.listSnapshotsMutex.RLock()
+	defer fake.listSnapshotsMutex.RUnlock()
+	return len(fake.listSnapshotsArgsForCall)
+}
+
+func (fake *FakeClient) ListSnapshotsArgsForCall(i int) (voldriver.Env, string) {
+	fake.listSnapshotsMutex.RLock()
+	defer fake.listSnapshotsMutex.RUnlock()
+	return fake.listSnapshotsArgsForCall[i].arg1, fake.listSnapshotsArgsForCall[i].arg2
+}
+
+func (fake *FakeClient) ListSnapshotsReturns(result1 []string, result2 error) {
+	fake.ListSnapshotsStub = nil
+	fake.listSnapshotsReturns = struct {
+		result1 []string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeClient) DeleteSnapshot(arg1 voldriver.Env, arg2 string, arg3 string) error {
+	fake.deleteSnapshotMutex.Lock()
+	fake.deleteSnapshotArgsForCall = append(fake.deleteSnapshotArgsForCall, struct {
+		arg1 voldriver.Env
+		arg2 string
+		arg3 string
+	}{arg1, arg2, arg3})
+	fake.recordInvocation("DeleteSnapshot", []interface{}{arg1, arg2, arg3})
+	fake.deleteSnapshotMutex.Unlock()
+	if fake.DeleteSnapshotStub != nil {
+		return fake.DeleteSnapshotStub(arg1, arg2, arg3)
+	} else {
+		return fake.deleteSnapshotReturns.result1
+	}
+}
+
+func (fake *FakeClient) DeleteSnapshotCallCount() int {
+	fake.deleteSnapshotMutex.RLock()
+	defer fake.deleteSnapshotMutex.RUnlock()
+	return len(fake.deleteSnapshotArgsForCall)
+}
+
+func (fake *FakeClient) DeleteSnapshotArgsForCall(i int) (voldriver.Env, string, string) {
+	fake.deleteSnapshotMutex.RLock()
+	defer fake.deleteSnapshotMutex.RUnlock()
+	return fake.deleteSnapshotArgsForCall[i].arg1, fake.deleteSnapshotArgsForCall[i].arg2, fake.deleteSnapshotArgsForCall[i].arg3
+}
+
+func (fake *FakeClient) DeleteSnapshotReturns(result1 error) {
+	fake.DeleteSnapshotStub = nil
+	fake.deleteSnapshotReturns = struct {
+		result1 error
+	}{result1}
 }
 
 func (fake *FakeClient) Invocations() map[string][][]interface{} {
@@ -284,16 +912,44 @@ func (fake *FakeClient) Invocations() map[string][][]interface{} {
 	defer fake.invocationsMutex.RUnlock()
 	fake.isFilesystemMountedMutex.RLock()
 	defer fake.isFilesystemMountedMutex.RUnlock()
+	fake.getMountSettingsMutex.RLock()
+	defer fake.getMountSettingsMutex.RUnlock()
 	fake.mountFileSystemMutex.RLock()
 	defer fake.mountFileSystemMutex.RUnlock()
+	fake.unmountFileSystemMutex.RLock()
+	defer fake.unmountFileSystemMutex.RUnlock()
 	fake.createShareMutex.RLock()
 	defer fake.createShareMutex.RUnlock()
+	fake.cloneShareMutex.RLock()
+	defer fake.cloneShareMutex.RUnlock()
 	fake.deleteShareMutex.RLock()
 	defer fake.deleteShareMutex.RUnlock()
+	fake.listSharesMutex.RLock()
+	defer fake.listSharesMutex.RUnlock()
+	fake.quarantineShareMutex.RLock()
+	defer fake.quarantineShareMutex.RUnlock()
 	fake.getPathsForShareMutex.RLock()
 	defer fake.getPathsForShareMutex.RUnlock()
 	fake.getConfigDetailsMutex.RLock()
 	defer fake.getConfigDetailsMutex.RUnlock()
+	fake.setQuotaMutex.RLock()
+	defer fake.setQuotaMutex.RUnlock()
+	fake.setOwnershipMutex.RLock()
+	defer fake.setOwnershipMutex.RUnlock()
+	fake.getQuotaMutex.RLock()
+	defer fake.getQuotaMutex.RUnlock()
+	fake.getUsageMutex.RLock()
+	defer fake.getUsageMutex.RUnlock()
+	fake.createClientKeyMutex.RLock()
+	defer fake.createClientKeyMutex.RUnlock()
+	fake.deleteClientKeyMutex.RLock()
+	defer fake.deleteClientKeyMutex.RUnlock()
+	fake.createSnapshotMutex.RLock()
+	defer fake.createSnapshotMutex.RUnlock()
+	fake.listSnapshotsMutex.RLock()
+	defer fake.listSnapshotsMutex.RUnlock()
+	fake.deleteSnapshotMutex.RLock()
+	defer fake.deleteSnapshotMutex.RUnlock()
 	return fake.invocations
 }
 
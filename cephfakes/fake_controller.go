@@ -27,15 +27,117 @@ type FakeController struct {
 	removeReturns struct {
 		result1 voldriver.ErrorResponse
 	}
-	BindStub        func(env voldriver.Env, instanceID string) cephbroker.BindResponse
+	UpdateStub        func(env voldriver.Env, updateRequest cephbroker.UpdateRequest) voldriver.ErrorResponse
+	updateMutex       sync.RWMutex
+	updateArgsForCall []struct {
+		env           voldriver.Env
+		updateRequest cephbroker.UpdateRequest
+	}
+	updateReturns struct {
+		result1 voldriver.ErrorResponse
+	}
+	BindStub        func(env voldriver.Env, instanceID string, bindingID string, readOnly bool) cephbroker.BindResponse
 	bindMutex       sync.RWMutex
 	bindArgsForCall []struct {
 		env        voldriver.Env
 		instanceID string
+		bindingID  string
+		readOnly   bool
 	}
 	bindReturns struct {
 		result1 cephbroker.BindResponse
 	}
+	UnbindStub        func(env voldriver.Env, instanceID string, bindingID string) voldriver.ErrorResponse
+	unbindMutex       sync.RWMutex
+	unbindArgsForCall []struct {
+		env        voldriver.Env
+		instanceID string
+		bindingID  string
+	}
+	unbindReturns struct {
+		result1 voldriver.ErrorResponse
+	}
+	CreateSnapshotStub        func(env voldriver.Env, instanceID string, snapshotName string) voldriver.ErrorResponse
+	createSnapshotMutex       sync.RWMutex
+	createSnapshotArgsForCall []struct {
+		env          voldriver.Env
+		instanceID   string
+		snapshotName string
+	}
+	createSnapshotReturns struct {
+		result1 voldriver.ErrorResponse
+	}
+	ListSnapshotsStub        func(env voldriver.Env, instanceID string) cephbroker.SnapshotsResponse
+	listSnapshotsMutex       sync.RWMutex
+	listSnapshotsArgsForCall []struct {
+		env        voldriver.Env
+		instanceID string
+	}
+	listSnapshotsReturns struct {
+		result1 cephbroker.SnapshotsResponse
+	}
+	DeleteSnapshotStub        func(env voldriver.Env, instanceID string, snapshotName string) voldriver.ErrorResponse
+	deleteSnapshotMutex       sync.RWMutex
+	deleteSnapshotArgsForCall []struct {
+		env          voldriver.Env
+		instanceID   string
+		snapshotName string
+	}
+	deleteSnapshotReturns struct {
+		result1 voldriver.ErrorResponse
+	}
+	SharePathStub        func(env voldriver.Env, instanceID string) cephbroker.SharePathResponse
+	sharePathMutex       sync.RWMutex
+	sharePathArgsForCall []struct {
+		env        voldriver.Env
+		instanceID string
+	}
+	sharePathReturns struct {
+		result1 cephbroker.SharePathResponse
+	}
+	ShareUsageStub        func(env voldriver.Env, instanceID string) cephbroker.ShareUsageResponse
+	shareUsageMutex       sync.RWMutex
+	shareUsageArgsForCall []struct {
+		env        voldriver.Env
+		instanceID string
+	}
+	shareUsageReturns struct {
+		result1 cephbroker.ShareUsageResponse
+	}
+	ListSharesStub        func(env voldriver.Env) cephbroker.SharesResponse
+	listSharesMutex       sync.RWMutex
+	listSharesArgsForCall []struct {
+		env voldriver.Env
+	}
+	listSharesReturns struct {
+		result1 cephbroker.SharesResponse
+	}
+	QuarantineShareStub        func(env voldriver.Env, instanceID string) cephbroker.SharePathResponse
+	quarantineShareMutex       sync.RWMutex
+	quarantineShareArgsForCall []struct {
+		env        voldriver.Env
+		instanceID string
+	}
+	quarantineShareReturns struct {
+		result1 cephbroker.SharePathResponse
+	}
+	UnmountFileSystemStub        func(env voldriver.Env) voldriver.ErrorResponse
+	unmountFileSystemMutex       sync.RWMutex
+	unmountFileSystemArgsForCall []struct {
+		env voldriver.Env
+	}
+	unmountFileSystemReturns struct {
+		result1 voldriver.ErrorResponse
+	}
+	ForBackendStub        func(name string) (cephbroker.Controller, error)
+	forBackendMutex       sync.RWMutex
+	forBackendArgsForCall []struct {
+		name string
+	}
+	forBackendReturns struct {
+		result1 cephbroker.Controller
+		result2 error
+	}
 	invocations      map[string][][]interface{}
 	invocationsMutex sync.RWMutex
 }
@@ -108,16 +210,52 @@ func (fake *FakeController) RemoveReturns(result1 voldriver.ErrorResponse) {
 	}{result1}
 }
 
-func (fake *FakeController) Bind(env voldriver.Env, instanceID string) cephbroker.BindResponse {
+func (fake *FakeController) Update(env voldriver.Env, updateRequest cephbroker.UpdateRequest) voldriver.ErrorResponse {
+	fake.updateMutex.Lock()
+	fake.updateArgsForCall = append(fake.updateArgsForCall, struct {
+		env           voldriver.Env
+		updateRequest cephbroker.UpdateRequest
+	}{env, updateRequest})
+	fake.recordInvocation("Update", []interface{}{env, updateRequest})
+	fake.updateMutex.Unlock()
+	if fake.UpdateStub != nil {
+		return fake.UpdateStub(env, updateRequest)
+	} else {
+		return fake.updateReturns.result1
+	}
+}
+
+func (fake *FakeController) UpdateCallCount() int {
+	fake.updateMutex.RLock()
+	defer fake.updateMutex.RUnlock()
+	return len(fake.updateArgsForCall)
+}
+
+func (fake *FakeController) UpdateArgsForCall(i int) (voldriver.Env, cephbroker.UpdateRequest) {
+	fake.updateMutex.RLock()
+	defer fake.updateMutex.RUnlock()
+	return fake.updateArgsForCall[i].env, fake.updateArgsForCall[i].updateRequest
+}
+
+func (fake *FakeController) UpdateReturns(result1 voldriver.ErrorResponse) {
+	fake.UpdateStub = nil
+	fake.updateReturns = struct {
+		result1 voldriver.ErrorResponse
+	}{result1}
+}
+
+func (fake *FakeController) Bind(env voldriver.Env, instanceID string, bindingID string, readOnly bool) cephbroker.BindResponse {
 	fake.bindMutex.Lock()
 	fake.bindArgsForCall = append(fake.bindArgsForCall, struct {
 		env        voldriver.Env
 		instanceID string
-	}{env, instanceID})
-	fake.recordInvocation("Bind", []interface{}{env, instanceID})
+		bindingID  string
+		readOnly   bool
+	}{env, instanceID, bindingID, readOnly})
+	fake.recordInvocation("Bind", []interface{}{env, instanceID, bindingID, readOnly})
 	fake.bindMutex.Unlock()
 	if fake.BindStub != nil {
-		return fake.BindStub(env, instanceID)
+		return fake.BindStub(env, instanceID, bindingID, readOnly)
 	} else {
 		return fake.bindReturns.result1
 	}
@@ -129,10 +267,10 @@ func (fake *FakeController) BindCallCount() int {
 	return len(fake.bindArgsForCall)
 }
 
-func (fake *FakeController) BindArgsForCall(i int) (voldriver.Env, string) {
+func (fake *FakeController) BindArgsForCall(i int) (voldriver.Env, string, string, bool) {
 	fake.bindMutex.RLock()
 	defer fake.bindMutex.RUnlock()
-	return fake.bindArgsForCall[i].env, fake.bindArgsForCall[i].instanceID
+	return fake.bindArgsForCall[i].env, fake.bindArgsForCall[i].instanceID, fake.bindArgsForCall[i].bindingID, fake.bindArgsForCall[i].readOnly
 }
 
 func (fake *FakeController) BindReturns(result1 cephbroker.BindResponse) {
@@ -142,6 +280,347 @@ func (fake *FakeController) BindReturns(result1 cephbroker.BindResponse) {
 	}{result1}
 }
 
+func (fake *FakeController) Unbind(env voldriver.Env, instanceID string, bindingID string) voldriver.ErrorResponse {
+	fake.unbindMutex.Lock()
+	fake.unbindArgsForCall = append(fake.unbindArgsForCall, struct {
+		env        voldriver.Env
+		instanceID string
+		bindingID  string
+	}{env, instanceID, bindingID})
+	fake.recordInvocation("Unbind", []interface{}{env, instanceID, bindingID})
+	fake.unbindMutex.Unlock()
+	if fake.UnbindStub != nil {
+		return fake.UnbindStub(env, instanceID, bindingID)
+	} else {
+		return fake.unbindReturns.result1
+	}
+}
+
+func (fake *FakeController) UnbindCallCount() int {
+	fake.unbindMutex.RLock()
+	defer fake.unbindMutex.RUnlock()
+	return len(fake.unbindArgsForCall)
+}
+
+func (fake *FakeController) UnbindArgsForCall(i int) (voldriver.Env, string, string) {
+	fake.unbindMutex.RLock()
+	defer fake.unbindMutex.RUnlock()
+	return fake.unbindArgsForCall[i].env, fake.unbindArgsForCall[i].instanceID, fake.unbindArgsForCall[i].bindingID
+}
+
+func (fake *FakeController) UnbindReturns(result1 voldriver.ErrorResponse) {
+	fake.UnbindStub = nil
+	fake.unbindReturns = struct {
+		result1 voldriver.ErrorResponse
+	}{result1}
+}
+
+func (fake *FakeController) CreateSnapshot(env voldriver.Env, instanceID string, snapshotName string) voldriver.ErrorResponse {
+	fake.createSnapshotMutex.Lock()
+	fake.createSnapshotArgsForCall = append(fake.createSnapshotArgsForCall, struct {
+		env          voldriver.Env
+		instanceID   string
+		snapshotName string
+	}{env, instanceID, snapshotName})
+	fake.recordInvocation("CreateSnapshot", []interface{}{env, instanceID, snapshotName})
+	fake.createSnapshotMutex.Unlock()
+	if fake.CreateSnapshotStub != nil {
+		return fake.CreateSnapshotStub(env, instanceID, snapshotName)
+	} else {
+		return fake.createSnapshotReturns.result1
+	}
+}
+
+func (fake *FakeController) CreateSnapshotCallCount() int {
+	fake.createSnapshotMutex.RLock()
+	defer fake.createSnapshotMutex.RUnlock()
+	return len(fake.createSnapshotArgsForCall)
+}
+
+func (fake *FakeController) CreateSnapshotArgsForCall(i int) (voldriver.Env, string, string) {
+	fake.createSnapshotMutex.RLock()
+	defer fake.createSnapshotMutex.RUnlock()
+	return fake.createSnapshotArgsForCall[i].env, fake.createSnapshotArgsForCall[i].instanceID, fake.createSnapshotArgsForCall[i].snapshotName
+}
+
+func (fake *FakeController) CreateSnapshotReturns(result1 voldriver.ErrorResponse) {
+	fake.CreateSnapshotStub = nil
+	fake.createSnapshotReturns = struct {
+		result1 voldriver.ErrorResponse
+	}{result1}
+}
+
+func (fake *FakeController) ListSnapshots(env voldriver.Env, instanceID string) cephbroker.SnapshotsResponse {
+	fake.listSnapshotsMutex.Lock()
+	fake.listSnapshotsArgsForCall = append(fake.listSnapshotsArgsForCall, struct {
+		env        voldriver.Env
+		instanceID string
+	}{env, instanceID})
+	fake.recordInvocation("ListSnapshots", []interface{}{env, instanceID})
+	fake.listSnapshotsMutex.Unlock()
+	if fake.ListSnapshotsStub != nil {
+		return fake.ListSnapshotsStub(env, instanceID)
+	} else {
+		return fake.listSnapshotsReturns.result1
+	}
+}
+
+func (fake *FakeController) ListSnapshotsCallCount() int {
+	fake.listSnapshotsMutex.RLock()
+	defer fake.listSnapshotsMutex.RUnlock()
+	return len(fake.listSnapshotsArgsForCall)
+}
+
+func (fake *FakeController) ListSnapshotsArgsForCall(i int) (voldriver.Env, string) {
+	fake.listSnapshotsMutex.RLock()
+	defer fake.listSnapshotsMutex.RUnlock()
+	return fake.listSnapshotsArgsForCall[i].env, fake.listSnapshotsArgsForCall[i].instanceID
+}
+
+func (fake *FakeController) ListSnapshotsReturns(result1 cephbroker.SnapshotsResponse) {
+	fake.ListSnapshotsStub = nil
+	fake.listSnapshotsReturns = struct {
+		result1 cephbroker.SnapshotsResponse
+	}{result1}
+}
+
+func (fake *FakeController) DeleteSnapshot(env voldriver.Env, instanceID string, snapshotName string) voldriver.ErrorResponse {
+	fake.deleteSnapshotMutex.Lock()
+	fake.deleteSnapshotArgsForCall = append(fake.deleteSnapshotArgsForCall, struct {
+		env          voldriver.Env
+		instanceID   string
+		snapshotName string
+	}{env, instanceID, snapshotName})
+	fake.recordInvocation("DeleteSnapshot", []interface{}{env, instanceID, snapshotName})
+	fake.deleteSnapshotMutex.Unlock()
+	if fake.DeleteSnapshotStub != nil {
+		return fake.DeleteSnapshotStub(env, instanceID, snapshotName)
+	} else {
+		return fake.deleteSnapshotReturns.result1
+	}
+}
+
+func (fake *FakeController) DeleteSnapshotCallCount() int {
+	fake.deleteSnapshotMutex.RLock()
+	defer fake.deleteSnapshotMutex.RUnlock()
+	return len(fake.deleteSnapshotArgsForCall)
+}
+
+func (fake *FakeController) DeleteSnapshotArgsForCall(i int) (voldriver.Env, string, string) {
+	fake.deleteSnapshotMutex.RLock()
+	defer fake.deleteSnapshotMutex.RUnlock()
+	return fake.deleteSnapshotArgsForCall[i].env, fake.deleteSnapshotArgsForCall[i].instanceID, fake.deleteSnapshotArgsForCall[i].snapshotName
+}
+
+func (fake *FakeController) DeleteSnapshotReturns(result1 voldriver.ErrorResponse) {
+	fake.DeleteSnapshotStub = nil
+	fake.deleteSnapshotReturns = struct {
+		result1 voldriver.ErrorResponse
+	}{result1}
+}
+
+func (fake *FakeController) SharePath(env voldriver.Env, instanceID string) cephbroker.SharePathResponse {
+	fake.sharePathMutex.Lock()
+	fake.sharePathArgsForCall = append(fake.sharePathArgsForCall, struct {
+		env        voldriver.Env
+		instanceID string
+	}{env, instanceID})
+	fake.recordInvocation("SharePath", []interface{}{env, instanceID})
+	fake.sharePathMutex.Unlock()
+	if fake.SharePathStub != nil {
+		return fake.SharePathStub(env, instanceID)
+	} else {
+		return fake.sharePathReturns.result1
+	}
+}
+
+func (fake *FakeController) SharePathCallCount() int {
+	fake.sharePathMutex.RLock()
+	defer fake.sharePathMutex.RUnlock()
+	return len(fake.sharePathArgsForCall)
+}
+
+func (fake *FakeController) SharePathArgsForCall(i int) (voldriver.Env, string) {
+	fake.sharePathMutex.RLock()
+	defer fake.sharePathMutex.RUnlock()
+	return fake.sharePathArgsForCall[i].env, fake.sharePathArgsForCall[i].instanceID
+}
+
+func (fake *FakeController) SharePathReturns(result1 cephbroker.SharePathResponse) {
+	fake.SharePathStub = nil
+	fake.sharePathReturns = struct {
+		result1 cephbroker.SharePathResponse
+	}{result1}
+}
+
+func (fake *FakeController) ShareUsage(env voldriver.Env, instanceID string) cephbroker.ShareUsageResponse {
+	fake.shareUsageMutex.Lock()
+	fake.shareUsageArgsForCall = append(fake.shareUsageArgsForCall, struct {
+		env        voldriver.Env
+		instanceID string
+	}{env, instanceID})
+	fake.recordInvocation("ShareUsage", []interface{}{env, instanceID})
+	fake.shareUsageMutex.Unlock()
+	if fake.ShareUsageStub != nil {
+		return fake.ShareUsageStub(env, instanceID)
+	} else {
+		return fake.shareUsageReturns.result1
+	}
+}
+
+func (fake *FakeController) ShareUsageCallCount() int {
+	fake.shareUsageMutex.RLock()
+	defer fake.shareUsageMutex.RUnlock()
+	return len(fake.shareUsageArgsForCall)
+}
+
+func (fake *FakeController) ShareUsageArgsForCall(i int) (voldriver.Env, string) {
+	fake.shareUsageMutex.RLock()
+	defer fake.shareUsageMutex.RUnlock()
+	return fake.shareUsageArgsForCall[i].env, fake.shareUsageArgsForCall[i].instanceID
+}
+
+func (fake *FakeController) ShareUsageReturns(result1 cephbroker.ShareUsageResponse) {
+	fake.ShareUsageStub = nil
+	fake.shareUsageReturns = struct {
+		result1 cephbroker.ShareUsageResponse
+	}{result1}
+}
+
+func (fake *FakeController) ListShares(env voldriver.Env) cephbroker.SharesResponse {
+	fake.listSharesMutex.Lock()
+	fake.listSharesArgsForCall = append(fake.listSharesArgsForCall, struct {
+		env voldriver.Env
+	}{env})
+	fake.recordInvocation("ListShares", []interface{}{env})
+	fake.listSharesMutex.Unlock()
+	if fake.ListSharesStub != nil {
+		return fake.ListSharesStub(env)
+	} else {
+		return fake.listSharesReturns.result1
+	}
+}
+
+func (fake *FakeController) ListSharesCallCount() int {
+	fake.listSharesMutex.RLock()
+	defer fake.listSharesMutex.RUnlock()
+	return len(fake.listSharesArgsForCall)
+}
+
+func (fake *FakeController) ListSharesArgsForCall(i int) voldriver.Env {
+	fake.listSharesMutex.RLock()
+	defer fake.listSharesMutex.RUnlock()
+	return fake.listSharesArgsForCall[i].env
+}
+
+func (fake *FakeController) ListSharesReturns(result1 cephbroker.SharesResponse) {
+	fake.ListSharesStub = nil
+	fake.listSharesReturns = struct {
+		result1 cephbroker.SharesResponse
+	}{result1}
+}
+
+func (fake *FakeController) QuarantineShare(env voldriver.Env, instanceID string) cephbroker.SharePathResponse {
+	fake.quarantineShareMutex.Lock()
+	fake.quarantineShareArgsForCall = append(fake.quarantineShareArgsForCall, struct {
+		env        voldriver.Env
+		instanceID string
+	}{env, instanceID})
+	fake.recordInvocation("QuarantineShare", []interface{}{env, instanceID})
+	fake.quarantineShareMutex.Unlock()
+	if fake.QuarantineShareStub != nil {
+		return fake.QuarantineShareStub(env, instanceID)
+	} else {
+		return fake.quarantineShareReturns.result1
+	}
+}
+
+func (fake *FakeController) QuarantineShareCallCount() int {
+	fake.quarantineShareMutex.RLock()
+	defer fake.quarantineShareMutex.RUnlock()
+	return len(fake.quarantineShareArgsForCall)
+}
+
+func (fake *FakeController) QuarantineShareArgsForCall(i int) (voldriver.Env, string) {
+	fake.quarantineShareMutex.RLock()
+	defer fake.quarantineShareMutex.RUnlock()
+	return fake.quarantineShareArgsForCall[i].env, fake.quarantineShareArgsForCall[i].instanceID
+}
+
+func (fake *FakeController) QuarantineShareReturns(result1 cephbroker.SharePathResponse) {
+	fake.QuarantineShareStub = nil
+	fake.quarantineShareReturns = struct {
+		result1 cephbroker.SharePathResponse
+	}{result1}
+}
+
+func (fake *FakeController) UnmountFileSystem(env voldriver.Env) voldriver.ErrorResponse {
+	fake.unmountFileSystemMutex.Lock()
+	fake.unmountFileSystemArgsForCall = append(fake.unmountFileSystemArgsForCall, struct {
+		env voldriver.Env
+	}{env})
+	fake.recordInvocation("UnmountFileSystem", []interface{}{env})
+	fake.unmountFileSystemMutex.Unlock()
+	if fake.UnmountFileSystemStub != nil {
+		return fake.UnmountFileSystemStub(env)
+	} else {
+		return fake.unmountFileSystemReturns.result1
+	}
+}
+
+func (fake *FakeController) UnmountFileSystemCallCount() int {
+	fake.unmountFileSystemMutex.RLock()
+	defer fake.unmountFileSystemMutex.RUnlock()
+	return len(fake.unmountFileSystemArgsForCall)
+}
+
+func (fake *FakeController) UnmountFileSystemArgsForCall(i int) voldriver.Env {
+	fake.unmountFileSystemMutex.RLock()
+	defer fake.unmountFileSystemMutex.RUnlock()
+	return fake.unmountFileSystemArgsForCall[i].env
+}
+
+func (fake *FakeController) UnmountFileSystemReturns(result1 voldriver.ErrorResponse) {
+	fake.UnmountFileSystemStub = nil
+	fake.unmountFileSystemReturns = struct {
+		result1 voldriver.ErrorResponse
+	}{result1}
+}
+
+func (fake *FakeController) ForBackend(name string) (cephbroker.Controller, error) {
+	fake.forBackendMutex.Lock()
+	fake.forBackendArgsForCall = append(fake.forBackendArgsForCall, struct {
+		name string
+	}{name})
+	fake.recordInvocation("ForBackend", []interface{}{name})
+	fake.forBackendMutex.Unlock()
+	if fake.ForBackendStub != nil {
+		return fake.ForBackendStub(name)
+	} else {
+		return fake.forBackendReturns.result1, fake.forBackendReturns.result2
+	}
+}
+
+func (fake *FakeController) ForBackendCallCount() int {
+	fake.forBackendMutex.RLock()
+	defer fake.forBackendMutex.RUnlock()
+	return len(fake.forBackendArgsForCall)
+}
+
+func (fake *FakeController) ForBackendArgsForCall(i int) string {
+	fake.forBackendMutex.RLock()
+	defer fake.forBackendMutex.RUnlock()
+	return fake.forBackendArgsForCall[i].name
+}
+
+func (fake *FakeController) ForBackendReturns(result1 cephbroker.Controller, result2 error) {
+	fake.ForBackendStub = nil
+	fake.forBackendReturns = struct {
+		result1 cephbroker.Controller
+		result2 error
+	}{result1, result2}
+}
+
 func (fake *FakeController) Invocations() map[string][][]interface{} {
 	fake.invocationsMutex.RLock()
 	defer fake.invocationsMutex.RUnlock()
@@ -149,8 +628,30 @@ func (fake *FakeController) Invocations() map[string][][]interface{} {
 	defer fake.createMutex.RUnlock()
 	fake.removeMutex.RLock()
 	defer fake.removeMutex.RUnlock()
+	fake.updateMutex.RLock()
+	defer fake.updateMutex.RUnlock()
 	fake.bindMutex.RLock()
 	defer fake.bindMutex.RUnlock()
+	fake.unbindMutex.RLock()
+	defer fake.unbindMutex.RUnlock()
+	fake.createSnapshotMutex.RLock()
+	defer fake.createSnapshotMutex.RUnlock()
+	fake.listSnapshotsMutex.RLock()
+	defer fake.listSnapshotsMutex.RUnlock()
+	fake.deleteSnapshotMutex.RLock()
+	defer fake.deleteSnapshotMutex.RUnlock()
+	fake.sharePathMutex.RLock()
+	defer fake.sharePathMutex.RUnlock()
+	fake.shareUsageMutex.RLock()
+	defer fake.shareUsageMutex.RUnlock()
+	fake.listSharesMutex.RLock()
+	defer fake.listSharesMutex.RUnlock()
+	fake.quarantineShareMutex.RLock()
+	defer fake.quarantineShareMutex.RUnlock()
+	fake.unmountFileSystemMutex.RLock()
+	defer fake.unmountFileSystemMutex.RUnlock()
+	fake.forBackendMutex.RLock()
+	defer fake.forBackendMutex.RUnlock()
 	return fake.invocations
 }
 
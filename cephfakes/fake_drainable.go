@@ -0,0 +1,80 @@
+// This file was generated by counterfeiter
+package cephfakes
+
+import (
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/cephbroker/cephbroker"
+	"code.cloudfoundry.org/lager"
+)
+
+type FakeDrainable struct {
+	DrainStub        func(logger lager.Logger, timeout time.Duration) bool
+	drainMutex       sync.RWMutex
+	drainArgsForCall []struct {
+		logger  lager.Logger
+		timeout time.Duration
+	}
+	drainReturns struct {
+		result1 bool
+	}
+	invocations      map[string][][]interface{}
+	invocationsMutex sync.RWMutex
+}
+
+func (fake *FakeDrainable) Drain(logger lager.Logger, timeout time.Duration) bool {
+	fake.drainMutex.Lock()
+	fake.drainArgsForCall = append(fake.drainArgsForCall, struct {
+		logger  lager.Logger
+		timeout time.Duration
+	}{logger, timeout})
+	fake.recordInvocation("Drain", []interface{}{logger, timeout})
+	fake.drainMutex.Unlock()
+	if fake.DrainStub != nil {
+		return fake.DrainStub(logger, timeout)
+	} else {
+		return fake.drainReturns.result1
+	}
+}
+
+func (fake *FakeDrainable) DrainCallCount() int {
+	fake.drainMutex.RLock()
+	defer fake.drainMutex.RUnlock()
+	return len(fake.drainArgsForCall)
+}
+
+func (fake *FakeDrainable) DrainArgsForCall(i int) (lager.Logger, time.Duration) {
+	fake.drainMutex.RLock()
+	defer fake.drainMutex.RUnlock()
+	return fake.drainArgsForCall[i].logger, fake.drainArgsForCall[i].timeout
+}
+
+func (fake *FakeDrainable) DrainReturns(result1 bool) {
+	fake.DrainStub = nil
+	fake.drainReturns = struct {
+		result1 bool
+	}{result1}
+}
+
+func (fake *FakeDrainable) Invocations() map[string][][]interface{} {
+	fake.invocationsMutex.RLock()
+	defer fake.invocationsMutex.RUnlock()
+	fake.drainMutex.RLock()
+	defer fake.drainMutex.RUnlock()
+	return fake.invocations
+}
+
+func (fake *FakeDrainable) recordInvocation(key string, args []interface{}) {
+	fake.invocationsMutex.Lock()
+	defer fake.invocationsMutex.Unlock()
+	if fake.invocations == nil {
+		fake.invocations = map[string][][]interface{}{}
+	}
+	if fake.invocations[key] == nil {
+		fake.invocations[key] = [][]interface{}{}
+	}
+	fake.invocations[key] = append(fake.invocations[key], args)
+}
+
+var _ cephbroker.Drainable = new(FakeDrainable)
@@ -0,0 +1,81 @@
+// This file was generated by counterfeiter
+package cephfakes
+
+import (
+	"sync"
+
+	"code.cloudfoundry.org/cephbroker/cephbroker"
+	"code.cloudfoundry.org/lager"
+)
+
+type FakeReconcilable struct {
+	ReconcileStub        func(logger lager.Logger, options cephbroker.ReconcileOptions) (cephbroker.ReconcileReport, error)
+	reconcileMutex       sync.RWMutex
+	reconcileArgsForCall []struct {
+		logger  lager.Logger
+		options cephbroker.ReconcileOptions
+	}
+	reconcileReturns struct {
+		result1 cephbroker.ReconcileReport
+		result2 error
+	}
+	invocations      map[string][][]interface{}
+	invocationsMutex sync.RWMutex
+}
+
+func (fake *FakeReconcilable) Reconcile(logger lager.Logger, options cephbroker.ReconcileOptions) (cephbroker.ReconcileReport, error) {
+	fake.reconcileMutex.Lock()
+	fake.reconcileArgsForCall = append(fake.reconcileArgsForCall, struct {
+		logger  lager.Logger
+		options cephbroker.ReconcileOptions
+	}{logger, options})
+	fake.recordInvocation("Reconcile", []interface{}{logger, options})
+	fake.reconcileMutex.Unlock()
+	if fake.ReconcileStub != nil {
+		return fake.ReconcileStub(logger, options)
+	} else {
+		return fake.reconcileReturns.result1, fake.reconcileReturns.result2
+	}
+}
+
+func (fake *FakeReconcilable) ReconcileCallCount() int {
+	fake.reconcileMutex.RLock()
+	defer fake.reconcileMutex.RUnlock()
+	return len(fake.reconcileArgsForCall)
+}
+
+func (fake *FakeReconcilable) ReconcileArgsForCall(i int) (lager.Logger, cephbroker.ReconcileOptions) {
+	fake.reconcileMutex.RLock()
+	defer fake.reconcileMutex.RUnlock()
+	return fake.reconcileArgsForCall[i].logger, fake.reconcileArgsForCall[i].options
+}
+
+func (fake *FakeReconcilable) ReconcileReturns(result1 cephbroker.ReconcileReport, result2 error) {
+	fake.ReconcileStub = nil
+	fake.reconcileReturns = struct {
+		result1 cephbroker.ReconcileReport
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeReconcilable) Invocations() map[string][][]interface{} {
+	fake.invocationsMutex.RLock()
+	defer fake.invocationsMutex.RUnlock()
+	fake.reconcileMutex.RLock()
+	defer fake.reconcileMutex.RUnlock()
+	return fake.invocations
+}
+
+func (fake *FakeReconcilable) recordInvocation(key string, args []interface{}) {
+	fake.invocationsMutex.Lock()
+	defer fake.invocationsMutex.Unlock()
+	if fake.invocations == nil {
+		fake.invocations = map[string][][]interface{}{}
+	}
+	if fake.invocations[key] == nil {
+		fake.invocations[key] = [][]interface{}{}
+	}
+	fake.invocations[key] = append(fake.invocations[key], args)
+}
+
+var _ cephbroker.Reconcilable = new(FakeReconcilable)
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/cephbroker/cephbroker"
+	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// adminOwnerPrefix names the commands that hold the lock on a shared sql store, so that they are not taken for brokers
+const adminOwnerPrefix = "cephbroker-admin-"
+
+const usage = `usage: cephbroker-admin [flags] <command> [arguments]
+
+Commands that read the broker's state use the admin API of a running broker when -brokerURL is given, and the state
+in -dataDir otherwise.  Commands that change the state need -dataDir; stop the broker first unless its replicas share
+the sql state store.  They refuse to change a sql state store that no running broker replica shares unless given
+-force, as a broker that does not share it fails its writes once the state has changed under it.
+
+  instances                    list service instances
+  instance <instance id>       show a service instance, with its parameters
+  bindings                     list bindings
+  binding <binding id>         show a binding, with its parameters
+  check-shares                 report shares that belong to no instance, and instances whose shares are missing
+                               (-brokerURL only)
+  export [file]                write the state to a file, or to stdout
+  import <file>                replace the state with an exported one, refusing to replace existing state without -force
+  purge-binding <binding id>   forget a binding that cannot be unbound, without revoking its client key
+  delete-instance <instance id>
+                               forget a service instance and its bindings, without deleting its share
+
+Flags:
+`
+
+var brokerURL = flag.String(
+	"brokerURL",
+	"",
+	"[OPTIONAL] - URL of a running broker, e.g. http://localhost:8999, to read its state through the admin API",
+)
+var username = flag.String(
+	"username",
+	"admin",
+	"basic auth username of the broker's admin API",
+)
+var password = flag.String(
+	"password",
+	"admin",
+	"basic auth password of the broker's admin API",
+)
+var timeout = flag.Duration(
+	"timeout",
+	time.Minute,
+	"how long to wait for the broker's admin API",
+)
+var dataDir = flag.String(
+	"dataDir",
+	"",
+	"[OPTIONAL] - the broker's dataDir, to read or change its state directly",
+)
+var stateStore = flag.String(
+	"stateStore",
+	cephbroker.StoreTypeFile,
+	"the broker's state store: 'file', 'bolt' or 'sql'",
+)
+var sqlDriver = flag.String(
+	"sqlDriver",
+	cephbroker.SqlDriverSqlite,
+	"database driver for the sql state store: 'sqlite3', 'mysql' or 'postgres'",
+)
+var sqlDataSource = flag.String(
+	"sqlDataSource",
+	"",
+	"[OPTIONAL] - data source name for the sql state store, defaults to a sqlite3 database in dataDir",
+)
+var stateKeyFile = flag.String(
+	"stateKeyFile",
+	"",
+	"[OPTIONAL] - file of the keys the state is encrypted with, to show encrypted parameters; defaults to $"+cephbroker.StateKeysEnv,
+)
+var serviceName = flag.String(
+	"serviceName",
+	"localvolume",
+	"name of the broker's service, which its state is named after",
+)
+var catalogFile = flag.String(
+	"catalogFile",
+	"",
+	"[OPTIONAL] - the broker's catalog file, overrides serviceName",
+)
+var force = flag.Bool(
+	"force",
+	false,
+	"[OPTIONAL] - let import replace existing state, and let commands change a sql state store that no running broker replica shares",
+)
+var verbose = flag.Bool(
+	"verbose",
+	false,
+	"[OPTIONAL] - log to stderr",
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	logger := lager.NewLogger("cephbroker-admin")
+	if *verbose {
+		logger.RegisterSink(lager.NewWriterSink(os.Stderr, lager.DEBUG))
+	}
+
+	if err := run(logger, flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "cephbroker-admin: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func run(logger lager.Logger, command string, args []string) error {
+	switch command {
+	case "instances":
+		return showInstances(logger, "", args)
+	case "instance":
+		return showInstances(logger, argument(args), args)
+	case "bindings":
+		return showBindings(logger, "", args)
+	case "binding":
+		return showBindings(logger, argument(args), args)
+	case "check-shares":
+		return checkShares(args)
+	case "export":
+		return exportState(logger, args)
+	case "import":
+		return importState(logger, args)
+	case "purge-binding":
+		return purgeBinding(logger, args)
+	case "delete-instance":
+		return deleteInstance(logger, args)
+	default:
+		return fmt.Errorf("unknown command '%s', see -help", command)
+	}
+}
+
+func showInstances(logger lager.Logger, instanceID string, args []string) error {
+	if err := checkArgs(args, instanceID != ""); err != nil {
+		return err
+	}
+
+	if *brokerURL != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		if instanceID != "" {
+			instance, err := adminClient().GetInstance(ctx, instanceID)
+			if err != nil {
+				return err
+			}
+			return printJSON(instance)
+		}
+		instances, err := adminClient().ListInstances(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(cephbroker.InstancesResponseBody{Instances: instances})
+	}
+
+	catalog, err := loadCatalog()
+	if err != nil {
+		return err
+	}
+	state, err := readState(logger, catalog)
+	if err != nil {
+		return err
+	}
+	instances := cephbroker.DescribeInstances(state, catalog, instanceID)
+	if instanceID != "" {
+		if len(instances) == 0 {
+			return brokerapi.ErrInstanceDoesNotExist
+		}
+		return printJSON(instances[0])
+	}
+	return printJSON(cephbroker.InstancesResponseBody{Instances: instances})
+}
+
+func showBindings(logger lager.Logger, bindingID string, args []string) error {
+	if err := checkArgs(args, bindingID != ""); err != nil {
+		return err
+	}
+
+	if *brokerURL != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		if bindingID != "" {
+			binding, err := adminClient().GetBinding(ctx, bindingID)
+			if err != nil {
+				return err
+			}
+			return printJSON(binding)
+		}
+		bindings, err := adminClient().ListBindings(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(cephbroker.BindingsResponseBody{Bindings: bindings})
+	}
+
+	catalog, err := loadCatalog()
+	if err != nil {
+		return err
+	}
+	state, err := readState(logger, catalog)
+	if err != nil {
+		return err
+	}
+	bindings := cephbroker.DescribeBindings(state, bindingID)
+	if bindingID != "" {
+		if len(bindings) == 0 {
+			return brokerapi.ErrBindingDoesNotExist
+		}
+		return printJSON(bindings[0])
+	}
+	return printJSON(cephbroker.BindingsResponseBody{Bindings: bindings})
+}
+
+// checkShares needs the broker, which knows how to reach the filesystem
+func checkShares(args []string) error {
+	if err := checkArgs(args, false); err != nil {
+		return err
+	}
+	if *brokerURL == "" {
+		return fmt.Errorf("check-shares needs -brokerURL")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	report, err := adminClient().CheckShares(ctx)
+	if err != nil {
+		return err
+	}
+	return printJSON(report)
+}
+
+// exportState writes the state as it is saved, so that encrypted parameters stay encrypted
+func exportState(logger lager.Logger, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("too many arguments")
+	}
+	store, err := createStore(logger, "export")
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	state, err := store.Restore(logger)
+	if err != nil {
+		return err
+	}
+	data, err := cephbroker.ExportState(state)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+	return ioutil.WriteFile(args[0], data, 0600)
+}
+
+func importState(logger lager.Logger, args []string) error {
+	if err := checkArgs(args, true); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	imported, err := cephbroker.ImportState(data)
+	if err != nil {
+		return fmt.Errorf("failed to read '%s': %s", args[0], err.Error())
+	}
+
+	store, err := editStore(logger, "import")
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	err = cephbroker.EditState(logger, store, func(state cephbroker.State) (cephbroker.State, error) {
+		if !*force && (len(state.InstanceMap) > 0 || len(state.BindingMap) > 0) {
+			return state, fmt.Errorf("the broker already has state, use -force to replace it")
+		}
+		return imported, nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d instances and %d bindings\n", len(imported.InstanceMap), len(imported.BindingMap))
+	return nil
+}
+
+func purgeBinding(logger lager.Logger, args []string) error {
+	if err := checkArgs(args, true); err != nil {
+		return err
+	}
+	store, err := editStore(logger, "purge-binding")
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	err = cephbroker.EditState(logger, store, func(state cephbroker.State) (cephbroker.State, error) {
+		return state, cephbroker.PurgeBinding(state, args[0])
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("purged binding %s\n", args[0])
+	return nil
+}
+
+func deleteInstance(logger lager.Logger, args []string) error {
+	if err := checkArgs(args, true); err != nil {
+		return err
+	}
+	store, err := editStore(logger, "delete-instance")
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var bindings []string
+	err = cephbroker.EditState(logger, store, func(state cephbroker.State) (cephbroker.State, error) {
+		var err error
+		bindings, err = cephbroker.ForceDeleteInstance(state, args[0])
+		return state, err
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("deleted instance %s\n", args[0])
+	for _, bindingID := range bindings {
+		fmt.Printf("deleted binding %s\n", bindingID)
+	}
+	return nil
+}
+
+func argument(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+func checkArgs(args []string, oneArgument bool) error {
+	switch {
+	case oneArgument && len(args) == 0:
+		return fmt.Errorf("missing argument")
+	case oneArgument && len(args) > 1, !oneArgument && len(args) > 0:
+		return fmt.Errorf("too many arguments")
+	}
+	return nil
+}
+
+func printJSON(value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(data, '\n'))
+	return err
+}
+
+func adminClient() cephbroker.AdminBroker {
+	credentials := brokerapi.BrokerCredentials{Username: *username, Password: *password}
+	return cephbroker.NewAdminClient(*brokerURL, credentials, &http.Client{Timeout: *timeout})
+}
+
+func loadCatalog() (cephbroker.Catalog, error) {
+	if *catalogFile != "" {
+		return cephbroker.LoadCatalog(*catalogFile, &ioutilshim.IoutilShim{})
+	}
+	return cephbroker.NewCatalog(*serviceName, "", "", "", ""), nil
+}
+
+func readState(logger lager.Logger, catalog cephbroker.Catalog) (cephbroker.State, error) {
+	store, err := openStore(logger, catalog, "")
+	if err != nil {
+		return cephbroker.State{}, err
+	}
+	defer store.Close()
+
+	stateCipher, err := createStateCipher()
+	if err != nil {
+		return cephbroker.State{}, err
+	}
+	return cephbroker.ReadState(logger, store, stateCipher)
+}
+
+func createStore(logger lager.Logger, command string) (cephbroker.Store, error) {
+	catalog, err := loadCatalog()
+	if err != nil {
+		return nil, err
+	}
+	return openStore(logger, catalog, command)
+}
+
+// editStore opens the broker's state store for a command that changes it.  A broker that does not share the sql store
+// holds on to the state it has and fails its writes once the state has changed under it, so the store has to be
+// shared by a running broker replica, which waits for the change and picks it up, unless -force is given.
+func editStore(logger lager.Logger, command string) (cephbroker.Store, error) {
+	store, err := createStore(logger, command)
+	if err != nil || *stateStore != cephbroker.StoreTypeSql {
+		return store, err
+	}
+
+	shared, ok := store.(cephbroker.SharedStore)
+	if !ok {
+		return store, nil
+	}
+	replicas, err := shared.LiveReplicas()
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	for _, replica := range replicas {
+		if !strings.HasPrefix(replica, adminOwnerPrefix) {
+			return store, nil
+		}
+	}
+
+	if !*force {
+		store.Close()
+		return nil, fmt.Errorf("no running broker replica shares the sql state store; a broker running without -replicaName fails its writes once the state changes under it, so stop it and use -force")
+	}
+	fmt.Fprintln(os.Stderr, "cephbroker-admin: warning: no running broker replica shares the sql state store; a broker running without -replicaName must be stopped, or it fails its writes once the state changes under it")
+	return store, nil
+}
+
+// openStore opens the broker's state store.  The sql store is always opened as a shared one, so that changes wait for
+// any broker replicas to release the state; owner names the command holding the lock.
+func openStore(logger lager.Logger, catalog cephbroker.Catalog, owner string) (cephbroker.Store, error) {
+	if *dataDir == "" {
+		return nil, fmt.Errorf("either -brokerURL or -dataDir is needed")
+	}
+	stateName := cephbroker.StateName(*dataDir, catalog)
+
+	switch *stateStore {
+	case cephbroker.StoreTypeFile:
+		return cephbroker.NewFileStore(stateName+".json", &osshim.OsShim{}, &ioutilshim.IoutilShim{}), nil
+	case cephbroker.StoreTypeBolt:
+		return cephbroker.NewBoltStore(stateName + ".db")
+	case cephbroker.StoreTypeSql:
+		dataSource := *sqlDataSource
+		if dataSource == "" && *sqlDriver == cephbroker.SqlDriverSqlite {
+			dataSource = stateName + ".sqlite"
+		}
+		if owner == "" {
+			return cephbroker.NewSqlStore(*sqlDriver, dataSource)
+		}
+		return cephbroker.NewSharedSqlStore(*sqlDriver, dataSource, adminOwnerPrefix+owner, cephbroker.DefaultLeaseDuration, cephbroker.DefaultLockTimeout)
+	default:
+		return nil, fmt.Errorf("unknown state store '%s'", *stateStore)
+	}
+}
+
+// createStateCipher returns nil, leaving encrypted parameters out, when no keys are given
+func createStateCipher() (*cephbroker.StateCipher, error) {
+	keys := os.Getenv(cephbroker.StateKeysEnv)
+	if *stateKeyFile != "" {
+		data, err := ioutil.ReadFile(*stateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = string(data)
+	}
+	if keys == "" {
+		return nil, nil
+	}
+	return cephbroker.NewStateCipher(keys)
+}
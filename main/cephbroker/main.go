@@ -2,11 +2,15 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"code.cloudfoundry.org/debugserver"
 
-	"syscall"
-
 	"code.cloudfoundry.org/cephbroker/cephbroker"
 	"code.cloudfoundry.org/cephbroker/utils"
 	"code.cloudfoundry.org/lager"
@@ -15,6 +19,7 @@ import (
 	"github.com/tedsuo/ifrit/grouper"
 	"github.com/tedsuo/ifrit/http_server"
 	"code.cloudfoundry.org/goshims/ioutilshim"
+	"code.cloudfoundry.org/goshims/osshim"
 	"code.cloudfoundry.org/lager/lagerflags"
 )
 
@@ -33,13 +38,28 @@ var atAddress = flag.String(
 var mds = flag.String(
 	"mds",
 	"10.0.0.106:6789",
-	"host:port for ceph mds server",
+	"ceph monitor addresses, comma separated host[:port] entries or a ceph.conf mon_host value",
+)
+var cephConf = flag.String(
+	"cephConf",
+	"",
+	"[OPTIONAL] - ceph.conf to take the fsid, monitors (mon_host), keyring, secret file (keyfile) and remote mount path (client_mountpoint) from; mds, keyringFile, secretFile and baseRemoteMountPath override it when given",
 )
 var keyringFile = flag.String(
 	"keyringFile",
 	"/etc/ceph/ceph.client.admin.keyring",
 	"keyring file for ceph authentication",
 )
+var secretFile = flag.String(
+	"secretFile",
+	"",
+	"[OPTIONAL] - file with nothing but the key of the ceph client, used instead of keyringFile when that is not given, and given to the kernel client when mountMode is 'kernel'",
+)
+var cephUser = flag.String(
+	"cephUser",
+	"",
+	"[OPTIONAL] - ceph client the broker acts as, without the 'client.' prefix, passed to ceph with --id; defaults to the client in cephConf, or else the one in keyringFile",
+)
 var configPath = flag.String(
 	"configPath",
 	"/tmp/cephbroker",
@@ -70,6 +90,106 @@ var planDesc = flag.String(
 	"free local filesystem",
 	"description of the service plan to register with cloud controller",
 )
+var mountMode = flag.String(
+	"mountMode",
+	cephbroker.MountModeFuse,
+	"how the broker, and the cells through the bindings, mount the ceph file system: 'fuse' (ceph-fuse) or 'kernel' (mount -t ceph)",
+)
+var mountOptions = flag.String(
+	"mountOptions",
+	"",
+	"[OPTIONAL] - extra comma separated mount options, passed to ceph-fuse or mount with -o",
+)
+var shareBackend = flag.String(
+	"shareBackend",
+	cephbroker.ShareBackendDirectory,
+	"how to provision shares: 'directory' (subdirectories of a ceph-fuse mount) or 'subvolume' (ceph fs subvolume)",
+)
+var fsName = flag.String(
+	"fsName",
+	"cephfs",
+	"name of the ceph file system to create subvolumes in (subvolume backend only)",
+)
+var subvolumeGroup = flag.String(
+	"subvolumeGroup",
+	"",
+	"[OPTIONAL] - subvolume group to create subvolumes in (subvolume backend only)",
+)
+var cloneTimeout = flag.Duration(
+	"cloneTimeout",
+	cephbroker.DefaultCloneTimeout,
+	"how long a subvolume clone may take to copy before it is cancelled and the provision fails (subvolume backend only)",
+)
+var stateStore = flag.String(
+	"stateStore",
+	cephbroker.StoreTypeFile,
+	"where to keep the broker's state: 'file' (JSON file in dataDir), 'bolt' (BoltDB database in dataDir) or 'sql' (see sqlDriver and sqlDataSource)",
+)
+var sqlDriver = flag.String(
+	"sqlDriver",
+	cephbroker.SqlDriverSqlite,
+	"database driver for the sql state store: 'sqlite3', 'mysql' or 'postgres'",
+)
+var sqlDataSource = flag.String(
+	"sqlDataSource",
+	"",
+	"[OPTIONAL] - data source name for the sql state store, defaults to a sqlite3 database in dataDir",
+)
+var recoverState = flag.Bool(
+	"recoverState",
+	false,
+	"[OPTIONAL] - quarantine saved state that cannot be read, and start from the newest previous state file that can be (file state store only)",
+)
+var stateKeyFile = flag.String(
+	"stateKeyFile",
+	"",
+	"[OPTIONAL] - file of keys to encrypt instance and binding parameters in the broker's state with, one '<key id>:<base64 key>' per line, current key first; defaults to $"+cephbroker.StateKeysEnv,
+)
+var replicaName = flag.String(
+	"replicaName",
+	"",
+	"[OPTIONAL] - unique name of this broker replica; when set, several replicas can share the sql state store",
+)
+var stateLeaseDuration = flag.Duration(
+	"stateLeaseDuration",
+	cephbroker.DefaultLeaseDuration,
+	"how long other replicas wait for a replica that stopped renewing its lock on the shared state (replicaName only)",
+)
+var stateLockTimeout = flag.Duration(
+	"stateLockTimeout",
+	cephbroker.DefaultLockTimeout,
+	"how long a request waits for the lock on the shared state before failing (replicaName only)",
+)
+var reconcileInterval = flag.Duration(
+	"reconcileInterval",
+	0,
+	"[OPTIONAL] - how often to compare the broker's instances with the shares in the filesystem and report differences, 0 to never",
+)
+var recreateMissingShares = flag.Bool(
+	"recreateMissingShares",
+	false,
+	"[OPTIONAL] - have reconciliation create empty shares again for provisioned instances whose shares are gone",
+)
+var quarantineOrphanedShares = flag.Bool(
+	"quarantineOrphanedShares",
+	false,
+	"[OPTIONAL] - have reconciliation move shares that belong to no instance into the quarantine directory (directory share backend only)",
+)
+var drainTimeout = flag.Duration(
+	"drainTimeout",
+	30*time.Second,
+	"how long to wait on shutdown for asynchronous operations to finish before unmounting the filesystem; the filesystem is left mounted if they do not",
+)
+var backendsFile = flag.String(
+	"backendsFile",
+	"",
+	"[OPTIONAL] - JSON file describing further ceph clusters or file systems that catalog plans can provision their shares in by naming them as their backend",
+)
+var catalogFile = flag.String(
+	"catalogFile",
+	"",
+	"[OPTIONAL] - JSON file describing the services and plans to offer, overrides serviceName, serviceId, planName, planId and planDesc",
+)
 var username = flag.String(
 	"username",
 	"admin",
@@ -93,24 +213,24 @@ var baseRemoteMountPath = flag.String(
 
 func main() {
 	parseCommandLine()
-	syscall.Umask(000)
 
 	logger, logSink := lagerflags.New("localbroker")
 	logger.Info("starting")
 	defer logger.Info("ends")
 
-	server := createServer(logger)
+	servers, store := createServer(logger)
 
 	if dbgAddr := debugserver.DebugAddress(flag.CommandLine); dbgAddr != "" {
-		server = utils.ProcessRunnerFor(grouper.Members{
-			{"debug-server", debugserver.Runner(dbgAddr, logSink)},
-			{"broker-api", server},
-		})
+		servers = append(grouper.Members{{"debug-server", debugserver.Runner(dbgAddr, logSink)}}, servers...)
 	}
 
-	process := ifrit.Invoke(server)
+	process := ifrit.Invoke(utils.ProcessRunnerFor(servers))
 	logger.Info("started")
 	utils.UntilTerminated(logger, process)
+
+	if err := store.Close(); err != nil {
+		logger.Error("failed-to-close-state-store", err)
+	}
 }
 
 func parseCommandLine() {
@@ -119,20 +239,192 @@ func parseCommandLine() {
 	flag.Parse()
 }
 
-func createServer(logger lager.Logger) ifrit.Runner {
-	controller := cephbroker.NewController(cephbroker.NewCephClient(
-		*mds,
-		*baseMountPath,
-		*keyringFile,
-		*baseRemoteMountPath,
-	))
-	serviceBroker := cephbroker.New(
+func createServer(logger lager.Logger) (grouper.Members, cephbroker.Store) {
+	catalog := cephbroker.NewCatalog(*serviceName, *serviceId, *planName, *planId, *planDesc)
+	if *catalogFile != "" {
+		var err error
+		catalog, err = cephbroker.LoadCatalog(*catalogFile, &ioutilshim.IoutilShim{})
+		utils.ExitOnFailure(logger, err)
+	}
+	store := createStore(logger, catalog)
+	if *recoverState {
+		utils.ExitOnFailure(logger, cephbroker.RecoverState(logger, store))
+	}
+
+	controller := cephbroker.NewBackendController(createClient(logger, store), createBackendClients(logger, catalog))
+
+	serviceBroker, err := cephbroker.New(
 		logger, controller,
-		*serviceName, *serviceId, *planName, *planId, *planDesc, *dataDir,
-		&ioutilshim.IoutilShim{},
+		catalog, store, createStateCipher(logger),
 	)
+	utils.ExitOnFailure(logger, err)
 	credentials := brokerapi.BrokerCredentials{Username: *username, Password: *password}
 	handler := brokerapi.New(serviceBroker, logger.Session("broker-api"), credentials)
 
-	return http_server.New(*atAddress, handler)
+	adminHandler, err := cephbroker.NewAdminHandler(logger, serviceBroker, credentials)
+	utils.ExitOnFailure(logger, err)
+
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", adminHandler)
+	mux.Handle("/", handler)
+
+	// members are stopped in reverse order, so the broker is drained once its API has stopped
+	servers := grouper.Members{
+		{"shutdown", cephbroker.NewShutdown(logger, serviceBroker, controller, *drainTimeout)},
+		{"broker-api", http_server.New(*atAddress, mux)},
+	}
+	if *reconcileInterval > 0 {
+		options := cephbroker.ReconcileOptions{
+			RecreateMissingShares:    *recreateMissingShares,
+			QuarantineOrphanedShares: *quarantineOrphanedShares,
+		}
+		servers = append(servers, grouper.Member{"reconciler", cephbroker.NewReconciler(logger, serviceBroker, *reconcileInterval, options)})
+	}
+	return servers, store
+}
+
+func createStore(logger lager.Logger, catalog cephbroker.Catalog) cephbroker.Store {
+	stateName := cephbroker.StateName(*dataDir, catalog)
+
+	if *replicaName != "" && *stateStore != cephbroker.StoreTypeSql {
+		utils.ExitOnFailure(logger, fmt.Errorf("replicas can only share the sql state store"))
+	}
+
+	switch *stateStore {
+	case cephbroker.StoreTypeFile:
+		return cephbroker.NewFileStore(stateName+".json", &osshim.OsShim{}, &ioutilshim.IoutilShim{})
+	case cephbroker.StoreTypeBolt:
+		store, err := cephbroker.NewBoltStore(stateName + ".db")
+		utils.ExitOnFailure(logger, err)
+		return store
+	case cephbroker.StoreTypeSql:
+		dataSource := *sqlDataSource
+		if dataSource == "" && *sqlDriver == cephbroker.SqlDriverSqlite {
+			dataSource = stateName + ".sqlite"
+		}
+		if *replicaName != "" {
+			store, err := cephbroker.NewSharedSqlStore(*sqlDriver, dataSource, *replicaName, *stateLeaseDuration, *stateLockTimeout)
+			utils.ExitOnFailure(logger, err)
+			return store
+		}
+		store, err := cephbroker.NewSqlStore(*sqlDriver, dataSource)
+		utils.ExitOnFailure(logger, err)
+		return store
+	default:
+		utils.ExitOnFailure(logger, fmt.Errorf("unknown state store '%s'", *stateStore))
+		return nil
+	}
+}
+
+// createStateCipher returns nil, leaving the state unencrypted, when no keys are given
+func createStateCipher(logger lager.Logger) *cephbroker.StateCipher {
+	keys := os.Getenv(cephbroker.StateKeysEnv)
+	if *stateKeyFile != "" {
+		data, err := ioutil.ReadFile(*stateKeyFile)
+		utils.ExitOnFailure(logger, err)
+		keys = string(data)
+	}
+	if keys == "" {
+		return nil
+	}
+
+	stateCipher, err := cephbroker.NewStateCipher(keys)
+	utils.ExitOnFailure(logger, err)
+	return stateCipher
+}
+
+func createClient(logger lager.Logger, store cephbroker.Store) cephbroker.Client {
+	if *mountMode != cephbroker.MountModeFuse && *mountMode != cephbroker.MountModeKernel {
+		utils.ExitOnFailure(logger, fmt.Errorf("unknown mount mode '%s'", *mountMode))
+	}
+	cluster := createCephConfig(logger)
+	mount := cephbroker.MountSettings{Mode: *mountMode, Options: *mountOptions, FSID: cluster.FSID}
+
+	monitors, err := cephbroker.ParseMonitors(cluster.MonHost)
+	utils.ExitOnFailure(logger, err)
+	monitorList := strings.Join(monitors, ",")
+	credentials := cephbroker.Credentials{ClientName: cluster.ClientName, Keyring: cluster.Keyring, SecretFile: cluster.SecretFile}
+
+	switch *shareBackend {
+	case cephbroker.ShareBackendDirectory:
+		return cephbroker.NewCephClient(monitorList, *baseMountPath, credentials, remoteMountPath(logger, store, cluster.RemoteMountPath), mount)
+	case cephbroker.ShareBackendSubvolume:
+		return cephbroker.NewSubvolumeClient(monitorList, credentials, *fsName, *subvolumeGroup, *cloneTimeout, mount)
+	default:
+		utils.ExitOnFailure(logger, fmt.Errorf("unknown share backend '%s'", *shareBackend))
+		return nil
+	}
+}
+
+// remoteMountPath is the directory of the file system the default backend mounts and makes its shares in.  Brokers
+// that predate mounting it made shares at the top of the file system, and those have to stay where they were found.
+func remoteMountPath(logger lager.Logger, store cephbroker.Store, configured string) string {
+	if configured == "/" {
+		return configured
+	}
+	topLevel, err := cephbroker.TopLevelShares(logger, store)
+	utils.ExitOnFailure(logger, err)
+	if topLevel {
+		logger.Info("keeping-shares-at-top-of-file-system", lager.Data{"baseRemoteMountPath": configured})
+		return "/"
+	}
+	return configured
+}
+
+// createBackendClients returns a client for each backend in backendsFile, and checks that the catalog only names
+// backends that are in it
+func createBackendClients(logger lager.Logger, catalog cephbroker.Catalog) map[string]cephbroker.Client {
+	clients := map[string]cephbroker.Client{}
+	if *backendsFile != "" {
+		backends, err := cephbroker.LoadBackends(*backendsFile, &osshim.OsShim{}, &ioutilshim.IoutilShim{})
+		utils.ExitOnFailure(logger, err)
+
+		for _, backend := range backends {
+			mount := cephbroker.MountSettings{Mode: *mountMode, Options: *mountOptions, FSID: backend.FSID, FSName: backend.FSName}
+			switch backend.ShareBackend {
+			case cephbroker.ShareBackendDirectory:
+				mountPath := backend.MountPath
+				if mountPath == "" {
+					mountPath = *baseMountPath + "-" + backend.Name
+				}
+				clients[backend.Name] = cephbroker.NewCephClient(backend.Monitors, mountPath, backend.Credentials(), backend.RootPath, mount)
+			case cephbroker.ShareBackendSubvolume:
+				clients[backend.Name] = cephbroker.NewSubvolumeClient(backend.Monitors, backend.Credentials(), backend.FSName, backend.SubvolumeGroup, *cloneTimeout, mount)
+			}
+			logger.Info("created-backend", lager.Data{"backend": backend.Name, "monitors": backend.Monitors, "fsName": backend.FSName, "shareBackend": backend.ShareBackend})
+		}
+	}
+
+	for _, name := range catalog.Backends() {
+		if _, ok := clients[name]; name != "" && !ok {
+			utils.ExitOnFailure(logger, fmt.Errorf("catalog names backend '%s', which is not in the backends file", name))
+		}
+	}
+	return clients
+}
+
+// createCephConfig reads cephConf, when it is given, with the flags that were set taking precedence over it.  Flags
+// that were not set only fill in what the file does not have.
+func createCephConfig(logger lager.Logger) cephbroker.CephConfig {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	// a secret file on its own replaces the default keyring
+	keyring := *keyringFile
+	if *secretFile != "" && !set["keyringFile"] {
+		keyring = ""
+	}
+
+	flags := cephbroker.CephConfig{MonHost: *mds, ClientName: *cephUser, Keyring: keyring, SecretFile: *secretFile, RemoteMountPath: *baseRemoteMountPath}
+	if *cephConf == "" {
+		return flags
+	}
+
+	cluster, err := cephbroker.LoadCephConfig(*cephConf, *cephUser, &osshim.OsShim{}, &ioutilshim.IoutilShim{})
+	utils.ExitOnFailure(logger, err)
+
+	cluster = cluster.Override(flags, set)
+
+	logger.Info("read-ceph-config", lager.Data{"path": *cephConf, "cluster": cluster.Cluster, "fsid": cluster.FSID, "client": cluster.ClientName, "keyring": cluster.Keyring, "secretFile": cluster.SecretFile})
+	return cluster
 }